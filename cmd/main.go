@@ -1,20 +1,54 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
 	"github.com/pavlov061356/http_based_file_storage/pkg/server"
 	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
 )
 
 // main is the entry point of the application.
 //
-// It reads the configuration from environment variables, creates a new storage
-// and a new HTTP file storage server, and starts the server.
+// It loads the configuration from the configuration file, environment variables
+// and flags, creates a new storage and a new HTTP file storage server, and starts
+// the server.
 func main() {
-	// Read the configuration from environment variables.
-	config := server.ReadConfigFromEnv()
+	// Load the configuration, every layer overrides the previous one.
+	loader := server.NewConfigLoader(os.Args[0])
+	printConfig := loader.Flags.Bool("print-config", false, "Print the effective configuration and exit")
+	config, err := loader.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if *printConfig {
+		// Print the configuration even if it is invalid, it shows where the values come from.
+		if printErr := loader.PrintConfig(os.Stdout); printErr != nil {
+			fmt.Fprintln(os.Stderr, printErr)
+			os.Exit(1)
+		}
+	}
+	if err != nil {
+		// Exit with a usage error status if the configuration is invalid.
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		// Exit after printing the valid configuration.
+		return
+	}
+
+	// Get the storage options, e.g. compression and encryption.
+	opts, err := config.StorageOptions()
+	if err != nil {
+		// Panic if the encryption keys could not be loaded.
+		panic(err)
+	}
 
 	// Create a new storage.
-	storage, err := storage.NewStorage(config.StoragePath)
+	storage, err := storage.NewStorage(config.StoragePath, opts...)
 	if err != nil {
 		// Panic if an error occurred while creating the storage.
 		panic(err)
@@ -27,6 +61,13 @@ func main() {
 		panic(err)
 	}
 
-	// Start the server.
-	server.StartServer()
+	// Reload the configuration on SIGHUP and by POST /admin/config/reload
+	server.SetConfigLoader(loader)
+
+	// Start the server, it returns once it is shut down.
+	if err := server.StartServer(); err != nil {
+		// Exit with a failure status if the server failed to start, serve or drain.
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -43,12 +43,19 @@ func GetFileHash(hash hash.Hash, file io.Reader) string {
 		return ""
 	}
 
+	// Get the sum of the hash function and encode it.
+	return EncodeHash(hash)
+}
+
+// EncodeHash returns the sum of a hash that has already been fed with data
+// as a base64 encoded string, the same way GetFileHash does.
+//
+// hash: The hash function holding the data.
+// Returns the base64 encoded hash as a string.
+func EncodeHash(hash hash.Hash) string {
 	// Get the sum of the hash function.
 	sum := hash.Sum(nil)
 
 	// Encode the sum as a base64 string.
-	base64Hash := base64.URLEncoding.EncodeToString(sum)
-
-	// Return the base64 encoded hash.
-	return base64Hash
+	return base64.URLEncoding.EncodeToString(sum)
 }
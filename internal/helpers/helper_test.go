@@ -1,6 +1,8 @@
 package helpers
 
 import (
+	"crypto/sha256"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,3 +17,10 @@ func TestGetFileParentPath(t *testing.T) {
 	fileParentPath := GetFileParentPath("/tmp", "hash")
 	assert.Equal(t, "/tmp/store/ha", fileParentPath)
 }
+
+func TestEncodeHashMatchesGetFileHash(t *testing.T) {
+	hash := sha256.New()
+	hash.Write([]byte("data"))
+
+	assert.Equal(t, GetFileHash(sha256.New(), strings.NewReader("data")), EncodeHash(hash))
+}
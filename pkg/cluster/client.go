@@ -0,0 +1,243 @@
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// ForwardedHeader marks requests sent by another cluster member. A node always
+// handles such requests locally, which prevents forwarding loops when members
+// disagree about the ring during a configuration rollout.
+const ForwardedHeader = "X-Cluster-Forwarded"
+
+// APIKeyHeader is the header the client sends its API key in.
+const APIKeyHeader = "X-API-Key"
+
+// RequestIDHeader carries the ID of the client request a request to another
+// member is made for, so that the logs of both members can be correlated.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of the context carrying the request ID, which
+// the client sends with the requests made with the context.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID carried by the context, empty if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Client talks to other cluster members over their public HTTP API.
+type Client struct {
+	// httpClient is the HTTP client used for all requests.
+	httpClient *http.Client
+
+	// apiKey is sent with every request if the members require authentication.
+	apiKey string
+}
+
+// NewClient creates a new Client.
+//
+// httpClient: the HTTP client to use, http.DefaultClient if nil.
+// apiKey: the API key to authenticate with, empty if members don't require authentication.
+//
+// Returns a pointer to a Client instance.
+func NewClient(httpClient *http.Client, apiKey string) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{httpClient: httpClient, apiKey: apiKey}
+}
+
+// do sends a request with the client credentials.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.apiKey != "" {
+		req.Header.Set(APIKeyHeader, c.apiKey)
+	}
+	if id := RequestIDFromContext(req.Context()); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	// Members continue the trace of the request
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	return c.httpClient.Do(req)
+}
+
+// Upload sends a file to the POST /file endpoint of the given member.
+//
+// The file is streamed to the member as a multipart form, it is never loaded
+// into memory as a whole. The caller is responsible for closing the response body.
+//
+// ctx: the context of the request.
+// member: the base URL of the member.
+// filePath: the path to the file to upload.
+// fileName: the file name reported in the multipart form, the base name of filePath if empty.
+//
+// Returns the response of the member and an error if there was any.
+func (c *Client) Upload(ctx context.Context, member string, filePath string, fileName string) (*http.Response, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+
+	if fileName == "" {
+		fileName = filepath.Base(filePath)
+	}
+
+	// Stream the multipart form through a pipe
+	pipeReader, pipeWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(pipeWriter)
+
+	go func() {
+		defer file.Close()
+
+		part, err := multipartWriter.CreateFormFile("file", fileName)
+		if err != nil {
+			pipeWriter.CloseWithError(err)
+			return
+		}
+
+		if _, err = io.Copy(part, file); err != nil {
+			pipeWriter.CloseWithError(err)
+			return
+		}
+
+		pipeWriter.CloseWithError(multipartWriter.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, NormalizeMember(member)+"/file", pipeReader)
+	if err != nil {
+		pipeReader.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	req.Header.Set(ForwardedHeader, "1")
+
+	resp, err := c.do(req)
+	if err != nil {
+		pipeReader.Close()
+		return nil, fmt.Errorf("error uploading file to %s: %v", member, err)
+	}
+
+	return resp, nil
+}
+
+// Download fetches a file stored on the given member into a temporary file and
+// verifies that its content matches the hash.
+//
+// The request is marked as forwarded, so the member serves the file from its
+// own storage instead of forwarding the request to the owner of the hash.
+//
+// ctx: the context of the request.
+// member: the base URL of the member.
+// hash: the hash of the file.
+//
+// Returns the path to the temporary file and an error if there was any,
+// os.ErrNotExist if the member doesn't have the file.
+// The caller is responsible for removing the file.
+func (c *Client) Download(ctx context.Context, member string, hash string) (string, error) {
+	return c.download(ctx, member, hash, true)
+}
+
+// Fetch fetches a file from another instance of the storage, e.g. an upstream,
+// into a temporary file and verifies that its content matches the hash.
+//
+// Unlike Download, the instance handles the request as a regular client request.
+//
+// ctx: the context of the request.
+// baseURL: the base URL of the instance.
+// hash: the hash of the file.
+//
+// Returns the path to the temporary file and an error if there was any,
+// os.ErrNotExist if the instance doesn't have the file.
+// The caller is responsible for removing the file.
+func (c *Client) Fetch(ctx context.Context, baseURL string, hash string) (string, error) {
+	return c.download(ctx, baseURL, hash, false)
+}
+
+// Health checks that another instance of the storage answers its liveness probe.
+//
+// ctx: the context of the request.
+// baseURL: the base URL of the instance.
+//
+// Returns an error if the instance is unreachable or not alive.
+func (c *Client) Health(ctx context.Context, baseURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, NormalizeMember(baseURL)+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", baseURL, resp.Status)
+	}
+
+	return nil
+}
+
+// download fetches a file into a temporary file and verifies its hash.
+func (c *Client) download(ctx context.Context, member string, hash string, forwarded bool) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, NormalizeMember(member)+"/file/"+url.PathEscape(hash), nil)
+	if err != nil {
+		return "", err
+	}
+	if forwarded {
+		req.Header.Set(ForwardedHeader, "1")
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("error downloading file from %s: %v", member, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from %s", resp.StatusCode, member)
+	}
+
+	file, err := os.CreateTemp("", "download")
+	if err != nil {
+		return "", fmt.Errorf("error creating temp file: %v", err)
+	}
+	defer file.Close()
+
+	// Hash the content while writing it to disk
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(file, hasher), resp.Body); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("error downloading file from %s: %v", member, err)
+	}
+
+	if computedHash := helpers.EncodeHash(hasher); computedHash != hash {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("hash of the file from %s does not match", member)
+	}
+
+	return file.Name(), nil
+}
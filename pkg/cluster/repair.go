@@ -0,0 +1,247 @@
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+)
+
+// ShardSummary is a two-level Merkle summary of a storage: the digests of
+// every shard and the root digest over all of them.
+type ShardSummary struct {
+	// Root is the digest of all shard digests.
+	Root string `json:"root"`
+	// Shards maps shard names to their digests.
+	Shards map[string]string `json:"shards"`
+}
+
+// RepairResult describes the changes made by Repair.
+type RepairResult struct {
+	// Pulled is the number of files copied from the peer.
+	Pulled int `json:"pulled"`
+	// Pushed is the number of files copied to the peer.
+	Pushed int `json:"pushed"`
+}
+
+// Summarize builds a ShardSummary from the shard digests of a storage.
+//
+// digests: the map of shard names to digests.
+//
+// Returns the summary with the computed root digest.
+func Summarize(digests map[string]string) ShardSummary {
+	shards := make([]string, 0, len(digests))
+	for shard := range digests {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	root := sha256.New()
+	for _, shard := range shards {
+		fmt.Fprintf(root, "%s:%s\n", shard, digests[shard])
+	}
+
+	return ShardSummary{
+		Root:   hex.EncodeToString(root.Sum(nil)),
+		Shards: digests,
+	}
+}
+
+// Shards fetches the shard summary of the given member.
+//
+// ctx: the context of the request.
+// member: the base URL of the member.
+//
+// Returns the summary and an error if there was any.
+func (c *Client) Shards(ctx context.Context, member string) (ShardSummary, error) {
+	var summary ShardSummary
+	err := c.getJSON(ctx, NormalizeMember(member)+"/sync/shards", &summary)
+	return summary, err
+}
+
+// ShardHashes fetches the sorted hashes of the files in a shard of the given member.
+//
+// ctx: the context of the request.
+// member: the base URL of the member.
+// shard: the name of the shard.
+//
+// Returns the list of hashes and an error if there was any.
+func (c *Client) ShardHashes(ctx context.Context, member string, shard string) ([]string, error) {
+	var response struct {
+		Hashes []string `json:"hashes"`
+	}
+	err := c.getJSON(ctx, NormalizeMember(member)+"/sync/shards/"+url.PathEscape(shard), &response)
+	return response.Hashes, err
+}
+
+// Repair compares the storage with the given peer and copies the files missing
+// on either side, so that both hold the union of their files.
+//
+// Only the shards with different digests are listed, so the cost of a repair
+// is proportional to the divergence rather than to the size of the storage.
+//
+// ctx: the context controlling the repair.
+// storer: the local storage.
+// client: the client used to talk to the peer.
+// peer: the base URL of the peer.
+//
+// Returns the number of copied files and an error if there was any.
+func Repair(ctx context.Context, storer storage.Storer, client *Client, peer string) (RepairResult, error) {
+	result := RepairResult{}
+
+	localDigests, err := storer.ShardDigests()
+	if err != nil {
+		return result, fmt.Errorf("error computing shard digests: %v", err)
+	}
+	local := Summarize(localDigests)
+
+	remote, err := client.Shards(ctx, peer)
+	if err != nil {
+		return result, err
+	}
+
+	if local.Root == remote.Root {
+		return result, nil
+	}
+
+	for _, shard := range divergedShards(local.Shards, remote.Shards) {
+		localHashes, err := storer.ListShard(shard)
+		if err != nil {
+			return result, fmt.Errorf("error listing shard %s: %v", shard, err)
+		}
+
+		remoteHashes := []string{}
+		if _, ok := remote.Shards[shard]; ok {
+			if remoteHashes, err = client.ShardHashes(ctx, peer, shard); err != nil {
+				return result, err
+			}
+		}
+
+		missingLocally, missingRemotely := diffHashes(localHashes, remoteHashes)
+
+		for _, hash := range missingLocally {
+			if err := pullFile(ctx, storer, client, peer, hash); err != nil {
+				return result, fmt.Errorf("error pulling file %s: %v", hash, err)
+			}
+			result.Pulled++
+		}
+
+		for _, hash := range missingRemotely {
+			if err := pushFile(ctx, storer, client, peer, hash); err != nil {
+				return result, fmt.Errorf("error pushing file %s: %v", hash, err)
+			}
+			result.Pushed++
+		}
+	}
+
+	return result, nil
+}
+
+// pullFile copies a file from the peer to the local storage.
+func pullFile(ctx context.Context, storer storage.Storer, client *Client, peer string, hash string) error {
+	filePath, err := client.Download(ctx, peer, hash)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(filePath)
+
+	err = storer.SaveFileFromTemp(hash, filePath)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// pushFile copies a file from the local storage to the peer.
+func pushFile(ctx context.Context, storer storage.Storer, client *Client, peer string, hash string) error {
+	filePath, err := storer.Read(hash)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(filePath)
+
+	resp, err := client.Upload(ctx, peer, filePath, hash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// divergedShards returns the sorted names of the shards whose digests differ.
+func divergedShards(local map[string]string, remote map[string]string) []string {
+	shards := []string{}
+	for shard, digest := range local {
+		if remote[shard] != digest {
+			shards = append(shards, shard)
+		}
+	}
+	for shard := range remote {
+		if _, ok := local[shard]; !ok {
+			shards = append(shards, shard)
+		}
+	}
+	sort.Strings(shards)
+
+	return shards
+}
+
+// diffHashes returns the hashes present only remotely and only locally.
+func diffHashes(local []string, remote []string) (missingLocally []string, missingRemotely []string) {
+	localSet := make(map[string]struct{}, len(local))
+	for _, hash := range local {
+		localSet[hash] = struct{}{}
+	}
+
+	remoteSet := make(map[string]struct{}, len(remote))
+	for _, hash := range remote {
+		remoteSet[hash] = struct{}{}
+		if _, ok := localSet[hash]; !ok {
+			missingLocally = append(missingLocally, hash)
+		}
+	}
+
+	for _, hash := range local {
+		if _, ok := remoteSet[hash]; !ok {
+			missingRemotely = append(missingRemotely, hash)
+		}
+	}
+
+	return missingLocally, missingRemotely
+}
+
+// getJSON sends a GET request and decodes the JSON response into v.
+func (c *Client) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ForwardedHeader, "1")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error requesting %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultVirtualNodes is the number of points each member gets on the ring
+// when no explicit value is provided.
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent-hash ring built from a static list of cluster members.
+//
+// Every member is placed on the ring several times (virtual nodes) so that the
+// hash space is split evenly even for small clusters. A file hash is owned by
+// the first member point found clockwise from the point of the file hash.
+type Ring struct {
+	// members is the sorted list of cluster members.
+	members []string
+
+	// points is the sorted list of points on the ring.
+	points []uint64
+
+	// owners maps every point on the ring to the member that owns it.
+	owners map[uint64]string
+}
+
+// NewRing creates a new consistent-hash ring for the given members.
+//
+// members: the base URLs of the cluster members, e.g. "http://10.0.0.1:8080".
+// virtualNodes: the number of points per member, DefaultVirtualNodes if not positive.
+//
+// Returns a pointer to a Ring instance and an error if there was any.
+func NewRing(members []string, virtualNodes int) (*Ring, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("cluster has no members")
+	}
+
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+
+	ring := &Ring{
+		owners: make(map[uint64]string, len(members)*virtualNodes),
+	}
+
+	seen := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		member = NormalizeMember(member)
+		if member == "" {
+			return nil, fmt.Errorf("cluster member address is empty")
+		}
+		if _, ok := seen[member]; ok {
+			return nil, fmt.Errorf("duplicate cluster member %q", member)
+		}
+		seen[member] = struct{}{}
+		ring.members = append(ring.members, member)
+
+		// Place virtual nodes of the member on the ring
+		for i := 0; i < virtualNodes; i++ {
+			point := ringPoint(member + "#" + strconv.Itoa(i))
+			// Collisions are practically impossible, but keep the result
+			// deterministic regardless of the members order if they happen
+			if owner, ok := ring.owners[point]; ok && owner < member {
+				continue
+			}
+			ring.owners[point] = member
+		}
+	}
+
+	for point := range ring.owners {
+		ring.points = append(ring.points, point)
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	sort.Strings(ring.members)
+
+	return ring, nil
+}
+
+// Owner returns the member that owns the given file hash.
+//
+// hash: the hash of the file.
+//
+// Returns the base URL of the owning member.
+func (r *Ring) Owner(hash string) string {
+	point := ringPoint(hash)
+
+	// Find the first point clockwise from the point of the hash
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
+
+// Members returns the sorted list of the ring members.
+func (r *Ring) Members() []string {
+	members := make([]string, len(r.members))
+	copy(members, r.members)
+	return members
+}
+
+// Has reports whether the given address is a member of the ring.
+func (r *Ring) Has(member string) bool {
+	member = NormalizeMember(member)
+	for _, m := range r.members {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeMember trims spaces and trailing slashes from a member address so
+// that "http://node:8080/" and "http://node:8080" are the same member.
+func NormalizeMember(member string) string {
+	return strings.TrimRight(strings.TrimSpace(member), "/")
+}
+
+// ringPoint maps a key to a point on the ring.
+func ringPoint(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRingWithoutMembers(t *testing.T) {
+	_, err := NewRing(nil, 0)
+	assert.Error(t, err)
+}
+
+func TestNewRingWithDuplicateMembers(t *testing.T) {
+	_, err := NewRing([]string{"http://a:8080", "http://a:8080/"}, 0)
+	assert.Error(t, err)
+}
+
+func TestRingOwnerIsDeterministic(t *testing.T) {
+	first, err := NewRing([]string{"http://a:8080", "http://b:8080", "http://c:8080"}, 0)
+	assert.NoError(t, err)
+
+	// The order of members must not affect the ownership
+	second, err := NewRing([]string{"http://c:8080", "http://a:8080", "http://b:8080"}, 0)
+	assert.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		hash := fmt.Sprintf("hash%d", i)
+		assert.Equal(t, first.Owner(hash), second.Owner(hash))
+	}
+}
+
+func TestRingDistribution(t *testing.T) {
+	members := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	ring, err := NewRing(members, 0)
+	assert.NoError(t, err)
+
+	counts := map[string]int{}
+	for i := 0; i < 30000; i++ {
+		counts[ring.Owner(fmt.Sprintf("hash%d", i))]++
+	}
+
+	// Every member must own a reasonable share of the hash space
+	for _, member := range members {
+		assert.Greater(t, counts[member], 5000, member)
+	}
+}
+
+func TestRingMinimalMovementOnMembershipChange(t *testing.T) {
+	before, err := NewRing([]string{"http://a:8080", "http://b:8080", "http://c:8080"}, 0)
+	assert.NoError(t, err)
+
+	after, err := NewRing([]string{"http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080"}, 0)
+	assert.NoError(t, err)
+
+	for i := 0; i < 10000; i++ {
+		hash := fmt.Sprintf("hash%d", i)
+		// A file either stays on its owner or moves to the new member
+		if owner := after.Owner(hash); owner != before.Owner(hash) {
+			assert.Equal(t, "http://d:8080", owner)
+		}
+	}
+}
+
+func TestRingHas(t *testing.T) {
+	ring, err := NewRing([]string{"http://a:8080"}, 0)
+	assert.NoError(t, err)
+
+	assert.True(t, ring.Has("http://a:8080/"))
+	assert.False(t, ring.Has("http://b:8080"))
+	assert.Equal(t, []string{"http://a:8080"}, ring.Members())
+}
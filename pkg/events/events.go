@@ -0,0 +1,177 @@
+// Package events publishes the changes of the storage to subscribers and
+// delivers them to webhooks.
+package events
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Types of the events.
+const (
+	// BlobCreated is published when a file is stored or referenced by a tenant.
+	BlobCreated = "blob.created"
+	// BlobDeleted is published when a file is deleted or dereferenced by a tenant.
+	BlobDeleted = "blob.deleted"
+	// BlobAccessed is published when a file is downloaded.
+	BlobAccessed = "blob.accessed"
+	// BlobCorrupted is published when the content of a file doesn't match its hash.
+	BlobCorrupted = "blob.corrupted"
+)
+
+// Types are all types of the events.
+var Types = []string{BlobCreated, BlobDeleted, BlobAccessed, BlobCorrupted}
+
+// Event is a change of the storage.
+type Event struct {
+	// ID identifies the event. IDs of the events of a bus are consecutive numbers.
+	ID string `json:"id"`
+	// Type is the type of the event, e.g. BlobCreated.
+	Type string `json:"type"`
+	// Time is the time the event was published.
+	Time time.Time `json:"time"`
+	// Hash is the hash of the file.
+	Hash string `json:"hash"`
+	// Size is the size of the file, zero if it is not known.
+	Size int64 `json:"size,omitempty"`
+	// Tenant is the tenant the event happened in, empty outside of tenants.
+	Tenant string `json:"tenant,omitempty"`
+	// Principal is the name of the principal causing the event, empty if unknown.
+	Principal string `json:"principal,omitempty"`
+}
+
+// Bus publishes events to its subscribers.
+type Bus struct {
+	// lock guards the subscribers and the sequence. It is only held to number
+	// the events and queue them for the subscribers, handlers are called
+	// outside of it
+	lock        sync.Mutex
+	subscribers []*subscriber
+	// nextKey is the key of the next subscriber
+	nextKey uint64
+
+	// seq is the number of the last event. It starts at the time the bus was
+	// created, so that IDs keep increasing across restarts.
+	seq uint64
+
+	// log records the published events, nil if they are not recorded
+	log *Log
+}
+
+// subscriber is a handler subscribed to a bus.
+type subscriber struct {
+	key     uint64
+	handler func(Event)
+
+	// lock guards pending and draining
+	lock sync.Mutex
+	// pending are the events queued for the handler, in the order of their IDs
+	pending []Event
+	// draining is set while a publisher calls the handler with the pending events
+	draining bool
+}
+
+// NewBus creates a bus without subscribers.
+func NewBus() *Bus {
+	return &Bus{seq: uint64(time.Now().UnixMicro())}
+}
+
+// Record appends every event to the log as it is published, before any
+// subscriber gets it. Subscribers reading the log after subscribing miss no
+// event then, every event is either in the log or passed to them.
+//
+// It must be called before any event is published.
+func (b *Bus) Record(log *Log) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.log = log
+}
+
+// Subscribe registers a handler called with every published event.
+//
+// The handler is called with one event at a time, in the order of their IDs,
+// by the goroutines publishing them. Publishing doesn't wait for a handler
+// busy with an earlier event, that call passes the event on, so handlers
+// must not block. They may publish events themselves.
+//
+// This function is thread-safe.
+//
+// Returns a function removing the subscription. The handler may still be
+// called with the events published before the subscription was removed.
+func (b *Bus) Subscribe(handler func(Event)) func() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sub := &subscriber{key: b.nextKey, handler: handler}
+	b.nextKey++
+	b.subscribers = append(b.subscribers, sub)
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		// The slice is copied, publishers may hold the current one
+		b.subscribers = slices.DeleteFunc(slices.Clone(b.subscribers), func(s *subscriber) bool {
+			return s.key == sub.key
+		})
+	}
+}
+
+// Publish assigns an ID and a time to the event and passes it to all subscribers.
+//
+// Parameters:
+// - event: the event, its ID and time are overwritten
+//
+// Returns the published event
+func (b *Bus) Publish(event Event) Event {
+	b.lock.Lock()
+	b.seq++
+	event.ID = strconv.FormatUint(b.seq, 10)
+	event.Time = time.Now().UTC()
+
+	if b.log != nil {
+		b.log.Append(event)
+	}
+
+	// Events are queued under the lock, so that every subscriber gets them in
+	// the order of their IDs
+	subscribers := b.subscribers
+	for _, sub := range subscribers {
+		sub.lock.Lock()
+		sub.pending = append(sub.pending, event)
+		sub.lock.Unlock()
+	}
+	b.lock.Unlock()
+
+	for _, sub := range subscribers {
+		sub.drain()
+	}
+
+	return event
+}
+
+// drain calls the handler with the pending events, unless another publisher
+// is already doing so.
+func (s *subscriber) drain() {
+	s.lock.Lock()
+	if s.draining {
+		s.lock.Unlock()
+		return
+	}
+	s.draining = true
+
+	for len(s.pending) > 0 {
+		event := s.pending[0]
+		s.pending = s.pending[1:]
+
+		s.lock.Unlock()
+		s.handler(event)
+		s.lock.Lock()
+	}
+
+	s.draining = false
+	s.lock.Unlock()
+}
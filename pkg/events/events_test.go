@@ -0,0 +1,62 @@
+package events
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBusAssignsIncreasingIDs(t *testing.T) {
+	bus := NewBus()
+	var received []Event
+	bus.Subscribe(func(event Event) { received = append(received, event) })
+
+	first := bus.Publish(Event{Type: BlobCreated, Hash: "a"})
+	second := bus.Publish(Event{Type: BlobDeleted, Hash: "a"})
+
+	assert.Equal(t, []Event{first, second}, received)
+	firstID, _ := strconv.ParseUint(first.ID, 10, 64)
+	secondID, _ := strconv.ParseUint(second.ID, 10, 64)
+	assert.Greater(t, secondID, firstID)
+	assert.False(t, first.Time.IsZero())
+}
+
+func TestBusDoesNotWaitForBusySubscriber(t *testing.T) {
+	bus := NewBus()
+	log := NewLog(10)
+	bus.Record(log)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var received []Event
+	bus.Subscribe(func(event Event) {
+		if event.Hash == "a" {
+			close(started)
+			<-release
+		}
+		received = append(received, event)
+	})
+
+	done := make(chan Event)
+	go func() { done <- bus.Publish(Event{Type: BlobCreated, Hash: "a"}) }()
+	<-started
+
+	// The busy call gets the event, this one doesn't wait for it
+	published := make(chan Event)
+	go func() { published <- bus.Publish(Event{Type: BlobCreated, Hash: "b"}) }()
+	var second Event
+	select {
+	case second = <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing waited for the subscriber")
+	}
+	events, _, err := log.Since("0")
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	close(release)
+	first := <-done
+	assert.Equal(t, []Event{first, second}, received)
+}
@@ -0,0 +1,92 @@
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// DefaultLogSize is the number of events kept by a log unless configured otherwise.
+const DefaultLogSize = 1000
+
+// Log keeps the latest events, so that subscribers can resume after a
+// disconnect without missing events.
+type Log struct {
+	lock sync.RWMutex
+
+	// events is a ring buffer of the events, next is the index of the oldest
+	// one once the buffer is full
+	events []Event
+	next   int
+	size   int
+}
+
+// NewLog creates a log keeping the given number of events, DefaultLogSize if
+// it is not positive.
+func NewLog(size int) *Log {
+	if size <= 0 {
+		size = DefaultLogSize
+	}
+	return &Log{events: make([]Event, 0, size), size: size}
+}
+
+// Append adds the event to the log, dropping the oldest one if the log is full.
+//
+// This function is thread-safe.
+func (l *Log) Append(event Event) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.events) < l.size {
+		l.events = append(l.events, event)
+		return
+	}
+	l.events[l.next] = event
+	l.next = (l.next + 1) % l.size
+}
+
+// Since returns the events published after the event with the given ID, oldest first.
+//
+// Parameters:
+// - id: the ID of the last event seen by the subscriber
+//
+// Returns:
+// - []Event: the events after the ID kept by the log
+// - bool: false if older events after the ID were already dropped, so some were missed
+// - error: an error if the ID is invalid
+func (l *Log) Since(id string) ([]Event, bool, error) {
+	last, err := ParseID(id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	ordered := append(append([]Event(nil), l.events[l.next:]...), l.events[:l.next]...)
+
+	// IDs of the events of a bus are consecutive, so every event since the ID
+	// is kept if nothing was dropped yet or the oldest kept event follows it
+	complete := len(ordered) < l.size
+	var since []Event
+	for i, event := range ordered {
+		eventID, _ := ParseID(event.ID)
+		if i == 0 && eventID <= last+1 {
+			complete = true
+		}
+		if eventID > last {
+			since = append(since, event)
+		}
+	}
+
+	return since, complete, nil
+}
+
+// ParseID parses the ID of an event into its sequence number.
+func ParseID(id string) (uint64, error) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid event ID %q", id)
+	}
+	return seq, nil
+}
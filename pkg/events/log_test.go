@@ -0,0 +1,52 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ids returns the IDs of the events.
+func ids(events []Event) []string {
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestLogSince(t *testing.T) {
+	bus := NewBus()
+	log := NewLog(3)
+	bus.Subscribe(log.Append)
+
+	first := bus.Publish(Event{Type: BlobCreated, Hash: "a"})
+	second := bus.Publish(Event{Type: BlobCreated, Hash: "b"})
+
+	since, complete, err := log.Since(first.ID)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, []string{second.ID}, ids(since))
+
+	// The oldest events are dropped once the log is full
+	third := bus.Publish(Event{Type: BlobCreated, Hash: "c"})
+	fourth := bus.Publish(Event{Type: BlobDeleted, Hash: "a"})
+	fifth := bus.Publish(Event{Type: BlobDeleted, Hash: "b"})
+
+	since, complete, err = log.Since(second.ID)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, []string{third.ID, fourth.ID, fifth.ID}, ids(since))
+
+	since, complete, err = log.Since(first.ID)
+	assert.NoError(t, err)
+	assert.False(t, complete)
+	assert.Equal(t, []string{third.ID, fourth.ID, fifth.ID}, ids(since))
+
+	since, _, err = log.Since(fifth.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, since)
+
+	_, _, err = log.Since("not-an-id")
+	assert.Error(t, err)
+}
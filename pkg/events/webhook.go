@@ -0,0 +1,527 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the webhook delivery.
+const (
+	// DefaultMaxAttempts is the number of attempts to deliver an event before it is given up.
+	DefaultMaxAttempts = 10
+	// DefaultInitialBackoff is the delay before the first retry, doubled for every next one.
+	DefaultInitialBackoff = time.Second
+	// DefaultMaxBackoff is the maximal delay between retries.
+	DefaultMaxBackoff = 10 * time.Minute
+	// DefaultDeliveryTimeout is the time a webhook has to answer.
+	DefaultDeliveryTimeout = 10 * time.Second
+)
+
+// Headers of the webhook requests.
+const (
+	// HeaderEvent is the type of the event.
+	HeaderEvent = "X-Webhook-Event"
+	// HeaderID is the ID of the event, the same for all attempts to deliver it.
+	HeaderID = "X-Webhook-Id"
+	// HeaderTimestamp is the Unix time the request was signed at.
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	// HeaderSignature is the "sha256=<hex>" HMAC of the timestamp and the body.
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Webhook is a URL the events are delivered to.
+type Webhook struct {
+	// URL is the URL the events are posted to.
+	URL string `json:"url"`
+	// Secret is the key signing the requests, they are not signed if it is empty.
+	Secret string `json:"-"`
+	// Events are the types of the events delivered to the webhook, all if empty.
+	Events []string `json:"events"`
+}
+
+// Accepts reports whether events of the type are delivered to the webhook.
+func (w *Webhook) Accepts(eventType string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, eventType)
+}
+
+// Sign computes the signature of a webhook request.
+//
+// The signature is the hex HMAC-SHA256 of "<timestamp>.<body>", so that the
+// receiver can reject replayed requests by their timestamp.
+//
+// Parameters:
+// - secret: the secret of the webhook
+// - timestamp: the Unix time of the request
+// - body: the body of the request
+//
+// Returns the value of the signature header
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// delivery is an event waiting to be delivered to a webhook, stored in the outbox.
+type delivery struct {
+	Event Event  `json:"event"`
+	URL   string `json:"url"`
+	// Attempts is the number of failed attempts
+	Attempts int `json:"attempts"`
+	// NextAttempt is the time of the next attempt
+	NextAttempt time.Time `json:"next_attempt"`
+	// LastError is the error of the last attempt
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Dispatcher delivers events to webhooks.
+//
+// Enqueued events are written to an outbox directory before Enqueue returns,
+// so that they survive restarts and crashes. Every webhook is delivered to by its own worker, so that a slow webhook
+// doesn't delay the others. Failed deliveries are retried with exponential
+// backoff and moved to the "dead" subdirectory when all attempts failed.
+type Dispatcher struct {
+	// MaxAttempts is the number of attempts to deliver an event.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximal delay between retries.
+	MaxBackoff time.Duration
+	// Client sends the requests to the webhooks.
+	Client *http.Client
+	// Logger logs the failed deliveries.
+	Logger *slog.Logger
+
+	dir string
+
+	// lock guards the webhooks, the deliveries and the workers, and serializes
+	// the changes of the outbox
+	lock     sync.Mutex
+	webhooks []Webhook
+	// deliveries are the deliveries in the outbox keyed by their paths, nil
+	// until Run loads them, so that the outbox is read once
+	deliveries map[string]*delivery
+	// busy are the URLs of the webhooks a worker delivers to
+	busy map[string]bool
+
+	// wake is signalled when a delivery is stored or a worker is done
+	wake chan struct{}
+}
+
+// NewDispatcher creates a dispatcher with its outbox in the directory.
+//
+// Parameters:
+// - dir: the outbox directory, created if it doesn't exist
+// - webhooks: the webhooks to deliver the events to
+//
+// Returns:
+// - *Dispatcher: the dispatcher, Run must be called to deliver the events
+// - error: any error that occurred while creating the outbox
+func NewDispatcher(dir string, webhooks []Webhook) (*Dispatcher, error) {
+	if err := validateWebhooks(webhooks); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "dead"), 0755); err != nil {
+		return nil, err
+	}
+
+	return &Dispatcher{
+		MaxAttempts:    DefaultMaxAttempts,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+		Client:         &http.Client{Timeout: DefaultDeliveryTimeout},
+		Logger:         slog.Default(),
+		dir:            dir,
+		webhooks:       webhooks,
+		busy:           make(map[string]bool),
+		wake:           make(chan struct{}, 1),
+	}, nil
+}
+
+// validateWebhooks checks the URLs and the event types of the webhooks.
+func validateWebhooks(webhooks []Webhook) error {
+	for _, webhook := range webhooks {
+		if !strings.HasPrefix(webhook.URL, "http://") && !strings.HasPrefix(webhook.URL, "https://") {
+			return fmt.Errorf("invalid webhook URL %q", webhook.URL)
+		}
+		for _, eventType := range webhook.Events {
+			if !slices.Contains(Types, eventType) {
+				return fmt.Errorf("unknown event type %q of webhook %q", eventType, webhook.URL)
+			}
+		}
+	}
+	return nil
+}
+
+// SetWebhooks replaces the webhooks the events are delivered to. Events
+// already enqueued are delivered to the webhooks kept by their URLs, with
+// their new secrets, and dropped for the removed ones.
+//
+// Parameters:
+// - webhooks: the webhooks to deliver the events to
+//
+// Returns an error if any webhook is invalid, the webhooks are kept then
+func (d *Dispatcher) SetWebhooks(webhooks []Webhook) error {
+	if err := validateWebhooks(webhooks); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	d.webhooks = webhooks
+	d.lock.Unlock()
+	return nil
+}
+
+// Enqueue writes the event to the outbox for every webhook accepting it and
+// wakes Run up to deliver it.
+//
+// Parameters:
+// - event: the event to deliver
+//
+// Returns an error if the event couldn't be written to the outbox
+func (d *Dispatcher) Enqueue(event Event) error {
+	d.lock.Lock()
+	var items []*delivery
+	for _, webhook := range d.webhooks {
+		if webhook.Accepts(event.Type) {
+			items = append(items, &delivery{Event: event, URL: webhook.URL, NextAttempt: event.Time})
+		}
+	}
+	d.lock.Unlock()
+
+	for _, item := range items {
+		if err := d.store(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// store writes the delivery to the outbox and wakes Run up.
+func (d *Dispatcher) store(item *delivery) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	path := d.deliveryPath(item)
+	if err := d.write(path, item); err != nil {
+		return err
+	}
+	if d.deliveries != nil {
+		d.deliveries[path] = item
+	}
+
+	d.signal()
+	return nil
+}
+
+// signal wakes Run up.
+func (d *Dispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the events of the outbox, including the ones left from
+// previous runs, until the context is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.load()
+
+	var workers sync.WaitGroup
+	defer workers.Wait()
+
+	for {
+		next := d.startWorkers(ctx, &workers)
+
+		wait := time.Until(next)
+		if next.IsZero() {
+			wait = time.Hour
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-d.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// load reads the deliveries left in the outbox, e.g. by previous runs.
+func (d *Dispatcher) load() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.deliveries = make(map[string]*delivery)
+
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		d.Logger.Error("error reading webhook outbox", "error", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".json") || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(d.dir, entry.Name())
+		item, err := readDelivery(path)
+		if err != nil {
+			d.Logger.Error("error reading webhook delivery", "path", path, "error", err)
+			continue
+		}
+		d.deliveries[path] = item
+	}
+}
+
+// startWorkers starts a worker for every webhook with due deliveries that has none yet.
+//
+// Returns the time of the next attempt to the webhooks without a worker, zero if there is none
+func (d *Dispatcher) startWorkers(ctx context.Context, workers *sync.WaitGroup) time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	var next time.Time
+	due := make(map[string]bool)
+	for _, item := range d.deliveries {
+		if d.busy[item.URL] {
+			continue
+		}
+		if now.Before(item.NextAttempt) {
+			if next.IsZero() || item.NextAttempt.Before(next) {
+				next = item.NextAttempt
+			}
+			continue
+		}
+		due[item.URL] = true
+	}
+
+	for url := range due {
+		d.busy[url] = true
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			d.deliverTo(ctx, url)
+		}()
+	}
+
+	return next
+}
+
+// deliverTo attempts the due deliveries to the webhook with the URL in the order of their events.
+func (d *Dispatcher) deliverTo(ctx context.Context, url string) {
+	defer func() {
+		d.lock.Lock()
+		delete(d.busy, url)
+		d.lock.Unlock()
+		d.signal()
+	}()
+
+	d.lock.Lock()
+	now := time.Now()
+	var paths []string
+	for path, item := range d.deliveries {
+		if item.URL == url && !now.Before(item.NextAttempt) {
+			paths = append(paths, path)
+		}
+	}
+	d.lock.Unlock()
+
+	// Names start with the event ID
+	slices.Sort(paths)
+
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+
+		d.lock.Lock()
+		item, ok := d.deliveries[path]
+		d.lock.Unlock()
+		if ok {
+			d.attempt(ctx, path, *item)
+		}
+	}
+}
+
+// attempt delivers the event and updates the outbox.
+func (d *Dispatcher) attempt(ctx context.Context, path string, item delivery) {
+	webhook := d.webhook(item.URL)
+	if webhook == nil {
+		// The webhook was removed from the configuration
+		d.Logger.Warn("dropping event of removed webhook", "url", item.URL, "event", item.Event.ID)
+		d.remove(path)
+		return
+	}
+
+	err := d.send(ctx, webhook, &item.Event)
+	if err == nil {
+		d.remove(path)
+		return
+	}
+	if ctx.Err() != nil {
+		// Interrupted by a shutdown, retry on the next run
+		return
+	}
+
+	item.Attempts++
+	item.LastError = err.Error()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if item.Attempts >= d.MaxAttempts {
+		d.Logger.Error("giving up webhook delivery", "url", item.URL, "event", item.Event.ID, "attempts", item.Attempts, "error", err)
+		if err = d.write(filepath.Join(d.dir, "dead", filepath.Base(path)), &item); err != nil {
+			d.Logger.Error("error writing dead webhook delivery", "error", err)
+		}
+		os.Remove(path)
+		delete(d.deliveries, path)
+		return
+	}
+
+	item.NextAttempt = time.Now().Add(d.backoff(item.Attempts))
+	d.Logger.Warn("webhook delivery failed", "url", item.URL, "event", item.Event.ID, "attempts", item.Attempts, "next_attempt", item.NextAttempt, "error", err)
+	if err = d.write(path, &item); err != nil {
+		d.Logger.Error("error updating webhook delivery", "error", err)
+	}
+	d.deliveries[path] = &item
+}
+
+// send posts the signed event to the webhook.
+func (d *Dispatcher) send(ctx context.Context, webhook *Webhook, event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, event.Type)
+	req.Header.Set(HeaderID, event.ID)
+	if webhook.Secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, body))
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// backoff returns the delay before the next attempt after the given number of failed ones.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.InitialBackoff
+	for i := 1; i < attempts && backoff < d.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, d.MaxBackoff)
+}
+
+// webhook returns the configured webhook with the URL, nil if there is none.
+func (d *Dispatcher) webhook(url string) *Webhook {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i := range d.webhooks {
+		if d.webhooks[i].URL == url {
+			return &d.webhooks[i]
+		}
+	}
+	return nil
+}
+
+// deliveryPath returns the path of the delivery in the outbox. Names start
+// with the event ID, so that events are delivered in order.
+func (d *Dispatcher) deliveryPath(item *delivery) string {
+	sum := sha256.Sum256([]byte(item.URL))
+	return filepath.Join(d.dir, item.Event.ID+"-"+hex.EncodeToString(sum[:4])+".json")
+}
+
+// remove removes the delivery from the outbox.
+func (d *Dispatcher) remove(path string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.deliveries, path)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		d.Logger.Error("error removing webhook delivery", "path", path, "error", err)
+	}
+}
+
+// write atomically writes the delivery to the path. The caller must hold the lock.
+func (d *Dispatcher) write(path string, item *delivery) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err = tmpFile.Write(data); err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// readDelivery reads a delivery from the outbox.
+func readDelivery(path string) (*delivery, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &delivery{}
+	if err = json.Unmarshal(data, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
@@ -0,0 +1,235 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookReceiver records the events posted to it, failing the first requests.
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	failures int
+
+	lock     sync.Mutex
+	requests int
+	events   []Event
+	received chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, secret string, failures int) (*webhookReceiver, *httptest.Server) {
+	receiver := &webhookReceiver{t: t, secret: secret, failures: failures, received: make(chan struct{}, 100)}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return receiver, server
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.requests++
+	if r.requests <= r.failures {
+		w.WriteHeader(503)
+		return
+	}
+
+	body, _ := io.ReadAll(req.Body)
+	timestamp, err := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+	assert.NoError(r.t, err)
+	assert.Equal(r.t, Sign(r.secret, timestamp, body), req.Header.Get(HeaderSignature))
+
+	var event Event
+	assert.NoError(r.t, json.Unmarshal(body, &event))
+	assert.Equal(r.t, event.Type, req.Header.Get(HeaderEvent))
+	assert.Equal(r.t, event.ID, req.Header.Get(HeaderID))
+	r.events = append(r.events, event)
+	r.received <- struct{}{}
+}
+
+// wait waits for the receiver to record n events.
+func (r *webhookReceiver) wait(n int) []Event {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			r.t.Fatal("webhook was not called")
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// runDispatcher runs the dispatcher until the end of the test.
+func runDispatcher(t *testing.T, d *Dispatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestWebhookDeliveryWithRetries(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "secret", 2)
+	bus := NewBus()
+
+	d, err := NewDispatcher(t.TempDir(), []Webhook{
+		{URL: server.URL, Secret: "secret", Events: []string{BlobCreated, BlobDeleted}},
+	})
+	assert.NoError(t, err)
+	d.InitialBackoff = 10 * time.Millisecond
+	bus.Subscribe(func(event Event) { assert.NoError(t, d.Enqueue(event)) })
+	runDispatcher(t, d)
+
+	created := bus.Publish(Event{Type: BlobCreated, Hash: "hash", Size: 4})
+	// Accesses are not delivered to the webhook
+	bus.Publish(Event{Type: BlobAccessed, Hash: "hash"})
+	deleted := bus.Publish(Event{Type: BlobDeleted, Hash: "hash"})
+
+	events := receiver.wait(2)
+	assert.Equal(t, []string{created.ID, deleted.ID}, []string{events[0].ID, events[1].ID})
+	assert.Equal(t, "hash", events[0].Hash)
+	assert.Equal(t, int64(4), events[0].Size)
+}
+
+func TestWebhookOutboxSurvivesRestart(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "secret", 0)
+	dir := t.TempDir()
+	webhooks := []Webhook{{URL: server.URL, Secret: "secret"}}
+
+	// Events enqueued without a running dispatcher wait in the outbox
+	d, err := NewDispatcher(dir, webhooks)
+	assert.NoError(t, err)
+	event := NewBus().Publish(Event{Type: BlobCreated, Hash: "hash"})
+	assert.NoError(t, d.Enqueue(event))
+
+	d, err = NewDispatcher(dir, webhooks)
+	assert.NoError(t, err)
+	runDispatcher(t, d)
+
+	events := receiver.wait(1)
+	assert.Equal(t, event.ID, events[0].ID)
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	_, server := newWebhookReceiver(t, "secret", 1000)
+	dir := t.TempDir()
+
+	d, err := NewDispatcher(dir, []Webhook{{URL: server.URL}})
+	assert.NoError(t, err)
+	d.MaxAttempts = 3
+	d.InitialBackoff = time.Millisecond
+
+	assert.NoError(t, d.Enqueue(NewBus().Publish(Event{Type: BlobCreated, Hash: "hash"})))
+	runDispatcher(t, d)
+
+	// The event is moved to the dead letters after the last attempt
+	assert.Eventually(t, func() bool {
+		dead, _ := filepath.Glob(filepath.Join(dir, "dead", "*.json"))
+		pending, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		return len(dead) == 1 && len(pending) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	dead, _ := filepath.Glob(filepath.Join(dir, "dead", "*.json"))
+	item, err := readDelivery(dead[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 3, item.Attempts)
+	assert.NotEmpty(t, item.LastError)
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, d.backoff(1))
+	assert.Equal(t, 2*time.Second, d.backoff(2))
+	assert.Equal(t, 4*time.Second, d.backoff(3))
+	assert.Equal(t, 5*time.Second, d.backoff(4))
+	assert.Equal(t, 5*time.Second, d.backoff(100))
+}
+
+func TestNewDispatcherValidatesWebhooks(t *testing.T) {
+	_, err := NewDispatcher(t.TempDir(), []Webhook{{URL: "ftp://example.com"}})
+	assert.Error(t, err)
+
+	_, err = NewDispatcher(t.TempDir(), []Webhook{{URL: "http://example.com", Events: []string{"blob.renamed"}}})
+	assert.Error(t, err)
+}
+
+func TestSetWebhooks(t *testing.T) {
+	old, oldServer := newWebhookReceiver(t, "old", 0)
+	receiver, server := newWebhookReceiver(t, "new", 0)
+
+	d, err := NewDispatcher(t.TempDir(), []Webhook{{URL: oldServer.URL, Secret: "old"}})
+	assert.NoError(t, err)
+
+	// Invalid webhooks keep the current ones
+	assert.Error(t, d.SetWebhooks([]Webhook{{URL: "ftp://example.com"}}))
+	assert.NoError(t, d.Enqueue(NewBus().Publish(Event{Type: BlobCreated, Hash: "old"})))
+
+	// Events of the removed webhook are dropped, the new one gets the next ones
+	assert.NoError(t, d.SetWebhooks([]Webhook{{URL: server.URL, Secret: "new"}}))
+	event := NewBus().Publish(Event{Type: BlobCreated, Hash: "new"})
+	assert.NoError(t, d.Enqueue(event))
+	runDispatcher(t, d)
+
+	events := receiver.wait(1)
+	assert.Equal(t, event.ID, events[0].ID)
+	assert.Eventually(t, func() bool {
+		pending, _ := filepath.Glob(filepath.Join(d.dir, "*.json"))
+		return len(pending) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	old.lock.Lock()
+	assert.Zero(t, old.requests)
+	old.lock.Unlock()
+}
+
+func TestSlowWebhookDoesNotDelayOthers(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "secret", 0)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	d, err := NewDispatcher(t.TempDir(), []Webhook{{URL: slow.URL}, {URL: server.URL, Secret: "secret"}})
+	assert.NoError(t, err)
+	runDispatcher(t, d)
+
+	bus := NewBus()
+	first := bus.Publish(Event{Type: BlobCreated, Hash: "first"})
+	second := bus.Publish(Event{Type: BlobCreated, Hash: "second"})
+	assert.NoError(t, d.Enqueue(first))
+	assert.NoError(t, d.Enqueue(second))
+
+	events := receiver.wait(2)
+	assert.Equal(t, []string{first.ID, second.ID}, []string{events[0].ID, events[1].ID})
+}
+
+func TestEnqueueWritesOutbox(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDispatcher(dir, []Webhook{{URL: "http://127.0.0.1:1"}})
+	assert.NoError(t, err)
+
+	// The delivery is on disk once Enqueue returns, without Run
+	assert.NoError(t, d.Enqueue(NewBus().Publish(Event{Type: BlobCreated, Hash: "hash"})))
+	pending, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Len(t, pending, 1)
+}
@@ -0,0 +1,152 @@
+// Package ratelimit implements token buckets limiting the rate of events and
+// the bandwidth of transfers.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket. Tokens are added at a constant rate up to the
+// burst size, every event takes tokens from the bucket.
+//
+// Transfers may take more tokens than the bucket holds and leave it in debt,
+// which delays the next events until the debt is paid off.
+type Bucket struct {
+	mu sync.Mutex
+
+	// rate is the number of tokens added per second
+	rate float64
+	// burst is the maximal number of tokens in the bucket
+	burst float64
+
+	// tokens is the number of tokens at the time of last, negative if the bucket is in debt
+	tokens float64
+	// last is the time the tokens were last updated
+	last time.Time
+}
+
+// NewBucket creates a full bucket.
+//
+// Parameters:
+// - rate: the number of tokens added per second, must be positive
+// - burst: the maximal number of tokens in the bucket, at least one token
+//
+// Returns:
+// - *Bucket: the bucket
+func NewBucket(rate float64, burst float64) *Bucket {
+	burst = math.Max(burst, 1)
+
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last update. The caller must hold the lock.
+func (b *Bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// delay returns the time until the bucket holds the given number of tokens.
+// The caller must hold the lock.
+func (b *Bucket) delay(tokens float64) time.Duration {
+	if b.tokens >= tokens {
+		return 0
+	}
+	return time.Duration(math.Ceil((tokens - b.tokens) / b.rate * float64(time.Second)))
+}
+
+// Allow takes a token from the bucket if there is one.
+//
+// Returns:
+// - bool: whether the token was taken
+// - time.Duration: the time until a token is available if it wasn't taken
+func (b *Bucket) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, b.delay(1)
+}
+
+// Delay returns the time until the bucket is out of debt.
+func (b *Bucket) Delay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	return b.delay(0)
+}
+
+// Wait takes n tokens from the bucket and waits until the bucket is out of
+// debt, so that consecutive calls proceed at the rate of the bucket.
+//
+// Parameters:
+// - ctx: the context to stop waiting on
+// - n: the number of tokens to take
+//
+// Returns:
+// - error: the error of the context if it was done before the wait was over
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	delay := b.delay(0)
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Inherit sets the tokens of the bucket to the ones of another bucket, capped
+// at its burst size, e.g. when the limit of a client changes. A bucket in debt
+// passes its debt on.
+//
+// Parameters:
+// - other: the bucket replaced by this one
+func (b *Bucket) Inherit(other *Bucket) {
+	other.mu.Lock()
+	other.refill(time.Now())
+	tokens := other.tokens
+	other.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(b.burst, tokens)
+	b.last = time.Now()
+}
+
+// Full reports whether the bucket is full, i.e. it limits nothing right now
+// and can be dropped without loosening the limit.
+func (b *Bucket) Full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	return b.tokens >= b.burst
+}
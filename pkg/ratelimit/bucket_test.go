@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketAllow(t *testing.T) {
+	bucket := NewBucket(10, 3)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := bucket.Allow()
+		assert.True(t, ok, "burst must be allowed")
+	}
+
+	ok, retryAfter := bucket.Allow()
+	assert.False(t, ok)
+	assert.Greater(t, retryAfter, time.Duration(0))
+	assert.LessOrEqual(t, retryAfter, 100*time.Millisecond)
+
+	time.Sleep(retryAfter)
+	ok, _ = bucket.Allow()
+	assert.True(t, ok, "a token must be added after the retry delay")
+}
+
+func TestBucketWait(t *testing.T) {
+	bucket := NewBucket(1000, 1000)
+
+	// The burst passes without waiting
+	start := time.Now()
+	assert.NoError(t, bucket.Wait(context.Background(), 1000))
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+	// Tokens over the burst are paid off at the rate
+	start = time.Now()
+	assert.NoError(t, bucket.Wait(context.Background(), 100))
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+	// A bucket in debt delays the next events
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, bucket.Wait(ctx, 500), context.Canceled)
+	assert.Greater(t, bucket.Delay(), 400*time.Millisecond)
+	assert.False(t, bucket.Full())
+}
+
+func TestBucketFull(t *testing.T) {
+	bucket := NewBucket(100, 1)
+	assert.True(t, bucket.Full())
+
+	ok, _ := bucket.Allow()
+	assert.True(t, ok)
+	assert.False(t, bucket.Full())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, bucket.Full())
+}
+
+func TestBucketInherit(t *testing.T) {
+	old := NewBucket(1, 5)
+	for i := 0; i < 4; i++ {
+		ok, _ := old.Allow()
+		assert.True(t, ok)
+	}
+
+	// The tokens left are taken over instead of a full burst
+	bucket := NewBucket(1, 10)
+	bucket.Inherit(old)
+	ok, _ := bucket.Allow()
+	assert.True(t, ok)
+	ok, _ = bucket.Allow()
+	assert.False(t, ok)
+
+	// And capped at the burst of the new bucket
+	bucket = NewBucket(1, 2)
+	bucket.Inherit(NewBucket(1, 10))
+	assert.True(t, bucket.Full())
+	for i := 0; i < 2; i++ {
+		ok, _ = bucket.Allow()
+		assert.True(t, ok)
+	}
+	ok, _ = bucket.Allow()
+	assert.False(t, ok)
+}
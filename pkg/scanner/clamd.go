@@ -0,0 +1,130 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks the content is streamed to clamd in.
+const clamdChunkSize = 64 << 10
+
+// Clamd scans content with clamd using the INSTREAM command.
+type Clamd struct {
+	// Network is "tcp" or "unix".
+	Network string
+	// Address is the address of clamd, a host and port or a socket path.
+	Address string
+	// Timeout is the time a scan may take.
+	Timeout time.Duration
+}
+
+// Name returns the name of the engine.
+func (c *Clamd) Name() string {
+	return "clamd"
+}
+
+// Scan streams the content to clamd and parses its reply.
+//
+// Parameters:
+// - ctx: the context of the scan
+// - r: the content to scan
+//
+// Returns:
+// - *Verdict: the verdict of clamd
+// - error: any error that occurred while scanning
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (*Verdict, error) {
+	conn, stop, err := dial(ctx, c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to clamd: %v", err)
+	}
+	defer conn.Close()
+	defer stop()
+
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err = w.WriteString("zINSTREAM\x00"); err != nil {
+		return nil, fmt.Errorf("error sending to clamd: %v", err)
+	}
+
+	// Every chunk is prefixed with its big-endian length, an empty chunk ends the stream
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, chunk)
+		if n > 0 {
+			if err = binary.Write(w, binary.BigEndian, uint32(n)); err == nil {
+				_, err = w.Write(chunk[:n])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error sending to clamd: %v", err)
+			}
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return nil, fmt.Errorf("error reading content: %v", readErr)
+		}
+	}
+
+	if err = binary.Write(w, binary.BigEndian, uint32(0)); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error sending to clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return nil, fmt.Errorf("error reading clamd reply: %v", err)
+	}
+
+	return parseClamdReply(reply)
+}
+
+// Ping sends the PING command to clamd, which answers PONG when it is ready.
+//
+// Parameters:
+// - ctx: the context of the check
+//
+// Returns an error if clamd is not ready
+func (c *Clamd) Ping(ctx context.Context) error {
+	conn, stop, err := dial(ctx, c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return fmt.Errorf("error connecting to clamd: %v", err)
+	}
+	defer conn.Close()
+	defer stop()
+
+	if _, err = conn.Write([]byte("zPING\x00")); err != nil {
+		return fmt.Errorf("error sending to clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return fmt.Errorf("error reading clamd reply: %v", err)
+	}
+	if reply = strings.TrimRight(reply, "\x00"); reply != "PONG" {
+		return fmt.Errorf("clamd error: %s", reply)
+	}
+
+	return nil
+}
+
+// parseClamdReply parses a reply such as "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (*Verdict, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+
+	switch {
+	case result == "OK":
+		return &Verdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &Verdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return nil, fmt.Errorf("clamd error: %s", reply)
+	}
+}
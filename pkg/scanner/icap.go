@@ -0,0 +1,247 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icapChunkSize is the size of the chunks the content is sent to the ICAP server in.
+const icapChunkSize = 64 << 10
+
+// ICAP scans content with an ICAP server using the RESPMOD method, as if the
+// content was an HTTP response passing through a proxy.
+type ICAP struct {
+	// URL is the URL of the ICAP service, e.g. "icap://host:1344/avscan".
+	URL *url.URL
+	// Timeout is the time a scan may take.
+	Timeout time.Duration
+}
+
+// Name returns the name of the engine.
+func (c *ICAP) Name() string {
+	return "icap"
+}
+
+// Scan sends the content to the ICAP server.
+//
+// The server answers 204 No Content if the content is clean. It answers
+// 200 OK with the content it blocked or modified, which is reported as
+// infected if the server names the malware or the content differs from the
+// one sent. A server echoing the content unchanged gives no verdict.
+//
+// Parameters:
+// - ctx: the context of the scan
+// - r: the content to scan
+//
+// Returns:
+// - *Verdict: the verdict of the server
+// - error: any error that occurred while scanning
+func (c *ICAP) Scan(ctx context.Context, r io.Reader) (*Verdict, error) {
+	conn, stop, err := dial(ctx, "tcp", c.address(), c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ICAP server: %v", err)
+	}
+	defer conn.Close()
+	defer stop()
+
+	httpHeader := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	// The digest of the content tells whether the server modified it
+	sent := sha256.New()
+	r = io.TeeReader(r, sent)
+
+	w := bufio.NewWriterSize(conn, icapChunkSize+16)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", c.URL.String())
+	fmt.Fprintf(w, "Host: %s\r\n", c.URL.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(httpHeader))
+	w.WriteString(httpHeader)
+
+	chunk := make([]byte, icapChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, chunk)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(chunk[:n])
+			if _, err = w.WriteString("\r\n"); err != nil {
+				return nil, fmt.Errorf("error sending to ICAP server: %v", err)
+			}
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return nil, fmt.Errorf("error reading content: %v", readErr)
+		}
+	}
+
+	w.WriteString("0\r\n\r\n")
+	if err = w.Flush(); err != nil {
+		return nil, fmt.Errorf("error sending to ICAP server: %v", err)
+	}
+
+	buffered := bufio.NewReader(conn)
+	reader := textproto.NewReader(buffered)
+	statusLine, err := reader.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("error reading ICAP response: %v", err)
+	}
+
+	status, err := parseICAPStatus(statusLine)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading ICAP response: %v", err)
+	}
+
+	switch status {
+	case 204:
+		return &Verdict{}, nil
+	case 200:
+		if header.Get("X-Infection-Found") != "" || header.Get("X-Virus-ID") != "" {
+			return &Verdict{Infected: true, Signature: icapSignature(header)}, nil
+		}
+
+		received, err := icapBodyDigest(buffered, header.Get("Encapsulated"))
+		if err != nil {
+			return nil, fmt.Errorf("error reading ICAP response: %v", err)
+		}
+		if !bytes.Equal(received, sent.Sum(nil)) {
+			// The server replaced the content, e.g. with a page telling it was blocked
+			return &Verdict{Infected: true, Signature: icapSignature(header)}, nil
+		}
+		return nil, fmt.Errorf("ICAP server returned the content unchanged without a verdict")
+	default:
+		return nil, fmt.Errorf("ICAP error: %s", statusLine)
+	}
+}
+
+// icapBodyDigest reads the encapsulated HTTP response of an ICAP response
+// and returns the SHA256 digest of its body.
+//
+// Parameters:
+// - r: the reader positioned after the ICAP header
+// - encapsulated: the Encapsulated header, e.g. "res-hdr=0, res-body=85"
+//
+// Returns:
+// - []byte: the digest of the body, the one of empty content if there is none
+// - error: an error if the response is invalid
+func icapBodyDigest(r *bufio.Reader, encapsulated string) ([]byte, error) {
+	offsets := make(map[string]int64)
+	for _, field := range strings.Split(encapsulated, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid Encapsulated header %q", encapsulated)
+		}
+		offset, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Encapsulated header %q", encapsulated)
+		}
+		offsets[name] = offset
+	}
+
+	digest := sha256.New()
+	bodyOffset, ok := offsets["res-body"]
+	if !ok {
+		// The server sent no body, e.g. "null-body=0"
+		return digest.Sum(nil), nil
+	}
+
+	// Skip the header of the encapsulated HTTP response
+	if _, err := io.CopyN(io.Discard, r, bodyOffset); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(digest, httputil.NewChunkedReader(r)); err != nil {
+		return nil, err
+	}
+
+	return digest.Sum(nil), nil
+}
+
+// Ping sends an OPTIONS request for the service to the ICAP server, which
+// answers 200 OK when the service is available.
+//
+// Parameters:
+// - ctx: the context of the check
+//
+// Returns an error if the service is not available
+func (c *ICAP) Ping(ctx context.Context) error {
+	conn, stop, err := dial(ctx, "tcp", c.address(), c.Timeout)
+	if err != nil {
+		return fmt.Errorf("error connecting to ICAP server: %v", err)
+	}
+	defer conn.Close()
+	defer stop()
+
+	if _, err = fmt.Fprintf(conn, "OPTIONS %s ICAP/1.0\r\nHost: %s\r\nEncapsulated: null-body=0\r\n\r\n", c.URL.String(), c.URL.Host); err != nil {
+		return fmt.Errorf("error sending to ICAP server: %v", err)
+	}
+
+	statusLine, err := textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+	if err != nil {
+		return fmt.Errorf("error reading ICAP response: %v", err)
+	}
+
+	status, err := parseICAPStatus(statusLine)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("ICAP error: %s", statusLine)
+	}
+
+	return nil
+}
+
+// address returns the address of the ICAP server, with the default port if the URL has none.
+func (c *ICAP) address() string {
+	if c.URL.Port() == "" {
+		return net.JoinHostPort(c.URL.Hostname(), "1344")
+	}
+	return c.URL.Host
+}
+
+// parseICAPStatus returns the status code of an ICAP status line.
+func parseICAPStatus(line string) (int, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return 0, fmt.Errorf("invalid ICAP status line %q", line)
+	}
+
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid ICAP status line %q", line)
+	}
+
+	return status, nil
+}
+
+// icapSignature returns the name of the malware reported by the ICAP server.
+func icapSignature(header textproto.MIMEHeader) string {
+	// X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;
+	for _, field := range strings.Split(header.Get("X-Infection-Found"), ";") {
+		if threat, ok := strings.CutPrefix(strings.TrimSpace(field), "Threat="); ok && threat != "" {
+			return threat
+		}
+	}
+
+	if virus := header.Get("X-Virus-ID"); virus != "" {
+		return virus
+	}
+
+	return "unknown"
+}
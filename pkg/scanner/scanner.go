@@ -0,0 +1,109 @@
+// Package scanner scans content for malware with external antivirus engines
+// speaking the clamd or the ICAP protocol.
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// DefaultTimeout is the time a scan may take unless configured otherwise.
+const DefaultTimeout = time.Minute
+
+// Verdict is the result of a scan.
+type Verdict struct {
+	// Infected reports whether malware was found.
+	Infected bool `json:"infected"`
+	// Signature is the name of the malware found, empty if the content is clean.
+	Signature string `json:"signature,omitempty"`
+}
+
+// Scanner scans content for malware.
+type Scanner interface {
+	// Scan scans the content.
+	//
+	// Parameters:
+	// - ctx: the context of the scan
+	// - r: the content to scan
+	//
+	// Returns:
+	// - *Verdict: the verdict of the engine
+	// - error: any error that occurred while scanning, the content is not known to be clean then
+	Scan(ctx context.Context, r io.Reader) (*Verdict, error)
+
+	// Ping checks that the engine is reachable and ready to scan.
+	//
+	// Parameters:
+	// - ctx: the context of the check
+	//
+	// Returns an error if the engine is not ready
+	Ping(ctx context.Context) error
+
+	// Name returns the name of the engine recorded with the verdicts.
+	Name() string
+}
+
+// New creates a scanner from its address.
+//
+// Supported addresses are "clamd://host:3310" for clamd over TCP,
+// "clamd:///var/run/clamav/clamd.ctl" for clamd over a Unix socket and
+// "icap://host:1344/service" for ICAP servers.
+//
+// Parameters:
+// - address: the address of the engine
+// - timeout: the time a scan may take, DefaultTimeout if zero
+//
+// Returns:
+// - Scanner: the scanner
+// - error: any error that occurred while parsing the address
+func New(address string, timeout time.Duration) (Scanner, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scanner address: %v", err)
+	}
+
+	switch u.Scheme {
+	case "clamd":
+		if u.Host != "" {
+			return &Clamd{Network: "tcp", Address: u.Host, Timeout: timeout}, nil
+		}
+		if u.Path != "" {
+			return &Clamd{Network: "unix", Address: u.Path, Timeout: timeout}, nil
+		}
+		return nil, fmt.Errorf("scanner address %q has no host or socket path", address)
+	case "icap":
+		if u.Host == "" {
+			return nil, fmt.Errorf("scanner address %q has no host", address)
+		}
+		return &ICAP{URL: u, Timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scanner %q", u.Scheme)
+	}
+}
+
+// dial connects to the engine, the connection is closed when the context is
+// done and times out after the given time.
+func dial(ctx context.Context, network string, address string, timeout time.Duration) (net.Conn, func() bool, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// Unblock reads and writes once the context is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	return conn, stop, nil
+}
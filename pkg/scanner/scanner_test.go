@@ -0,0 +1,271 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eicar is the standard antivirus test string.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// serveFakeClamd answers INSTREAM commands on the listener, reporting content
+// containing the EICAR string as infected.
+func serveFakeClamd(t *testing.T, listener net.Listener) {
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				command, err := r.ReadString(0)
+				if command == "zPING\x00" {
+					conn.Write([]byte("PONG\x00"))
+					return
+				}
+				if err != nil || command != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				content := new(bytes.Buffer)
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(content, r, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if strings.Contains(content.String(), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE") {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+}
+
+// serveFakeICAP answers RESPMOD requests on the listener, blocking content
+// containing the EICAR string.
+func serveFakeICAP(t *testing.T, listener net.Listener) {
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := textproto.NewReader(bufio.NewReader(conn))
+
+				line, err := r.ReadLine()
+				if err != nil {
+					return
+				}
+				if _, err := r.ReadMIMEHeader(); err != nil {
+					return
+				}
+				if strings.HasPrefix(line, "OPTIONS ") {
+					conn.Write([]byte("ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nEncapsulated: null-body=0\r\n\r\n"))
+					return
+				}
+				if !strings.HasPrefix(line, "RESPMOD ") {
+					return
+				}
+				// The encapsulated HTTP response status line and header
+				if _, err := r.ReadLine(); err != nil {
+					return
+				}
+				if _, err := r.ReadMIMEHeader(); err != nil {
+					return
+				}
+
+				content := new(bytes.Buffer)
+				for {
+					line, err := r.ReadLine()
+					if err != nil {
+						return
+					}
+					size, err := strconv.ParseInt(line, 16, 64)
+					if err != nil {
+						return
+					}
+					if size == 0 {
+						r.ReadLine()
+						break
+					}
+					if _, err := io.CopyN(content, r.R, size); err != nil {
+						return
+					}
+					if _, err := r.R.Discard(2); err != nil {
+						return
+					}
+				}
+
+				switch {
+				case strings.Contains(content.String(), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"):
+					conn.Write([]byte("ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;\r\nEncapsulated: null-body=0\r\n\r\n"))
+				case strings.HasPrefix(content.String(), "echo"):
+					// Servers ignoring "Allow: 204" return the clean content unchanged
+					writeICAPContent(conn, content.Bytes())
+				case strings.HasPrefix(content.String(), "block"):
+					// Servers blocking content may replace it without naming the malware
+					writeICAPContent(conn, []byte("access denied"))
+				default:
+					conn.Write([]byte("ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n"))
+				}
+			}()
+		}
+	}()
+}
+
+// writeICAPContent writes a 200 OK ICAP response encapsulating the content.
+func writeICAPContent(w io.Writer, content []byte) {
+	httpHeader := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+	fmt.Fprintf(w, "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=%d\r\n\r\n%s", len(httpHeader), httpHeader)
+	fmt.Fprintf(w, "%x\r\n%s\r\n0; ieof\r\n\r\n", len(content), content)
+}
+
+// testScanner checks the verdicts of the scanner for clean and infected content.
+func testScanner(t *testing.T, scanner Scanner) {
+	t.Helper()
+
+	assert.NoError(t, scanner.Ping(context.Background()))
+
+	verdict, err := scanner.Scan(context.Background(), strings.NewReader("clean content"))
+	assert.NoError(t, err)
+	assert.False(t, verdict.Infected)
+
+	// Content larger than a chunk is streamed in several chunks
+	infected := strings.Repeat("x", 100<<10) + eicar
+	verdict, err = scanner.Scan(context.Background(), strings.NewReader(infected))
+	assert.NoError(t, err)
+	assert.True(t, verdict.Infected)
+	assert.NotEmpty(t, verdict.Signature)
+}
+
+func TestClamdOverTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveFakeClamd(t, listener)
+
+	scanner, err := New("clamd://"+listener.Addr().String(), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "clamd", scanner.Name())
+	testScanner(t, scanner)
+}
+
+func TestClamdOverUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clamd.sock")
+	listener, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	serveFakeClamd(t, listener)
+
+	scanner, err := New("clamd://"+path, 0)
+	assert.NoError(t, err)
+	testScanner(t, scanner)
+}
+
+func TestICAP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveFakeICAP(t, listener)
+
+	scanner, err := New("icap://"+listener.Addr().String()+"/avscan", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "icap", scanner.Name())
+	testScanner(t, scanner)
+}
+
+func TestICAPContentWithoutVerdict(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveFakeICAP(t, listener)
+
+	scanner, err := New("icap://"+listener.Addr().String()+"/avscan", 0)
+	assert.NoError(t, err)
+
+	// Content echoed unchanged is neither clean nor infected
+	_, err = scanner.Scan(context.Background(), strings.NewReader("echo clean content"))
+	assert.ErrorContains(t, err, "without a verdict")
+
+	// Replaced content was blocked
+	verdict, err := scanner.Scan(context.Background(), strings.NewReader("block this content"))
+	assert.NoError(t, err)
+	assert.True(t, verdict.Infected)
+	assert.Equal(t, "unknown", verdict.Signature)
+}
+
+func TestScanTimeout(t *testing.T) {
+	// A listener that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	scanner, err := New("clamd://"+listener.Addr().String(), 100*time.Millisecond)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = scanner.Scan(context.Background(), strings.NewReader("content"))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestParseClamdReply(t *testing.T) {
+	verdict, err := parseClamdReply("stream: OK\x00")
+	assert.NoError(t, err)
+	assert.False(t, verdict.Infected)
+
+	verdict, err = parseClamdReply("stream: Win.Test.EICAR_HDB-1 FOUND\x00")
+	assert.NoError(t, err)
+	assert.Equal(t, &Verdict{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, verdict)
+
+	_, err = parseClamdReply("INSTREAM size limit exceeded. ERROR\x00")
+	assert.Error(t, err)
+}
+
+func TestNewWithInvalidAddress(t *testing.T) {
+	for _, address := range []string{"http://localhost", "clamd://", "icap:///service"} {
+		_, err := New(address, 0)
+		assert.Error(t, err, address)
+	}
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+)
+
+// PrincipalKey is the key of the authenticated principal in the gin context.
+const PrincipalKey = "principal"
+
+// APIKeyHeader is the header carrying a static API key.
+const APIKeyHeader = "X-API-Key"
+
+// Authentication methods of a principal.
+const (
+	// AuthMethodAPIKey is used for principals authenticated with a static API key.
+	AuthMethodAPIKey = "api_key"
+	// AuthMethodJWT is used for principals authenticated with a JWT bearer token.
+	AuthMethodJWT = "jwt"
+	// AuthMethodAnonymous is used for requests without credentials if anonymous access is allowed.
+	AuthMethodAnonymous = "anonymous"
+	// AuthMethodSignedURL is used for requests to valid signed URLs.
+	AuthMethodSignedURL = "signed_url"
+	// AuthMethodClientCert is used for principals authenticated with a TLS client certificate.
+	AuthMethodClientCert = "client_cert"
+)
+
+// errUnauthenticated is returned when a request carries no credentials.
+var errUnauthenticated = errors.New("authentication required")
+
+// Principal is the identity a request is made on behalf of.
+type Principal struct {
+	// Name identifies the principal: the name of an API key or the subject of a token.
+	Name string `json:"name"`
+	// AuthMethod is the method the principal was authenticated with.
+	AuthMethod string `json:"auth_method"`
+	// Scopes are the scopes granted to the principal.
+	Scopes []string `json:"scopes"`
+	// Tenant is the tenant the principal belongs to, empty if it may access all tenants.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// APIKey is a static API key of a principal.
+type APIKey struct {
+	// Principal is the name of the principal the key belongs to.
+	Principal string `json:"principal"`
+	// Key is the secret value of the key.
+	Key string `json:"-"`
+	// Scopes are the scopes granted to the key.
+	Scopes []string `json:"scopes"`
+	// Tenant is the tenant the principal of the key belongs to.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// ClientCert maps the subject of a verified TLS client certificate to a principal.
+type ClientCert struct {
+	// Subject is the distinguished name of the certificate, e.g. "CN=ci,O=Acme",
+	// or "CN=name" to match the common name only.
+	Subject string `json:"subject"`
+	// Principal is the name of the principal the certificate belongs to.
+	Principal string `json:"principal"`
+	// Scopes are the scopes granted to the certificate.
+	Scopes []string `json:"scopes"`
+	// Tenant is the tenant the principal of the certificate belongs to.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// PrincipalFromContext returns the principal of the request.
+//
+// Parameters:
+// - c: the gin context
+//
+// Returns:
+// - *Principal: the authenticated principal
+// - bool: false if the request is not authenticated
+func PrincipalFromContext(c *gin.Context) (*Principal, bool) {
+	value, ok := c.Get(PrincipalKey)
+	if !ok {
+		return nil, false
+	}
+
+	principal, ok := value.(*Principal)
+	return principal, ok
+}
+
+// authenticator verifies the credentials of requests.
+type authenticator struct {
+	// apiKeys maps the SHA256 of API keys to their principals. Keys are
+	// compared by their digests, which keeps the comparison constant-time.
+	apiKeys map[[sha256.Size]byte]*Principal
+
+	// jwks holds the keys to verify JWT signatures with, nil if JWT is disabled.
+	jwks *jwks
+
+	// parser validates JWT claims.
+	parser *jwt.Parser
+
+	// anonymous is the principal of requests without credentials, nil if they are rejected.
+	anonymous *Principal
+
+	// clientCerts maps the subjects of client certificates to their principals.
+	clientCerts map[string]*Principal
+}
+
+// newAuthenticator creates an authenticator from the server configuration.
+//
+// Parameters:
+// - config: the server configuration
+//
+// Returns:
+// - *authenticator: the authenticator, nil if authentication is disabled
+// - error: any error that occurred while loading the keys
+func newAuthenticator(config *Config) (*authenticator, error) {
+	if !config.IsAuthEnabled() {
+		return nil, nil
+	}
+
+	auth := &authenticator{
+		apiKeys: make(map[[sha256.Size]byte]*Principal, len(config.APIKeys)),
+	}
+
+	for _, apiKey := range config.APIKeys {
+		if apiKey.Principal == "" || apiKey.Key == "" {
+			return nil, fmt.Errorf("API key must have a principal and a key")
+		}
+
+		digest := sha256.Sum256([]byte(apiKey.Key))
+		if _, ok := auth.apiKeys[digest]; ok {
+			return nil, fmt.Errorf("duplicate API key of principal %q", apiKey.Principal)
+		}
+		if err := validateScopes(apiKey.Scopes); err != nil {
+			return nil, fmt.Errorf("invalid API key of principal %q: %v", apiKey.Principal, err)
+		}
+
+		if apiKey.Tenant != "" {
+			if err := storage.ValidateTenant(apiKey.Tenant); err != nil {
+				return nil, fmt.Errorf("invalid API key of principal %q: %v", apiKey.Principal, err)
+			}
+		}
+
+		auth.apiKeys[digest] = &Principal{
+			Name:       apiKey.Principal,
+			AuthMethod: AuthMethodAPIKey,
+			Scopes:     apiKey.Scopes,
+			Tenant:     apiKey.Tenant,
+		}
+	}
+
+	if len(config.ClientCerts) > 0 && config.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("client certificates require a client CA")
+	}
+	auth.clientCerts = make(map[string]*Principal, len(config.ClientCerts))
+	for _, clientCert := range config.ClientCerts {
+		if clientCert.Subject == "" || clientCert.Principal == "" {
+			return nil, fmt.Errorf("client certificate must have a subject and a principal")
+		}
+		if _, ok := auth.clientCerts[clientCert.Subject]; ok {
+			return nil, fmt.Errorf("duplicate client certificate subject %q", clientCert.Subject)
+		}
+		if err := validateScopes(clientCert.Scopes); err != nil {
+			return nil, fmt.Errorf("invalid client certificate of principal %q: %v", clientCert.Principal, err)
+		}
+		if clientCert.Tenant != "" {
+			if err := storage.ValidateTenant(clientCert.Tenant); err != nil {
+				return nil, fmt.Errorf("invalid client certificate of principal %q: %v", clientCert.Principal, err)
+			}
+		}
+
+		auth.clientCerts[clientCert.Subject] = &Principal{
+			Name:       clientCert.Principal,
+			AuthMethod: AuthMethodClientCert,
+			Scopes:     clientCert.Scopes,
+			Tenant:     clientCert.Tenant,
+		}
+	}
+
+	if len(config.AnonymousScopes) > 0 {
+		if err := validateScopes(config.AnonymousScopes); err != nil {
+			return nil, fmt.Errorf("invalid anonymous scopes: %v", err)
+		}
+		auth.anonymous = &Principal{Name: "anonymous", AuthMethod: AuthMethodAnonymous, Scopes: config.AnonymousScopes}
+	}
+
+	if config.JWKSFile != "" {
+		keys, err := loadJWKS(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.jwks = keys
+
+		opts := []jwt.ParserOption{
+			jwt.WithValidMethods([]string{"HS256", "RS256"}),
+			jwt.WithExpirationRequired(),
+		}
+		if config.JWTIssuer != "" {
+			opts = append(opts, jwt.WithIssuer(config.JWTIssuer))
+		}
+		if config.JWTAudience != "" {
+			opts = append(opts, jwt.WithAudience(config.JWTAudience))
+		}
+		auth.parser = jwt.NewParser(opts...)
+	}
+
+	return auth, nil
+}
+
+// authenticate returns the principal of the request credentials.
+//
+// API keys are accepted in the X-API-Key header or as bearer tokens, any
+// other bearer token is verified as a JWT. Requests without credentials in
+// headers get the principal of their verified client certificate, or the
+// anonymous principal if anonymous access is allowed.
+//
+// Parameters:
+// - c: the gin context
+//
+// Returns:
+// - *Principal: the authenticated principal
+// - error: errUnauthenticated if the request has no credentials, any other error if they are invalid
+func (a *authenticator) authenticate(c *gin.Context) (*Principal, error) {
+	if key := c.GetHeader(APIKeyHeader); key != "" {
+		if principal, ok := a.apiKeys[sha256.Sum256([]byte(key))]; ok {
+			return principal, nil
+		}
+		return nil, fmt.Errorf("invalid API key")
+	}
+
+	authorization := c.GetHeader("Authorization")
+	if authorization == "" {
+		if principal := a.clientCertPrincipal(c.Request.TLS); principal != nil {
+			return principal, nil
+		}
+		if a.anonymous != nil {
+			return a.anonymous, nil
+		}
+	}
+
+	scheme, token, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errUnauthenticated
+	}
+	token = strings.TrimSpace(token)
+
+	if principal, ok := a.apiKeys[sha256.Sum256([]byte(token))]; ok {
+		return principal, nil
+	}
+
+	if a.jwks == nil {
+		return nil, fmt.Errorf("invalid API key")
+	}
+
+	return a.verifyJWT(token)
+}
+
+// clientCertPrincipal returns the principal of the verified client certificate
+// of the connection, nil if there is none or its subject is not mapped.
+func (a *authenticator) clientCertPrincipal(state *tls.ConnectionState) *Principal {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	subject := state.VerifiedChains[0][0].Subject
+	if principal, ok := a.clientCerts[subject.String()]; ok {
+		return principal
+	}
+	return a.clientCerts["CN="+subject.CommonName]
+}
+
+// verifyJWT verifies a JWT bearer token and returns the principal of its subject.
+//
+// The scopes of the principal are taken from the space-separated "scope" claim
+// or the "scp" claim, which may also be a list. Unknown scopes are ignored.
+// The tenant of the principal is taken from the "tenant" claim.
+//
+// Parameters:
+// - token: the JWT
+//
+// Returns:
+// - *Principal: the principal named after the subject of the token
+// - error: any error that occurred while verifying the token
+func (a *authenticator) verifyJWT(token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.jwks.keyFunc); err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, fmt.Errorf("invalid token: subject is missing")
+	}
+
+	principal := &Principal{Name: subject, AuthMethod: AuthMethodJWT, Scopes: scopesFromClaims(claims)}
+	if tenant, ok := claims["tenant"].(string); ok && tenant != "" {
+		if err := storage.ValidateTenant(tenant); err != nil {
+			return nil, fmt.Errorf("invalid token: %v", err)
+		}
+		principal.Tenant = tenant
+	}
+
+	return principal, nil
+}
+
+// scopesFromClaims returns the known scopes granted by the claims of a token.
+func scopesFromClaims(claims jwt.MapClaims) []string {
+	var granted []string
+	for _, name := range []string{"scope", "scp"} {
+		switch value := claims[name].(type) {
+		case string:
+			granted = append(granted, strings.Fields(value)...)
+		case []interface{}:
+			for _, element := range value {
+				if scope, ok := element.(string); ok {
+					granted = append(granted, scope)
+				}
+			}
+		}
+	}
+
+	scopes := []string{}
+	for _, scope := range granted {
+		if slices.Contains(knownScopes, scope) && !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// authenticate is a middleware authenticating every request and attaching
+// its principal to the gin context.
+//
+// Requests already authenticated by a signed URL are passed on. It returns
+// 401 Unauthorized if the request has no credentials or they are invalid.
+func (s *HTTPFileStorageServer) authenticate(c *gin.Context) {
+	if _, ok := PrincipalFromContext(c); ok {
+		c.Next()
+		return
+	}
+
+	principal, err := s.auth.Load().authenticate(c)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer realm="file storage"`)
+		c.AbortWithStatusJSON(401, gin.H{"msg": err.Error()})
+		return
+	}
+
+	c.Set(PrincipalKey, principal)
+	c.Next()
+}
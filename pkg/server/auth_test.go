@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+var testHMACSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// writeTestJWKS writes a JWKS with an HS256 and an RS256 key and returns its path.
+func writeTestJWKS(t *testing.T, rsaKey *rsa.PrivateKey) string {
+	t.Helper()
+
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "oct", "kid": "hmac", "alg": "HS256", "k": base64.RawURLEncoding.EncodeToString(testHMACSecret)},
+			{
+				"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+		},
+	}
+
+	data, err := json.Marshal(set)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+// signTestToken signs a token with the given method, key ID and claims.
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+// newAuthTestRouter creates a router with authentication and a handler returning the principal.
+func newAuthTestRouter(t *testing.T, rsaKey *rsa.PrivateKey) *gin.Engine {
+	t.Helper()
+
+	server, _ := newTestServer(t, &Config{
+		APIKeys:     []APIKey{{Principal: "ci", Key: "ci-secret"}},
+		JWKSFile:    writeTestJWKS(t, rsaKey),
+		JWTIssuer:   "issuer",
+		JWTAudience: "storage",
+	})
+	r := server.setupRouter()
+	r.GET("/whoami", func(c *gin.Context) {
+		principal, _ := PrincipalFromContext(c)
+		c.JSON(200, principal)
+	})
+
+	return r
+}
+
+func TestAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	r := newAuthTestRouter(t, rsaKey)
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "alice",
+			"iss": "issuer",
+			"aud": "storage",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	expiredClaims := validClaims()
+	expiredClaims["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongAudienceClaims := validClaims()
+	wrongAudienceClaims["aud"] = "other"
+
+	tests := []struct {
+		name      string
+		header    string
+		value     string
+		code      int
+		principal string
+	}{
+		{"no credentials", "", "", 401, ""},
+		{"API key header", "X-API-Key", "ci-secret", 200, "ci"},
+		{"API key bearer", "Authorization", "Bearer ci-secret", 200, "ci"},
+		{"invalid API key", "X-API-Key", "wrong", 401, ""},
+		{"HS256 token", "Authorization", "Bearer " + signTestToken(t, jwt.SigningMethodHS256, "hmac", testHMACSecret, validClaims()), 200, "alice"},
+		{"RS256 token", "Authorization", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, validClaims()), 200, "alice"},
+		{"token signed with unknown key", "Authorization", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "rsa", otherRSAKey, validClaims()), 401, ""},
+		{"token with unknown key ID", "Authorization", "Bearer " + signTestToken(t, jwt.SigningMethodHS256, "missing", testHMACSecret, validClaims()), 401, ""},
+		{"HMAC token with RSA key ID", "Authorization", "Bearer " + signTestToken(t, jwt.SigningMethodHS256, "rsa", testHMACSecret, validClaims()), 401, ""},
+		{"expired token", "Authorization", "Bearer " + signTestToken(t, jwt.SigningMethodHS256, "hmac", testHMACSecret, expiredClaims), 401, ""},
+		{"token for another audience", "Authorization", "Bearer " + signTestToken(t, jwt.SigningMethodHS256, "hmac", testHMACSecret, wrongAudienceClaims), 401, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/whoami", nil)
+			if test.header != "" {
+				req.Header.Set(test.header, test.value)
+			}
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, test.code, w.Code)
+			if test.code == 401 {
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+				return
+			}
+
+			var principal Principal
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&principal))
+			assert.Equal(t, test.principal, principal.Name)
+		})
+	}
+}
+
+func TestAuthenticationProtectsFileRoutes(t *testing.T) {
+	server, _ := newTestServer(t, &Config{APIKeys: []APIKey{{Principal: "ci", Key: "ci-secret", Scopes: []string{ScopeFilesWrite}}}})
+	r := server.setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newUploadRequest(t, "/file", []byte("content")))
+	assert.Equal(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	req := newUploadRequest(t, "/file", []byte("content"))
+	req.Header.Set("X-API-Key", "ci-secret")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+}
+
+func TestNewServerWithInvalidJWKS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"keys":[{"kty":"EC","kid":"ec"}]}`), 0600))
+
+	storer, _ := newTestServer(t, nil)
+	_, err := NewHTTPFileStorageServer(storer.storer, &Config{JWKSFile: path})
+	assert.Error(t, err)
+}
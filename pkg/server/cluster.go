@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/cluster"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// isClusterEnabled reports whether the server runs in cluster mode.
+func (s *HTTPFileStorageServer) isClusterEnabled() bool {
+	return s.ring != nil
+}
+
+// remoteOwner returns the cluster member owning the given hash if it is not
+// this node, and an empty string otherwise.
+//
+// Requests already forwarded by another member are always handled locally,
+// see isForwardedByMember.
+//
+// Parameters:
+// - c: the gin context.
+// - hash: the hash of the file.
+//
+// Returns:
+// - string: the base URL of the owner, empty if the file is handled locally
+func (s *HTTPFileStorageServer) remoteOwner(c *gin.Context, hash string) string {
+	if !s.isClusterEnabled() || s.isForwardedByMember(c) {
+		return ""
+	}
+
+	owner := s.ring.Owner(hash)
+	if owner == s.clusterSelf {
+		return ""
+	}
+
+	return owner
+}
+
+// isForwardedByMember reports whether the request was forwarded by another
+// cluster member. The forwarded header is only trusted from members, i.e.
+// principals granted the admin scope, which members need on each other
+// anyway, or requests with the peer API key. Otherwise clients could bypass
+// the ring and store files on any member.
+func (s *HTTPFileStorageServer) isForwardedByMember(c *gin.Context) bool {
+	if c.GetHeader(cluster.ForwardedHeader) == "" {
+		return false
+	}
+
+	if principal, ok := PrincipalFromContext(c); ok && principal.HasScope(ScopeAdmin) {
+		return true
+	}
+
+	key := c.GetHeader(APIKeyHeader)
+	return s.config.PeerAPIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.config.PeerAPIKey)) == 1
+}
+
+// forwardToOwner is a middleware for the /file/:hash routes that sends the
+// request to the cluster member owning the hash.
+//
+// Depending on the configuration the request is either proxied to the owner
+// or the client is redirected to it with 307 Temporary Redirect.
+func (s *HTTPFileStorageServer) forwardToOwner(c *gin.Context) {
+	owner := s.remoteOwner(c, c.Param("hash"))
+	if owner == "" {
+		c.Next()
+		return
+	}
+
+	if s.config.ClusterRedirect {
+		c.Redirect(http.StatusTemporaryRedirect, owner+c.Request.URL.RequestURI())
+		c.Abort()
+		return
+	}
+
+	// Proxied requests keep the credentials of the client, so the forwarded
+	// header isn't trusted by the owner. A proxied request the owner would
+	// proxy again means the members disagree about the ring, so it is
+	// rejected instead of looping between them.
+	if c.GetHeader(cluster.ForwardedHeader) != "" {
+		c.AbortWithStatusJSON(http.StatusLoopDetected, gin.H{"msg": "request was already forwarded by another cluster member"})
+		return
+	}
+
+	target, err := url.Parse(owner)
+	if err != nil {
+		c.AbortWithError(500, fmt.Errorf("error parsing cluster member address: %v", err))
+		return
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if s.peerTransport != nil {
+		proxy.Transport = s.peerTransport
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		s.requestLogger(c).Error("error forwarding request", "owner", owner, "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	c.Request.Header.Set(cluster.ForwardedHeader, "1")
+	// The owner continues the trace of this node rather than the one of the client
+	s.propagator.Inject(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	proxy.ServeHTTP(c.Writer, c.Request)
+	c.Abort()
+}
+
+// forwardUpload sends an uploaded file to the cluster member owning its hash
+// and relays the response of the member to the client.
+//
+// Parameters:
+// - c: the gin context.
+// - owner: the base URL of the owning member.
+// - filePath: the path to the uploaded file.
+// - fileName: the name of the file provided by the client.
+func (s *HTTPFileStorageServer) forwardUpload(c *gin.Context, owner string, filePath string, fileName string) {
+	resp, err := s.clusterClient.Upload(c.Request.Context(), owner, filePath, fileName)
+	if err != nil {
+		c.AbortWithError(502, fmt.Errorf("error forwarding file: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
+}
+
+// Rebalance moves all files stored on this node but owned by other cluster
+// members to their owners.
+//
+// A file is deleted locally only after the owner confirmed that it has stored it.
+// Rebalance is a no-op if cluster mode is disabled.
+//
+// Parameters:
+// - ctx: the context controlling the rebalancing.
+//
+// Returns:
+// - int: the number of moved files
+// - error: any error that occurred during rebalancing
+func (s *HTTPFileStorageServer) Rebalance(ctx context.Context) (int, error) {
+	if !s.isClusterEnabled() {
+		return 0, nil
+	}
+
+	hashes, err := s.tracedStorage(ctx).List()
+	if err != nil {
+		return 0, fmt.Errorf("error listing files: %v", err)
+	}
+
+	moved := 0
+	for _, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+
+		owner := s.ring.Owner(hash)
+		if owner == s.clusterSelf {
+			continue
+		}
+
+		if err := s.moveFile(ctx, hash, owner); err != nil {
+			return moved, fmt.Errorf("error moving file %s to %s: %v", hash, owner, err)
+		}
+		moved++
+	}
+
+	return moved, nil
+}
+
+// moveFile streams a local file to the given cluster member and deletes it locally.
+//
+// Parameters:
+// - ctx: the context of the transfer.
+// - hash: the hash of the file.
+// - owner: the base URL of the member to move the file to.
+//
+// Returns:
+// - error: any error that occurred while moving the file
+func (s *HTTPFileStorageServer) moveFile(ctx context.Context, hash string, owner string) error {
+	filePath, err := s.tracedStorage(ctx).Read(hash)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(filePath)
+
+	resp, err := s.clusterClient.Upload(ctx, owner, filePath, hash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	// The owner returns 200 if it already has the file and 201 if it was stored
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return s.tracedStorage(ctx).Delete(hash)
+}
+
+// rebalanceHandler handles the HTTP POST request to rebalance the cluster.
+// It returns the number of files moved to other members.
+func (s *HTTPFileStorageServer) rebalanceHandler(c *gin.Context) {
+	moved, err := s.Rebalance(c.Request.Context())
+	if err != nil {
+		c.AbortWithStatusJSON(500, gin.H{"msg": err.Error(), "moved": moved})
+		return
+	}
+
+	c.JSON(200, gin.H{"moved": moved})
+}
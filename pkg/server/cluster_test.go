@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/pavlov061356/http_based_file_storage/pkg/cluster"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type testNode struct {
+	url    string
+	server *HTTPFileStorageServer
+	storer storage.Storer
+}
+
+// newTestCluster starts n cluster members on loopback listeners.
+func newTestCluster(t *testing.T, n int, redirect bool) []*testNode {
+	t.Helper()
+
+	nodes := make([]*testNode, n)
+	httpServers := make([]*httptest.Server, n)
+	members := make([]string, n)
+	for i := range nodes {
+		nodes[i] = &testNode{}
+		node := nodes[i]
+
+		// The handler is set after the ring is known, i.e. after all listeners are started
+		httpServers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			node.server.engine.ServeHTTP(w, r)
+		}))
+		t.Cleanup(httpServers[i].Close)
+
+		node.url = httpServers[i].URL
+		members[i] = httpServers[i].URL
+	}
+
+	for _, node := range nodes {
+		node.server, node.storer = newTestServer(t, &Config{
+			ClusterSelf:     node.url,
+			ClusterMembers:  members,
+			ClusterRedirect: redirect,
+		})
+		node.server.engine = node.server.setupRouter()
+	}
+
+	return nodes
+}
+
+// findNodes returns the member owning the hash and any other member.
+func findNodes(nodes []*testNode, hash string) (*testNode, *testNode) {
+	var owner, other *testNode
+	for _, node := range nodes {
+		if node.server.ring.Owner(hash) == node.url {
+			owner = node
+		} else {
+			other = node
+		}
+	}
+	return owner, other
+}
+
+func TestNewServerWithSelfOutsideCluster(t *testing.T) {
+	storer, err := storage.NewStorage(t.TempDir())
+	assert.NoError(t, err)
+
+	_, err = NewHTTPFileStorageServer(storer, &Config{
+		ClusterSelf:    "http://c:8080",
+		ClusterMembers: []string{"http://a:8080", "http://b:8080"},
+	})
+	assert.Error(t, err)
+}
+
+func TestClusterForwardsRequestsToOwner(t *testing.T) {
+	for _, redirect := range []bool{false, true} {
+		t.Run(fmt.Sprintf("redirect=%v", redirect), func(t *testing.T) {
+			nodes := newTestCluster(t, 2, redirect)
+
+			content := []byte("cluster test content")
+			hash := contentHash(content)
+			owner, other := findNodes(nodes, hash)
+
+			// Upload the file through the member that doesn't own it
+			resp, err := http.DefaultClient.Do(newUploadRequest(t, other.url+"/file", content))
+			assert.NoError(t, err)
+			var response map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&response)
+			resp.Body.Close()
+			assert.Equal(t, 201, resp.StatusCode)
+			assert.Equal(t, hash, response["hash"])
+
+			// The file must be stored on the owner only
+			exists, err := owner.storer.Exists(hash)
+			assert.NoError(t, err)
+			assert.True(t, exists)
+			exists, err = other.storer.Exists(hash)
+			assert.NoError(t, err)
+			assert.False(t, exists)
+
+			// Download the file through the member that doesn't own it
+			resp, err = http.Get(other.url + "/file/" + hash)
+			assert.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, 200, resp.StatusCode)
+			assert.Equal(t, content, body)
+
+			// Delete the file through the member that doesn't own it
+			req, err := http.NewRequest("DELETE", other.url+"/file/"+hash, nil)
+			assert.NoError(t, err)
+			resp, err = http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, 200, resp.StatusCode)
+
+			exists, err = owner.storer.Exists(hash)
+			assert.NoError(t, err)
+			assert.False(t, exists)
+		})
+	}
+}
+
+func TestClusterRebalance(t *testing.T) {
+	nodes := newTestCluster(t, 2, false)
+
+	content := []byte("misplaced content")
+	hash := contentHash(content)
+	owner, other := findNodes(nodes, hash)
+
+	// Put the file on the member that doesn't own it
+	tmpFile, err := os.CreateTemp("", "rebalance")
+	assert.NoError(t, err)
+	_, err = tmpFile.Write(content)
+	assert.NoError(t, err)
+	tmpFile.Close()
+	assert.NoError(t, other.storer.SaveFileFromTemp(hash, tmpFile.Name()))
+
+	moved, err := other.server.Rebalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, moved)
+
+	exists, err := owner.storer.Exists(hash)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = other.storer.Exists(hash)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// Nothing is left to move
+	moved, err = other.server.Rebalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestClusterForwardsReplacedContentToOwner(t *testing.T) {
+	nodes := newTestCluster(t, 2, false)
+	for _, node := range nodes {
+		node.server.RegisterPreSaveHook(func(ctx context.Context, upload *UploadContext) error {
+			file, err := upload.Open()
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			content, err := io.ReadAll(file)
+			if err != nil {
+				return err
+			}
+			return upload.ReplaceContent(bytes.NewReader(bytes.ToUpper(content)))
+		})
+	}
+
+	// Find content owned by another member than its replacement
+	var content, replaced []byte
+	for i := 0; ; i++ {
+		content = []byte(fmt.Sprintf("replaced content %d", i))
+		replaced = bytes.ToUpper(content)
+		if nodes[0].server.ring.Owner(contentHash(content)) != nodes[0].server.ring.Owner(contentHash(replaced)) {
+			break
+		}
+	}
+	received, _ := findNodes(nodes, contentHash(content))
+	owner, _ := findNodes(nodes, contentHash(replaced))
+
+	resp, err := http.DefaultClient.Do(newUploadRequest(t, received.url+"/file", content))
+	assert.NoError(t, err)
+	var response map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, contentHash(replaced), response["hash"])
+
+	// The replaced content is stored on its owner only
+	exists, err := owner.storer.Exists(contentHash(replaced))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = received.storer.Exists(contentHash(replaced))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// And found through any member
+	for _, node := range nodes {
+		resp, err = http.Get(node.url + "/file/" + contentHash(replaced))
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, replaced, body)
+	}
+}
+
+func TestClusterIgnoresForwardedHeaderOfClients(t *testing.T) {
+	nodes := newTestCluster(t, 2, false)
+	for _, node := range nodes {
+		node.server.config.PeerAPIKey = "peer-secret"
+	}
+
+	content := []byte("spoofed forwarded header")
+	hash := contentHash(content)
+	owner, other := findNodes(nodes, hash)
+
+	// A client can't make a member store a file it doesn't own
+	req := newUploadRequest(t, other.url+"/file", content)
+	req.Header.Set(cluster.ForwardedHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 201, resp.StatusCode)
+
+	exists, err := owner.storer.Exists(hash)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = other.storer.Exists(hash)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// Nor read from a member that doesn't own the file
+	req, err = http.NewRequest("GET", other.url+"/file/"+hash, nil)
+	assert.NoError(t, err)
+	req.Header.Set(cluster.ForwardedHeader, "1")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusLoopDetected, resp.StatusCode)
+
+	// Members with the peer API key are handled locally
+	req.Header.Set(APIKeyHeader, "peer-secret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseAcceptEncoding returns the content codings accepted by the client
+// according to the Accept-Encoding header, excluding the ones with zero quality.
+//
+// Parameters:
+// - header: the value of the Accept-Encoding header
+//
+// Returns:
+// - []string: the accepted content codings in lower case
+func parseAcceptEncoding(header string) []string {
+	encodings := []string{}
+
+	for _, element := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(element, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		// Skip the codings explicitly refused with q=0
+		refused := false
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			if quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && quality == 0 {
+				refused = true
+			}
+		}
+
+		if !refused {
+			encodings = append(encodings, coding)
+		}
+	}
+
+	return encodings
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAcceptEncoding(t *testing.T) {
+	assert.Equal(t, []string{}, parseAcceptEncoding(""))
+	assert.Equal(t, []string{"gzip", "zstd"}, parseAcceptEncoding("gzip, ZSTD"))
+	assert.Equal(t, []string{"zstd", "br"}, parseAcceptEncoding("zstd;q=1.0, gzip;q=0, br;q=0.5"))
+}
+
+func TestSendFileServesCompressedContent(t *testing.T) {
+	basePath := t.TempDir()
+	storer, err := storage.NewStorage(basePath, storage.WithCompression(storage.EncodingZstd))
+	assert.NoError(t, err)
+
+	server, err := NewHTTPFileStorageServer(storer, &Config{StoragePath: basePath, Compression: storage.EncodingZstd})
+	assert.NoError(t, err)
+	r := server.setupRouter()
+
+	content := []byte(strings.Repeat("compressible content ", 1000))
+	hash := saveToStorage(t, storer, content)
+
+	// Clients accepting zstd get the stored compressed content
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/file/"+hash, nil)
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "zstd", w.Header().Get("Content-Encoding"))
+	assert.Less(t, w.Body.Len(), len(content))
+
+	decoder, err := zstd.NewReader(nil)
+	assert.NoError(t, err)
+	decoded, err := decoder.DecodeAll(w.Body.Bytes(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, content, decoded)
+
+	// Other clients get the original content
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/file/"+hash, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, content, w.Body.Bytes())
+}
@@ -1,11 +1,17 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/pavlov061356/http_based_file_storage/pkg/events"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
 )
 
 // Config represents the server configuration.
@@ -16,47 +22,404 @@ type Config struct {
 	Port int `json:"port"`
 	// StoragePath is the path to the storage directory.
 	StoragePath string `json:"storage_path"`
+
+	// LogLevel is the minimal level of the log records: "debug", "info", "warn"
+	// or "error", "info" if empty.
+	LogLevel string `json:"log_level"`
+	// LogFormat is the format of the log records: "text" or "json", "text" if empty.
+	LogFormat string `json:"log_format"`
+
+	// MinFreeSpace is the number of bytes that must be available on the file
+	// system of the storage for the node to be ready, not checked if zero.
+	MinFreeSpace int64 `json:"min_free_space"`
+	// ReadinessRequirePeers makes the node unready while other cluster members,
+	// sync peers or the upstream are unreachable. Otherwise their reachability
+	// is only reported by the readiness probe.
+	ReadinessRequirePeers bool `json:"readiness_require_peers"`
+	// ShutdownDelay is the time between failing the readiness probe and closing
+	// the listener on shutdown, so that load balancers notice the node is draining.
+	ShutdownDelay time.Duration `json:"shutdown_delay"`
+	// DrainTimeout is the time the requests in flight are given to complete on
+	// shutdown before their connections are closed, DefaultDrainTimeout if zero.
+	DrainTimeout time.Duration `json:"drain_timeout"`
+
+	// TLSCertFile is the path to the PEM certificate chain the server is served
+	// with over HTTPS. The server is served over plain HTTP if it is empty.
+	TLSCertFile string `json:"tls_cert_file"`
+	// TLSKeyFile is the path to the PEM private key of the certificate.
+	TLSKeyFile string `json:"tls_key_file"`
+	// TLSClientCAFile is the path to the PEM certificates of the CAs verifying
+	// client certificates. Client certificates are not requested if it is empty.
+	TLSClientCAFile string `json:"tls_client_ca_file"`
+	// TLSRequireClientCert rejects the connections of clients without a valid certificate.
+	TLSRequireClientCert bool `json:"tls_require_client_cert"`
+	// ClientCerts map the subjects of verified client certificates to principals.
+	ClientCerts []ClientCert `json:"client_certs"`
+
+	// H2C serves HTTP/2 without TLS besides HTTP/1.1 on the same port. It can't
+	// be combined with TLS, HTTP/2 is negotiated over TLS then.
+	H2C bool `json:"h2c"`
+	// HTTP3 serves HTTP/3 over QUIC on the UDP port of the same number besides
+	// the TCP port. It requires TLS.
+	HTTP3 bool `json:"http3"`
+
+	// ReadHeaderTimeout is the time clients are given to send the request
+	// headers, DefaultReadHeaderTimeout if zero.
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout"`
+	// IdleTimeout is the time keep-alive connections are kept open without
+	// requests, DefaultIdleTimeout if zero.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+	// ProgressTimeout is the time a request body or a response may go without
+	// a byte sent or received before the transfer is cut off,
+	// DefaultProgressTimeout if zero. Transfers making progress are not limited.
+	ProgressTimeout time.Duration `json:"progress_timeout"`
+	// MinTransferRate is the minimal rate in bytes per second clients must send
+	// request bodies and receive responses at, measured over the time spent
+	// waiting for them. It is not checked if zero.
+	MinTransferRate int64 `json:"min_transfer_rate"`
+
+	// TracingEndpoint is the base URL of the OTLP/HTTP collector the spans are
+	// exported to, e.g. "http://localhost:4318". Tracing is disabled if it is empty.
+	TracingEndpoint string `json:"tracing_endpoint"`
+	// TracingSampleRatio is the ratio of the traces started by the server that
+	// are sampled, all if zero. Traces of clients keep their sampling decision.
+	TracingSampleRatio float64 `json:"tracing_sample_ratio"`
+
+	// ClusterSelf is the base URL of this node in the cluster, e.g. "http://10.0.0.1:8080".
+	ClusterSelf string `json:"cluster_self"`
+	// ClusterMembers is the list of base URLs of all cluster members, including this node.
+	// Cluster mode is disabled if the list is empty.
+	ClusterMembers []string `json:"cluster_members"`
+	// ClusterRedirect makes the node redirect requests for files it doesn't own
+	// to the owner instead of proxying them.
+	ClusterRedirect bool `json:"cluster_redirect"`
+
+	// SyncPeers is the list of base URLs of the replicas to repair the storage with.
+	SyncPeers []string `json:"sync_peers"`
+	// SyncInterval is the interval between anti-entropy repairs, periodic repair is disabled if zero.
+	SyncInterval time.Duration `json:"sync_interval"`
+
+	// UpstreamURL is the base URL of the storage to fetch missing files from.
+	// The server acts as a pull-through cache if it is set.
+	UpstreamURL string `json:"upstream_url"`
+	// UpstreamTimeout is the time a fetch from the upstream may take,
+	// DefaultUpstreamTimeout if zero.
+	UpstreamTimeout time.Duration `json:"upstream_timeout"`
+
+	// Compression is the encoding used to compress files at rest: "zstd", "gzip"
+	// or empty to store files uncompressed.
+	Compression string `json:"compression"`
+
+	// EncryptionKeyFile is the path to the file with the key-encryption keys in the
+	// "id:base64key" format, one key per line.
+	EncryptionKeyFile string `json:"encryption_key_file"`
+	// EncryptionKeys are the comma-separated key-encryption keys in the "id:base64key" format.
+	// They are used if EncryptionKeyFile is not set. Encryption is disabled if both are empty.
+	EncryptionKeys string `json:"-"`
+	// EncryptionActiveKey is the ID of the key to encrypt new files with,
+	// may be empty if there is only one key.
+	EncryptionActiveKey string `json:"encryption_active_key"`
+
+	// APIKeys are the static API keys of the principals.
+	APIKeys []APIKey `json:"api_keys"`
+	// JWKSFile is the path to the JSON Web Key Set to verify JWT bearer tokens with.
+	// JWT authentication is disabled if it is empty.
+	JWKSFile string `json:"jwks_file"`
+	// JWTIssuer is the required "iss" claim of JWT bearer tokens, not checked if empty.
+	JWTIssuer string `json:"jwt_issuer"`
+	// JWTAudience is the required "aud" claim of JWT bearer tokens, not checked if empty.
+	JWTAudience string `json:"jwt_audience"`
+	// PeerAPIKey is the API key sent to cluster members, sync peers and the upstream.
+	PeerAPIKey string `json:"-"`
+	// AnonymousScopes are the scopes granted to requests without credentials.
+	// Requests without credentials are rejected if it is empty.
+	AnonymousScopes []string `json:"anonymous_scopes"`
+
+	// URLSigningKey is the secret key signing pre-signed download and upload URLs.
+	// Signed URLs are disabled if it is empty.
+	URLSigningKey string `json:"-"`
+
+	// Tenants enables multi-tenant namespaces. Every tenant references its own
+	// files, which are deduplicated in the shared store.
+	Tenants bool `json:"tenants"`
+	// TenantQuota is the default maximal total size of the files of a tenant
+	// in bytes, not limited if zero.
+	TenantQuota int64 `json:"tenant_quota"`
+	// TenantQuotas overrides the quotas of specific tenants.
+	TenantQuotas map[string]int64 `json:"tenant_quotas"`
+
+	// RateLimit is the default limit of every client, nothing is limited if it is empty.
+	RateLimit RateLimit `json:"rate_limit"`
+	// RouteRateLimits override the default limit on routes. They are keyed by the
+	// method and the path as registered in the router, e.g. "GET /file/:hash".
+	RouteRateLimits map[string]RateLimit `json:"route_rate_limits"`
+	// PrincipalRateLimits override the limits of principals, keyed by their names.
+	PrincipalRateLimits map[string]RateLimit `json:"principal_rate_limits"`
+	// TrustedProxies are the addresses or CIDR ranges of the reverse proxies
+	// whose X-Forwarded-For and X-Real-IP headers identify the clients. The
+	// headers are ignored if it is empty, clients are identified by the
+	// address of the connection then.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// UploadPolicy restricts the size and the types of uploaded files.
+	UploadPolicy UploadPolicy `json:"upload_policy"`
+
+	// Scanner is the address of the antivirus engine scanning uploads, e.g.
+	// "clamd://localhost:3310" or "icap://localhost:1344/avscan".
+	// Uploads are not scanned if it is empty.
+	Scanner string `json:"scanner"`
+	// ScanTimeout is the time a scan may take, scanner.DefaultTimeout if zero.
+	ScanTimeout time.Duration `json:"scan_timeout"`
+
+	// HookTimeout is the time a pre-save hook may take, DefaultHookTimeout if zero.
+	HookTimeout time.Duration `json:"hook_timeout"`
+
+	// Webhooks are the URLs the storage events are delivered to.
+	Webhooks []events.Webhook `json:"webhooks"`
+	// WebhookMaxAttempts is the number of attempts to deliver an event to a
+	// webhook, events.DefaultMaxAttempts if zero.
+	WebhookMaxAttempts int `json:"webhook_max_attempts"`
+	// EventLogSize is the number of the latest events kept for clients of the
+	// event stream resuming after a disconnect, events.DefaultLogSize if zero.
+	EventLogSize int `json:"event_log_size"`
+}
+
+// QuotaOf returns the quota of the tenant in bytes, zero if it is not limited.
+func (c *Config) QuotaOf(tenant string) int64 {
+	if quota, ok := c.TenantQuotas[tenant]; ok {
+		return quota
+	}
+	return c.TenantQuota
+}
+
+// IsAuthEnabled reports whether requests must be authenticated.
+func (c *Config) IsAuthEnabled() bool {
+	return len(c.APIKeys) > 0 || c.JWKSFile != "" || len(c.AnonymousScopes) > 0 || len(c.ClientCerts) > 0
+}
+
+// IsTLSEnabled reports whether the server is served over HTTPS.
+func (c *Config) IsTLSEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSKeyFile != ""
+}
+
+// IsEncryptionEnabled reports whether the files are encrypted at rest.
+func (c *Config) IsEncryptionEnabled() bool {
+	return c.EncryptionKeyFile != "" || c.EncryptionKeys != ""
+}
+
+// StorageOptions returns the options of the storage described by the configuration.
+//
+// Returns:
+// - []storage.Option: the options to pass to storage.NewStorage
+// - error: any error that occurred while loading the encryption keys
+func (c *Config) StorageOptions() ([]storage.Option, error) {
+	opts := []storage.Option{storage.WithCompression(c.Compression)}
+
+	if c.IsEncryptionEnabled() {
+		var keyring *storage.Keyring
+		var err error
+		if c.EncryptionKeyFile != "" {
+			keyring, err = storage.LoadKeyring(c.EncryptionKeyFile, c.EncryptionActiveKey)
+		} else {
+			keyring, err = storage.ParseKeyring(c.EncryptionKeys, c.EncryptionActiveKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error loading encryption keys: %v", err)
+		}
+
+		opts = append(opts, storage.WithEncryption(keyring))
+	}
+
+	return opts, nil
+}
+
+// Validate checks the settings depending on each other and the ones the
+// server can't start with.
+//
+// Returns:
+// - error: an error naming every invalid setting
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.StoragePath == "" {
+		errs = append(errs, fmt.Errorf("storage_path is required"))
+	}
+
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log_level: %v", err))
+	}
+	if _, err := newLogger(io.Discard, c.LogFormat, nil); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log_format: %v", err))
+	}
+
+	switch c.Compression {
+	case "", storage.EncodingZstd, storage.EncodingGzip:
+	default:
+		errs = append(errs, fmt.Errorf("invalid compression %q, must be %s or %s", c.Compression, storage.EncodingZstd, storage.EncodingGzip))
+	}
+	if c.EncryptionKeyFile != "" && c.EncryptionKeys != "" {
+		errs = append(errs, fmt.Errorf("only one of encryption_key_file and encryption_keys may be set"))
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, fmt.Errorf("tls_cert_file and tls_key_file must be set together"))
+	}
+	if !c.IsTLSEnabled() && (c.TLSClientCAFile != "" || c.TLSRequireClientCert) {
+		errs = append(errs, fmt.Errorf("client certificates require tls_cert_file and tls_key_file"))
+	}
+	if c.TLSClientCAFile == "" && (c.TLSRequireClientCert || len(c.ClientCerts) > 0) {
+		errs = append(errs, fmt.Errorf("tls_require_client_cert and client_certs require tls_client_ca_file"))
+	}
+	if err := validateProtocols(c); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("invalid trusted_proxies: %v", err))
+	}
+
+	// Without authentication anyone could delete the files of every tenant
+	// through the routes of the shared store
+	if c.Tenants && !c.IsAuthEnabled() {
+		errs = append(errs, fmt.Errorf("tenants require authentication"))
+	}
+
+	if c.URLSigningKey != "" && len(c.URLSigningKey) < minURLSigningKeySize {
+		errs = append(errs, fmt.Errorf("url_signing_key must be at least %d bytes long", minURLSigningKeySize))
+	}
+
+	if len(c.ClusterMembers) > 0 {
+		if c.ClusterSelf == "" {
+			errs = append(errs, fmt.Errorf("cluster_self is required in cluster mode"))
+		}
+		if c.Tenants {
+			errs = append(errs, fmt.Errorf("tenants are not supported in cluster mode"))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
-// ReadConfigFromEnv reads the server configuration from the environment variables.
+// ReadConfigFromEnv reads the server configuration from the environment
+// variables and the .env file, printing a warning for every invalid value
+// and leaving it zero.
 //
-// It loads the environment variables from the .env file and sets default values if
-// the variables are not set.
+// Deprecated: ReadConfigFromEnv doesn't read the configuration file and the
+// flags and starts with invalid configurations, use ConfigLoader instead.
 //
 // Returns:
 // - *Config: the server configuration
 func ReadConfigFromEnv() *Config {
-	// Load environment variables from .env file
-	if err := godotenv.Load(); err != nil {
-		fmt.Printf("WARNING: err while loading env file: %v\n", err)
+	config, err := NewConfigLoader(os.Args[0]).load(nil)
+	if err != nil {
+		fmt.Printf("WARNING: %v\n", err)
 	}
+	return config
+}
+
+// parseAPIKeys parses comma-separated API keys in the "principal[@tenant]:key:scope|scope" format.
+func parseAPIKeys(value string) ([]APIKey, error) {
+	var apiKeys []APIKey
+	for _, element := range splitList(value) {
+		// Scopes contain colons themselves, so only the first two separate fields
+		fields := strings.SplitN(element, ":", 3)
+		if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("API key must be in the principal[@tenant]:key:scope|scope format")
+		}
 
-	// Get the host address from the environment variable, default to "localhost"
-	host, exists := os.LookupEnv("HOST")
-	if !exists {
-		host = "localhost"
+		apiKey := APIKey{Key: fields[1]}
+		apiKey.Principal, apiKey.Tenant, _ = strings.Cut(fields[0], "@")
+		if len(fields) == 3 {
+			for _, scope := range strings.Split(fields[2], "|") {
+				if scope = strings.TrimSpace(scope); scope != "" {
+					apiKey.Scopes = append(apiKey.Scopes, scope)
+				}
+			}
+		}
+		apiKeys = append(apiKeys, apiKey)
 	}
+	return apiKeys, nil
+}
+
+// parseClientCerts parses semicolon-separated client certificates in the
+// "subject|principal[@tenant]|scope,scope" format. Subjects contain commas
+// themselves, e.g. "CN=ci,O=Acme".
+func parseClientCerts(value string) ([]ClientCert, error) {
+	var clientCerts []ClientCert
+	for _, element := range strings.Split(value, ";") {
+		if element = strings.TrimSpace(element); element == "" {
+			continue
+		}
+
+		fields := strings.Split(element, "|")
+		if len(fields) < 2 || len(fields) > 3 || strings.TrimSpace(fields[0]) == "" || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("client certificate must be in the subject|principal[@tenant]|scope,scope format")
+		}
 
-	// Get the port number from the environment variable, default to 8080
-	port, exists := os.LookupEnv("PORT")
-	if !exists {
-		port = "8080"
+		clientCert := ClientCert{Subject: strings.TrimSpace(fields[0])}
+		clientCert.Principal, clientCert.Tenant, _ = strings.Cut(strings.TrimSpace(fields[1]), "@")
+		if len(fields) == 3 {
+			clientCert.Scopes = splitList(fields[2])
+		}
+		clientCerts = append(clientCerts, clientCert)
 	}
-	parsedPort, err := strconv.Atoi(port)
-	if err != nil {
-		parsedPort = 8080
+	return clientCerts, nil
+}
+
+// parseTenantQuotas parses comma-separated quotas in the "tenant:size" format.
+func parseTenantQuotas(value string) (map[string]int64, error) {
+	quotas := map[string]int64{}
+	for _, element := range splitList(value) {
+		tenant, size, ok := strings.Cut(element, ":")
+		if !ok || tenant == "" {
+			return nil, fmt.Errorf("tenant quota must be in the tenant:size format")
+		}
+
+		quota, err := parseSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota of tenant %q: %v", tenant, err)
+		}
+		quotas[tenant] = quota
+	}
+	return quotas, nil
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix of
+// binary multiples, e.g. "512M". An empty value is parsed as zero.
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
 	}
+	value = strings.TrimSuffix(value, "B")
 
-	// Get the storage path from the environment variable, default to "/tmp"
-	storagePath, exists := os.LookupEnv("STORAGE_PATH")
-	if !exists {
-		storagePath = "/tmp"
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			value = number
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
 	}
 
-	// Create and return the server configuration
-	return &Config{
-		Host:        host,
-		Port:        parsedPort,
-		StoragePath: storagePath,
+	size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	if size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+
+	return size * multiplier, nil
+}
+
+// splitList splits a comma-separated list and drops empty elements.
+func splitList(value string) []string {
+	var list []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
 	}
+	return list
 }
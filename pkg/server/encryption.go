@@ -0,0 +1,81 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reencryptJob tracks the background job rewriting files with the active encryption key.
+type reencryptJob struct {
+	mux sync.Mutex
+
+	// Running reports whether the job is in progress.
+	Running bool `json:"running"`
+	// StartedAt is the time the last job was started.
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// FinishedAt is the time the last job finished.
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Rewritten is the number of files rewritten by the last job.
+	Rewritten int `json:"rewritten"`
+	// Error is the error the last job failed with.
+	Error string `json:"error,omitempty"`
+}
+
+// startReencryptHandler handles the HTTP POST request to start reencrypting
+// the files with the active key. The job runs in the background until it is
+// done or the server shuts down.
+// It returns 202 Accepted if the job was started and 409 Conflict if it is already running.
+func (s *HTTPFileStorageServer) startReencryptHandler(c *gin.Context) {
+	job := &s.reencryptJob
+
+	job.mux.Lock()
+	defer job.mux.Unlock()
+
+	if job.Running {
+		c.AbortWithStatusJSON(409, gin.H{"msg": "reencryption is already running"})
+		return
+	}
+
+	now := time.Now()
+	job.Running = true
+	job.StartedAt = &now
+	job.FinishedAt = nil
+	job.Rewritten = 0
+	job.Error = ""
+
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+
+		ctx := s.background
+		rewritten, err := s.tracedStorage(ctx).Reencrypt(ctx)
+
+		job.mux.Lock()
+		defer job.mux.Unlock()
+
+		now := time.Now()
+		job.Running = false
+		job.FinishedAt = &now
+		job.Rewritten = rewritten
+		if err != nil {
+			job.Error = err.Error()
+			s.logger.Error("error reencrypting files", "rewritten", rewritten, "error", err)
+			return
+		}
+		s.logger.Info("files reencrypted", "rewritten", rewritten)
+	}()
+
+	c.JSON(202, gin.H{"msg": "reencryption started"})
+}
+
+// reencryptStatusHandler handles the HTTP GET request for the status of the reencryption job.
+func (s *HTTPFileStorageServer) reencryptStatusHandler(c *gin.Context) {
+	job := &s.reencryptJob
+
+	job.mux.Lock()
+	defer job.mux.Unlock()
+
+	c.JSON(200, job)
+}
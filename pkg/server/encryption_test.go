@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// newEncryptingServer creates a server with an encryption key and a file
+// stored before encryption was enabled.
+func newEncryptingServer(t *testing.T) (*HTTPFileStorageServer, string) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+
+	config := &Config{
+		StoragePath:    t.TempDir(),
+		EncryptionKeys: "key:" + base64.StdEncoding.EncodeToString(key),
+	}
+
+	// Store a file before encryption is enabled
+	plain, err := storage.NewStorage(config.StoragePath)
+	assert.NoError(t, err)
+	hash := saveToStorage(t, plain, []byte("plain data"))
+
+	opts, err := config.StorageOptions()
+	assert.NoError(t, err)
+	storer, err := storage.NewStorage(config.StoragePath, opts...)
+	assert.NoError(t, err)
+	server, err := NewHTTPFileStorageServer(storer, config)
+	assert.NoError(t, err)
+
+	return server.(*HTTPFileStorageServer), hash
+}
+
+// runReencryptJob starts the reencryption job and returns its status once it is done.
+func runReencryptJob(t *testing.T, r *gin.Engine) map[string]interface{} {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/reencrypt", nil))
+	assert.Equal(t, 202, w.Code)
+
+	// Wait for the job to finish
+	var status map[string]interface{}
+	assert.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/admin/reencrypt", nil))
+		json.NewDecoder(w.Body).Decode(&status)
+		return status["running"] == false
+	}, 5*time.Second, 10*time.Millisecond)
+	return status
+}
+
+func TestReencryptEndpoint(t *testing.T) {
+	server, hash := newEncryptingServer(t)
+	r := server.setupRouter()
+
+	status := runReencryptJob(t, r)
+	assert.Equal(t, float64(1), status["rewritten"])
+	assert.Nil(t, status["error"])
+
+	// The file is still served
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+hash, nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "plain data", w.Body.String())
+}
+
+func TestReencryptStopsOnShutdown(t *testing.T) {
+	server, _ := newEncryptingServer(t)
+	r := server.setupRouter()
+
+	server.stopBackground()
+
+	status := runReencryptJob(t, r)
+	assert.Equal(t, float64(0), status["rewritten"])
+	assert.Contains(t, status["error"], "context canceled")
+}
+
+func TestStorageOptionsWithInvalidKeys(t *testing.T) {
+	_, err := (&Config{EncryptionKeys: "key:not base64"}).StorageOptions()
+	assert.Error(t, err)
+}
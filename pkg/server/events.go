@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/events"
+)
+
+// newWebhookDispatcher creates the dispatcher delivering the events to the
+// webhooks of the configuration, with its outbox in the storage directory.
+//
+// Returns nil if no webhooks are configured and an error if there was any
+func newWebhookDispatcher(config *Config) (*events.Dispatcher, error) {
+	if len(config.Webhooks) == 0 {
+		return nil, nil
+	}
+
+	dispatcher, err := events.NewDispatcher(filepath.Join(config.StoragePath, "outbox"), config.Webhooks)
+	if err != nil {
+		return nil, err
+	}
+	if config.WebhookMaxAttempts > 0 {
+		dispatcher.MaxAttempts = config.WebhookMaxAttempts
+	}
+
+	return dispatcher, nil
+}
+
+// publish publishes an event about a file, attributing it to the tenant and
+// the principal of the request.
+//
+// Parameters:
+// - c: the gin context
+// - eventType: the type of the event, e.g. events.BlobCreated
+// - hash: the hash of the file
+// - size: the size of the file, zero if it is not known
+func (s *HTTPFileStorageServer) publish(c *gin.Context, eventType string, hash string, size int64) {
+	event := events.Event{
+		Type:   eventType,
+		Hash:   hash,
+		Size:   size,
+		Tenant: c.GetString(tenantKey),
+	}
+	if principal, ok := PrincipalFromContext(c); ok {
+		event.Principal = principal.Name
+	}
+
+	s.events.Publish(event)
+}
+
+// enqueueWebhooks writes the event to the outbox of the webhooks.
+func (s *HTTPFileStorageServer) enqueueWebhooks(event events.Event) {
+	if err := s.webhooks.Enqueue(event); err != nil {
+		s.logger.Error("error enqueuing webhook delivery", "event", event.ID, "type", event.Type, "hash", event.Hash, "error", err)
+	}
+}
+
+// parseWebhooks parses semicolon-separated webhooks in the "url|secret|type,type" format.
+// The secret and the event types are optional.
+func parseWebhooks(value string) ([]events.Webhook, error) {
+	var webhooks []events.Webhook
+	for _, element := range strings.Split(value, ";") {
+		if element = strings.TrimSpace(element); element == "" {
+			continue
+		}
+
+		fields := strings.Split(element, "|")
+		if len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("webhook must be in the url|secret|type,type format")
+		}
+
+		webhook := events.Webhook{URL: strings.TrimSpace(fields[0])}
+		if len(fields) > 1 {
+			webhook.Secret = strings.TrimSpace(fields[1])
+		}
+		if len(fields) > 2 {
+			webhook.Events = splitList(fields[2])
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pavlov061356/http_based_file_storage/pkg/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileEventsAreDeliveredToWebhooks(t *testing.T) {
+	received := make(chan events.Event, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event events.Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		assert.NotEmpty(t, r.Header.Get(events.HeaderSignature))
+		received <- event
+	}))
+	t.Cleanup(webhook.Close)
+
+	server, _ := newTestServer(t, &Config{
+		Webhooks: []events.Webhook{{URL: webhook.URL, Secret: "secret"}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go server.webhooks.Run(ctx)
+
+	r := server.setupRouter()
+	content := []byte("content of an event")
+	hash := contentHash(content)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newUploadRequest(t, "/file", content))
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+hash, nil))
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/file/"+hash, nil))
+	assert.Equal(t, 200, w.Code)
+
+	// Deleting a missing file is not an event
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/file/"+hash, nil))
+	assert.Equal(t, 200, w.Code)
+
+	var types []string
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-received:
+			assert.Equal(t, hash, event.Hash)
+			types = append(types, event.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatal("event was not delivered")
+		}
+	}
+	assert.Equal(t, []string{events.BlobCreated, events.BlobAccessed, events.BlobDeleted}, types)
+
+	select {
+	case event := <-received:
+		t.Fatalf("unexpected event %s", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestParseWebhooks(t *testing.T) {
+	webhooks, err := parseWebhooks("http://a/hook ; http://b/hook|secret|blob.created,blob.deleted")
+	assert.NoError(t, err)
+	assert.Equal(t, []events.Webhook{
+		{URL: "http://a/hook"},
+		{URL: "http://b/hook", Secret: "secret", Events: []string{events.BlobCreated, events.BlobDeleted}},
+	}, webhooks)
+
+	_, err = parseWebhooks("http://a/hook|secret|blob.created|extra")
+	assert.Error(t, err)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build information reported by GET /version, set at build time with e.g.
+//
+//	go build -ldflags "-X github.com/pavlov061356/http_based_file_storage/pkg/server.Version=v1.2.0"
+//
+// Commit and BuildTime default to the VCS information recorded by the Go toolchain.
+var (
+	// Version is the version of the server.
+	Version = "dev"
+	// Commit is the VCS revision the server was built from.
+	Commit = ""
+	// BuildTime is the time the server was built at.
+	BuildTime = ""
+)
+
+// readinessTimeout is the time the checks of a readiness probe may take.
+const readinessTimeout = 2 * time.Second
+
+// readinessCheck is a check a node must pass to receive traffic.
+type readinessCheck struct {
+	// name identifies the check in the response, its first word is the kind of
+	// the check shown to callers who may not see the details
+	name string
+	// check returns an error if the node is not ready
+	check func(ctx context.Context) error
+	// optional checks are reported without making the node unready
+	optional bool
+}
+
+// healthzHandler handles the liveness probe. The server is alive as long as it answers.
+func (s *HTTPFileStorageServer) healthzHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"status": "ok"})
+}
+
+// readyzHandler handles the readiness probe.
+//
+// The node is ready if the storage is writable, has enough free space and the
+// scanner is reachable. The other members, sync peers and the upstream are
+// reported, but only required with ReadinessRequirePeers. The node is not
+// ready anymore once the graceful shutdown started, so that load balancers
+// stop sending traffic.
+//
+// The checks name the peers and their errors, so only admins get them. Other
+// callers get whether each kind of check passed, the details are logged.
+func (s *HTTPFileStorageServer) readyzHandler(c *gin.Context) {
+	if s.shuttingDown.Load() {
+		c.JSON(503, gin.H{"status": "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := s.readinessChecks()
+	results := make(map[string]string, len(checks))
+	ready := true
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result := "ok"
+			if err := check.check(ctx); err != nil {
+				result = err.Error()
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			results[check.name] = result
+			if result != "ok" && !check.optional {
+				ready = false
+			}
+		}()
+	}
+	wg.Wait()
+
+	failed := false
+	for _, result := range results {
+		failed = failed || result != "ok"
+	}
+	if !ready {
+		s.requestLogger(c).Warn("node is not ready", "checks", results)
+	} else if failed {
+		s.requestLogger(c).Warn("optional readiness checks failed", "checks", results)
+	}
+
+	if !s.isAdminRequest(c) {
+		results = summarizeChecks(results)
+	}
+
+	if !ready {
+		c.JSON(503, gin.H{"status": "not ready", "checks": results})
+		return
+	}
+	c.JSON(200, gin.H{"status": "ready", "checks": results})
+}
+
+// isAdminRequest reports whether the request carries the credentials of a
+// principal granted the admin scope. Probes are not authenticated by the
+// middleware, so that the orchestrator needs no credentials.
+func (s *HTTPFileStorageServer) isAdminRequest(c *gin.Context) bool {
+	auth := s.auth.Load()
+	if auth == nil {
+		return false
+	}
+
+	principal, err := auth.authenticate(c)
+	return err == nil && principal.HasScope(ScopeAdmin)
+}
+
+// summarizeChecks reduces the results of the checks to whether each kind of
+// check passed, e.g. {"member": "failed"} for any unreachable member.
+func summarizeChecks(results map[string]string) map[string]string {
+	summary := make(map[string]string, len(results))
+	for name, result := range results {
+		kind, _, _ := strings.Cut(name, " ")
+		if result != "ok" {
+			summary[kind] = "failed"
+		} else if _, ok := summary[kind]; !ok {
+			summary[kind] = "ok"
+		}
+	}
+	return summary
+}
+
+// readinessChecks returns the checks of the readiness probe of the configuration.
+func (s *HTTPFileStorageServer) readinessChecks() []readinessCheck {
+	checks := []readinessCheck{{name: "storage", check: s.checkStorageWritable}}
+
+	if s.config.MinFreeSpace > 0 {
+		checks = append(checks, readinessCheck{name: "free_space", check: s.checkFreeSpace})
+	}
+
+	// Other members and replicas are only required to be alive, so that
+	// a draining node doesn't make the whole cluster unready. Unless configured
+	// otherwise they are not required at all, so that a crashed member doesn't
+	// make the others unready either.
+	dependency := func(name string, baseURL string) readinessCheck {
+		return readinessCheck{name: name + " " + baseURL, optional: !s.config.ReadinessRequirePeers, check: func(ctx context.Context) error {
+			return s.clusterClient.Health(ctx, baseURL)
+		}}
+	}
+	if s.isClusterEnabled() {
+		for _, member := range s.ring.Members() {
+			if member != s.clusterSelf {
+				checks = append(checks, dependency("member", member))
+			}
+		}
+	}
+	for _, peer := range s.config.SyncPeers {
+		checks = append(checks, dependency("sync_peer", peer))
+	}
+	if s.config.UpstreamURL != "" {
+		checks = append(checks, dependency("upstream", s.config.UpstreamURL))
+	}
+
+	if s.scanner != nil {
+		checks = append(checks, readinessCheck{name: "scanner", check: s.scanner.Ping})
+	}
+
+	return checks
+}
+
+// checkStorageWritable checks that files can be created in the storage directory.
+func (s *HTTPFileStorageServer) checkStorageWritable(ctx context.Context) error {
+	// Dot files are skipped by the storage
+	file, err := os.CreateTemp(s.config.StoragePath, ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("storage is not writable: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write([]byte("ok"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("storage is not writable: %v", err)
+	}
+
+	return nil
+}
+
+// checkFreeSpace checks that the file system of the storage has at least
+// MinFreeSpace bytes available.
+func (s *HTTPFileStorageServer) checkFreeSpace(ctx context.Context) error {
+	free, err := freeSpace(s.config.StoragePath)
+	if errors.Is(err, errors.ErrUnsupported) {
+		// The platform can't report the free space, the check passes
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting free space: %v", err)
+	}
+
+	if free < uint64(s.config.MinFreeSpace) {
+		return fmt.Errorf("free space of %d bytes is below %d bytes", free, s.config.MinFreeSpace)
+	}
+
+	return nil
+}
+
+// versionHandler returns the build information of the server.
+func (s *HTTPFileStorageServer) versionHandler(c *gin.Context) {
+	commit, buildTime := Commit, BuildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && buildTime == "":
+				buildTime = setting.Value
+			}
+		}
+	}
+
+	c.JSON(200, gin.H{
+		"version":    Version,
+		"commit":     commit,
+		"build_time": buildTime,
+		"go_version": runtime.Version(),
+	})
+}
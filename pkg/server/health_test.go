@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// probe sends a GET request to the probe and returns the status code and the decoded body.
+func probe(t *testing.T, r *gin.Engine, path string) (int, map[string]any) {
+	t.Helper()
+	return probeAs(t, r, "", path)
+}
+
+// probeAs sends a GET request to the probe with the API key, if any.
+func probeAs(t *testing.T, r *gin.Engine, apiKey string, path string) (int, map[string]any) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", path, nil)
+	if apiKey != "" {
+		req.Header.Set(APIKeyHeader, apiKey)
+	}
+	r.ServeHTTP(w, req)
+
+	var body map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return w.Code, body
+}
+
+func TestProbesDontRequireCredentials(t *testing.T) {
+	server, _ := newTestServer(t, &Config{APIKeys: []APIKey{{Principal: "ci", Key: "ci-secret"}}})
+	r := server.setupRouter()
+
+	code, body := probe(t, r, "/healthz")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ok", body["status"])
+
+	code, body = probe(t, r, "/readyz")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ready", body["status"])
+	assert.Equal(t, map[string]any{"storage": "ok"}, body["checks"])
+
+	code, body = probe(t, r, "/version")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "dev", body["version"])
+	assert.NotEmpty(t, body["go_version"])
+}
+
+func TestReadinessChecksDependencies(t *testing.T) {
+	upstream, _ := newTestServer(t, nil)
+	upstreamServer := httptest.NewServer(upstream.setupRouter())
+	t.Cleanup(upstreamServer.Close)
+
+	down := httptest.NewServer(nil)
+	down.Close()
+
+	for _, requirePeers := range []bool{false, true} {
+		t.Run(fmt.Sprintf("require_peers=%v", requirePeers), func(t *testing.T) {
+			server, _ := newTestServer(t, &Config{
+				APIKeys:               []APIKey{{Principal: "ops", Key: "ops-secret", Scopes: []string{ScopeAdmin}}},
+				UpstreamURL:           upstreamServer.URL,
+				SyncPeers:             []string{down.URL},
+				Scanner:               startFakeClamd(t),
+				ReadinessRequirePeers: requirePeers,
+			})
+			r := server.setupRouter()
+
+			// Anonymous callers only learn which kinds of checks failed
+			_, body := probe(t, r, "/readyz")
+			assert.Equal(t, map[string]any{"storage": "ok", "upstream": "ok", "scanner": "ok", "sync_peer": "failed"}, body["checks"])
+
+			code, body := probeAs(t, r, "ops-secret", "/readyz")
+			if requirePeers {
+				assert.Equal(t, 503, code)
+				assert.Equal(t, "not ready", body["status"])
+			} else {
+				// An unreachable peer is reported without making the node unready
+				assert.Equal(t, 200, code)
+				assert.Equal(t, "ready", body["status"])
+			}
+
+			checks := body["checks"].(map[string]any)
+			assert.Equal(t, "ok", checks["storage"])
+			assert.Equal(t, "ok", checks["upstream "+upstreamServer.URL])
+			assert.Equal(t, "ok", checks["scanner"])
+			assert.NotEqual(t, "ok", checks["sync_peer "+down.URL])
+		})
+	}
+}
+
+func TestReadinessChecksFreeSpace(t *testing.T) {
+	server, _ := newTestServer(t, &Config{
+		APIKeys:      []APIKey{{Principal: "ops", Key: "ops-secret", Scopes: []string{ScopeAdmin}}},
+		MinFreeSpace: 1 << 62,
+	})
+	r := server.setupRouter()
+
+	code, body := probe(t, r, "/readyz")
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "failed", body["checks"].(map[string]any)["free_space"])
+
+	code, body = probeAs(t, r, "ops-secret", "/readyz")
+	assert.Equal(t, 503, code)
+	assert.Contains(t, body["checks"].(map[string]any)["free_space"], "is below")
+}
+
+func TestNotReadyWhileShuttingDown(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	r := server.setupRouter()
+
+	server.shuttingDown.Store(true)
+
+	code, body := probe(t, r, "/readyz")
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "shutting down", body["status"])
+
+	// The node is still alive while it drains
+	code, _ = probe(t, r, "/healthz")
+	assert.Equal(t, 200, code)
+}
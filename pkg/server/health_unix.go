@@ -0,0 +1,15 @@
+//go:build unix
+
+package server
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to the server on the file
+// system of the path.
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
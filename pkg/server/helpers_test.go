@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+)
+
+// newUploadRequest creates a POST request uploading the given content as a multipart form.
+func newUploadRequest(t *testing.T, url string, content []byte) *http.Request {
+	t.Helper()
+
+	b := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(b)
+
+	part, err := multipartWriter.CreateFormFile("file", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = part.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	multipartWriter.Close()
+
+	req, err := http.NewRequest("POST", url, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", multipartWriter.FormDataContentType())
+
+	return req
+}
+
+// newTestServer creates a server with a storage in a temporary directory.
+func newTestServer(t *testing.T, config *Config) (*HTTPFileStorageServer, storage.Storer) {
+	t.Helper()
+
+	if config == nil {
+		config = &Config{Host: "localhost", Port: 8080}
+	}
+	if config.StoragePath == "" {
+		config.StoragePath = t.TempDir()
+	}
+
+	storer, err := storage.NewStorage(config.StoragePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewHTTPFileStorageServer(storer, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server.(*HTTPFileStorageServer), storer
+}
+
+// contentHash returns the hash the server assigns to the given content.
+func contentHash(content []byte) string {
+	return helpers.GetFileHash(sha256.New(), bytes.NewReader(content))
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultHookTimeout is the time a pre-save hook may take unless configured otherwise.
+const DefaultHookTimeout = 30 * time.Second
+
+// PreSaveHook is called with every upload before it is saved.
+//
+// A hook can reject the upload by returning an error, created with
+// RejectUpload to choose the status code, otherwise the upload is rejected
+// with 422 Unprocessable Entity. It can also attach metadata to the file or
+// replace its content.
+//
+// Hooks of different uploads run concurrently. The context is cancelled when
+// the hook times out or the client goes away.
+type PreSaveHook func(ctx context.Context, upload *UploadContext) error
+
+// RejectUpload returns an error rejecting an upload from a pre-save hook with
+// the given status code and message.
+func RejectUpload(status int, msg string) error {
+	return &uploadError{status: status, msg: msg}
+}
+
+// UploadContext describes an upload to pre-save hooks.
+type UploadContext struct {
+	// Header is the header of the upload request.
+	Header http.Header
+	// Principal is the authenticated principal, nil if authentication is disabled.
+	Principal *Principal
+	// Tenant is the namespace the file is uploaded to, empty outside of tenants.
+	Tenant string
+	// Filename is the name of the file given by the client.
+	Filename string
+
+	// lock guards the fields below, which hooks change through the methods
+	lock sync.Mutex
+	// upload is a copy of the received file
+	upload upload
+	// metadata is the metadata attached by the hooks
+	metadata map[string]string
+	// replaced is set when a hook replaced the content, its temporary file is removed then
+	replaced bool
+	// done is set when the hook returned or timed out, the upload can't be changed then
+	done bool
+}
+
+// Size returns the size of the content.
+func (u *UploadContext) Size() int64 {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.upload.size
+}
+
+// Hash returns the hash of the content.
+func (u *UploadContext) Hash() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.upload.hash
+}
+
+// ContentType returns the content type detected from the content.
+func (u *UploadContext) ContentType() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.upload.contentType
+}
+
+// Open opens the content for reading. The caller must close the file.
+func (u *UploadContext) Open() (*os.File, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return os.Open(u.upload.path)
+}
+
+// SetMetadata attaches a value to the metadata of the file. It is stored with
+// the file once it is saved.
+func (u *UploadContext) SetMetadata(key string, value string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if !u.done {
+		u.metadata[key] = value
+	}
+}
+
+// ReplaceContent replaces the content of the upload, e.g. with a converted
+// image. The file is saved under the hash of the new content.
+//
+// The new content is not checked against the upload policy. In cluster mode
+// it is forwarded to the member owning its hash, which runs the hooks again,
+// so a hook must leave the content it replaced unchanged.
+//
+// Parameters:
+// - r: the new content
+//
+// Returns an error if the content can't be replaced
+func (u *UploadContext) ReplaceContent(r io.Reader) error {
+	content := bufio.NewReaderSize(r, sniffSize)
+	head, err := content.Peek(sniffSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	contentType := http.DetectContentType(head)
+
+	path, size, hash, err := writeTemp(content)
+	if err != nil {
+		return err
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.done {
+		os.Remove(path)
+		return errors.New("upload is already handled")
+	}
+
+	// The content received by the server or replaced by previous hooks is
+	// removed by the caller
+	if u.replaced {
+		os.Remove(u.upload.path)
+	}
+	u.replaced = true
+	u.upload.path = path
+	u.upload.size = size
+	u.upload.hash = hash
+	u.upload.contentType = contentType
+	return nil
+}
+
+// RegisterPreSaveHook registers a hook to be executed before a file is saved.
+//
+// This function is thread-safe.
+//
+// Parameters:
+// - hook: the hook to register.
+func (s *HTTPFileStorageServer) RegisterPreSaveHook(hook PreSaveHook) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.preSaveHooks = append(s.preSaveHooks, hook)
+}
+
+// runPreSaveHooks runs the pre-save hooks on the upload one after another,
+// stopping at the first error. The upload is changed in place if a hook
+// replaces its content, the caller must remove both the temporary file
+// received from the client and the one holding the content of the hooks.
+//
+// Parameters:
+// - c: the gin context
+// - upload: the received file
+//
+// Returns:
+// - map[string]string: the metadata attached by the hooks
+// - error: an *uploadError rejecting the upload
+func (s *HTTPFileStorageServer) runPreSaveHooks(c *gin.Context, upload *upload) (map[string]string, error) {
+	// Copy the hooks, so that uploads don't wait for each other's hooks
+	s.mux.Lock()
+	hooks := append([]PreSaveHook(nil), s.preSaveHooks...)
+	s.mux.Unlock()
+
+	metadata := map[string]string{}
+	if len(hooks) == 0 {
+		return metadata, nil
+	}
+
+	timeout := s.config.HookTimeout
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+
+	principal, _ := PrincipalFromContext(c)
+	received := upload.path
+
+	for i, hook := range hooks {
+		uploadCtx := &UploadContext{
+			Header:    c.Request.Header.Clone(),
+			Principal: principal,
+			Tenant:    c.GetString(tenantKey),
+			Filename:  upload.name,
+			upload:    *upload,
+			metadata:  map[string]string{},
+		}
+
+		// Spans the hook starts from its context are children of the span of the hook
+		ctx, span := s.tracer.Start(c.Request.Context(), "hook.pre_save", trace.WithAttributes(
+			attribute.Int("hook.index", i), attribute.String("file.hash", upload.hash)))
+		err := runHook(ctx, timeout, hook, uploadCtx)
+		if uploadCtx.replaced {
+			span.SetAttributes(attribute.String("file.replaced_hash", uploadCtx.upload.hash))
+		}
+		endSpan(span, err)
+
+		// The hook can't change its context anymore, drop the content replaced
+		// by the previous hooks
+		if uploadCtx.replaced && upload.path != received {
+			os.Remove(upload.path)
+		}
+		*upload = uploadCtx.upload
+		maps.Copy(metadata, uploadCtx.metadata)
+
+		var uploadErr *uploadError
+		if errors.As(err, &uploadErr) {
+			return nil, uploadErr
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			s.requestLogger(c).Error("pre-save hook timed out", "hash", upload.hash, "timeout", timeout)
+			return nil, &uploadError{503, "pre-save hook timed out"}
+		} else if err != nil {
+			return nil, &uploadError{422, err.Error()}
+		}
+	}
+
+	return metadata, nil
+}
+
+// runHook runs the hook, giving up on it when the timeout expires. A hook
+// that didn't return in time can't change the upload anymore.
+func runHook(ctx context.Context, timeout time.Duration, hook PreSaveHook, upload *UploadContext) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errCh <- fmt.Errorf("pre-save hook panicked: %v", r)
+			}
+		}()
+		errCh <- hook(ctx, upload)
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	upload.lock.Lock()
+	upload.done = true
+	upload.lock.Unlock()
+
+	return err
+}
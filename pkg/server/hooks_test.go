@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreSaveHookGetsUploadAndAttachesMetadata(t *testing.T) {
+	server, storer := newTestServer(t, nil)
+	content := []byte("content seen by the hook")
+
+	var seen struct {
+		filename, header, hash string
+		size                   int64
+	}
+	server.RegisterPreSaveHook(func(ctx context.Context, upload *UploadContext) error {
+		seen.filename = upload.Filename
+		seen.header = upload.Header.Get("X-Source")
+		seen.hash = upload.Hash()
+		seen.size = upload.Size()
+		upload.SetMetadata("source", seen.header)
+		return nil
+	})
+
+	req := newNamedUploadRequest(t, "report.txt", content)
+	req.Header.Set("X-Source", "scanner-42")
+	code, _ := serveUpload(t, server, req)
+	assert.Equal(t, 201, code)
+
+	assert.Equal(t, "report.txt", seen.filename)
+	assert.Equal(t, "scanner-42", seen.header)
+	assert.Equal(t, contentHash(content), seen.hash)
+	assert.Equal(t, int64(len(content)), seen.size)
+
+	metadata, err := storer.Metadata(contentHash(content))
+	assert.NoError(t, err)
+	assert.Equal(t, "scanner-42", metadata["source"])
+}
+
+func TestPreSaveHookRejectsUpload(t *testing.T) {
+	server, storer := newTestServer(t, nil)
+	server.RegisterPreSaveHook(func(ctx context.Context, upload *UploadContext) error {
+		return RejectUpload(403, "uploads of this client are blocked")
+	})
+	content := []byte("blocked content")
+
+	code, msg := serveUpload(t, server, newNamedUploadRequest(t, "file.txt", content))
+	assert.Equal(t, 403, code)
+	assert.Equal(t, "uploads of this client are blocked", msg)
+
+	exists, err := storer.Exists(contentHash(content))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestPreSaveHookReplacesContent(t *testing.T) {
+	server, storer := newTestServer(t, nil)
+	server.RegisterPreSaveHook(func(ctx context.Context, upload *UploadContext) error {
+		file, err := upload.Open()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		content, err := io.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		return upload.ReplaceContent(bytes.NewReader(bytes.ToUpper(content)))
+	})
+
+	w := httptest.NewRecorder()
+	server.setupRouter().ServeHTTP(w, newNamedUploadRequest(t, "file.txt", []byte("lower case")))
+	assert.Equal(t, 201, w.Code)
+
+	var resp struct {
+		Hash string `json:"hash"`
+	}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, contentHash([]byte("LOWER CASE")), resp.Hash)
+
+	exists, err := storer.Exists(contentHash([]byte("lower case")))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	path, err := storer.Read(resp.Hash)
+	assert.NoError(t, err)
+	stored, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "LOWER CASE", string(stored))
+}
+
+func TestPreSaveHookTimeout(t *testing.T) {
+	server, _ := newTestServer(t, &Config{HookTimeout: 50 * time.Millisecond})
+	server.RegisterPreSaveHook(func(ctx context.Context, upload *UploadContext) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	code, _ := serveUpload(t, server, newNamedUploadRequest(t, "file.txt", []byte("slow hook")))
+	assert.Equal(t, 503, code)
+}
+
+func TestPreSaveHooksRunConcurrently(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+
+	// Every hook waits for the hook of the other upload to start
+	var started sync.WaitGroup
+	started.Add(2)
+	server.RegisterPreSaveHook(func(ctx context.Context, upload *UploadContext) error {
+		started.Done()
+
+		done := make(chan struct{})
+		go func() {
+			started.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			return nil
+		case <-time.After(5 * time.Second):
+			return RejectUpload(500, "hooks of uploads ran one after another")
+		}
+	})
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i], _ = serveUpload(t, server, newNamedUploadRequest(t, "file.txt", []byte{byte(i)}))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, []int{201, 201}, codes)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwk is a JSON Web Key as defined by RFC 7517. Only symmetric ("oct") keys
+// for HS256 and RSA public keys for RS256 are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwks holds the keys of a JSON Web Key Set.
+type jwks struct {
+	// hmacKeys maps key IDs to the secrets of HS256 keys.
+	hmacKeys map[string][]byte
+
+	// rsaKeys maps key IDs to the public keys of RS256 keys.
+	rsaKeys map[string]*rsa.PublicKey
+}
+
+// loadJWKS reads a JSON Web Key Set from a local file.
+//
+// Parameters:
+// - path: the path to the JWKS file
+//
+// Returns:
+// - *jwks: the loaded keys
+// - error: any error that occurred while reading or parsing the keys
+func loadJWKS(path string) (*jwks, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS file: %v", err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS file: %v", err)
+	}
+
+	keys := &jwks{
+		hmacKeys: map[string][]byte{},
+		rsaKeys:  map[string]*rsa.PublicKey{},
+	}
+
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		if _, ok := keys.hmacKeys[key.Kid]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q in JWKS", key.Kid)
+		}
+		if _, ok := keys.rsaKeys[key.Kid]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q in JWKS", key.Kid)
+		}
+
+		switch key.Kty {
+		case "oct":
+			if key.Alg != "" && key.Alg != "HS256" {
+				return nil, fmt.Errorf("unsupported algorithm %q of key %q", key.Alg, key.Kid)
+			}
+
+			secret, err := base64.RawURLEncoding.DecodeString(key.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("invalid secret of key %q", key.Kid)
+			}
+			keys.hmacKeys[key.Kid] = secret
+
+		case "RSA":
+			if key.Alg != "" && key.Alg != "RS256" {
+				return nil, fmt.Errorf("unsupported algorithm %q of key %q", key.Alg, key.Kid)
+			}
+
+			n, err := base64.RawURLEncoding.DecodeString(key.N)
+			if err != nil || len(n) == 0 {
+				return nil, fmt.Errorf("invalid modulus of key %q", key.Kid)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(key.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("invalid exponent of key %q", key.Kid)
+			}
+
+			keys.rsaKeys[key.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+
+		default:
+			return nil, fmt.Errorf("unsupported key type %q of key %q", key.Kty, key.Kid)
+		}
+	}
+
+	if len(keys.hmacKeys)+len(keys.rsaKeys) == 0 {
+		return nil, fmt.Errorf("JWKS has no signing keys")
+	}
+
+	return keys, nil
+}
+
+// keyFunc returns the key to verify the token with. The key is looked up by
+// the "kid" header of the token and must match the signing algorithm, so an
+// RSA public key can never be used as an HMAC secret.
+//
+// Parameters:
+// - token: the parsed token
+//
+// Returns:
+// - interface{}: the verification key
+// - error: any error that occurred while looking up the key
+func (k *jwks) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	switch token.Method.Alg() {
+	case "HS256":
+		if secret, ok := k.hmacKeys[kid]; ok {
+			return secret, nil
+		}
+	case "RS256":
+		if key, ok := k.rsaKeys[kid]; ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key %q for algorithm %s", kid, token.Method.Alg())
+}
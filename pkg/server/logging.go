@@ -0,0 +1,197 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/cluster"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// LogFormatText writes log records as key=value pairs.
+	LogFormatText = "text"
+	// LogFormatJSON writes log records as JSON objects, one per line.
+	LogFormatJSON = "json"
+)
+
+const (
+	// requestIDKey is the key of the ID of the request in the gin context
+	requestIDKey = "request_id"
+	// logHashKey is the key of the hash of the file handled by the request in the gin context
+	logHashKey = "log_hash"
+	// logSizeKey is the key of the size of the file handled by the request in the gin context
+	logSizeKey = "log_size"
+
+	// maxRequestIDLength is the maximal length of a request ID accepted from a client
+	maxRequestIDLength = 128
+)
+
+// newLogger creates the logger of the server writing to w.
+//
+// Parameters:
+// - w: the writer of the log records
+// - format: LogFormatText or LogFormatJSON, LogFormatText if empty
+// - level: the minimal level of the records, it can be changed while the logger is used
+//
+// Returns:
+// - *slog.Logger: the logger
+// - error: an error if the format is unknown
+func newLogger(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(format) {
+	case "", LogFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// parseLogLevel parses a log level: "debug", "info", "warn" or "error",
+// optionally with an offset like "debug-4". An empty level is parsed as info.
+func parseLogLevel(value string) (slog.Level, error) {
+	if value == "" {
+		return slog.LevelInfo, nil
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", value)
+	}
+	return level, nil
+}
+
+// assignRequestID is a middleware assigning an ID to the request.
+//
+// The ID from the X-Request-ID header of the client is kept, so that requests
+// can be traced across services, otherwise a random one is generated. The ID
+// is returned in the X-Request-ID header and sent to other cluster members.
+func (s *HTTPFileStorageServer) assignRequestID(c *gin.Context) {
+	id := c.GetHeader(cluster.RequestIDHeader)
+	if !isValidRequestID(id) {
+		id = newRequestID()
+	}
+
+	c.Set(requestIDKey, id)
+	c.Header(cluster.RequestIDHeader, id)
+
+	// Proxied requests keep the headers of the client
+	c.Request.Header.Set(cluster.RequestIDHeader, id)
+	c.Request = c.Request.WithContext(cluster.WithRequestID(c.Request.Context(), id))
+
+	c.Next()
+}
+
+// isValidRequestID reports whether the request ID can be logged as is.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		// Printable ASCII without spaces, so that IDs can't forge log records
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogger returns the logger of the request, adding its ID, trace ID
+// and principal to every record.
+func (s *HTTPFileStorageServer) requestLogger(c *gin.Context) *slog.Logger {
+	logger := s.logger.With("request_id", c.GetString(requestIDKey))
+	if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.IsValid() {
+		logger = logger.With("trace_id", spanContext.TraceID().String())
+	}
+	if principal, ok := PrincipalFromContext(c); ok {
+		logger = logger.With("principal", principal.Name)
+	}
+	return logger
+}
+
+// setLogFile records the file handled by the request for its access log record.
+//
+// Parameters:
+// - c: the gin context
+// - hash: the hash of the file
+// - size: the size of the file in bytes
+func setLogFile(c *gin.Context, hash string, size int64) {
+	c.Set(logHashKey, hash)
+	c.Set(logSizeKey, size)
+}
+
+// logRequests is a middleware writing an access log record for every request.
+//
+// Besides the request and the response, records carry the hash and the size
+// of the handled file. Records of requests failed with 5xx have the error level.
+func (s *HTTPFileStorageServer) logRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	attrs := []any{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"route", c.FullPath(),
+		"status", status,
+		"duration", time.Since(start),
+		"client_ip", c.ClientIP(),
+		"response_size", c.Writer.Size(),
+	}
+
+	hash := c.GetString(logHashKey)
+	if hash == "" {
+		hash = c.Param("hash")
+	}
+	if hash != "" {
+		attrs = append(attrs, "hash", hash)
+	}
+	if size, ok := c.Get(logSizeKey); ok {
+		attrs = append(attrs, "size", size)
+	}
+	if errs := c.Errors.ByType(gin.ErrorTypePrivate).Errors(); len(errs) > 0 {
+		attrs = append(attrs, "error", strings.Join(errs, "; "))
+	}
+
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	s.requestLogger(c).Log(c.Request.Context(), level, "request handled", attrs...)
+}
+
+// recoverPanics is a middleware logging panics of the handlers and returning
+// 500 Internal Server Error instead of dropping the connection.
+func (s *HTTPFileStorageServer) recoverPanics(c *gin.Context) {
+	defer s.recoverHandler(c)
+	c.Next()
+}
+
+// recoverHandler recovers from a panic of the handler of the request, logs it
+// and returns 500 Internal Server Error. It must be deferred.
+func (s *HTTPFileStorageServer) recoverHandler(c *gin.Context) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	s.requestLogger(c).Error("panic while handling request", "panic", r, "stack", string(debug.Stack()))
+	c.AbortWithError(500, fmt.Errorf("internal server error"))
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLogs makes the server write JSON log records to a buffer.
+func captureLogs(t *testing.T, server *HTTPFileStorageServer) *bytes.Buffer {
+	t.Helper()
+
+	logs := new(bytes.Buffer)
+	logger, err := newLogger(logs, LogFormatJSON, &server.logLevel)
+	assert.NoError(t, err)
+	server.logger = logger
+
+	return logs
+}
+
+// logRecords parses the JSON log records, keeping those with the given message.
+func logRecords(t *testing.T, logs *bytes.Buffer, msg string) []map[string]any {
+	t.Helper()
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		var record map[string]any
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestRequestsAreLogged(t *testing.T) {
+	server, _ := newTestServer(t, &Config{
+		APIKeys: []APIKey{{Principal: "ci", Key: "ci-secret", Scopes: []string{ScopeFilesWrite}}},
+	})
+	logs := captureLogs(t, server)
+	r := server.setupRouter()
+
+	content := []byte("logged content")
+	req := newUploadRequest(t, "/file", content)
+	req.Header.Set("X-API-Key", "ci-secret")
+	req.Header.Set("X-Request-ID", "client-request-1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	// The ID of the client is kept
+	assert.Equal(t, "client-request-1", w.Header().Get("X-Request-ID"))
+
+	records := logRecords(t, logs, "request handled")
+	if assert.Len(t, records, 1) {
+		record := records[0]
+		assert.Equal(t, "INFO", record["level"])
+		assert.Equal(t, "client-request-1", record["request_id"])
+		assert.Equal(t, "ci", record["principal"])
+		assert.Equal(t, "POST", record["method"])
+		assert.Equal(t, "/file", record["route"])
+		assert.Equal(t, float64(201), record["status"])
+		assert.Equal(t, contentHash(content), record["hash"])
+		assert.Equal(t, float64(len(content)), record["size"])
+		assert.Contains(t, record, "duration")
+	}
+}
+
+func TestRequestIDIsGenerated(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	r := server.setupRouter()
+
+	for _, id := range []string{"", "forged\nrecord"} {
+		req := httptest.NewRequest("GET", "/file/"+contentHash([]byte("missing")), nil)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		generated := w.Header().Get("X-Request-ID")
+		assert.Len(t, generated, 32)
+		assert.NotEqual(t, id, generated)
+	}
+}
+
+func TestPanicsAreLogged(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	logs := captureLogs(t, server)
+	r := server.setupRouter()
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	assert.Equal(t, 500, w.Code)
+
+	records := logRecords(t, bytes.NewBuffer(logs.Bytes()), "panic while handling request")
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "boom", records[0]["panic"])
+		assert.NotEmpty(t, records[0]["request_id"])
+	}
+
+	records = logRecords(t, logs, "request handled")
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "ERROR", records[0]["level"])
+		assert.Equal(t, float64(500), records[0]["status"])
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	server, _ := newTestServer(t, &Config{LogLevel: "warn"})
+	logs := captureLogs(t, server)
+	r := server.setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+contentHash([]byte("missing")), nil))
+	assert.Equal(t, 404, w.Code)
+
+	// Access records of requests failed with 4xx have the info level
+	assert.Empty(t, logRecords(t, logs, "request handled"))
+	assert.Equal(t, slog.LevelWarn, server.logLevel.Level())
+}
+
+func TestInvalidLoggingConfig(t *testing.T) {
+	for _, config := range []*Config{
+		{LogLevel: "verbose"},
+		{LogFormat: "xml"},
+	} {
+		storer, err := storage.NewStorage(t.TempDir())
+		assert.NoError(t, err)
+
+		_, err = NewHTTPFileStorageServer(storer, config)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes the names of all metrics of the server.
+const metricsNamespace = "file_storage"
+
+// usageCacheTTL is the time the storage usage is reused between scrapes,
+// since computing it walks the whole store.
+const usageCacheTTL = 30 * time.Second
+
+// metrics holds the Prometheus metrics of the server.
+type metrics struct {
+	registry *prometheus.Registry
+
+	// requests counts the requests by method, route and status
+	requests *prometheus.CounterVec
+	// requestDuration observes the latency of the requests by method, route and status
+	requestDuration *prometheus.HistogramVec
+
+	// uploadedBytes counts the bytes of received files
+	uploadedBytes prometheus.Counter
+	// downloadedBytes counts the bytes of sent files
+	downloadedBytes prometheus.Counter
+
+	// dedupHits counts uploads of files that were already stored
+	dedupHits prometheus.Counter
+	// corruptions counts files whose content didn't match their hash
+	corruptions prometheus.Counter
+}
+
+// newMetrics creates the metrics of a server backed by the storage.
+func newMetrics(storer storage.Storer, logger *slog.Logger) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by method, route and status code.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by method, route and status code.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"method", "route", "status"}),
+		uploadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "uploaded_bytes_total",
+			Help:      "Bytes of uploaded files.",
+		}),
+		downloadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "downloaded_bytes_total",
+			Help:      "Bytes of downloaded files.",
+		}),
+		dedupHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dedup_hits_total",
+			Help:      "Uploads of files that were already stored.",
+		}),
+		corruptions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "corruptions_total",
+			Help:      "Files whose content didn't match their hash when read.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.uploadedBytes,
+		m.downloadedBytes,
+		m.dedupHits,
+		m.corruptions,
+		&storageCollector{storer: storer, logger: logger},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// observeRequests is a middleware counting the requests and observing their latency.
+//
+// Requests are labelled with the route as registered in the router, so that
+// the number of series doesn't grow with the hashes of the files.
+func (s *HTTPFileStorageServer) observeRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+
+	s.metrics.requests.WithLabelValues(c.Request.Method, route, status).Inc()
+	s.metrics.requestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+}
+
+// metricsHandler serves the metrics in the Prometheus exposition format.
+func (s *HTTPFileStorageServer) metricsHandler(c *gin.Context) {
+	promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
+}
+
+// storageCollector collects the usage and the lock statistics of the storage on scrape.
+type storageCollector struct {
+	storer storage.Storer
+	logger *slog.Logger
+
+	// lock guards the cached usage
+	lock      sync.Mutex
+	usage     storage.Usage
+	usageTime time.Time
+}
+
+var (
+	storageObjectsDesc = prometheus.NewDesc(metricsNamespace+"_storage_objects",
+		"Number of stored files.", nil, nil)
+	storageBytesDesc = prometheus.NewDesc(metricsNamespace+"_storage_bytes",
+		"Size of the stored files on disk.", nil, nil)
+	lockAcquisitionsDesc = prometheus.NewDesc(metricsNamespace+"_file_lock_acquisitions_total",
+		"Number of times the mutex of a file was locked.", nil, nil)
+	lockContentionsDesc = prometheus.NewDesc(metricsNamespace+"_file_lock_contentions_total",
+		"Number of times the mutex of a file was held by another operation.", nil, nil)
+	lockWaitDesc = prometheus.NewDesc(metricsNamespace+"_file_lock_wait_seconds_total",
+		"Time spent waiting for the mutexes of files.", nil, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storageObjectsDesc
+	ch <- storageBytesDesc
+	ch <- lockAcquisitionsDesc
+	ch <- lockContentionsDesc
+	ch <- lockWaitDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	if usage, ok := c.cachedUsage(); ok {
+		ch <- prometheus.MustNewConstMetric(storageObjectsDesc, prometheus.GaugeValue, float64(usage.Objects))
+		ch <- prometheus.MustNewConstMetric(storageBytesDesc, prometheus.GaugeValue, float64(usage.Bytes))
+	}
+
+	stats := c.storer.LockStats()
+	ch <- prometheus.MustNewConstMetric(lockAcquisitionsDesc, prometheus.CounterValue, float64(stats.Acquisitions))
+	ch <- prometheus.MustNewConstMetric(lockContentionsDesc, prometheus.CounterValue, float64(stats.Contended))
+	ch <- prometheus.MustNewConstMetric(lockWaitDesc, prometheus.CounterValue, stats.WaitTime.Seconds())
+}
+
+// cachedUsage returns the usage of the storage, computing it if the cached one is stale.
+//
+// Returns false if the usage couldn't be computed
+func (c *storageCollector) cachedUsage() (storage.Usage, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.usageTime) < usageCacheTTL {
+		return c.usage, true
+	}
+
+	usage, err := c.storer.Usage()
+	if err != nil {
+		c.logger.Error("error computing storage usage", "error", err)
+		return storage.Usage{}, false
+	}
+
+	c.usage = usage
+	c.usageTime = time.Now()
+	return usage, true
+}
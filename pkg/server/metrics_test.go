@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+	"github.com/stretchr/testify/assert"
+)
+
+// scrapeMetrics returns the metrics of the server in the exposition format.
+func scrapeMetrics(t *testing.T, r *gin.Engine) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+
+	body, err := io.ReadAll(w.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	r := server.setupRouter()
+
+	content := []byte("measured content")
+	hash := contentHash(content)
+
+	// The second upload is deduplicated
+	for _, code := range []int{201, 200} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, newUploadRequest(t, "/file", content))
+		assert.Equal(t, code, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+hash, nil))
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/no/such/route", nil))
+	assert.Equal(t, 404, w.Code)
+
+	metrics := scrapeMetrics(t, r)
+
+	// Requests are labelled with the route, not the path
+	assert.Contains(t, metrics, `file_storage_http_requests_total{method="POST",route="/file",status="201"} 1`)
+	assert.Contains(t, metrics, `file_storage_http_requests_total{method="POST",route="/file",status="200"} 1`)
+	assert.Contains(t, metrics, `file_storage_http_requests_total{method="GET",route="/file/:hash",status="200"} 1`)
+	assert.Contains(t, metrics, `file_storage_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, metrics, `file_storage_http_request_duration_seconds_count{method="GET",route="/file/:hash",status="200"} 1`)
+
+	assert.Contains(t, metrics, "file_storage_uploaded_bytes_total 32")
+	assert.Contains(t, metrics, "file_storage_downloaded_bytes_total 16")
+	assert.Contains(t, metrics, "file_storage_dedup_hits_total 1")
+	assert.Contains(t, metrics, "file_storage_corruptions_total 0")
+	assert.Contains(t, metrics, "file_storage_storage_objects 1")
+	assert.Contains(t, metrics, "file_storage_file_lock_acquisitions_total")
+}
+
+func TestMetricsCountCorruptions(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	r := server.setupRouter()
+
+	content := []byte("content to corrupt")
+	hash := contentHash(content)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newUploadRequest(t, "/file", content))
+	assert.Equal(t, 201, w.Code)
+
+	err := os.WriteFile(helpers.GetFilePath(server.config.StoragePath, hash), []byte("corrupted"), 0o644)
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+hash, nil))
+	assert.Equal(t, 500, w.Code)
+
+	assert.Contains(t, scrapeMetrics(t, r), "file_storage_corruptions_total 1")
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Query parameters of signed URLs.
+const (
+	signedURLExpires = "expires"
+	signedURLMaxSize = "max_size"
+	signedURLSig     = "sig"
+)
+
+// uploadMaxSizeKey is the key of the maximal upload size in the gin context.
+const uploadMaxSizeKey = "upload_max_size"
+
+// minURLSigningKeySize is the minimal size of the key signing URLs.
+const minURLSigningKeySize = 32
+
+// defaultSignedURLTTL is the lifetime of signed URLs if the client doesn't request one.
+const defaultSignedURLTTL = 15 * time.Minute
+
+// maxSignedURLTTL is the maximal lifetime of signed URLs.
+const maxSignedURLTTL = 7 * 24 * time.Hour
+
+// multipartOverhead is the room left in the request body of signed uploads
+// for the multipart envelope around the file.
+const multipartOverhead = 64 << 10
+
+// presignRequest is the body of the requests minting signed URLs.
+type presignRequest struct {
+	// Hash is the hash of the file to download.
+	Hash string `json:"hash"`
+	// MaxSize is the maximal size of the file to upload in bytes.
+	MaxSize int64 `json:"max_size"`
+	// ExpiresIn is the lifetime of the URL in seconds.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// signURL returns the signature of a request to the path valid until the
+// expiry time. maxSize is zero for downloads.
+func signURL(key []byte, method string, path string, expires int64, maxSize int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%d", method, path, expires, maxSize)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mintSignedURL returns the signed URL of a request to the path.
+func (s *HTTPFileStorageServer) mintSignedURL(method string, path string, ttl time.Duration, maxSize int64) (string, int64) {
+	expires := time.Now().Add(ttl).Unix()
+
+	query := url.Values{}
+	query.Set(signedURLExpires, strconv.FormatInt(expires, 10))
+	if maxSize > 0 {
+		query.Set(signedURLMaxSize, strconv.FormatInt(maxSize, 10))
+	}
+	query.Set(signedURLSig, signURL([]byte(s.config.URLSigningKey), method, path, expires, maxSize))
+
+	return path + "?" + query.Encode(), expires
+}
+
+// bindPresignRequest reads the body of a request minting a signed URL and
+// returns it with the lifetime of the URL.
+func bindPresignRequest(c *gin.Context) (*presignRequest, time.Duration, bool) {
+	req := &presignRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"msg": fmt.Sprintf("invalid request: %v", err)})
+		return nil, 0, false
+	}
+
+	ttl := defaultSignedURLTTL
+	if req.ExpiresIn != 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl <= 0 || ttl > maxSignedURLTTL {
+		c.AbortWithStatusJSON(400, gin.H{"msg": fmt.Sprintf("expires_in must be between 1 and %d seconds", int64(maxSignedURLTTL.Seconds()))})
+		return nil, 0, false
+	}
+
+	return req, ttl, true
+}
+
+// presignDownloadHandler mints a signed URL to download a file.
+func (s *HTTPFileStorageServer) presignDownloadHandler(c *gin.Context) {
+	req, ttl, ok := bindPresignRequest(c)
+	if !ok {
+		return
+	}
+
+	if req.Hash == "" {
+		c.AbortWithStatusJSON(400, gin.H{"msg": "hash is required"})
+		return
+	}
+
+	signedURL, expires := s.mintSignedURL(http.MethodGet, tenantFilePath(c.GetString(tenantKey))+"/"+url.PathEscape(req.Hash), ttl, 0)
+	c.JSON(200, gin.H{"url": signedURL, "expires": expires})
+}
+
+// presignUploadHandler mints a signed URL to upload a file of a limited size.
+func (s *HTTPFileStorageServer) presignUploadHandler(c *gin.Context) {
+	req, ttl, ok := bindPresignRequest(c)
+	if !ok {
+		return
+	}
+
+	if req.MaxSize <= 0 {
+		c.AbortWithStatusJSON(400, gin.H{"msg": "max_size must be positive"})
+		return
+	}
+
+	signedURL, expires := s.mintSignedURL(http.MethodPost, tenantFilePath(c.GetString(tenantKey)), ttl, req.MaxSize)
+	c.JSON(200, gin.H{"url": signedURL, "expires": expires})
+}
+
+// verifySignedURL is a middleware authenticating requests to signed URLs.
+//
+// A request with a valid signature gets a principal allowed to perform only
+// the signed request, so it passes without other credentials. Uploads are
+// limited to the signed size. Requests with an invalid or expired signature
+// get 403 Forbidden, requests without a signature are passed on unchanged.
+func (s *HTTPFileStorageServer) verifySignedURL(c *gin.Context) {
+	query := c.Request.URL.Query()
+	sig := query.Get(signedURLSig)
+	if sig == "" {
+		c.Next()
+		return
+	}
+
+	expires, err := strconv.ParseInt(query.Get(signedURLExpires), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(403, gin.H{"msg": "invalid signed URL"})
+		return
+	}
+
+	var maxSize int64
+	if value := query.Get(signedURLMaxSize); value != "" {
+		if maxSize, err = strconv.ParseInt(value, 10, 64); err != nil || maxSize <= 0 {
+			c.AbortWithStatusJSON(403, gin.H{"msg": "invalid signed URL"})
+			return
+		}
+	}
+
+	expected := signURL([]byte(s.config.URLSigningKey), c.Request.Method, c.Request.URL.Path, expires, maxSize)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		c.AbortWithStatusJSON(403, gin.H{"msg": "invalid signature"})
+		return
+	}
+
+	if time.Now().Unix() > expires {
+		c.AbortWithStatusJSON(403, gin.H{"msg": "signed URL has expired"})
+		return
+	}
+
+	// The signature covers the path, so the URL grants access to the tenant in it
+	principal := &Principal{Name: "signed-url", AuthMethod: AuthMethodSignedURL, Tenant: c.Param("tenant")}
+	switch {
+	case c.Request.Method == http.MethodGet:
+		principal.Scopes = []string{ScopeFilesRead}
+	case c.Request.Method == http.MethodPost && maxSize > 0:
+		principal.Scopes = []string{ScopeFilesWrite}
+		c.Set(uploadMaxSizeKey, maxSize)
+	}
+
+	c.Set(PrincipalKey, principal)
+	c.Next()
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const testURLSigningKey = "0123456789abcdef0123456789abcdef"
+
+// newPresignTestRouter creates a router with authentication and URL signing enabled.
+func newPresignTestRouter(t *testing.T) (*gin.Engine, *HTTPFileStorageServer) {
+	t.Helper()
+
+	server, _ := newTestServer(t, &Config{
+		APIKeys: []APIKey{
+			{Principal: "app", Key: "app-secret", Scopes: []string{ScopeFilesRead, ScopeFilesWrite}},
+			{Principal: "reader", Key: "reader-secret", Scopes: []string{ScopeFilesRead}},
+		},
+		URLSigningKey: testURLSigningKey,
+	})
+
+	return server.setupRouter(), server
+}
+
+// presign mints a signed URL with the API key and returns the response code and URL.
+func presign(t *testing.T, r *gin.Engine, kind string, apiKey string, body interface{}) (int, string) {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/presign/"+kind, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(APIKeyHeader, apiKey)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp struct {
+		URL string `json:"url"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp.URL
+}
+
+func TestSignedDownloadURL(t *testing.T) {
+	r, server := newPresignTestRouter(t)
+
+	content := []byte("shared by email")
+	hash := saveToStorage(t, server.storer, content)
+
+	code, signedURL := presign(t, r, "download", "reader-secret", gin.H{"hash": hash, "expires_in": 60})
+	assert.Equal(t, 200, code)
+
+	// The signed URL works without credentials
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", signedURL, nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// The signature is bound to the hash and the method
+	otherHash := saveToStorage(t, server.storer, []byte("not shared"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+otherHash+signedURL[len("/file/"+hash):], nil))
+	assert.Equal(t, 403, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", signedURL, nil))
+	assert.Equal(t, 403, w.Code)
+
+	// Without a signature credentials are required
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+hash, nil))
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestExpiredSignedURL(t *testing.T) {
+	r, server := newPresignTestRouter(t)
+	hash := saveToStorage(t, server.storer, []byte("expired link"))
+
+	expires := time.Now().Add(-time.Minute).Unix()
+	sig := signURL([]byte(testURLSigningKey), "GET", "/file/"+hash, expires, 0)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/file/%s?expires=%d&sig=%s", hash, expires, sig), nil))
+	assert.Equal(t, 403, w.Code)
+}
+
+func TestSignedUploadURL(t *testing.T) {
+	r, _ := newPresignTestRouter(t)
+
+	// Minting upload URLs requires the write scope
+	code, _ := presign(t, r, "upload", "reader-secret", gin.H{"max_size": 16})
+	assert.Equal(t, 403, code)
+
+	code, signedURL := presign(t, r, "upload", "app-secret", gin.H{"max_size": 16})
+	assert.Equal(t, 200, code)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newUploadRequest(t, signedURL, []byte("small upload")))
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newUploadRequest(t, signedURL, []byte("upload larger than the signed size")))
+	assert.Equal(t, 413, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newUploadRequest(t, signedURL, bytes.Repeat([]byte("x"), 2*multipartOverhead)))
+	assert.Equal(t, 413, w.Code)
+
+	// The size can't be raised without breaking the signature
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newUploadRequest(t, strings.Replace(signedURL, "max_size=16", "max_size=1024", 1), []byte("upload larger than the signed size")))
+	assert.Equal(t, 403, w.Code)
+}
+
+func TestPresignValidation(t *testing.T) {
+	r, _ := newPresignTestRouter(t)
+
+	code, _ := presign(t, r, "upload", "app-secret", gin.H{})
+	assert.Equal(t, 400, code)
+
+	code, _ = presign(t, r, "download", "app-secret", gin.H{})
+	assert.Equal(t, 400, code)
+
+	code, _ = presign(t, r, "download", "app-secret", gin.H{"hash": "hash", "expires_in": int64(maxSignedURLTTL.Seconds()) + 1})
+	assert.Equal(t, 400, code)
+}
+
+func TestNewServerWithShortURLSigningKey(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+
+	_, err := NewHTTPFileStorageServer(server.storer, &Config{URLSigningKey: "short"})
+	assert.Error(t, err)
+}
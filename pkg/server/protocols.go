@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// http3MaxAge is the time in seconds clients may remember that the server serves HTTP/3.
+const http3MaxAge = 86400
+
+// validateProtocols checks that the protocols of the configuration can be served together.
+func validateProtocols(config *Config) error {
+	if config.H2C && config.IsTLSEnabled() {
+		return fmt.Errorf("h2c can't be combined with TLS, HTTP/2 is negotiated over TLS")
+	}
+	if config.HTTP3 && !config.IsTLSEnabled() {
+		return fmt.Errorf("HTTP/3 requires TLS")
+	}
+	return nil
+}
+
+// serveH2C makes the server serve HTTP/2 without TLS besides HTTP/1.1, both
+// to clients with prior knowledge and to clients upgrading from HTTP/1.1.
+func serveH2C(server *http.Server) error {
+	h2Server := &http2.Server{IdleTimeout: server.IdleTimeout}
+	// Connections of h2c are hijacked from the server, configuring it lets
+	// its shutdown send them GOAWAY
+	if err := http2.ConfigureServer(server, h2Server); err != nil {
+		return fmt.Errorf("error configuring h2c: %v", err)
+	}
+	server.Handler = h2c.NewHandler(server.Handler, h2Server)
+	return nil
+}
+
+// listenHTTP3 listens on the UDP port of the same number as the server and
+// creates the HTTP/3 server sharing its handler and TLS configuration.
+//
+// Returns:
+// - *http3.Server: the HTTP/3 server
+// - net.PacketConn: the connection to serve on, which must be closed after the server
+// - error: an error if the port can't be listened on
+func listenHTTP3(server *http.Server) (*http3.Server, net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", server.Addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listening on %s/udp: %v", server.Addr, err)
+	}
+
+	return &http3.Server{
+		Handler:     server.Handler,
+		TLSConfig:   http3.ConfigureTLSConfig(server.TLSConfig),
+		IdleTimeout: server.IdleTimeout,
+	}, conn, nil
+}
+
+// advertiseHTTP3 is a middleware telling clients with the Alt-Svc header that
+// the server also serves HTTP/3 on the same port.
+func (s *HTTPFileStorageServer) advertiseHTTP3(c *gin.Context) {
+	c.Header("Alt-Svc", fmt.Sprintf(`h3=":%d"; ma=%d`, s.config.Port, http3MaxAge))
+	c.Next()
+}
+
+// shutdownHTTP3 shuts down the HTTP/3 server if there is one, telling the
+// clients to go away and closing their connections when the context is done.
+func (s *HTTPFileStorageServer) shutdownHTTP3(ctx context.Context) {
+	s.mux.Lock()
+	http3Server, http3Conn := s.http3Server, s.http3Conn
+	s.mux.Unlock()
+	if http3Server == nil {
+		return
+	}
+
+	// The error only tells the connections were closed before the clients went away
+	http3Server.Shutdown(ctx)
+	http3Conn.Close()
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+// assertTransfers uploads a file with the client and downloads it back,
+// checking the protocol of the responses.
+func assertTransfers(t *testing.T, client *http.Client, baseURL string, proto string) {
+	t.Helper()
+
+	content := []byte("transferred over " + proto)
+	resp, err := client.Do(newUploadRequest(t, baseURL+"/file", content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, proto, resp.Proto)
+
+	resp, err = client.Get(baseURL + "/file/" + contentHash(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, proto, resp.Proto)
+	assert.Equal(t, content, body)
+}
+
+func TestServesHTTP1(t *testing.T) {
+	_, baseURL, _ := startServer(t, &Config{})
+
+	assertTransfers(t, http.DefaultClient, baseURL, "HTTP/1.1")
+
+	resp, err := http.Get(baseURL + "/healthz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Empty(t, resp.Header.Get("Alt-Svc"))
+	}
+}
+
+func TestServesH2C(t *testing.T) {
+	server, baseURL, result := startServer(t, &Config{H2C: true})
+
+	// The client speaks HTTP/2 with prior knowledge
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	assertTransfers(t, client, baseURL, "HTTP/2.0")
+
+	// HTTP/1.1 is still served on the same port
+	assertTransfers(t, http.DefaultClient, baseURL, "HTTP/1.1")
+
+	// The shutdown waits for the uploads over connections hijacked from the server
+	pipe, multipartWriter, responses := startSlowUpload(t, client, baseURL+"/file")
+	assert.Eventually(t, func() bool { return server.activeRequests.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- server.Shutdown(context.Background()) }()
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, shutdownErr)
+
+	pipe.Write([]byte("second half"))
+	multipartWriter.Close()
+	pipe.Close()
+	if resp := <-responses; assert.NotNil(t, resp) {
+		assert.Equal(t, 201, resp.StatusCode)
+	}
+	assert.NoError(t, <-shutdownErr)
+	assert.NoError(t, <-result)
+}
+
+func TestServesHTTP3(t *testing.T) {
+	ca := newTestCA(t)
+	config := newTLSConfig(t, ca)
+	config.HTTP3 = true
+	_, baseURL, _ := startServer(t, config)
+
+	// Responses over TCP advertise HTTP/3
+	resp, err := newTLSClient(ca).Get(baseURL + "/healthz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, fmt.Sprintf(`h3=":%d"; ma=86400`, config.Port), resp.Header.Get("Alt-Svc"))
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	transport := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer transport.Close()
+	assertTransfers(t, &http.Client{Transport: transport}, baseURL, "HTTP/3.0")
+}
+
+func TestInvalidProtocols(t *testing.T) {
+	ca := newTestCA(t)
+
+	tlsConfig := newTLSConfig(t, ca)
+	tlsConfig.H2C = true
+	assert.Error(t, validateProtocols(tlsConfig))
+
+	assert.Error(t, validateProtocols(&Config{HTTP3: true}))
+	assert.NoError(t, validateProtocols(&Config{H2C: true}))
+
+	// The UDP port must be free as well
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	config := newTLSConfig(t, ca)
+	config.HTTP3 = true
+	config.Host = "127.0.0.1"
+	config.Port = conn.LocalAddr().(*net.UDPAddr).Port
+	server, _ := newTestServer(t, config)
+	captureLogs(t, server)
+	err = server.StartServer()
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "udp"))
+	}
+}
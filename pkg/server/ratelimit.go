@@ -0,0 +1,389 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/ratelimit"
+)
+
+// rateLimiterKey is the key of the limiter of the client in the gin context.
+const rateLimiterKey = "rate_limiter"
+
+// throttleChunkSize is the size of the chunks throttled responses are written in.
+const throttleChunkSize = 32 << 10
+
+// rateLimiterSweepInterval is the interval between sweeps of unused client limiters.
+const rateLimiterSweepInterval = time.Minute
+
+// RateLimit describes the limits of a client. Zero values mean no limit.
+type RateLimit struct {
+	// RequestsPerSecond is the rate of requests.
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// Burst is the number of requests allowed at once, defaults to the rate rounded up.
+	Burst int `json:"burst"`
+	// UploadBytesPerSecond is the bandwidth of uploads.
+	UploadBytesPerSecond int64 `json:"upload_bytes_per_second"`
+	// DownloadBytesPerSecond is the bandwidth of downloads.
+	DownloadBytesPerSecond int64 `json:"download_bytes_per_second"`
+	// ConcurrentTransfers is the number of uploads and downloads in flight.
+	ConcurrentTransfers int `json:"concurrent_transfers"`
+}
+
+// IsZero reports whether the limit limits nothing.
+func (l RateLimit) IsZero() bool {
+	return l == RateLimit{}
+}
+
+// parseRateLimit parses a limit in the "rps=10 burst=20 upload=1M download=10M concurrent=4" format.
+func parseRateLimit(value string) (RateLimit, error) {
+	var limit RateLimit
+	for _, field := range strings.Fields(value) {
+		name, number, ok := strings.Cut(field, "=")
+		if !ok {
+			return RateLimit{}, fmt.Errorf("rate limit field must be in the name=value format")
+		}
+
+		var err error
+		switch name {
+		case "rps":
+			limit.RequestsPerSecond, err = strconv.ParseFloat(number, 64)
+			if err == nil && (limit.RequestsPerSecond < 0 || math.IsInf(limit.RequestsPerSecond, 0) || math.IsNaN(limit.RequestsPerSecond)) {
+				err = fmt.Errorf("invalid rate %q", number)
+			}
+		case "burst":
+			limit.Burst, err = strconv.Atoi(number)
+		case "upload":
+			limit.UploadBytesPerSecond, err = parseSize(number)
+		case "download":
+			limit.DownloadBytesPerSecond, err = parseSize(number)
+		case "concurrent":
+			limit.ConcurrentTransfers, err = strconv.Atoi(number)
+		default:
+			err = fmt.Errorf("unknown rate limit field %q", name)
+		}
+		if err != nil {
+			return RateLimit{}, err
+		}
+	}
+
+	if limit.Burst < 0 || limit.ConcurrentTransfers < 0 {
+		return RateLimit{}, fmt.Errorf("rate limit values must not be negative")
+	}
+
+	return limit, nil
+}
+
+// parseRateLimits parses semicolon-separated limits in the "target|limit" format.
+func parseRateLimits(value string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	for _, element := range strings.Split(value, ";") {
+		if element = strings.TrimSpace(element); element == "" {
+			continue
+		}
+
+		target, spec, ok := strings.Cut(element, "|")
+		target = strings.TrimSpace(target)
+		if !ok || target == "" {
+			return nil, fmt.Errorf("rate limit must be in the target|limit format")
+		}
+
+		limit, err := parseRateLimit(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit of %q: %v", target, err)
+		}
+		limits[target] = limit
+	}
+	return limits, nil
+}
+
+// clientLimiter holds the buckets of a client. The buckets are nil if their
+// values are not limited.
+type clientLimiter struct {
+	limit RateLimit
+
+	requests *ratelimit.Bucket
+	upload   *ratelimit.Bucket
+	download *ratelimit.Bucket
+
+	// transfers is the number of transfers in flight, protected by the lock of
+	// the rateLimiter. It is shared with the limiters replacing this one when the
+	// limit changes, so that the transfers started before are released from it
+	transfers *int
+}
+
+// newClientLimiter creates the buckets of a client.
+func newClientLimiter(limit RateLimit) *clientLimiter {
+	client := &clientLimiter{limit: limit, transfers: new(int)}
+
+	if limit.RequestsPerSecond > 0 {
+		burst := float64(limit.Burst)
+		if burst == 0 {
+			burst = math.Ceil(limit.RequestsPerSecond)
+		}
+		client.requests = ratelimit.NewBucket(limit.RequestsPerSecond, burst)
+	}
+	// Bandwidth buckets hold a second worth of transfer
+	if limit.UploadBytesPerSecond > 0 {
+		client.upload = ratelimit.NewBucket(float64(limit.UploadBytesPerSecond), float64(limit.UploadBytesPerSecond))
+	}
+	if limit.DownloadBytesPerSecond > 0 {
+		client.download = ratelimit.NewBucket(float64(limit.DownloadBytesPerSecond), float64(limit.DownloadBytesPerSecond))
+	}
+
+	return client
+}
+
+// inherit takes over the tokens of the buckets of the limiter replaced by this
+// one, so that a limit change doesn't give the client a fresh burst. Buckets
+// of values that were not limited before start full.
+func (l *clientLimiter) inherit(old *clientLimiter) {
+	if l.requests != nil && old.requests != nil {
+		l.requests.Inherit(old.requests)
+	}
+	if l.upload != nil && old.upload != nil {
+		l.upload.Inherit(old.upload)
+	}
+	if l.download != nil && old.download != nil {
+		l.download.Inherit(old.download)
+	}
+}
+
+// idle reports whether the limiter holds no state, so dropping it doesn't loosen the limit.
+func (l *clientLimiter) idle() bool {
+	for _, bucket := range []*ratelimit.Bucket{l.requests, l.upload, l.download} {
+		if bucket != nil && !bucket.Full() {
+			return false
+		}
+	}
+	return *l.transfers == 0
+}
+
+// rateLimiter keeps the limiters of the clients.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	// clients maps the keys of clients to their limiters
+	clients map[string]*clientLimiter
+
+	// lastSweep is the time idle limiters were last dropped
+	lastSweep time.Time
+}
+
+// get returns the limiter of the client, creating it if the client is new or its limit has changed.
+func (r *rateLimiter) get(key string, limit RateLimit) *clientLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.clients == nil {
+		r.clients = map[string]*clientLimiter{}
+	}
+
+	// Drop idle limiters, so that the map doesn't grow with every client ever seen
+	if now := time.Now(); now.Sub(r.lastSweep) > rateLimiterSweepInterval {
+		for clientKey, client := range r.clients {
+			if client.idle() {
+				delete(r.clients, clientKey)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	client, ok := r.clients[key]
+	if !ok || client.limit != limit {
+		old := client
+		client = newClientLimiter(limit)
+		if ok {
+			// Transfers in flight and the tokens taken still count against the new limit
+			client.transfers = old.transfers
+			client.inherit(old)
+		}
+		r.clients[key] = client
+	}
+
+	return client
+}
+
+// acquireTransfer counts a transfer of the client if it is under the limit of concurrent transfers.
+func (r *rateLimiter) acquireTransfer(client *clientLimiter) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if client.limit.ConcurrentTransfers > 0 && *client.transfers >= client.limit.ConcurrentTransfers {
+		return false
+	}
+	*client.transfers++
+	return true
+}
+
+// releaseTransfer stops counting a transfer of the client.
+func (r *rateLimiter) releaseTransfer(client *clientLimiter) {
+	r.mu.Lock()
+	*client.transfers--
+	r.mu.Unlock()
+}
+
+// validateTrustedProxies checks that the trusted proxies are IP addresses or CIDR ranges.
+func validateTrustedProxies(proxies []string) error {
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return err
+			}
+		} else if net.ParseIP(proxy) == nil {
+			return fmt.Errorf("%q is not an IP address", proxy)
+		}
+	}
+	return nil
+}
+
+// clientRateLimit returns the limit of the request and the key of the client's limiter.
+//
+// The limit of the principal takes precedence over the limit of the route,
+// which takes precedence over the default limit. Route limits are counted
+// separately for every route, the others are shared by all routes. Clients
+// are identified by their principal or, if they have none, by their IP,
+// taken from the forwarding headers of trusted proxies only.
+func (s *HTTPFileStorageServer) clientRateLimit(c *gin.Context) (RateLimit, string) {
+	config := s.liveConfig()
+	client := "ip:" + c.ClientIP()
+	principal, ok := PrincipalFromContext(c)
+	if ok && principal.AuthMethod != AuthMethodAnonymous && principal.AuthMethod != AuthMethodSignedURL {
+		client = "principal:" + principal.Name
+
+		if limit, ok := config.PrincipalRateLimits[principal.Name]; ok {
+			return limit, "*|" + client
+		}
+	}
+
+	route := c.Request.Method + " " + c.FullPath()
+	if limit, ok := config.RouteRateLimits[route]; ok {
+		return limit, route + "|" + client
+	}
+
+	return config.RateLimit, "*|" + client
+}
+
+// abortRateLimited aborts the request with 429 Too Many Requests.
+func abortRateLimited(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(math.Max(retryAfter.Seconds(), 1))), 10))
+	c.AbortWithStatusJSON(429, gin.H{"msg": "rate limit exceeded"})
+}
+
+// rateLimit is a middleware limiting the rate of requests of every client.
+//
+// It returns 429 Too Many Requests with Retry-After if the client is over its limit.
+func (s *HTTPFileStorageServer) rateLimit(c *gin.Context) {
+	limit, key := s.clientRateLimit(c)
+	if limit.IsZero() {
+		c.Next()
+		return
+	}
+
+	client := s.rateLimiter.get(key, limit)
+	if client.requests != nil {
+		if ok, retryAfter := client.requests.Allow(); !ok {
+			abortRateLimited(c, retryAfter)
+			return
+		}
+	}
+
+	c.Set(rateLimiterKey, client)
+	c.Next()
+}
+
+// limitTransfer is a middleware for the upload and download routes limiting
+// the concurrent transfers and the bandwidth of the client.
+//
+// Transfers over the bandwidth are slowed down. New transfers are rejected
+// with 429 Too Many Requests while the client is over the limit of concurrent
+// transfers or still has to pay off the bandwidth used by previous ones.
+func (s *HTTPFileStorageServer) limitTransfer(c *gin.Context) {
+	value, ok := c.Get(rateLimiterKey)
+	if !ok {
+		c.Next()
+		return
+	}
+	client := value.(*clientLimiter)
+
+	bucket := client.download
+	if c.Request.Method == http.MethodPost {
+		bucket = client.upload
+	}
+
+	if bucket != nil {
+		if retryAfter := bucket.Delay(); retryAfter > 0 {
+			abortRateLimited(c, retryAfter)
+			return
+		}
+	}
+
+	if !s.rateLimiter.acquireTransfer(client) {
+		abortRateLimited(c, time.Second)
+		return
+	}
+	defer s.rateLimiter.releaseTransfer(client)
+
+	if client.upload != nil && c.Request.Method == http.MethodPost {
+		c.Request.Body = &throttledReader{ReadCloser: c.Request.Body, bucket: client.upload, c: c}
+	}
+	if client.download != nil && c.Request.Method == http.MethodGet {
+		c.Writer = &throttledWriter{ResponseWriter: c.Writer, bucket: client.download, c: c}
+	}
+
+	c.Next()
+}
+
+// throttledReader limits the bandwidth of reading the request body.
+type throttledReader struct {
+	io.ReadCloser
+	bucket *ratelimit.Bucket
+	c      *gin.Context
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := r.bucket.Wait(r.c.Request.Context(), n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// throttledWriter limits the bandwidth of writing the response.
+type throttledWriter struct {
+	gin.ResponseWriter
+	bucket *ratelimit.Bucket
+	c      *gin.Context
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunkSize)]
+		if err := w.bucket.Wait(w.c.Request.Context(), len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestRateLimit(t *testing.T) {
+	server, storer := newTestServer(t, &Config{
+		APIKeys: []APIKey{
+			{Principal: "ci", Key: "ci-secret", Scopes: []string{ScopeFilesRead}},
+			{Principal: "app", Key: "app-secret", Scopes: []string{ScopeFilesRead}},
+		},
+		RateLimit:           RateLimit{RequestsPerSecond: 0.1, Burst: 2},
+		PrincipalRateLimits: map[string]RateLimit{"ci": {RequestsPerSecond: 100, Burst: 100}},
+	})
+	r := server.setupRouter()
+	hash := saveToStorage(t, storer, []byte("limited"))
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, 200, serveAs(r, "app-secret", "GET", "/file/"+hash).Code)
+	}
+
+	w := serveAs(r, "app-secret", "GET", "/file/"+hash)
+	assert.Equal(t, 429, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.Greater(t, retryAfter, 0)
+
+	// The principal with its own limit is not affected
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 200, serveAs(r, "ci-secret", "GET", "/file/"+hash).Code)
+	}
+}
+
+func TestRouteRateLimitByIP(t *testing.T) {
+	server, storer := newTestServer(t, &Config{
+		RouteRateLimits: map[string]RateLimit{"POST /file": {RequestsPerSecond: 0.1, Burst: 1}},
+	})
+	r := server.setupRouter()
+	hash := saveToStorage(t, storer, []byte("limited"))
+
+	upload := func(remoteAddr string, content string) int {
+		req := newUploadRequest(t, "/file", []byte(content))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 201, upload("10.0.0.1:1234", "first"))
+	assert.Equal(t, 429, upload("10.0.0.1:1234", "second"))
+
+	// Clients are limited separately
+	assert.Equal(t, 201, upload("10.0.0.2:1234", "third"))
+
+	// Other routes are not limited
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/file/"+hash, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		r.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+	}
+}
+
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	limits := map[string]RateLimit{"GET /file/:hash": {RequestsPerSecond: 0.1, Burst: 1}}
+	request := func(r http.Handler, forwardedFor string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/file/"+contentHash([]byte("missing")), nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Clients can't get a new limiter by sending a new X-Forwarded-For
+	server, _ := newTestServer(t, &Config{RouteRateLimits: limits})
+	r := server.setupRouter()
+	assert.Equal(t, 404, request(r, "192.0.2.1"))
+	assert.Equal(t, 429, request(r, "192.0.2.2"))
+
+	// Trusted proxies tell the clients apart
+	server, _ = newTestServer(t, &Config{RouteRateLimits: limits, TrustedProxies: []string{"10.0.0.0/8"}})
+	r = server.setupRouter()
+	assert.Equal(t, 404, request(r, "192.0.2.1"))
+	assert.Equal(t, 429, request(r, "192.0.2.1"))
+	assert.Equal(t, 404, request(r, "192.0.2.2"))
+}
+
+func TestTransferLimits(t *testing.T) {
+	server, storer := newTestServer(t, &Config{
+		RateLimit: RateLimit{
+			UploadBytesPerSecond:   32 << 10,
+			DownloadBytesPerSecond: 32 << 10,
+			ConcurrentTransfers:    1,
+		},
+	})
+	httpServer := httptest.NewServer(server.setupRouter())
+	defer httpServer.Close()
+
+	content := bytes.Repeat([]byte("x"), 48<<10)
+	hash := saveToStorage(t, storer, content)
+
+	// The download over the burst is slowed down to the bandwidth
+	done := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		resp, err := http.Get(httpServer.URL + "/file/" + hash)
+		if assert.NoError(t, err) {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, content, body)
+		}
+		done <- time.Since(start)
+	}()
+
+	// Only one transfer is allowed at a time
+	time.Sleep(100 * time.Millisecond)
+	resp, err := http.Get(httpServer.URL + "/file/" + hash)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	assert.GreaterOrEqual(t, <-done, 400*time.Millisecond)
+
+	// Uploads are slowed down as well
+	req := newUploadRequest(t, httpServer.URL+"/file", bytes.Repeat([]byte("y"), 48<<10))
+	start := time.Now()
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limit, err := parseRateLimit("rps=2.5 burst=5 upload=1M download=10M concurrent=4")
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimit{
+		RequestsPerSecond:      2.5,
+		Burst:                  5,
+		UploadBytesPerSecond:   1 << 20,
+		DownloadBytesPerSecond: 10 << 20,
+		ConcurrentTransfers:    4,
+	}, limit)
+
+	limits, err := parseRateLimits("POST /file|rps=1 upload=1M; GET /file/:hash|download=10M")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]RateLimit{
+		"POST /file":      {RequestsPerSecond: 1, UploadBytesPerSecond: 1 << 20},
+		"GET /file/:hash": {DownloadBytesPerSecond: 10 << 20},
+	}, limits)
+
+	_, err = parseRateLimit("rps=fast")
+	assert.Error(t, err)
+	_, err = parseRateLimit("speed=1")
+	assert.Error(t, err)
+	_, err = parseRateLimits("rps=1")
+	assert.Error(t, err)
+}
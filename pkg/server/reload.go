@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+// liveConfig returns the configuration with the reloadable settings applied
+// last, see ConfigLoader.Reload. The other settings are the ones the server
+// was started with.
+func (s *HTTPFileStorageServer) liveConfig() *Config {
+	return s.live.Load()
+}
+
+// SetConfigLoader sets the loader the configuration is reloaded from on
+// SIGHUP and by POST /admin/config/reload. It must be called before
+// StartServer, the configuration is not reloaded without a loader.
+//
+// Parameters:
+// - loader: the loader the configuration of the server was loaded with
+func (s *HTTPFileStorageServer) SetConfigLoader(loader *ConfigLoader) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.configLoader = loader
+}
+
+// ReloadConfig loads the configuration again and applies its reloadable
+// settings: the log level, the authentication keys, the tenant quotas, the
+// rate limits and the webhooks. They are applied all at once, requests in
+// flight keep the settings they started with.
+//
+// There are no eviction thresholds to reload: the storage never evicts files,
+// its size is only bounded by the tenant quotas.
+//
+// Returns:
+// - []string: the names of the changed settings that need a restart to be applied
+// - error: an error if the configuration is invalid, the settings in effect are kept then
+func (s *HTTPFileStorageServer) ReloadConfig() ([]string, error) {
+	s.mux.Lock()
+	loader := s.configLoader
+	s.mux.Unlock()
+	if loader == nil {
+		return nil, fmt.Errorf("configuration reload is not enabled")
+	}
+
+	// Reloads read and replace the live configuration as a whole
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	values := loader.values
+	config, restart, err := loader.Reload(s.liveConfig())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.applyConfig(config); err != nil {
+		// Keep printing the values in effect
+		loader.values = values
+		return nil, err
+	}
+
+	if len(restart) > 0 {
+		s.logger.Warn("configuration reloaded, some changes need a restart", "restart_required", restart)
+	} else {
+		s.logger.Info("configuration reloaded")
+	}
+	return restart, nil
+}
+
+// applyConfig applies the reloadable settings of the configuration. Everything
+// that can fail is prepared before anything is replaced, so that an invalid
+// configuration leaves the server as it was.
+func (s *HTTPFileStorageServer) applyConfig(config *Config) error {
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	// The authentication middleware is only installed if authentication was
+	// enabled on startup, so that a typo can't make the storage public
+	if config.IsAuthEnabled() != (s.auth.Load() != nil) {
+		return fmt.Errorf("enabling or disabling authentication requires a restart")
+	}
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		return fmt.Errorf("error setting up authentication: %v", err)
+	}
+
+	if s.webhooks == nil {
+		if len(config.Webhooks) > 0 {
+			return fmt.Errorf("enabling webhooks requires a restart")
+		}
+	} else if err := s.webhooks.SetWebhooks(config.Webhooks); err != nil {
+		return fmt.Errorf("error setting up webhooks: %v", err)
+	}
+
+	// Nothing fails from here on
+	s.auth.Store(auth)
+	s.live.Store(config)
+	s.logLevel.Set(level)
+	return nil
+}
+
+// watchConfig reloads the configuration on SIGHUP until the context is done.
+// The signal is subscribed to before watchConfig returns.
+func (s *HTTPFileStorageServer) watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+
+			if _, err := s.ReloadConfig(); err != nil {
+				s.logger.Error("error reloading configuration, keeping the current one", "error", err)
+			}
+		}
+	}()
+}
+
+// reloadConfigHandler handles the HTTP POST request to reload the configuration.
+// It returns 200 OK with the names of the changed settings that need a restart,
+// or 422 Unprocessable Entity if the configuration is invalid and was not applied.
+func (s *HTTPFileStorageServer) reloadConfigHandler(c *gin.Context) {
+	restart, err := s.ReloadConfig()
+	if err != nil {
+		s.requestLogger(c).Error("error reloading configuration, keeping the current one", "error", err)
+		c.AbortWithStatusJSON(422, gin.H{"msg": err.Error()})
+		return
+	}
+
+	if restart == nil {
+		restart = []string{}
+	}
+	c.JSON(200, gin.H{"msg": "configuration reloaded", "restart_required": restart})
+}
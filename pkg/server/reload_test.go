@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newReloadableServer starts a server loading its configuration from a YAML
+// file with the content, reloaded by POST /admin/config/reload.
+//
+// Returns the server, the path of the configuration file and the base URL
+func newReloadableServer(t *testing.T, content string) (*HTTPFileStorageServer, string, string) {
+	t.Helper()
+
+	path := writeConfigFile(t, "config.yaml", "storage_path: "+t.TempDir()+"\n"+content)
+	loader := newConfigLoader(map[string]string{"CONFIG_FILE": path})
+	config, err := loader.Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, _ := newTestServer(t, config)
+	captureLogs(t, server)
+	server.SetConfigLoader(loader)
+
+	httpServer := httptest.NewServer(server.setupRouter())
+	t.Cleanup(httpServer.Close)
+	return server, path, httpServer.URL
+}
+
+// rewriteConfigFile replaces the content of the configuration file, keeping the storage path.
+func rewriteConfigFile(t *testing.T, server *HTTPFileStorageServer, path string, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte("storage_path: "+server.config.StoragePath+"\n"+content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reloadConfig requests a reload with the API key, returning the status code and the response.
+func reloadConfig(t *testing.T, url string, key string) (int, map[string]any) {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodPost, url+"/admin/config/reload", nil)
+	req.Header.Set(APIKeyHeader, key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]any
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+// getWithKey returns the status code of a GET request with the API key.
+func getWithKey(t *testing.T, url string, key string) int {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set(APIKeyHeader, key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReloadConfig(t *testing.T) {
+	server, path, url := newReloadableServer(t, `
+api_keys:
+  - admin:old-key:admin|files:read
+tenants: true
+tenant_quota: 1K
+`)
+	assert.Equal(t, 200, getWithKey(t, url+"/metrics", "old-key"))
+
+	// Rotate the key, tighten the rate limit and the quota and change a setting needing a restart
+	rewriteConfigFile(t, server, path, `
+api_keys:
+  - admin:new-key:admin|files:read
+tenants: true
+tenant_quota: 2K
+route_rate_limits:
+  GET /metrics: rps=1 burst=1
+log_level: debug
+port: 9000
+`)
+	status, body := reloadConfig(t, url, "old-key")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []any{"port"}, body["restart_required"])
+
+	assert.Equal(t, 401, getWithKey(t, url+"/metrics", "old-key"))
+	assert.Equal(t, 200, getWithKey(t, url+"/metrics", "new-key"))
+	assert.Equal(t, 429, getWithKey(t, url+"/metrics", "new-key"))
+	assert.Equal(t, int64(2<<10), server.liveConfig().QuotaOf("team-a"))
+	assert.Equal(t, slog.LevelDebug, server.logLevel.Level())
+
+	// Settings needing a restart keep their values
+	assert.Equal(t, 8080, server.liveConfig().Port)
+
+	output := new(bytes.Buffer)
+	assert.NoError(t, server.configLoader.PrintConfig(output))
+	assert.Contains(t, output.String(), "port: 8080 # default\n")
+	assert.Contains(t, output.String(), "tenant_quota: 2K # file\n")
+}
+
+func TestReloadConfigKeepsCurrentOnError(t *testing.T) {
+	server, path, url := newReloadableServer(t, `
+api_keys:
+  - admin:key:admin
+log_level: warn
+`)
+
+	for _, test := range []struct {
+		content string
+		err     string
+	}{
+		// Invalid values
+		{content: "api_keys: admin:new-key:admin\nlog_level: loud\n", err: "invalid log_level"},
+		{content: "api_keys: admin:new-key:admin\nrate_limit: rps=fast\n", err: "invalid rate_limit"},
+		// Valid values that can't be applied without a restart
+		{content: "log_level: debug\n", err: "enabling or disabling authentication requires a restart"},
+		{content: "api_keys: admin:new-key:admin\nwebhooks: http://localhost:9000/hook\n", err: "enabling webhooks requires a restart"},
+		{content: "api_keys: admin:new-key:admin\njwks_file: missing.json\n", err: "error reading JWKS file"},
+	} {
+		rewriteConfigFile(t, server, path, test.content)
+		status, body := reloadConfig(t, url, "key")
+		assert.Equal(t, 422, status, test.content)
+		assert.Contains(t, body["msg"], test.err)
+
+		// Nothing is applied
+		assert.Equal(t, 200, getWithKey(t, url+"/metrics", "key"))
+		assert.Equal(t, slog.LevelWarn, server.logLevel.Level())
+	}
+}
+
+func TestReloadConfigRequiresLoader(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	httpServer := httptest.NewServer(server.setupRouter())
+	defer httpServer.Close()
+
+	status, _ := reloadConfig(t, httpServer.URL, "")
+	assert.Equal(t, 404, status)
+
+	_, err := server.ReloadConfig()
+	assert.Error(t, err)
+}
+
+func TestReloadConfigDuringTransfer(t *testing.T) {
+	server, path, url := newReloadableServer(t, "rate_limit: concurrent=1\n")
+
+	pipe, multipartWriter, responses := startSlowUpload(t, http.DefaultClient, url+"/file")
+	assert.Eventually(t, func() bool { return server.activeRequests.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// The limit changes while the upload holds the only transfer
+	rewriteConfigFile(t, server, path, "rate_limit: concurrent=1 upload=1G\n")
+	status, _ := reloadConfig(t, url, "")
+	assert.Equal(t, 200, status)
+	resp, err := http.DefaultClient.Do(newUploadRequest(t, url+"/file", []byte("second")))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 429, resp.StatusCode)
+	}
+
+	multipartWriter.Close()
+	pipe.Close()
+	if resp := <-responses; assert.NotNil(t, resp) {
+		assert.Equal(t, 201, resp.StatusCode)
+	}
+
+	// The finished upload is released from the new limiter
+	resp, err = http.DefaultClient.Do(newUploadRequest(t, url+"/file", []byte("third")))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 201, resp.StatusCode)
+	}
+	for _, client := range server.rateLimiter.clients {
+		assert.True(t, client.idle())
+	}
+}
+
+func TestReloadConfigKeepsRateLimitTokens(t *testing.T) {
+	server, path, url := newReloadableServer(t, `
+route_rate_limits:
+  GET /metrics: rps=0.1 burst=2
+`)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, 200, getWithKey(t, url+"/metrics", ""))
+	}
+	assert.Equal(t, 429, getWithKey(t, url+"/metrics", ""))
+
+	// A reload changing the limit doesn't hand out a fresh burst
+	rewriteConfigFile(t, server, path, `
+route_rate_limits:
+  GET /metrics: rps=0.2 burst=5
+`)
+	status, _ := reloadConfig(t, url, "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 429, getWithKey(t, url+"/metrics", ""))
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package server
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadConfigOnSIGHUP(t *testing.T) {
+	server, path, _ := newReloadableServer(t, "log_level: info\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server.watchConfig(ctx)
+
+	// An invalid configuration is not applied
+	rewriteConfigFile(t, server, path, "log_level: loud\n")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, slog.LevelInfo, server.logLevel.Level())
+
+	rewriteConfigFile(t, server, path, "log_level: error\n")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	assert.Eventually(t, func() bool { return server.logLevel.Level() == slog.LevelError }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/scanner"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Metadata keys of the verdict of the antivirus scan of a file.
+const (
+	// MetadataScanVerdict is "clean" or "infected".
+	MetadataScanVerdict = "scan_verdict"
+	// MetadataScanSignature is the name of the malware found.
+	MetadataScanSignature = "scan_signature"
+	// MetadataScanEngine is the name of the engine that scanned the file.
+	MetadataScanEngine = "scan_engine"
+	// MetadataScannedAt is the time of the scan in RFC 3339 format.
+	MetadataScannedAt = "scanned_at"
+)
+
+// scanUpload scans the uploaded file with the antivirus engine.
+//
+// Infected files are rejected with 422 Unprocessable Entity. Files are also
+// rejected with 503 Service Unavailable if the engine can't scan them, since
+// they are not known to be clean then.
+//
+// Parameters:
+// - c: the gin context
+// - upload: the uploaded file
+//
+// Returns:
+// - map[string]string: the metadata recording the verdict, nil if scanning is disabled
+// - error: an *uploadError rejecting the upload or any error that occurred
+func (s *HTTPFileStorageServer) scanUpload(c *gin.Context, upload *upload) (map[string]string, error) {
+	if s.scanner == nil {
+		return nil, nil
+	}
+
+	file, err := os.Open(upload.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ctx, span := s.tracer.Start(c.Request.Context(), "scan", trace.WithAttributes(
+		attribute.String("file.hash", upload.hash), attribute.String("scan.engine", s.scanner.Name())))
+	verdict, err := s.scanner.Scan(ctx, file)
+	if err == nil {
+		span.SetAttributes(attribute.Bool("scan.infected", verdict.Infected))
+	}
+	endSpan(span, err)
+	if err != nil {
+		s.requestLogger(c).Error("error scanning file", "hash", upload.hash, "engine", s.scanner.Name(), "error", err)
+		return nil, &uploadError{status: 503, msg: "file can't be scanned for malware"}
+	}
+
+	if verdict.Infected {
+		s.requestLogger(c).Warn("infected file rejected", "hash", upload.hash, "engine", s.scanner.Name(), "signature", verdict.Signature)
+		return nil, &uploadError{status: 422, msg: fmt.Sprintf("file is infected: %s", verdict.Signature)}
+	}
+
+	return map[string]string{
+		MetadataScanVerdict: "clean",
+		MetadataScanEngine:  s.scanner.Name(),
+		MetadataScannedAt:   time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// newScanner creates the antivirus scanner described by the configuration.
+//
+// Returns nil if scanning is disabled and an error if the address is invalid
+func newScanner(config *Config) (scanner.Scanner, error) {
+	if config.Scanner == "" {
+		return nil, nil
+	}
+
+	return scanner.New(config.Scanner, config.ScanTimeout)
+}
+
+// scanMetadataKeys are the metadata keys of the verdict, which depends on the
+// content only and is shown to every tenant referencing the file.
+var scanMetadataKeys = []string{MetadataScanVerdict, MetadataScanSignature, MetadataScanEngine, MetadataScannedAt}
+
+// metadataHandler handles the HTTP GET request for the metadata of a file,
+// e.g. the verdict of its antivirus scan. Tenants get the verdict and the
+// metadata of their own uploads.
+//
+// Returns 404 Not Found if the file doesn't exist or isn't referenced by the tenant.
+func (s *HTTPFileStorageServer) metadataHandler(c *gin.Context) {
+	var hash hash
+	if err := c.ShouldBindUri(&hash); err != nil {
+		c.JSON(400, gin.H{"msg": err.Error()})
+		return
+	}
+	if err := validateHash(hash.Hash); err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"msg": err.Error()})
+		return
+	}
+
+	var file *storage.TenantFile
+	if tenant := c.GetString(tenantKey); tenant != "" {
+		var err error
+		file, err = s.tenants.Get(tenant, hash.Hash)
+		if errors.Is(err, os.ErrNotExist) {
+			c.AbortWithStatusJSON(404, gin.H{"msg": "file not found"})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"msg": err.Error()})
+			return
+		}
+	}
+
+	exists, err := s.tracedStorage(c.Request.Context()).Exists(hash.Hash)
+	if err != nil {
+		c.AbortWithError(500, fmt.Errorf("error checking file: %v", err))
+		return
+	}
+	if !exists {
+		c.AbortWithStatusJSON(404, gin.H{"msg": "file not found"})
+		return
+	}
+
+	metadata, err := s.tracedStorage(c.Request.Context()).Metadata(hash.Hash)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"msg": err.Error()})
+		return
+	}
+
+	if file != nil {
+		// Other metadata of the store was attached by uploads outside of tenants
+		maps.DeleteFunc(metadata, func(key string, _ string) bool {
+			return !slices.Contains(scanMetadataKeys, key)
+		})
+		maps.Copy(metadata, file.Metadata)
+	}
+
+	c.JSON(200, gin.H{"hash": hash.Hash, "metadata": metadata})
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eicar is the standard antivirus test string.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startFakeClamd starts a clamd answering INSTREAM commands, finding the EICAR
+// string. It returns the address of the scanner.
+func startFakeClamd(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				command, err := r.ReadString(0)
+				if err != nil {
+					return
+				}
+				if command == "zPING\x00" {
+					conn.Write([]byte("PONG\x00"))
+					return
+				}
+
+				content := new(bytes.Buffer)
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(content, r, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if bytes.Contains(content.Bytes(), []byte(eicar)) {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return "clamd://" + listener.Addr().String()
+}
+
+func TestScanCleanUpload(t *testing.T) {
+	server, storer := newTestServer(t, &Config{Scanner: startFakeClamd(t)})
+	content := []byte("clean content")
+
+	code, _ := serveUpload(t, server, newNamedUploadRequest(t, "clean.txt", content))
+	assert.Equal(t, 201, code)
+
+	metadata, err := storer.Metadata(contentHash(content))
+	assert.NoError(t, err)
+	assert.Equal(t, "clean", metadata[MetadataScanVerdict])
+	assert.Equal(t, "clamd", metadata[MetadataScanEngine])
+	assert.NotEmpty(t, metadata[MetadataScannedAt])
+
+	// The verdict is served with the metadata of the file
+	w := httptest.NewRecorder()
+	server.setupRouter().ServeHTTP(w, httptest.NewRequest("GET", "/file/"+contentHash(content)+"/meta", nil))
+	assert.Equal(t, 200, w.Code)
+	var resp struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "clean", resp.Metadata[MetadataScanVerdict])
+
+	// Hashes of another format are rejected before they reach the storage
+	for _, invalid := range []string{"a", "not a hash", strings.Repeat("a", 44)} {
+		w = httptest.NewRecorder()
+		server.setupRouter().ServeHTTP(w, httptest.NewRequest("GET", "/file/"+url.PathEscape(invalid)+"/meta", nil))
+		assert.Equal(t, 400, w.Code, invalid)
+	}
+}
+
+func TestScanInfectedUpload(t *testing.T) {
+	server, storer := newTestServer(t, &Config{Scanner: startFakeClamd(t)})
+	content := []byte(eicar)
+
+	code, msg := serveUpload(t, server, newNamedUploadRequest(t, "eicar.com", content))
+	assert.Equal(t, 422, code)
+	assert.Contains(t, msg, "Eicar-Signature")
+
+	exists, err := storer.Exists(contentHash(content))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestScanWithUnreachableScanner(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	server, storer := newTestServer(t, &Config{Scanner: "clamd://" + address})
+	content := []byte("unscanned content")
+
+	// Files that can't be scanned are not stored
+	code, _ := serveUpload(t, server, newNamedUploadRequest(t, "file.txt", content))
+	assert.Equal(t, 503, code)
+
+	exists, err := storer.Exists(contentHash(content))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestNewServerWithInvalidScanner(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	_, err := NewHTTPFileStorageServer(server.storer, &Config{Scanner: "ftp://localhost"})
+	assert.Error(t, err)
+}
+
+func TestPreSaveCallbackRejectsUpload(t *testing.T) {
+	server, storer := newTestServer(t, nil)
+	server.RegisterPreSaveCallback(func(hash string, filePath string) error {
+		return errors.New("rejected by callback")
+	})
+	content := []byte("rejected content")
+
+	code, msg := serveUpload(t, server, newNamedUploadRequest(t, "file.txt", content))
+	assert.Equal(t, 422, code)
+	assert.Equal(t, "rejected by callback", msg)
+
+	exists, err := storer.Exists(contentHash(content))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes granting access to the routes of the server.
+const (
+	// ScopeFilesRead allows downloading files.
+	ScopeFilesRead = "files:read"
+	// ScopeFilesWrite allows uploading files.
+	ScopeFilesWrite = "files:write"
+	// ScopeFilesDelete allows deleting files.
+	ScopeFilesDelete = "files:delete"
+	// ScopeAdmin allows the cluster, sync and admin endpoints.
+	ScopeAdmin = "admin"
+)
+
+// knownScopes lists all scopes that can be granted to principals.
+var knownScopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeFilesDelete, ScopeAdmin}
+
+// validateScopes checks that all scopes are known.
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !slices.Contains(knownScopes, scope) {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// HasScope reports whether the principal is granted the scope.
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+// RequireScope returns a middleware allowing only the principals granted the scope.
+//
+// Anonymous principals without the scope get 401 Unauthorized, so that they
+// know to authenticate, authenticated ones get 403 Forbidden. Requests are not
+// checked if authentication is disabled.
+//
+// Parameters:
+// - scope: the required scope
+//
+// Returns:
+// - gin.HandlerFunc: the middleware
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, ok := PrincipalFromContext(c)
+		if !ok {
+			// Authentication is disabled
+			c.Next()
+			return
+		}
+
+		if principal.HasScope(scope) {
+			c.Next()
+			return
+		}
+
+		if principal.AuthMethod == AuthMethodAnonymous {
+			c.Header("WWW-Authenticate", `Bearer realm="file storage"`)
+			c.AbortWithStatusJSON(401, gin.H{"msg": errUnauthenticated.Error()})
+			return
+		}
+
+		c.AbortWithStatusJSON(403, gin.H{"msg": fmt.Sprintf("scope %q is required", scope)})
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopes(t *testing.T) {
+	server, storer := newTestServer(t, &Config{
+		APIKeys: []APIKey{
+			{Principal: "ci", Key: "ci-secret", Scopes: []string{ScopeFilesRead, ScopeFilesWrite}},
+			{Principal: "ops", Key: "ops-secret", Scopes: []string{ScopeFilesDelete, ScopeAdmin}},
+		},
+		AnonymousScopes: []string{ScopeFilesRead},
+	})
+	r := server.setupRouter()
+
+	hash := saveToStorage(t, storer, []byte("scoped content"))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		apiKey string
+		code   int
+	}{
+		{"anonymous download", "GET", "/file/" + hash, "", 200},
+		{"anonymous upload", "POST", "/file", "", 401},
+		{"anonymous delete", "DELETE", "/file/" + hash, "", 401},
+		{"anonymous admin", "GET", "/sync/shards", "", 401},
+		{"CI upload", "POST", "/file", "ci-secret", 201},
+		{"CI download", "GET", "/file/" + hash, "ci-secret", 200},
+		{"CI delete", "DELETE", "/file/" + hash, "ci-secret", 403},
+		{"CI admin", "GET", "/sync/shards", "ci-secret", 403},
+		{"ops upload", "POST", "/file", "ops-secret", 403},
+		{"ops admin", "GET", "/sync/shards", "ops-secret", 200},
+		{"ops delete", "DELETE", "/file/" + hash, "ops-secret", 200},
+		{"invalid API key", "GET", "/file/" + hash, "wrong", 401},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, nil)
+			if test.method == "POST" {
+				req = newUploadRequest(t, test.path, []byte("uploaded by "+test.name))
+			}
+			if test.apiKey != "" {
+				req.Header.Set(APIKeyHeader, test.apiKey)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, test.code, w.Code)
+
+			if test.code == 401 {
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestScopesFromJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	server, _ := newTestServer(t, &Config{JWKSFile: writeTestJWKS(t, rsaKey)})
+	r := server.setupRouter()
+
+	uploads := 0
+	upload := func(claims jwt.MapClaims) int {
+		claims["sub"] = "alice"
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+
+		uploads++
+		req := newUploadRequest(t, "/file", []byte(fmt.Sprintf("upload %d", uploads)))
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims))
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 201, upload(jwt.MapClaims{"scope": "files:read files:write"}))
+	assert.Equal(t, 201, upload(jwt.MapClaims{"scp": []string{"files:write"}}))
+	assert.Equal(t, 403, upload(jwt.MapClaims{"scope": "files:read"}))
+	assert.Equal(t, 403, upload(jwt.MapClaims{}))
+}
+
+func TestNewServerWithUnknownScope(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+
+	_, err := NewHTTPFileStorageServer(server.storer, &Config{
+		APIKeys: []APIKey{{Principal: "ci", Key: "ci-secret", Scopes: []string{"files:execute"}}},
+	})
+	assert.Error(t, err)
+
+	_, err = NewHTTPFileStorageServer(server.storer, &Config{AnonymousScopes: []string{"everything"}})
+	assert.Error(t, err)
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	apiKeys, err := parseAPIKeys("ci:ci-secret:files:read|files:write, public:public-secret")
+	assert.NoError(t, err)
+	assert.Equal(t, []APIKey{
+		{Principal: "ci", Key: "ci-secret", Scopes: []string{ScopeFilesRead, ScopeFilesWrite}},
+		{Principal: "public", Key: "public-secret"},
+	}, apiKeys)
+
+	_, err = parseAPIKeys("ci")
+	assert.Error(t, err)
+}
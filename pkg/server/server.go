@@ -6,21 +6,33 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+	"github.com/pavlov061356/http_based_file_storage/pkg/cluster"
+	"github.com/pavlov061356/http_based_file_storage/pkg/events"
+	"github.com/pavlov061356/http_based_file_storage/pkg/scanner"
 	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+	"github.com/quic-go/quic-go/http3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TODO: additional hash check on POST with user provided hashing algs
@@ -57,10 +69,21 @@ type FileStorageServer interface {
 
 	// StartServer starts the HTTP server.
 	// It sets up the router and starts the server to listen for incoming requests.
+	// It returns once the server is shut down on SIGINT or SIGTERM or by Shutdown.
 	//
 	// Returns:
-	// - error: any error that occurs during startup
-	StartServer()
+	// - error: any error that occurs during startup, serving or shutdown
+	StartServer() error
+
+	// Shutdown gracefully shuts down the server, draining the requests in flight
+	// until the context is done.
+	//
+	// Parameters:
+	// - ctx: the context limiting the drain
+	//
+	// Returns:
+	// - error: an error if the requests in flight didn't complete in time
+	Shutdown(ctx context.Context) error
 
 	// setupRouter sets up the Gin router with the appropriate routes and handlers.
 	// It returns a pointer to the configured Gin engine.
@@ -74,11 +97,20 @@ type FileStorageServer interface {
 	//
 	// The callback function takes two parameters: the hash of the file and the path
 	// to the file. It must return an error if there was any problem executing
-	// the callback.
+	// the callback. An error rejects the upload with 422 Unprocessable Entity.
 	//
 	// This function is thread-safe.
 	RegisterPreSaveCallback(callback func(hash string, filePath string) error)
 
+	// RegisterPreSaveHook registers a hook to be executed before a file is saved.
+	//
+	// Unlike pre-save callbacks, hooks get the request headers, the principal
+	// and the file name, and can reject the upload with a chosen status code,
+	// attach metadata to the file or replace its content.
+	//
+	// This function is thread-safe.
+	RegisterPreSaveHook(hook PreSaveHook)
+
 	// RegisterPOSTSaveCallback registers a callback function to be executed after
 	// a file is successfully saved.
 	//
@@ -118,6 +150,45 @@ type FileStorageServer interface {
 	// Parameters:
 	// - middleware: the function to add as middleware
 	AddMiddleware(middleware gin.HandlerFunc)
+
+	// Rebalance moves all files stored on this node but owned by other cluster
+	// members to their owners. It is a no-op if cluster mode is disabled.
+	//
+	// Parameters:
+	// - ctx: the context controlling the rebalancing
+	//
+	// Returns:
+	// - int: the number of moved files
+	// - error: any error that occurred during rebalancing
+	Rebalance(ctx context.Context) (int, error)
+
+	// Repair compares the storage with the given peer using shard digests and
+	// copies the files missing on either side.
+	//
+	// Parameters:
+	// - ctx: the context controlling the repair
+	// - peer: the base URL of the peer
+	//
+	// Returns:
+	// - cluster.RepairResult: the number of pulled and pushed files
+	// - error: any error that occurred during the repair
+	Repair(ctx context.Context, peer string) (cluster.RepairResult, error)
+
+	// SetConfigLoader sets the loader the configuration is reloaded from on
+	// SIGHUP and by POST /admin/config/reload. It must be called before
+	// StartServer, the configuration is not reloaded without a loader.
+	//
+	// Parameters:
+	// - loader: the loader the configuration of the server was loaded with
+	SetConfigLoader(loader *ConfigLoader)
+
+	// ReloadConfig loads the configuration again and applies its reloadable
+	// settings all at once, without dropping connections.
+	//
+	// Returns:
+	// - []string: the names of the changed settings that need a restart to be applied
+	// - error: an error if the configuration is invalid, the settings in effect are kept then
+	ReloadConfig() ([]string, error)
 }
 
 type HTTPFileStorageServer struct {
@@ -128,31 +199,251 @@ type HTTPFileStorageServer struct {
 
 	engine *gin.Engine
 
-	preSaveCallbacks []func(hash string, filePath string) error
+	preSaveHooks []PreSaveHook
 
 	postSaveCallbacks []func(hash string, filePath string) error
+
+	// ring is the consistent-hash ring of the cluster, nil if cluster mode is disabled
+	ring *cluster.Ring
+
+	// clusterSelf is the normalized base URL of this node in the cluster
+	clusterSelf string
+
+	// clusterClient is used to exchange files with other cluster members, sync peers and the upstream
+	clusterClient *cluster.Client
+
+	// upstreamFlights coalesces concurrent upstream fetches of the same file
+	upstreamFlights flightGroup
+
+	// reencryptJob tracks the job rewriting files with the active encryption key
+	reencryptJob reencryptJob
+
+	// auth verifies the credentials of requests, nil if authentication is disabled
+	auth atomic.Pointer[authenticator]
+
+	// tenants keeps the references of tenants to their files, nil if tenants are disabled
+	tenants *storage.TenantIndex
+
+	// rateLimiter keeps the rate limits of the clients
+	rateLimiter rateLimiter
+
+	// scanner scans uploads for malware, nil if scanning is disabled
+	scanner scanner.Scanner
+
+	// events publishes the changes of the storage
+	events *events.Bus
+
+	// webhooks delivers the events to the webhooks, nil if none are configured
+	webhooks *events.Dispatcher
+
+	// eventLog keeps the latest events for clients of the event stream
+	eventLog *events.Log
+
+	// metrics holds the Prometheus metrics of the server
+	metrics *metrics
+
+	// logger writes the log records of the server
+	logger *slog.Logger
+
+	// logLevel is the minimal level of the log records
+	logLevel slog.LevelVar
+
+	// tracer starts the spans of the server, a no-op tracer if tracing is disabled
+	tracer trace.Tracer
+
+	// tracerProvider exports the spans, nil if tracing is disabled
+	tracerProvider *sdktrace.TracerProvider
+
+	// propagator extracts and injects the W3C trace context of requests
+	propagator propagation.TextMapPropagator
+
+	// shuttingDown is set once the graceful shutdown started, the node is not ready anymore
+	shuttingDown atomic.Bool
+
+	// httpServer serves the requests, nil until StartServer is called
+	httpServer *http.Server
+
+	// background is the context of the background jobs, cancelled by
+	// cancelBackground on shutdown
+	background       context.Context
+	cancelBackground context.CancelFunc
+	// jobs are the background jobs started by requests, which the shutdown waits for
+	jobs sync.WaitGroup
+
+	// activeRequests is the number of requests in flight
+	activeRequests atomic.Int64
+
+	// draining is closed once the listener is closed, ending the event streams
+	draining chan struct{}
+
+	// stopped is closed once the shutdown is complete
+	stopped chan struct{}
+
+	// shutdownErr is the error of the shutdown, set before stopped is closed
+	shutdownErr error
+
+	// certs keeps the TLS certificates, nil if the server is served over plain HTTP
+	certs *certReloader
+
+	// peerTransport sends the requests to other members over mutual TLS, nil if TLS is disabled
+	peerTransport http.RoundTripper
+
+	// http3Server serves the requests over QUIC, nil if HTTP/3 is disabled
+	http3Server *http3.Server
+	// http3Conn is the UDP connection http3Server serves on
+	http3Conn net.PacketConn
+
+	// rateWindow is the time spent waiting for clients their transfer rate is measured over
+	rateWindow time.Duration
+
+	// live is the configuration with the reloadable settings applied last
+	live atomic.Pointer[Config]
+
+	// configLoader reloads the configuration, nil if reloading is disabled
+	configLoader *ConfigLoader
+
+	// reloadLock serializes the reloads of the configuration
+	reloadLock sync.Mutex
 }
 
 type hash struct {
 	Hash string `uri:"hash" binding:"required"`
 }
 
+// validateHash checks that the hash has the format of the hashes of the
+// storage, the URL-safe base64 encoding of a SHA256 sum.
+func validateHash(hash string) error {
+	sum, err := base64.URLEncoding.DecodeString(hash)
+	if err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("invalid hash %q", hash)
+	}
+	return nil
+}
+
 // setupRouter sets up the Gin router with the appropriate routes and handlers.
 // It returns a pointer to the configured Gin engine.
 func (s *HTTPFileStorageServer) setupRouter() *gin.Engine {
-	// Create a new Gin engine with the default middleware
-	r := gin.Default()
+	// Create a new Gin engine, logging and recovery are done by the server
+	r := gin.New()
+
+	// Only trusted proxies may tell the IP of the client, so that clients
+	// can't pick a new IP for every request. The proxies are validated by the
+	// constructor
+	r.SetTrustedProxies(s.config.TrustedProxies)
+
+	// Count the requests in flight, so that the shutdown waits until they are logged
+	r.Use(s.trackRequests)
+
+	// Assign an ID to every request before anything is logged
+	r.Use(s.assignRequestID)
+
+	// Start a span for every request, continuing the trace of the client
+	r.Use(s.traceRequests)
 
-	// Add the recovery middleware to handle panics
-	r.Use(gin.Recovery())
+	// Write an access log record for every request
+	r.Use(s.logRequests)
+
+	// Log panics and return 500 Internal Server Error
+	r.Use(s.recoverPanics)
+
+	// Count the requests and observe their latency, including rejected ones
+	r.Use(s.observeRequests)
+
+	// Extend the deadlines of the connection while the transfers make progress
+	r.Use(s.guardTransfers)
+
+	// Tell clients over TCP they can switch to HTTP/3
+	if s.config.HTTP3 {
+		r.Use(s.advertiseHTTP3)
+	}
+
+	// Probes of the orchestrator are registered before the authentication
+	// middleware, so they don't need credentials
+	// GET /healthz - liveness probe
+	r.GET("/healthz", s.healthzHandler)
+	// GET /readyz - readiness probe checking the storage and the dependencies
+	r.GET("/readyz", s.readyzHandler)
+	// GET /version - build information
+	r.GET("/version", s.versionHandler)
+
+	// Verify signed URLs before other credentials, so that their holders need none
+	if s.config.URLSigningKey != "" {
+		r.Use(s.verifySignedURL)
+	}
+
+	// Authenticate every request if authentication is enabled
+	if s.auth.Load() != nil {
+		r.Use(s.authenticate)
+	}
+
+	// Limit the rate of requests of clients, identified by their principals.
+	// The limits may be set by a reload, so the limiter is always installed
+	r.Use(s.rateLimit)
 
 	// Add routes and handlers
 	// POST /file - SaveFile handler for saving files
-	r.POST("/file", s.SaveFile)
+	r.POST("/file", RequireScope(ScopeFilesWrite), s.rejectWhileDraining, s.resolveTenant, s.limitTransfer, s.SaveFile)
 	// GET /file/:hash - SendFile handler for retrieving files
-	r.GET("/file/:hash", s.SendFile)
+	r.GET("/file/:hash", RequireScope(ScopeFilesRead), s.resolveTenant, s.limitTransfer, s.forwardToOwner, s.SendFile)
 	// DELETE /file/:hash - DeleteFile handler for deleting files
-	r.DELETE("/file/:hash", s.DeleteFile)
+	r.DELETE("/file/:hash", RequireScope(ScopeFilesDelete), s.resolveTenant, s.forwardToOwner, s.DeleteFile)
+	// GET /file/:hash/meta - metadata of a file, e.g. the verdict of its antivirus scan
+	r.GET("/file/:hash/meta", RequireScope(ScopeFilesRead), s.resolveTenant, s.forwardToOwner, s.metadataHandler)
+
+	// GET /metrics - metrics in the Prometheus exposition format
+	r.GET("/metrics", RequireScope(ScopeAdmin), s.metricsHandler)
+
+	// GET /events - stream of the storage events
+	r.GET("/events", RequireScope(ScopeFilesRead), s.resolveTenant, s.eventsHandler)
+
+	if s.tenants != nil {
+		r.GET("/t/:tenant/events", RequireScope(ScopeFilesRead), s.resolveTenant, s.eventsHandler)
+
+		// The same file routes in the namespace of a tenant
+		r.POST("/t/:tenant/file", RequireScope(ScopeFilesWrite), s.rejectWhileDraining, s.resolveTenant, s.limitTransfer, s.SaveFile)
+		r.GET("/t/:tenant/file/:hash", RequireScope(ScopeFilesRead), s.resolveTenant, s.limitTransfer, s.SendFile)
+		r.DELETE("/t/:tenant/file/:hash", RequireScope(ScopeFilesDelete), s.resolveTenant, s.DeleteFile)
+		r.GET("/t/:tenant/file/:hash/meta", RequireScope(ScopeFilesRead), s.resolveTenant, s.metadataHandler)
+
+		// GET /files - files of the tenant of the principal with their metadata
+		r.GET("/files", RequireScope(ScopeFilesRead), s.resolveTenant, s.listTenantFilesHandler)
+		r.GET("/files/:hash", RequireScope(ScopeFilesRead), s.resolveTenant, s.tenantFileHandler)
+		r.GET("/t/:tenant/files", RequireScope(ScopeFilesRead), s.resolveTenant, s.listTenantFilesHandler)
+		r.GET("/t/:tenant/files/:hash", RequireScope(ScopeFilesRead), s.resolveTenant, s.tenantFileHandler)
+	}
+
+	if s.config.URLSigningKey != "" {
+		// POST /presign/download - mints a signed URL to download a file
+		r.POST("/presign/download", RequireScope(ScopeFilesRead), s.resolveTenant, s.presignDownloadHandler)
+		// POST /presign/upload - mints a signed URL to upload a file of a limited size
+		r.POST("/presign/upload", RequireScope(ScopeFilesWrite), s.resolveTenant, s.presignUploadHandler)
+	}
+
+	if s.isClusterEnabled() {
+		// POST /cluster/rebalance - moves files to the members owning them
+		r.POST("/cluster/rebalance", RequireScope(ScopeAdmin), s.rebalanceHandler)
+	}
+
+	// GET /sync/shards - digests of the shards for anti-entropy repair
+	r.GET("/sync/shards", RequireScope(ScopeAdmin), s.shardsHandler)
+	// GET /sync/shards/:shard - hashes of the files in a shard
+	r.GET("/sync/shards/:shard", RequireScope(ScopeAdmin), s.shardHandler)
+	if len(s.config.SyncPeers) > 0 {
+		// POST /sync/repair - repairs the storage with all sync peers
+		r.POST("/sync/repair", RequireScope(ScopeAdmin), s.repairHandler)
+	}
+
+	if s.config.IsEncryptionEnabled() {
+		// POST /admin/reencrypt - starts rewriting files with the active encryption key
+		r.POST("/admin/reencrypt", RequireScope(ScopeAdmin), s.startReencryptHandler)
+		// GET /admin/reencrypt - status of the reencryption job
+		r.GET("/admin/reencrypt", RequireScope(ScopeAdmin), s.reencryptStatusHandler)
+	}
+
+	if s.configLoader != nil {
+		// POST /admin/config/reload - reloads the configuration
+		r.POST("/admin/config/reload", RequireScope(ScopeAdmin), s.reloadConfigHandler)
+	}
 
 	// Return the configured Gin engine
 	return r
@@ -160,7 +451,20 @@ func (s *HTTPFileStorageServer) setupRouter() *gin.Engine {
 
 // StartServer starts the HTTP server.
 // It sets up the router and starts the server to listen for incoming requests.
-func (s *HTTPFileStorageServer) StartServer() {
+// It returns once the server is shut down on SIGINT or SIGTERM or by Shutdown.
+func (s *HTTPFileStorageServer) StartServer() error {
+	// Route the records of the packages logging with the default logger,
+	// including the standard log package, through the logger of the server
+	slog.SetDefault(s.logger)
+
+	// Propagate the trace context with the requests to other cluster members
+	otel.SetTextMapPropagator(s.propagator)
+
+	// Gin only logs its debug output, e.g. the registered routes, in debug mode
+	if s.logLevel.Level() > slog.LevelDebug {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
 	// Set up the router
 	r := s.setupRouter()
 
@@ -170,44 +474,117 @@ func (s *HTTPFileStorageServer) StartServer() {
 		Addr: fmt.Sprintf("%s:%d", s.config.Host, s.config.Port),
 		// Set the handler to the router
 		Handler: r,
-		// Set the timeouts for the server
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+		// Set the timeouts for the server, transfers have no absolute timeouts
+		// and are cut off by guardTransfers once they stall instead
+		ReadHeaderTimeout: s.readHeaderTimeout(),
+		IdleTimeout:       s.idleTimeout(),
+	}
+
+	if s.certs != nil {
+		// Serve over HTTPS, reloading the certificates without a restart
+		server.TLSConfig = s.certs.serverConfig()
+	}
+	if s.config.H2C {
+		if err := serveH2C(server); err != nil {
+			return err
+		}
+	}
+
+	// Listen before anything is started, so that startup errors are returned
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %v", server.Addr, err)
+	}
+	var http3Server *http3.Server
+	var http3Conn net.PacketConn
+	if s.config.HTTP3 {
+		http3Server, http3Conn, err = listenHTTP3(server)
+		if err != nil {
+			listener.Close()
+			return err
+		}
 	}
 
+	s.mux.Lock()
 	s.engine = r
+	s.httpServer = server
+	s.http3Server = http3Server
+	s.http3Conn = http3Conn
+	s.mux.Unlock()
+
+	// The background jobs are stopped on shutdown
+	background := s.background
+
+	if s.certs != nil {
+		s.certs.watch(background)
+	}
+
+	if s.configLoader != nil {
+		s.watchConfig(background)
+	}
+
+	if s.isClusterEnabled() {
+		// Membership is static, so files owned by other members can only appear
+		// after a configuration change, move them on startup
+		go func() {
+			moved, err := s.Rebalance(background)
+			if err != nil {
+				s.logger.Error("error rebalancing cluster", "moved", moved, "error", err)
+				return
+			}
+			s.logger.Info("cluster rebalanced", "moved", moved)
+		}()
+	}
+
+	if len(s.config.SyncPeers) > 0 && s.config.SyncInterval > 0 {
+		go s.runRepairLoop(background)
+	}
+
+	if s.webhooks != nil {
+		go s.webhooks.Run(background)
+	}
+
+	serveErr := make(chan error, 2)
 	go func() {
-		// Listen and serve
-		err := server.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			// Print the error if the server fails to start
-			log.Fatalf("listen: %s\n", err)
+		if s.certs != nil {
+			serveErr <- server.ServeTLS(listener, "", "")
+			return
 		}
+		serveErr <- server.Serve(listener)
 	}()
+	if http3Server != nil {
+		go func() { serveErr <- http3Server.Serve(http3Conn) }()
+	}
+	s.logger.Info("server started", "address", listener.Addr().String(), "h2c", s.config.H2C, "http3", s.config.HTTP3)
 
-	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 5 seconds.
-	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall. SIGKILL but can"t be catch, so don't need add it
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutdown Server ...")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal("Server Shutdown:", err)
+	defer signal.Stop(quit)
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			server.Close()
+			if http3Server != nil {
+				http3Server.Close()
+				http3Conn.Close()
+			}
+			s.stopBackground()
+			return fmt.Errorf("error serving: %v", err)
+		}
+		// Shutdown was called, wait until it is complete
+		<-s.stopped
+		return s.shutdownErr
+	case <-quit:
+		s.logger.Info("shutting down server")
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownDelay+s.drainTimeout())
+		defer cancel()
+		return s.Shutdown(ctx)
 	}
-	// catching ctx.Done(). timeout of 5 seconds.
-
-	<-ctx.Done()
-	log.Println("timeout of 5 seconds.")
-
-	log.Println("Server exiting")
-
 }
 
 // SaveFile handles the HTTP POST request to save a file to the storage.
@@ -216,95 +593,153 @@ func (s *HTTPFileStorageServer) StartServer() {
 // If the file already exists in the storage, it returns a status code 200 OK.
 // If the file is successfully saved, it returns a status code 201 Created and the hash of the file.
 func (s *HTTPFileStorageServer) SaveFile(c *gin.Context) {
+	span := s.startSpan(c, "SaveFile")
+	defer endHandlerSpan(c, span)
 
 	waitCh := make(chan struct{})
 	go func() {
 
-		defer func() {
-			// Recover from panic and return error 500 Internal Server Error
-			if r := recover(); r != nil {
-				fmt.Println("Recovered in f", r)
-				c.AbortWithError(500, fmt.Errorf("internal server error"))
-			}
-		}()
-
 		defer func() { waitCh <- struct{}{} }()
 
-		// Log the request
-		slog.Info("POST /file")
+		// Recover from panic and return error 500 Internal Server Error before
+		// the handler returns
+		defer s.recoverHandler(c)
 
-		// Get the form file
-		formFile, err := c.FormFile("file")
-		if err != nil {
-			c.AbortWithError(500, fmt.Errorf("error getting file: %v", err))
+		// Receive the file, enforcing the upload policy while streaming it
+		_, receiveSpan := s.tracer.Start(c.Request.Context(), "upload.receive")
+		upload, err := s.receiveUpload(c)
+		if err == nil {
+			receiveSpan.SetAttributes(attribute.String("file.hash", upload.hash), attribute.Int64("file.size", upload.size))
+		}
+		endSpan(receiveSpan, err)
+		var uploadErr *uploadError
+		if errors.As(err, &uploadErr) {
+			c.AbortWithStatusJSON(uploadErr.status, gin.H{"msg": uploadErr.msg})
+			return
+		} else if err != nil {
+			c.AbortWithError(500, fmt.Errorf("error saving file locally: %v", err))
 			return
 		}
+		defer os.Remove(upload.path)
+		s.metrics.uploadedBytes.Add(float64(upload.size))
+		setLogFile(c, upload.hash, upload.size)
+
+		hash := upload.hash
+
+		_, verifySpan := s.tracer.Start(c.Request.Context(), "hash.verify")
+		err = checkHashFromRequest(upload.path, c)
+		endSpan(verifySpan, err)
 
-		// Create a temporary file
-		file, err := os.CreateTemp("", formFile.Filename)
 		if err != nil {
-			c.AbortWithError(500, fmt.Errorf("error creating temp file: %v", err))
+			c.AbortWithError(412, fmt.Errorf("error checking hash: %v", err))
 			return
 		}
 
-		// Open the form file
-		multipartFile, err := formFile.Open()
-		if err != nil {
-			c.AbortWithError(500, fmt.Errorf("error opening file: %v", err))
+		// Forward the file to the cluster member owning its hash
+		if owner := s.remoteOwner(c, hash); owner != "" {
+			s.forwardUpload(c, owner, upload.path, upload.name)
 			return
 		}
 
-		// Copy the form file to the temporary file
-		_, err = io.Copy(file, multipartFile)
-		if err != nil {
-			c.AbortWithError(500, fmt.Errorf("error saving file locally: %v", err))
+		// Run all Pre-Save hooks, any of them can reject the file or replace its content
+		metadata, err := s.runPreSaveHooks(c, upload)
+		defer os.Remove(upload.path)
+		if errors.As(err, &uploadErr) {
+			c.AbortWithStatusJSON(uploadErr.status, gin.H{"msg": uploadErr.msg})
+			return
+		} else if err != nil {
+			c.AbortWithError(500, fmt.Errorf("error running pre-save hooks: %v", err))
 			return
 		}
+		setLogFile(c, upload.hash, upload.size)
+
+		// A hook replacing the content changes the hash, and with it the owner.
+		// The owner runs the hooks again on the new content.
+		if upload.hash != hash {
+			hash = upload.hash
+			if owner := s.remoteOwner(c, hash); owner != "" {
+				s.forwardUpload(c, owner, upload.path, upload.name)
+				return
+			}
+		}
 
-		// Close the form file and temporary file
-		defer func() {
-			multipartFile.Close()
-			file.Close()
-			os.Remove(file.Name())
-		}()
-
-		hash := helpers.GetFileHash(sha256.New(), file)
-
-		if hash == "" {
-			c.AbortWithError(500, fmt.Errorf("error computing hash: %v", err))
+		// Scan the file for malware before it becomes visible to anyone
+		verdict, err := s.scanUpload(c, upload)
+		if errors.As(err, &uploadErr) {
+			c.AbortWithStatusJSON(uploadErr.status, gin.H{"msg": uploadErr.msg})
+			return
+		} else if err != nil {
+			c.AbortWithError(500, fmt.Errorf("error scanning file: %v", err))
 			return
 		}
 
-		// Close the temporary file because it will be read in SaveFileFromTemp
-		file.Close()
-
-		err = checkHashFromRequest(file.Name(), c)
-
-		if err != nil {
-			c.AbortWithError(412, fmt.Errorf("error checking hash: %v", err))
-			return
+		// The verdict depends on the content only and is shared, the metadata of
+		// the hooks belongs to the upload. In the namespace of a tenant it is kept
+		// on the reference, so that tenants uploading the same content don't see
+		// each other's.
+		tenant := c.GetString(tenantKey)
+		shared := verdict
+		if tenant == "" {
+			shared = metadata
+			maps.Copy(shared, verdict)
 		}
 
-		// Run all Pre-Save callbacks
-		s.runCallbacks(&s.preSaveCallbacks, hash, file.Name())
+		// Reference the file from the tenant before saving it, so that it can't
+		// be deleted in between by another tenant dropping its reference
+		addedRef := false
+		if tenant != "" {
+			var ok bool
+			if addedRef, ok = s.addTenantRef(c, tenant, upload, metadata); !ok {
+				return
+			}
+		}
 
 		// Save the file to the storage
-		err = s.storer.SaveFileFromTemp(hash, file.Name())
+		err = s.tracedStorage(c.Request.Context()).SaveFileFromTemp(hash, upload.path)
+
+		// Record the metadata, also for files that were already stored
+		if err == nil || errors.Is(err, os.ErrExist) {
+			if len(shared) > 0 {
+				if err := s.tracedStorage(c.Request.Context()).SetMetadata(hash, shared); err != nil {
+					s.requestLogger(c).Error("error recording metadata", "hash", hash, "error", err)
+				}
+			}
+			if tenant != "" && !addedRef && len(metadata) > 0 {
+				if err := s.tenants.SetMetadata(tenant, hash, metadata); err != nil {
+					s.requestLogger(c).Error("error recording metadata of tenant", "tenant", tenant, "hash", hash, "error", err)
+				}
+			}
+		}
 
 		// If the file already exists in the storage, return a status code 200 OK
 		if errors.Is(err, os.ErrExist) {
+			s.metrics.dedupHits.Inc()
+			// A file new to the tenant is reported as created even if another
+			// tenant has stored it, so that tenants can't probe each other's content
+			if addedRef {
+				s.publish(c, events.BlobCreated, hash, upload.size)
+				c.JSON(201, gin.H{"hash": hash})
+				return
+			}
 			c.Status(200)
 			return
 		}
 
 		// If an error occurs during saving, return an error 500 Internal Server Error
 		if err != nil {
+			if addedRef {
+				s.tenants.RemoveRef(tenant, hash)
+			}
 			c.AbortWithError(500, fmt.Errorf("error saving file: %v", err))
 			return
 		}
 
-		// Run all Post-Save callbacks
-		s.runCallbacks(&s.postSaveCallbacks, hash, file.Name())
+		s.publish(c, events.BlobCreated, hash, upload.size)
+
+		// Run all Post-Save callbacks, the file is already saved whatever they return
+		if err = s.runCallbacks(c.Request.Context(), &s.postSaveCallbacks, hash, upload.path); err != nil {
+			s.requestLogger(c).Error("error running post-save callback", "hash", hash, "error", err)
+		}
 
 		// Return the hash of the file
 		c.JSON(201, gin.H{"hash": hash})
@@ -318,18 +753,17 @@ func (s *HTTPFileStorageServer) SaveFile(c *gin.Context) {
 // If the file does not exist, it returns an error 404 Not Found.
 // If an internal error occurs, it returns error 500 Internal Server Error.
 func (s *HTTPFileStorageServer) SendFile(c *gin.Context) {
+	span := s.startSpan(c, "SendFile")
+	defer endHandlerSpan(c, span)
+
 	waitCh := make(chan struct{})
 	go func() {
-		defer func() {
-			// Recover from panic and return error 500 Internal Server Error
-			if r := recover(); r != nil {
-				fmt.Println("Recovered in f", r)
-				c.AbortWithError(500, fmt.Errorf("internal server error"))
-			}
-		}()
-
 		defer func() { waitCh <- struct{}{} }()
 
+		// Recover from panic and return error 500 Internal Server Error before
+		// the handler returns
+		defer s.recoverHandler(c)
+
 		// Bind URI parameters to hash struct
 		var hash hash
 		if err := c.ShouldBindUri(&hash); err != nil {
@@ -338,8 +772,33 @@ func (s *HTTPFileStorageServer) SendFile(c *gin.Context) {
 			return
 		}
 
-		// Read file from storage
-		filePath, err := s.storer.Read(hash.Hash)
+		// Tenants only see the files they reference
+		if tenant := c.GetString(tenantKey); tenant != "" {
+			if _, err := s.tenants.Get(tenant, hash.Hash); errors.Is(err, os.ErrNotExist) {
+				c.AbortWithError(404, fmt.Errorf("file not found"))
+				return
+			} else if err != nil {
+				c.JSON(400, gin.H{"msg": err.Error()})
+				return
+			}
+		}
+
+		// Read file from storage, keeping it compressed if the client accepts the stored encoding
+		acceptedEncodings := parseAcceptEncoding(c.GetHeader("Accept-Encoding"))
+		filePath, encoding, err := s.tracedStorage(c.Request.Context()).ReadEncoded(hash.Hash, acceptedEncodings)
+
+		// Fetch the missing file from the upstream if the server is a pull-through cache
+		if errors.Is(err, os.ErrNotExist) && s.config.UpstreamURL != "" {
+			fetchErr := s.fetchFromUpstream(c.Request.Context(), hash.Hash)
+			if fetchErr != nil && !errors.Is(fetchErr, os.ErrNotExist) {
+				// Return error 502 Bad Gateway if the upstream failed
+				c.AbortWithError(502, fmt.Errorf("error fetching file from upstream: %v", fetchErr))
+				return
+			}
+			if fetchErr == nil {
+				filePath, encoding, err = s.tracedStorage(c.Request.Context()).ReadEncoded(hash.Hash, acceptedEncodings)
+			}
+		}
 
 		if errors.Is(err, os.ErrNotExist) {
 			// Return error 404 Not Found if file does not exist
@@ -350,6 +809,8 @@ func (s *HTTPFileStorageServer) SendFile(c *gin.Context) {
 			c.AbortWithError(500, fmt.Errorf("error reading file: %v", err))
 			return
 		}
+		// Delete file from temporary directory, also if the transfer is interrupted
+		defer os.Remove(filePath)
 
 		file, err := os.Open(filePath)
 
@@ -359,8 +820,20 @@ func (s *HTTPFileStorageServer) SendFile(c *gin.Context) {
 			return
 		}
 
-		computedHash := helpers.GetFileHash(sha256.New(), file)
+		// The hash is computed over the original content
+		decoder, err := storage.NewDecoder(encoding, file)
+		if err != nil {
+			file.Close()
+			c.AbortWithError(500, fmt.Errorf("error decoding file: %v", err))
+			return
+		}
+
+		_, hashSpan := s.tracer.Start(c.Request.Context(), "hash.compute", trace.WithAttributes(attribute.String("file.hash", hash.Hash)))
+		computedHash := helpers.GetFileHash(sha256.New(), decoder)
+		hashSpan.SetAttributes(attribute.Bool("file.hash_matches", computedHash == hash.Hash))
+		hashSpan.End()
 
+		decoder.Close()
 		file.Close()
 		if computedHash == "" {
 			c.AbortWithError(500, fmt.Errorf("error computing hash: %v", err))
@@ -374,14 +847,27 @@ func (s *HTTPFileStorageServer) SendFile(c *gin.Context) {
 			c.AbortWithError(500, fmt.Errorf("File is corrupted"))
 			file.Close()
 			os.Remove(filePath)
+			s.metrics.corruptions.Inc()
+			s.publish(c, events.BlobCorrupted, hash.Hash, 0)
 			return
 		}
 
+		if s.config.Compression != "" {
+			c.Header("Vary", "Accept-Encoding")
+		}
+		if encoding != "" {
+			// Serve the compressed content as is
+			c.Header("Content-Encoding", encoding)
+			c.Header("Content-Type", "application/octet-stream")
+		}
+
 		// Send file to client
 		c.File(filePath)
-
-		// Delete file from temporary directory
-		os.Remove(filePath)
+		if size := c.Writer.Size(); size > 0 {
+			s.metrics.downloadedBytes.Add(float64(size))
+			setLogFile(c, hash.Hash, int64(size))
+		}
+		s.publish(c, events.BlobAccessed, hash.Hash, 0)
 	}()
 
 	<-waitCh
@@ -391,19 +877,18 @@ func (s *HTTPFileStorageServer) SendFile(c *gin.Context) {
 // It checks if the file exists in the storage, and if so, deletes it.
 // Returns an error 500 Internal Server Error if an internal error occurs.
 func (s *HTTPFileStorageServer) DeleteFile(c *gin.Context) {
+	span := s.startSpan(c, "DeleteFile")
+	defer endHandlerSpan(c, span)
 
 	waitCh := make(chan struct{})
 	go func() {
 
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Println("Recovered in f", r)
-				c.AbortWithError(500, fmt.Errorf("internal server error"))
-			}
-		}()
-
 		defer func() { waitCh <- struct{}{} }()
 
+		// Recover from panic and return error 500 Internal Server Error before
+		// the handler returns
+		defer s.recoverHandler(c)
+
 		var hash hash
 		if err := c.ShouldBindUri(&hash); err != nil {
 			c.JSON(400, gin.H{"msg": err.Error()})
@@ -415,12 +900,38 @@ func (s *HTTPFileStorageServer) DeleteFile(c *gin.Context) {
 			return
 		}
 
-		err := s.storer.Delete(hash.Hash)
+		// Tenants only drop their reference, the file is deleted with the last one
+		if tenant := c.GetString(tenantKey); tenant != "" {
+			err := s.tenants.RemoveRef(tenant, hash.Hash)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				c.AbortWithError(500, fmt.Errorf("error deleting file: %v", err))
+				return
+			}
+			if err == nil {
+				s.publish(c, events.BlobDeleted, hash.Hash, 0)
+			}
+			c.Status(200)
+			return
+		}
+
+		// Deleting a missing file succeeds, but is not an event
+		storer := s.tracedStorage(c.Request.Context())
+		existed, _ := storer.Exists(hash.Hash)
+
+		err := storer.Delete(hash.Hash)
+
+		// Files deleted from the shared store disappear from all tenants
+		if err == nil && s.tenants != nil {
+			err = s.tenants.DropRefs(hash.Hash)
+		}
 
 		if err != nil {
 			c.AbortWithError(500, fmt.Errorf("error deleting file: %v", err))
 			return
 		}
+		if existed {
+			s.publish(c, events.BlobDeleted, hash.Hash, 0)
+		}
 		c.Status(200)
 	}()
 
@@ -447,14 +958,132 @@ func NewHTTPFileStorageServer(storer storage.Storer, config *Config) (FileStorag
 		return nil, fmt.Errorf("config field is nil")
 	}
 
-	// Create and return a new HTTPFileStorageServer instance
-	return &HTTPFileStorageServer{
+	// Set up the logger first, everything else may log
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up logging: %v", err)
+	}
+
+	// Create a new HTTPFileStorageServer instance
+	server := &HTTPFileStorageServer{
 		storer:            storer,
 		config:            config,
 		mux:               sync.Mutex{},
-		preSaveCallbacks:  []func(hash string, filePath string) error{},
+		preSaveHooks:      []PreSaveHook{},
 		postSaveCallbacks: []func(hash string, filePath string) error{},
-	}, nil
+		clusterClient:     cluster.NewClient(nil, config.PeerAPIKey),
+		events:            events.NewBus(),
+		eventLog:          events.NewLog(config.EventLogSize),
+		draining:          make(chan struct{}),
+		stopped:           make(chan struct{}),
+		rateWindow:        transferRateWindow,
+	}
+	server.background, server.cancelBackground = context.WithCancel(context.Background())
+	server.logLevel.Set(level)
+	server.live.Store(config)
+
+	server.logger, err = newLogger(os.Stderr, config.LogFormat, &server.logLevel)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up logging: %v", err)
+	}
+	server.metrics = newMetrics(storer, server.logger)
+
+	// Export the spans if tracing is configured
+	tracerProvider, err := newTracerProvider(config)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up tracing: %v", err)
+	}
+	server.tracerProvider = tracerProvider
+	server.tracer = newTracer(tracerProvider)
+	server.propagator = newPropagator()
+
+	server.events.Record(server.eventLog)
+
+	if err := validateProtocols(config); err != nil {
+		return nil, err
+	}
+
+	// Load the TLS certificates, other members are talked to over mutual TLS then
+	server.certs, err = newCertReloader(config, server.logger)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up TLS: %v", err)
+	}
+	if server.certs != nil {
+		transport, err := server.certs.peerTransport()
+		if err != nil {
+			return nil, fmt.Errorf("error setting up TLS: %v", err)
+		}
+		server.peerTransport = transport
+		server.clusterClient = cluster.NewClient(&http.Client{Transport: transport}, config.PeerAPIKey)
+	}
+
+	// Load the authentication keys
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up authentication: %v", err)
+	}
+	server.auth.Store(auth)
+
+	if err := validateTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+
+	if config.URLSigningKey != "" && len(config.URLSigningKey) < minURLSigningKeySize {
+		return nil, fmt.Errorf("URL signing key must be at least %d bytes long", minURLSigningKeySize)
+	}
+
+	// Set up the antivirus scanner if it is configured
+	fileScanner, err := newScanner(config)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up scanner: %v", err)
+	}
+	server.scanner = fileScanner
+
+	// Deliver the events to the webhooks if they are configured
+	webhooks, err := newWebhookDispatcher(config)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up webhooks: %v", err)
+	}
+	if webhooks != nil {
+		webhooks.Logger = server.logger
+		server.webhooks = webhooks
+		server.events.Subscribe(server.enqueueWebhooks)
+	}
+
+	// Set up the tenant namespaces if they are enabled
+	if config.Tenants {
+		// Tenant references are kept locally and are not moved between members
+		if len(config.ClusterMembers) > 0 {
+			return nil, fmt.Errorf("tenants are not supported in cluster mode")
+		}
+		// Without authentication anyone could delete the files of every tenant
+		if !config.IsAuthEnabled() {
+			return nil, fmt.Errorf("tenants require authentication")
+		}
+
+		tenants, err := storage.NewTenantIndex(config.StoragePath, storer)
+		if err != nil {
+			return nil, fmt.Errorf("error creating tenant index: %v", err)
+		}
+		server.tenants = tenants
+	}
+
+	// Set up the cluster mode if cluster members are configured
+	if len(config.ClusterMembers) > 0 {
+		ring, err := cluster.NewRing(config.ClusterMembers, cluster.DefaultVirtualNodes)
+		if err != nil {
+			return nil, fmt.Errorf("error creating cluster ring: %v", err)
+		}
+
+		if !ring.Has(config.ClusterSelf) {
+			return nil, fmt.Errorf("cluster self %q is not a cluster member", config.ClusterSelf)
+		}
+
+		server.ring = ring
+		server.clusterSelf = cluster.NormalizeMember(config.ClusterSelf)
+	}
+
+	return server, nil
 }
 
 // registerCallback appends a callback function to the given slice of callbacks.
@@ -478,11 +1107,17 @@ func (s *HTTPFileStorageServer) registerCallback(callbacks *[]func(hash string,
 //
 // The callback function takes two parameters: the hash of the file and the path
 // to the file. It must return an error if there was any problem executing
-// the callback.
+// the callback. An error rejects the upload with 422 Unprocessable Entity.
 //
 // This function is thread-safe.
 func (s *HTTPFileStorageServer) RegisterPreSaveCallback(callback func(hash string, filePath string) error) {
-	s.registerCallback(&s.preSaveCallbacks, callback)
+	s.RegisterPreSaveHook(func(ctx context.Context, upload *UploadContext) error {
+		upload.lock.Lock()
+		hash, filePath := upload.upload.hash, upload.upload.path
+		upload.lock.Unlock()
+
+		return callback(hash, filePath)
+	})
 }
 
 // RegisterPOSTSaveCallback registers a callback function to be executed after
@@ -501,26 +1136,37 @@ func (s *HTTPFileStorageServer) RegisterPOSTSaveCallback(callback func(hash stri
 }
 
 // runCallbacks runs all the callbacks in the given slice with the provided
-// hash and file path.
+// hash and file path, stopping at the first error.
 //
 // The callbacks slice is not modified.
 //
 // Parameters:
+// - ctx: the context of the request, the parent of the spans of the callbacks.
 // - callbacks: a pointer to a slice of callbacks.
 // - hash: the hash of the file.
 // - filePath: the path of the file.
-func (s *HTTPFileStorageServer) runCallbacks(callbacks *[]func(hash string, filePath string) error, hash string, filePath string) {
+//
+// Returns the error of the first failed callback.
+func (s *HTTPFileStorageServer) runCallbacks(ctx context.Context, callbacks *[]func(hash string, filePath string) error, hash string, filePath string) error {
 
-	// Lock the mutex to prevent concurrent access.
+	// Copy the callbacks under the mutex, so that uploads don't wait for each other's callbacks.
 	s.mux.Lock()
-	defer s.mux.Unlock()
+	snapshot := append([]func(hash string, filePath string) error(nil), *callbacks...)
+	s.mux.Unlock()
 
 	// Iterate over each callback in the slice.
-	for _, callback := range *callbacks {
+	for i, callback := range snapshot {
 		// Call the callback with the provided hash and file path.
-		callback(hash, filePath)
+		_, span := s.tracer.Start(ctx, "callback.post_save", trace.WithAttributes(
+			attribute.Int("callback.index", i), attribute.String("file.hash", hash)))
+		err := callback(hash, filePath)
+		endSpan(span, err)
+		if err != nil {
+			return err
+		}
 	}
 
+	return nil
 }
 
 // RegisterGETHandler registers a handler function for the GET method on the
@@ -593,6 +1239,10 @@ func checkHashFromRequest(filePath string, c *gin.Context) error {
 	// Check the SHA256 hash.
 	sha256Header := c.GetHeader("SHA256")
 	if sha256Header != "" {
+		// Rewind the file, it may have been read by the previous check
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error reading file: %v", err)
+		}
 		hash := helpers.GetFileHash(sha256.New(), file)
 		if sha256Header != hash {
 			return fmt.Errorf("SHA256 hash does not match")
@@ -602,6 +1252,10 @@ func checkHashFromRequest(filePath string, c *gin.Context) error {
 	// Check the SHA512 hash.
 	sha512Header := c.GetHeader("SHA512")
 	if sha512Header != "" {
+		// Rewind the file, it may have been read by the previous check
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error reading file: %v", err)
+		}
 		hash := helpers.GetFileHash(sha512.New(), file)
 		if sha512Header != hash {
 			return fmt.Errorf("SHA512 hash does not match")
@@ -611,6 +1265,10 @@ func checkHashFromRequest(filePath string, c *gin.Context) error {
 	// Check the SHA1 hash.
 	sha1Header := c.GetHeader("SHA1")
 	if sha1Header != "" {
+		// Rewind the file, it may have been read by the previous check
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error reading file: %v", err)
+		}
 		hash := helpers.GetFileHash(sha1.New(), file)
 		if sha1Header != hash {
 			return fmt.Errorf("SHA1 hash does not match")
@@ -0,0 +1,591 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pavlov061356/http_based_file_storage/pkg/events"
+	"github.com/pavlov061356/http_based_file_storage/pkg/scanner"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of the values of the settings, from the lowest precedence to the highest.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// redacted replaces the values of secret settings when the configuration is printed.
+const redacted = "<redacted>"
+
+// setting describes a tunable of the configuration.
+//
+// Its name is the key in the configuration file, the name of its environment
+// variable is the name in upper case, e.g. MAX_UPLOAD_SIZE, and the name of
+// its flag is the name in kebab case, e.g. --max-upload-size.
+type setting struct {
+	name  string
+	usage string
+	// value is the default value
+	value string
+	// separator joins the elements of lists given in the configuration file,
+	// the value must be a single one if it is empty
+	separator string
+	// pair joins the keys with the values of maps given in the configuration
+	// file, the value must not be a map if it is empty
+	pair string
+	// boolean settings may be given as flags without a value
+	boolean bool
+	// secret settings are redacted when the configuration is printed
+	secret bool
+	// reloadable settings are applied by a reload, the others need a restart
+	reloadable bool
+	// set parses the value into the configuration
+	set func(c *Config, value string) error
+}
+
+// field returns the function parsing a value into the field of the configuration.
+// An empty value sets the zero value.
+func field[T any](parse func(string) (T, error), ptr func(c *Config) *T) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		if value == "" {
+			var zero T
+			*ptr(c) = zero
+			return nil
+		}
+
+		parsed, err := parse(value)
+		if err != nil {
+			return err
+		}
+		*ptr(c) = parsed
+		return nil
+	}
+}
+
+// parseString parses a string value as is.
+func parseString(value string) (string, error) {
+	return value, nil
+}
+
+// parseList parses a comma-separated list.
+func parseList(value string) ([]string, error) {
+	return splitList(value), nil
+}
+
+// parseCount parses a non-negative integer.
+func parseCount(value string) (int, error) {
+	count, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative integer", value)
+	}
+	return count, nil
+}
+
+// parsePort parses a TCP port number, zero picks a free port.
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a port number between 0 and 65535", value)
+	}
+	return port, nil
+}
+
+// parseDuration parses a non-negative duration, e.g. "30s".
+func parseDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("duration %q is negative", value)
+	}
+	return duration, nil
+}
+
+// parseRatio parses a number between 0 and 1.
+func parseRatio(value string) (float64, error) {
+	ratio, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return 0, fmt.Errorf("%q is not a number between 0 and 1", value)
+	}
+	return ratio, nil
+}
+
+// settings are all tunables of the configuration, in the order they are printed.
+var settings = []setting{
+	{name: "host", value: "localhost", usage: "Hostname or IP address to listen on",
+		set: field(parseString, func(c *Config) *string { return &c.Host })},
+	{name: "port", value: "8080", usage: "Port to listen on",
+		set: field(parsePort, func(c *Config) *int { return &c.Port })},
+	{name: "storage_path", usage: "Directory the files are stored in, required",
+		set: field(parseString, func(c *Config) *string { return &c.StoragePath })},
+
+	{name: "log_level", reloadable: true, value: "info", usage: "Minimal level of log records: debug, info, warn or error",
+		set: field(parseString, func(c *Config) *string { return &c.LogLevel })},
+	{name: "log_format", value: LogFormatText, usage: "Format of log records: text or json",
+		set: field(parseString, func(c *Config) *string { return &c.LogFormat })},
+
+	{name: "tracing_endpoint", usage: "Base URL of the OTLP/HTTP collector to export spans to, tracing is disabled if empty",
+		set: field(parseString, func(c *Config) *string { return &c.TracingEndpoint })},
+	{name: "tracing_sample_ratio", value: "1", usage: "Ratio of sampled traces started by the server, between 0 and 1",
+		set: field(parseRatio, func(c *Config) *float64 { return &c.TracingSampleRatio })},
+
+	{name: "min_free_space", value: "0", usage: "Free space required on the file system of the storage for the node to be ready, e.g. 1G",
+		set: field(parseSize, func(c *Config) *int64 { return &c.MinFreeSpace })},
+	{name: "readiness_require_peers", value: "false", boolean: true, usage: "Make the node unready while other members, sync peers or the upstream are unreachable",
+		set: field(strconv.ParseBool, func(c *Config) *bool { return &c.ReadinessRequirePeers })},
+	{name: "shutdown_delay", value: "0s", usage: "Time between failing the readiness probe and closing the listener on shutdown",
+		set: field(parseDuration, func(c *Config) *time.Duration { return &c.ShutdownDelay })},
+	{name: "drain_timeout", value: DefaultDrainTimeout.String(), usage: "Time the requests in flight are given to complete on shutdown",
+		set: field(parseDuration, func(c *Config) *time.Duration { return &c.DrainTimeout })},
+
+	{name: "tls_cert_file", usage: "PEM certificate chain to serve HTTPS with, plain HTTP if empty",
+		set: field(parseString, func(c *Config) *string { return &c.TLSCertFile })},
+	{name: "tls_key_file", usage: "PEM private key of the certificate",
+		set: field(parseString, func(c *Config) *string { return &c.TLSKeyFile })},
+	{name: "tls_client_ca_file", usage: "PEM certificates of the CAs verifying client certificates",
+		set: field(parseString, func(c *Config) *string { return &c.TLSClientCAFile })},
+	{name: "tls_require_client_cert", value: "false", boolean: true, usage: "Reject connections without a valid client certificate",
+		set: field(strconv.ParseBool, func(c *Config) *bool { return &c.TLSRequireClientCert })},
+	{name: "client_certs", reloadable: true, separator: ";", usage: "Semicolon-separated client certificates in the subject|principal[@tenant]|scope,scope format",
+		set: field(parseClientCerts, func(c *Config) *[]ClientCert { return &c.ClientCerts })},
+
+	{name: "h2c", value: "false", boolean: true, usage: "Serve HTTP/2 without TLS besides HTTP/1.1",
+		set: field(strconv.ParseBool, func(c *Config) *bool { return &c.H2C })},
+	{name: "http3", value: "false", boolean: true, usage: "Serve HTTP/3 over QUIC on the UDP port of the same number, requires TLS",
+		set: field(strconv.ParseBool, func(c *Config) *bool { return &c.HTTP3 })},
+
+	{name: "read_header_timeout", value: DefaultReadHeaderTimeout.String(), usage: "Time clients are given to send the request headers",
+		set: field(parseDuration, func(c *Config) *time.Duration { return &c.ReadHeaderTimeout })},
+	{name: "idle_timeout", value: DefaultIdleTimeout.String(), usage: "Time keep-alive connections are kept open without requests",
+		set: field(parseDuration, func(c *Config) *time.Duration { return &c.IdleTimeout })},
+	{name: "progress_timeout", value: DefaultProgressTimeout.String(), usage: "Time an upload or a download may go without a byte transferred",
+		set: field(parseDuration, func(c *Config) *time.Duration { return &c.ProgressTimeout })},
+	{name: "min_transfer_rate", value: "0", usage: "Minimal rate per second clients must upload and download at, e.g. 1K, not checked if zero",
+		set: field(parseSize, func(c *Config) *int64 { return &c.MinTransferRate })},
+
+	{name: "cluster_self", usage: "Base URL of this node in the cluster",
+		set: field(parseString, func(c *Config) *string { return &c.ClusterSelf })},
+	{name: "cluster_members", separator: ",", usage: "Comma-separated base URLs of all cluster members, cluster mode is disabled if empty",
+		set: field(parseList, func(c *Config) *[]string { return &c.ClusterMembers })},
+	{name: "cluster_redirect", value: "false", boolean: true, usage: "Redirect requests for files owned by other members instead of proxying them",
+		set: field(strconv.ParseBool, func(c *Config) *bool { return &c.ClusterRedirect })},
+
+	{name: "sync_peers", separator: ",", usage: "Comma-separated base URLs of the replicas to repair the storage with",
+		set: field(parseList, func(c *Config) *[]string { return &c.SyncPeers })},
+	{name: "sync_interval", value: "10m0s", usage: "Interval between anti-entropy repairs, disabled if zero",
+		set: field(parseDuration, func(c *Config) *time.Duration { return &c.SyncInterval })},
+
+	{name: "upstream_url", usage: "Base URL of the storage to fetch missing files from",
+		set: field(parseString, func(c *Config) *string { return &c.UpstreamURL })},
+	{name: "upstream_timeout", value: DefaultUpstreamTimeout.String(), usage: "Time a fetch of a missing file from the upstream may take",
+		set: field(parseDuration, func(c *Config) *time.Duration { return &c.UpstreamTimeout })},
+
+	{name: "compression", usage: "Compression of files at rest: zstd or gzip, uncompressed if empty",
+		set: field(parseString, func(c *Config) *string { return &c.Compression })},
+
+	{name: "encryption_key_file", usage: "File with the key-encryption keys in the id:base64key format, one per line",
+		set: field(parseString, func(c *Config) *string { return &c.EncryptionKeyFile })},
+	{name: "encryption_keys", separator: ",", secret: true, usage: "Comma-separated key-encryption keys in the id:base64key format",
+		set: field(parseString, func(c *Config) *string { return &c.EncryptionKeys })},
+	{name: "encryption_active_key", usage: "ID of the key to encrypt new files with",
+		set: field(parseString, func(c *Config) *string { return &c.EncryptionActiveKey })},
+
+	{name: "api_keys", reloadable: true, separator: ",", secret: true, usage: "Comma-separated API keys in the principal[@tenant]:key:scope|scope format",
+		set: field(parseAPIKeys, func(c *Config) *[]APIKey { return &c.APIKeys })},
+	{name: "jwks_file", reloadable: true, usage: "JSON Web Key Set to verify JWT bearer tokens with",
+		set: field(parseString, func(c *Config) *string { return &c.JWKSFile })},
+	{name: "jwt_issuer", reloadable: true, usage: "Required iss claim of JWT bearer tokens",
+		set: field(parseString, func(c *Config) *string { return &c.JWTIssuer })},
+	{name: "jwt_audience", reloadable: true, usage: "Required aud claim of JWT bearer tokens",
+		set: field(parseString, func(c *Config) *string { return &c.JWTAudience })},
+	{name: "peer_api_key", secret: true, usage: "API key sent to cluster members, sync peers and the upstream",
+		set: field(parseString, func(c *Config) *string { return &c.PeerAPIKey })},
+	{name: "anonymous_scopes", reloadable: true, separator: ",", usage: "Comma-separated scopes granted to requests without credentials",
+		set: field(parseList, func(c *Config) *[]string { return &c.AnonymousScopes })},
+	{name: "url_signing_key", secret: true, usage: "Secret of at least 32 bytes signing pre-signed URLs",
+		set: field(parseString, func(c *Config) *string { return &c.URLSigningKey })},
+
+	{name: "tenants", value: "false", boolean: true, usage: "Enable multi-tenant namespaces, requires authentication",
+		set: field(strconv.ParseBool, func(c *Config) *bool { return &c.Tenants })},
+	{name: "tenant_quota", reloadable: true, value: "0", usage: "Default quota of a tenant, e.g. 10G, not limited if zero",
+		set: field(parseSize, func(c *Config) *int64 { return &c.TenantQuota })},
+	{name: "tenant_quotas", reloadable: true, separator: ",", pair: ":", usage: "Comma-separated quotas of specific tenants in the tenant:size format",
+		set: field(parseTenantQuotas, func(c *Config) *map[string]int64 { return &c.TenantQuotas })},
+
+	{name: "rate_limit", reloadable: true, usage: `Default limit of every client, e.g. "rps=10 burst=20 upload=1M download=10M concurrent=4"`,
+		set: field(parseRateLimit, func(c *Config) *RateLimit { return &c.RateLimit })},
+	{name: "route_rate_limits", reloadable: true, separator: ";", pair: "|", usage: "Semicolon-separated limits of routes in the METHOD /path|limit format",
+		set: field(parseRateLimits, func(c *Config) *map[string]RateLimit { return &c.RouteRateLimits })},
+	{name: "principal_rate_limits", reloadable: true, separator: ";", pair: "|", usage: "Semicolon-separated limits of principals in the principal|limit format",
+		set: field(parseRateLimits, func(c *Config) *map[string]RateLimit { return &c.PrincipalRateLimits })},
+
+	{name: "trusted_proxies", separator: ",", usage: "Comma-separated addresses or CIDR ranges of the reverse proxies whose X-Forwarded-For identifies clients",
+		set: field(parseList, func(c *Config) *[]string { return &c.TrustedProxies })},
+
+	{name: "max_upload_size", value: "0", usage: "Maximal size of an uploaded file, e.g. 5G, not limited if zero",
+		set: field(parseSize, func(c *Config) *int64 { return &c.UploadPolicy.MaxUploadSize })},
+	{name: "allowed_content_types", separator: ",", usage: "Comma-separated content types that may be uploaded, e.g. image/*",
+		set: field(parseList, func(c *Config) *[]string { return &c.UploadPolicy.AllowedContentTypes })},
+	{name: "denied_content_types", separator: ",", usage: "Comma-separated content types that must not be uploaded",
+		set: field(parseList, func(c *Config) *[]string { return &c.UploadPolicy.DeniedContentTypes })},
+	{name: "allowed_extensions", separator: ",", usage: "Comma-separated file name extensions that may be uploaded, e.g. .jpg",
+		set: field(parseList, func(c *Config) *[]string { return &c.UploadPolicy.AllowedExtensions })},
+	{name: "denied_extensions", separator: ",", usage: "Comma-separated file name extensions that must not be uploaded",
+		set: field(parseList, func(c *Config) *[]string { return &c.UploadPolicy.DeniedExtensions })},
+
+	{name: "scanner", usage: "Antivirus engine scanning uploads: clamd://host:3310, clamd:///path/to/clamd.sock or icap://host:1344/service",
+		set: field(parseString, func(c *Config) *string { return &c.Scanner })},
+	{name: "scan_timeout", value: scanner.DefaultTimeout.String(), usage: "Time a scan may take",
+		set: field(parseDuration, func(c *Config) *time.Duration { return &c.ScanTimeout })},
+	{name: "hook_timeout", value: DefaultHookTimeout.String(), usage: "Time a pre-save hook may take",
+		set: field(parseDuration, func(c *Config) *time.Duration { return &c.HookTimeout })},
+
+	{name: "webhooks", reloadable: true, separator: ";", secret: true, usage: "Semicolon-separated webhooks in the url|secret|type,type format",
+		set: field(parseWebhooks, func(c *Config) *[]events.Webhook { return &c.Webhooks })},
+	{name: "webhook_max_attempts", value: strconv.Itoa(events.DefaultMaxAttempts), usage: "Number of attempts to deliver an event to a webhook",
+		set: field(parseCount, func(c *Config) *int { return &c.WebhookMaxAttempts })},
+	{name: "event_log_size", value: strconv.Itoa(events.DefaultLogSize), usage: "Number of the latest events kept for clients of GET /events resuming after a disconnect",
+		set: field(parseCount, func(c *Config) *int { return &c.EventLogSize })},
+}
+
+// envName returns the name of the environment variable of the setting.
+func (s *setting) envName() string {
+	return strings.ToUpper(s.name)
+}
+
+// flagName returns the name of the flag of the setting.
+func (s *setting) flagName() string {
+	return strings.ReplaceAll(s.name, "_", "-")
+}
+
+// settingValue is the value of a setting and where it comes from.
+type settingValue struct {
+	value string
+	// source is the layer the value comes from
+	source string
+	// origin names the origin of the value in errors, e.g. "environment variable PORT"
+	origin string
+}
+
+// ConfigLoader loads the configuration in layers: the defaults, the
+// configuration file, the environment variables and the command-line flags,
+// each overriding the previous ones.
+//
+// The configuration file is given by the --config flag or the CONFIG_FILE
+// environment variable. It is in YAML or TOML, chosen by its extension, and
+// holds the settings by their names, e.g. "max_upload_size: 5G". Lists and
+// maps may be given as such, e.g. "tenant_quotas: {team-a: 10G}".
+type ConfigLoader struct {
+	// Flags are the command-line flags, with a flag for every setting and
+	// --config. More flags may be added before Load is called.
+	Flags *flag.FlagSet
+	// LookupEnv looks up the environment variables. The variables are read from
+	// the process and the .env file if it is nil.
+	LookupEnv func(key string) (string, bool)
+
+	configFile string
+	// envFile is the .env file read if LookupEnv is nil
+	envFile string
+	// args are the arguments of the last Load, parsed again on a reload
+	args []string
+	// flagValues are the values of the settings given as flags, keyed by their names
+	flagValues map[string]settingValue
+	// values are the effective values of the settings, keyed by their names
+	values map[string]settingValue
+}
+
+// NewConfigLoader creates a configuration loader with the flags of the program of the name.
+func NewConfigLoader(name string) *ConfigLoader {
+	l := &ConfigLoader{
+		Flags:      flag.NewFlagSet(name, flag.ContinueOnError),
+		envFile:    ".env",
+		flagValues: make(map[string]settingValue),
+	}
+
+	l.Flags.StringVar(&l.configFile, "config", "", "YAML or TOML configuration file, overridden by environment variables and flags")
+	for i := range settings {
+		s := &settings[i]
+		set := func(value string) error {
+			l.flagValues[s.name] = settingValue{value: value, source: sourceFlag, origin: "flag --" + s.flagName()}
+			return nil
+		}
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.envName())
+		if s.boolean {
+			l.Flags.BoolFunc(s.flagName(), usage, set)
+		} else {
+			l.Flags.Func(s.flagName(), usage, set)
+		}
+	}
+
+	return l
+}
+
+// Load parses the flags from the arguments and loads the configuration.
+//
+// Parameters:
+// - args: the command-line arguments without the program name
+//
+// Returns:
+// - *Config: the validated configuration
+// - error: an error naming every invalid setting and where it comes from, or flag.ErrHelp if help was requested
+func (l *ConfigLoader) Load(args []string) (*Config, error) {
+	l.args = args
+	config, err := l.load(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// load loads the configuration without validating it. The configuration is
+// returned along with the errors unless the flags are invalid, the invalid
+// settings are left zero.
+func (l *ConfigLoader) load(args []string) (*Config, error) {
+	// Flags are parsed first, they tell where the configuration file is,
+	// and their values are applied last
+	if err := l.Flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	lookupEnv := l.LookupEnv
+	if lookupEnv == nil {
+		// The .env file is read again on every load rather than loaded into the
+		// process, so that its edits are applied by a reload. Variables of the
+		// process take precedence over it
+		dotenv, err := godotenv.Read(l.envFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("error loading %s file: %v", l.envFile, err))
+		}
+		lookupEnv = func(key string) (string, bool) {
+			if value, ok := os.LookupEnv(key); ok {
+				return value, true
+			}
+			value, ok := dotenv[key]
+			return value, ok
+		}
+	}
+
+	l.values = make(map[string]settingValue)
+	for _, s := range settings {
+		l.values[s.name] = settingValue{value: s.value, source: sourceDefault, origin: "default"}
+	}
+
+	configFile := l.configFile
+	if configFile == "" {
+		configFile, _ = lookupEnv("CONFIG_FILE")
+	}
+	if configFile != "" {
+		if err := l.readFile(configFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Empty variables are ignored, e.g. the ones copied from .env.example
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.envName()); ok && value != "" {
+			l.values[s.name] = settingValue{value: value, source: sourceEnv, origin: "environment variable " + s.envName()}
+		}
+	}
+
+	for name, value := range l.flagValues {
+		l.values[name] = value
+	}
+
+	config := &Config{}
+	for _, s := range settings {
+		value := l.values[s.name]
+		if err := s.set(config, strings.TrimSpace(value.value)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s from %s: %v", s.name, value.origin, err))
+		}
+	}
+
+	return config, errors.Join(errs...)
+}
+
+// Reload loads the configuration again from the same layers, e.g. after the
+// configuration file was edited, and applies the reloadable settings to the
+// current configuration.
+//
+// The loaded configuration must be valid as a whole, including the settings
+// that need a restart, so that the next restart doesn't fail on it.
+//
+// Parameters:
+// - current: the configuration in effect, it is not modified
+//
+// Returns:
+// - *Config: a copy of the current configuration with the reloadable settings loaded
+// - []string: the names of the changed settings that need a restart to be applied
+// - error: an error if the configuration is invalid, the effective values are kept then
+func (l *ConfigLoader) Reload(current *Config) (*Config, []string, error) {
+	previous := l.values
+	if _, err := l.Load(l.args); err != nil {
+		l.values = previous
+		return nil, nil, err
+	}
+
+	config := *current
+	var restart []string
+	var errs []error
+	for _, s := range settings {
+		value := l.values[s.name]
+		if value.value == previous[s.name].value {
+			continue
+		}
+		if !s.reloadable {
+			// Keep printing the value in effect
+			l.values[s.name] = previous[s.name]
+			restart = append(restart, s.name)
+			continue
+		}
+		if err := s.set(&config, strings.TrimSpace(value.value)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s from %s: %v", s.name, value.origin, err))
+		}
+	}
+
+	// The reloaded settings must be valid along with the ones in effect
+	if len(errs) == 0 {
+		errs = append(errs, config.Validate())
+	}
+	if err := errors.Join(errs...); err != nil {
+		l.values = previous
+		return nil, nil, err
+	}
+
+	return &config, restart, nil
+}
+
+// readFile reads the values of the settings from the configuration file.
+func (l *ConfigLoader) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+
+	values := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	var errs []error
+	for name, raw := range values {
+		i := slices.IndexFunc(settings, func(s setting) bool { return s.name == name })
+		if i < 0 {
+			errs = append(errs, fmt.Errorf("unknown setting %q in config file %s", name, path))
+			continue
+		}
+
+		value, err := settings[i].fileValue(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s in config file %s: %v", name, path, err))
+			continue
+		}
+		l.values[name] = settingValue{value: value, source: sourceFile, origin: "config file " + path}
+	}
+
+	return errors.Join(errs...)
+}
+
+// fileValue converts a value of the configuration file to the value of the
+// setting, joining the elements of lists and maps.
+func (s *setting) fileValue(raw any) (string, error) {
+	switch raw := raw.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		if s.separator == "" {
+			return "", fmt.Errorf("must be a single value, not a list")
+		}
+		elements := make([]string, len(raw))
+		for i, element := range raw {
+			value, err := scalarValue(element)
+			if err != nil {
+				return "", err
+			}
+			elements[i] = value
+		}
+		return strings.Join(elements, s.separator), nil
+	case map[string]any:
+		if s.pair == "" {
+			return "", fmt.Errorf("must not be a map")
+		}
+		var elements []string
+		for key, element := range raw {
+			value, err := scalarValue(element)
+			if err != nil {
+				return "", err
+			}
+			elements = append(elements, key+s.pair+value)
+		}
+		// Maps are unordered, keep the value stable for printing
+		slices.Sort(elements)
+		return strings.Join(elements, s.separator), nil
+	default:
+		return scalarValue(raw)
+	}
+}
+
+// scalarValue converts a scalar of the configuration file to a string.
+func scalarValue(raw any) (string, error) {
+	switch raw := raw.(type) {
+	case string:
+		return raw, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(raw), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", raw)
+	}
+}
+
+// PrintConfig writes the effective configuration loaded last in YAML, so that
+// it can be used as a configuration file. Every setting is commented with
+// the layer it comes from, and the values of secrets are redacted.
+func (l *ConfigLoader) PrintConfig(w io.Writer) error {
+	document := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range settings {
+		value, ok := l.values[s.name]
+		if !ok {
+			continue
+		}
+		if s.secret && value.value != "" {
+			value.value = redacted
+		}
+
+		document.Content = append(document.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: s.name},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: value.value, LineComment: value.source},
+		)
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(document); err != nil {
+		return fmt.Errorf("error printing config: %v", err)
+	}
+	return encoder.Close()
+}
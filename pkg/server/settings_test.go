@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newConfigLoader returns a loader reading the environment variables from the map.
+func newConfigLoader(env map[string]string) *ConfigLoader {
+	loader := NewConfigLoader("storage")
+	loader.Flags.SetOutput(new(bytes.Buffer))
+	loader.LookupEnv = func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+	return loader
+}
+
+// writeConfigFile writes the configuration file with the name to a temporary directory.
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigLayers(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+port: 9000
+storage_path: /var/lib/storage
+max_upload_size: 5G
+sync_interval: 1m
+cluster_members:
+  - http://10.0.0.1:8080
+  - http://10.0.0.2:8080
+cluster_self: http://10.0.0.1:8080
+tenant_quotas:
+  team-a: 10G
+route_rate_limits:
+  POST /file: rps=1 upload=1M
+log_level: warn
+`)
+
+	config, err := newConfigLoader(map[string]string{
+		"CONFIG_FILE": path,
+		"PORT":        "9001",
+		"LOG_LEVEL":   "error",
+		// Empty variables don't override anything
+		"MAX_UPLOAD_SIZE": "",
+	}).Load([]string{"--port", "9002", "--h2c"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Defaults
+	assert.Equal(t, "localhost", config.Host)
+	assert.Equal(t, DefaultProgressTimeout, config.ProgressTimeout)
+	// The file
+	assert.Equal(t, "/var/lib/storage", config.StoragePath)
+	assert.Equal(t, int64(5<<30), config.UploadPolicy.MaxUploadSize)
+	assert.Equal(t, time.Minute, config.SyncInterval)
+	assert.Equal(t, []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}, config.ClusterMembers)
+	assert.Equal(t, map[string]int64{"team-a": 10 << 30}, config.TenantQuotas)
+	assert.Equal(t, map[string]RateLimit{"POST /file": {RequestsPerSecond: 1, UploadBytesPerSecond: 1 << 20}}, config.RouteRateLimits)
+	// The environment
+	assert.Equal(t, "error", config.LogLevel)
+	// The flags
+	assert.Equal(t, 9002, config.Port)
+	assert.True(t, config.H2C)
+}
+
+func TestConfigFileTOML(t *testing.T) {
+	path := writeConfigFile(t, "config.toml", `
+storage_path = "/var/lib/storage"
+port = 9000
+tenants = true
+anonymous_scopes = ["files:read"]
+
+[tenant_quotas]
+team-a = "10G"
+`)
+
+	config, err := newConfigLoader(nil).Load([]string{"--config", path})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 9000, config.Port)
+	assert.True(t, config.Tenants)
+	assert.Equal(t, []string{ScopeFilesRead}, config.AnonymousScopes)
+	assert.Equal(t, map[string]int64{"team-a": 10 << 30}, config.TenantQuotas)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, test := range []struct {
+		file string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{env: map[string]string{"PORT": "http"}, err: "invalid port from environment variable PORT"},
+		{args: []string{"--sync-interval", "-1m"}, err: "invalid sync_interval from flag --sync-interval"},
+		{args: []string{"--unknown"}, err: "flag provided but not defined: -unknown"},
+		{file: "port: 8080\nprot: 8081\n", err: `unknown setting "prot"`},
+		{file: "host: [a, b]\n", err: "invalid host in config file"},
+		{file: "max_upload_size: 5X\n", err: "invalid max_upload_size from config file"},
+		{env: map[string]string{}, err: "storage_path is required"},
+		{args: []string{"--log-format", "xml"}, err: "invalid log_format"},
+		{args: []string{"--tls-cert-file", "cert.pem"}, err: "tls_cert_file and tls_key_file must be set together"},
+		{args: []string{"--http3"}, err: "HTTP/3 requires TLS"},
+		{args: []string{"--trusted-proxies", "10.0.0.0/33"}, err: "invalid trusted_proxies"},
+		{args: []string{"--cluster-members", "http://10.0.0.1:8080"}, err: "cluster_self is required"},
+	} {
+		loader := newConfigLoader(test.env)
+		args := test.args
+		if test.file != "" {
+			args = append(args, "--config", writeConfigFile(t, "config.yaml", "storage_path: /data\n"+test.file))
+		} else if test.err != "storage_path is required" {
+			args = append(args, "--storage-path", "/data")
+		}
+
+		_, err := loader.Load(args)
+		if assert.Error(t, err, test.err) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	loader := newConfigLoader(map[string]string{
+		"STORAGE_PATH": "/var/lib/storage",
+		"API_KEYS":     "ci:secret-key:files:read",
+	})
+	config, err := loader.Load([]string{"--port", "9000", "--tenant-quotas", "team-a:10G"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var output bytes.Buffer
+	assert.NoError(t, loader.PrintConfig(&output))
+	assert.Contains(t, output.String(), "port: 9000 # flag\n")
+	assert.Contains(t, output.String(), "storage_path: /var/lib/storage # env\n")
+	assert.Contains(t, output.String(), "host: localhost # default\n")
+	assert.Contains(t, output.String(), "api_keys: <redacted> # env\n")
+	assert.NotContains(t, output.String(), "secret-key")
+
+	// The printed configuration loads back the same, secrets aside
+	path := writeConfigFile(t, "config.yml", output.String())
+	reloaded, err := newConfigLoader(map[string]string{"API_KEYS": "ci:secret-key:files:read"}).Load([]string{"--config", path})
+	if assert.NoError(t, err) {
+		assert.Equal(t, config, reloaded)
+	}
+}
+
+func TestReloadReadsDotEnv(t *testing.T) {
+	loader := NewConfigLoader("storage")
+	loader.envFile = writeConfigFile(t, ".env", "TENANT_QUOTA=1K\nLOG_LEVEL=warn\n")
+	config, err := loader.Load([]string{"--storage-path", t.TempDir()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(1<<10), config.TenantQuota)
+
+	// Edits of the .env file are applied by a reload
+	if err := os.WriteFile(loader.envFile, []byte("TENANT_QUOTA=2K\nLOG_LEVEL=warn\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, restart, err := loader.Reload(config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2<<10), reloaded.TenantQuota)
+		assert.Empty(t, restart)
+	}
+	_, ok := os.LookupEnv("TENANT_QUOTA")
+	assert.False(t, ok)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultDrainTimeout is the time the requests in flight are given to complete
+// on shutdown unless configured otherwise.
+const DefaultDrainTimeout = 30 * time.Second
+
+const (
+	// closeGracePeriod is the time the handlers of the connections closed after
+	// the drain timeout are given to return and remove their temporary files
+	closeGracePeriod = 5 * time.Second
+
+	// flushTimeout is the time the remaining spans are given to be exported on shutdown
+	flushTimeout = 5 * time.Second
+)
+
+// drainTimeout returns the time the requests in flight are given to complete on shutdown.
+func (s *HTTPFileStorageServer) drainTimeout() time.Duration {
+	if s.config.DrainTimeout > 0 {
+		return s.config.DrainTimeout
+	}
+	return DefaultDrainTimeout
+}
+
+// trackRequests is a middleware counting the requests in flight, so that the
+// shutdown can wait for their handlers to return.
+func (s *HTTPFileStorageServer) trackRequests(c *gin.Context) {
+	s.activeRequests.Add(1)
+	defer s.activeRequests.Add(-1)
+	c.Next()
+}
+
+// rejectWhileDraining is a middleware rejecting new uploads with 503 once the
+// shutdown started, so that clients retry them on another node instead of
+// being cut off by the drain timeout.
+func (s *HTTPFileStorageServer) rejectWhileDraining(c *gin.Context) {
+	if s.shuttingDown.Load() {
+		c.Header("Connection", "close")
+		c.AbortWithStatusJSON(503, gin.H{"msg": "server is shutting down"})
+		return
+	}
+	c.Next()
+}
+
+// waitRequests waits until no request is in flight.
+//
+// Returns false if requests are still in flight when the context is done.
+func (s *HTTPFileStorageServer) waitRequests(ctx context.Context) bool {
+	for s.activeRequests.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// Shutdown gracefully shuts down the server started by StartServer.
+//
+// The readiness probe fails and new uploads are rejected at once. After
+// ShutdownDelay the listener is closed and the requests in flight, including
+// long transfers, are given until the context is done to complete. The
+// connections still open then are closed, and their handlers are given a short
+// grace period to return and remove their temporary files. StartServer returns
+// once the shutdown is complete.
+//
+// Parameters:
+// - ctx: the context limiting the delay and the drain
+//
+// Returns:
+// - error: an error if the server is not started or the requests in flight didn't complete in time
+func (s *HTTPFileStorageServer) Shutdown(ctx context.Context) error {
+	s.mux.Lock()
+	httpServer := s.httpServer
+	s.mux.Unlock()
+	if httpServer == nil {
+		return fmt.Errorf("server is not started")
+	}
+
+	if !s.shuttingDown.CompareAndSwap(false, true) {
+		// The server is already shutting down, wait for it
+		select {
+		case <-s.stopped:
+			return s.shutdownErr
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer close(s.stopped)
+
+	// Keep serving until load balancers notice the failing readiness probe
+	if s.config.ShutdownDelay > 0 {
+		select {
+		case <-time.After(s.config.ShutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	// End the event streams, they never become idle
+	close(s.draining)
+
+	s.logger.Info("draining requests", "active", s.activeRequests.Load())
+	// HTTP/3 clients are told to go away at once and their connections are
+	// closed once the requests in flight completed
+	http3Ctx, stopHTTP3 := context.WithCancel(ctx)
+	http3Done := make(chan struct{})
+	go func() {
+		defer close(http3Done)
+		s.shutdownHTTP3(http3Ctx)
+	}()
+
+	err := httpServer.Shutdown(ctx)
+	// Connections of h2c are hijacked from the server, which doesn't wait for them
+	if err == nil && !s.waitRequests(ctx) {
+		err = ctx.Err()
+	}
+	stopHTTP3()
+	<-http3Done
+	if err != nil {
+		s.logger.Warn("requests didn't complete in time, closing their connections", "active", s.activeRequests.Load(), "error", err)
+		httpServer.Close()
+		s.shutdownErr = fmt.Errorf("error draining requests: %v", err)
+	}
+
+	// Handlers of closed connections fail and clean up after themselves
+	graceCtx, cancel := context.WithTimeout(context.Background(), closeGracePeriod)
+	defer cancel()
+	if !s.waitRequests(graceCtx) {
+		s.logger.Warn("requests still in flight after shutdown", "active", s.activeRequests.Load())
+	}
+
+	s.stopBackground()
+
+	s.logger.Info("server exiting")
+	return s.shutdownErr
+}
+
+// stopBackground stops the background jobs, waits for the ones started by
+// requests and exports the remaining spans.
+func (s *HTTPFileStorageServer) stopBackground() {
+	s.cancelBackground()
+	s.jobs.Wait()
+
+	if s.tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+		defer cancel()
+		if err := s.tracerProvider.Shutdown(ctx); err != nil {
+			s.logger.Error("error shutting down tracing", "error", err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startServer starts the server on a free loopback port and returns its base
+// URL and the channel receiving the result of StartServer.
+func startServer(t *testing.T, config *Config) (*HTTPFileStorageServer, string, <-chan error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	config.Host = "127.0.0.1"
+	config.Port = port
+	server, _ := newTestServer(t, config)
+	captureLogs(t, server)
+
+	result := make(chan error, 1)
+	go func() { result <- server.StartServer() }()
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	if config.IsTLSEnabled() {
+		return server, "https://" + address, result
+	}
+	return server, "http://" + address, result
+}
+
+// startSlowUpload starts an upload with the client whose content is written to
+// the returned pipe, and returns the channel receiving its response.
+func startSlowUpload(t *testing.T, client *http.Client, url string) (*io.PipeWriter, *multipart.Writer, <-chan *http.Response) {
+	t.Helper()
+
+	body, pipe := io.Pipe()
+	multipartWriter := multipart.NewWriter(pipe)
+
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := client.Do(req)
+		if err != nil {
+			responses <- nil
+			return
+		}
+		resp.Body.Close()
+		responses <- resp
+	}()
+
+	part, err := multipartWriter.CreateFormFile("file", "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("first half of the upload, "))
+
+	return pipe, multipartWriter, responses
+}
+
+func TestShutdownDrainsUploads(t *testing.T) {
+	// Temporary files of uploads and downloads are created in TMPDIR
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	server, baseURL, result := startServer(t, &Config{ShutdownDelay: 300 * time.Millisecond})
+
+	pipe, multipartWriter, responses := startSlowUpload(t, http.DefaultClient, baseURL+"/file")
+	assert.Eventually(t, func() bool { return server.activeRequests.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- server.Shutdown(context.Background()) }()
+
+	// The node is not ready and rejects new uploads while it drains
+	assert.Eventually(t, func() bool { return server.shuttingDown.Load() }, time.Second, 10*time.Millisecond)
+	resp, err := http.Get(baseURL + "/readyz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 503, resp.StatusCode)
+	}
+	resp, err = http.DefaultClient.Do(newUploadRequest(t, baseURL+"/file", []byte("new upload")))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 503, resp.StatusCode)
+	}
+
+	// The upload in flight completes
+	time.Sleep(500 * time.Millisecond)
+	pipe.Write([]byte("second half"))
+	multipartWriter.Close()
+	pipe.Close()
+	if resp := <-responses; assert.NotNil(t, resp) {
+		assert.Equal(t, 201, resp.StatusCode)
+	}
+
+	assert.NoError(t, <-shutdownErr)
+	assert.NoError(t, <-result)
+
+	entries, err := os.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestShutdownClosesConnectionsAfterDrainTimeout(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	server, baseURL, result := startServer(t, &Config{})
+
+	pipe, _, responses := startSlowUpload(t, http.DefaultClient, baseURL+"/file")
+	assert.Eventually(t, func() bool { return server.activeRequests.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// The upload never completes
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Error(t, server.Shutdown(ctx))
+	assert.Error(t, <-result)
+
+	// The client sees the closed connection once it stops writing
+	pipe.Close()
+	assert.Nil(t, <-responses)
+
+	// The interrupted upload removed its temporary file
+	assert.Equal(t, int64(0), server.activeRequests.Load())
+	entries, err := os.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestShutdownEndsEventStreams(t *testing.T) {
+	server, baseURL, result := startServer(t, &Config{})
+
+	resp, err := http.Get(baseURL + "/events")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.NoError(t, <-result)
+
+	// The stream ended instead of holding the shutdown until the timeout
+	_, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+}
+
+func TestStartServerReturnsListenErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	server, _ := newTestServer(t, &Config{Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port})
+	captureLogs(t, server)
+
+	assert.Error(t, server.StartServer())
+	assert.Error(t, server.Shutdown(context.Background()))
+}
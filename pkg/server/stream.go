@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/events"
+)
+
+const (
+	// streamBufferSize is the number of events buffered for a slow client
+	// before it is disconnected. It can resume from the event log then.
+	streamBufferSize = 256
+
+	// streamPingInterval is the interval of the comments keeping idle streams open.
+	streamPingInterval = 15 * time.Second
+
+	// streamEventMissed is the type of the event telling a resuming client
+	// that some events are no longer in the log
+	streamEventMissed = "events.missed"
+)
+
+// eventFilter selects the events sent to a client.
+type eventFilter struct {
+	// types are the types of the events, all if empty
+	types []string
+	// tenant is the tenant of the events, all if empty
+	tenant string
+}
+
+// matches reports whether the event passes the filter.
+func (f *eventFilter) matches(event events.Event) bool {
+	return (len(f.types) == 0 || slices.Contains(f.types, event.Type)) &&
+		(f.tenant == "" || f.tenant == event.Tenant)
+}
+
+// eventsHandler handles the HTTP GET request streaming the storage events as
+// Server-Sent Events.
+//
+// The "types" query parameter filters the comma-separated event types and the
+// "tenant" parameter the tenant. Principals of a tenant only get its events.
+// Clients resume after the event in the Last-Event-ID header or the
+// "last_event_id" query parameter, as far as the event log reaches back.
+func (s *HTTPFileStorageServer) eventsHandler(c *gin.Context) {
+	filter := &eventFilter{types: splitList(c.Query("types")), tenant: c.Query("tenant")}
+	for _, eventType := range filter.types {
+		if !slices.Contains(events.Types, eventType) {
+			c.AbortWithStatusJSON(400, gin.H{"msg": fmt.Sprintf("unknown event type %q", eventType)})
+			return
+		}
+	}
+	if tenant := c.GetString(tenantKey); tenant != "" {
+		if filter.tenant != "" && filter.tenant != tenant {
+			c.AbortWithStatusJSON(403, gin.H{"msg": fmt.Sprintf("access to tenant %q is denied", filter.tenant)})
+			return
+		}
+		filter.tenant = tenant
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+
+	// Subscribe before reading the log, so that no event is lost in between
+	live := make(chan events.Event, streamBufferSize)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+	unsubscribe := s.events.Subscribe(func(event events.Event) {
+		if !filter.matches(event) {
+			return
+		}
+		select {
+		case live <- event:
+		default:
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	defer unsubscribe()
+
+	var replay []events.Event
+	var lastSent uint64
+	complete := true
+	if lastEventID != "" {
+		var err error
+		if replay, complete, err = s.eventLog.Since(lastEventID); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"msg": err.Error()})
+			return
+		}
+		lastSent, _ = events.ParseID(lastEventID)
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.Flush()
+
+	send := func(event events.Event) {
+		id, _ := events.ParseID(event.ID)
+		if id <= lastSent {
+			// Already sent from the log
+			return
+		}
+		lastSent = id
+
+		c.Render(-1, sse.Event{Id: event.ID, Event: event.Type, Data: event})
+		c.Writer.Flush()
+	}
+
+	if !complete {
+		// Tell the client to resynchronize, events were dropped from the log
+		c.Render(-1, sse.Event{Event: streamEventMissed, Data: gin.H{"msg": "events after the last event ID were dropped from the log"}})
+	}
+	for _, event := range replay {
+		if filter.matches(event) {
+			send(event)
+		}
+	}
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-s.draining:
+			// The server is shutting down, the client resumes on another node
+			return
+		case <-overflow:
+			// The client can't keep up, it resumes from the log after reconnecting
+			return
+		case event := <-live:
+			send(event)
+		case <-ping.C:
+			c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pavlov061356/http_based_file_storage/pkg/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// streamEvents opens the event stream and returns a channel of its events.
+func streamEvents(t *testing.T, url string, lastEventID string) <-chan events.Event {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	assert.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	t.Cleanup(func() { resp.Body.Close() })
+
+	stream := make(chan events.Event, 10)
+	go func() {
+		defer close(stream)
+
+		scanner := bufio.NewScanner(resp.Body)
+		var id string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if value, ok := strings.CutPrefix(line, "id:"); ok {
+				id = value
+			} else if value, ok := strings.CutPrefix(line, "data:"); ok {
+				var event events.Event
+				if json.Unmarshal([]byte(value), &event) == nil && event.ID == id {
+					stream <- event
+				}
+			}
+		}
+	}()
+
+	return stream
+}
+
+// nextEvent waits for the next event of the stream.
+func nextEvent(t *testing.T, stream <-chan events.Event) events.Event {
+	t.Helper()
+
+	select {
+	case event := <-stream:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event was streamed")
+		return events.Event{}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	ts := httptest.NewServer(server.setupRouter())
+	t.Cleanup(ts.Close)
+
+	stream := streamEvents(t, ts.URL+"/events?types=blob.created,blob.deleted", "")
+
+	content := []byte("streamed content")
+	hash := contentHash(content)
+	for _, req := range []*http.Request{
+		newUploadRequest(t, ts.URL+"/file", content),
+		httptest.NewRequest("GET", ts.URL+"/file/"+hash, nil),
+		httptest.NewRequest("DELETE", ts.URL+"/file/"+hash, nil),
+	} {
+		req.RequestURI = ""
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// The access is filtered out
+	created := nextEvent(t, stream)
+	assert.Equal(t, events.BlobCreated, created.Type)
+	assert.Equal(t, hash, created.Hash)
+	assert.Equal(t, int64(len(content)), created.Size)
+
+	deleted := nextEvent(t, stream)
+	assert.Equal(t, events.BlobDeleted, deleted.Type)
+}
+
+func TestEventStreamResumesFromLastEventID(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	ts := httptest.NewServer(server.setupRouter())
+	t.Cleanup(ts.Close)
+
+	first := server.events.Publish(events.Event{Type: events.BlobCreated, Hash: "first"})
+	second := server.events.Publish(events.Event{Type: events.BlobCreated, Hash: "second"})
+
+	// Events after the last one seen are replayed from the log before live ones
+	stream := streamEvents(t, ts.URL+"/events", first.ID)
+	assert.Equal(t, second.ID, nextEvent(t, stream).ID)
+
+	third := server.events.Publish(events.Event{Type: events.BlobDeleted, Hash: "first"})
+	assert.Equal(t, third.ID, nextEvent(t, stream).ID)
+}
+
+func TestEventStreamValidation(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	r := server.setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/events?types=blob.renamed", nil))
+	assert.Equal(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/events", nil)
+	req.Header.Set("Last-Event-ID", "not-an-id")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/cluster"
+)
+
+// shardsHandler handles the HTTP GET request for the shard summary of the storage.
+// It returns the digest of every non-empty shard and the root digest over them.
+func (s *HTTPFileStorageServer) shardsHandler(c *gin.Context) {
+	digests, err := s.tracedStorage(c.Request.Context()).ShardDigests()
+	if err != nil {
+		c.AbortWithStatusJSON(500, gin.H{"msg": err.Error()})
+		return
+	}
+
+	c.JSON(200, cluster.Summarize(digests))
+}
+
+// shardHandler handles the HTTP GET request for the hashes of the files in a shard.
+// It returns error 400 Bad Request if the shard name is invalid.
+func (s *HTTPFileStorageServer) shardHandler(c *gin.Context) {
+	hashes, err := s.tracedStorage(c.Request.Context()).ListShard(c.Param("shard"))
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"msg": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"hashes": hashes})
+}
+
+// repairHandler handles the HTTP POST request to repair the storage with all
+// configured sync peers. It returns the result of the repair for every peer.
+func (s *HTTPFileStorageServer) repairHandler(c *gin.Context) {
+	results := gin.H{}
+	status := 200
+
+	for _, peer := range s.config.SyncPeers {
+		result, err := s.Repair(c.Request.Context(), peer)
+		if err != nil {
+			status = 500
+			results[peer] = gin.H{"pulled": result.Pulled, "pushed": result.Pushed, "msg": err.Error()}
+			continue
+		}
+		results[peer] = result
+	}
+
+	c.JSON(status, results)
+}
+
+// Repair compares the storage with the given peer using shard digests and
+// copies the files missing on either side.
+//
+// Parameters:
+// - ctx: the context controlling the repair
+// - peer: the base URL of the peer
+//
+// Returns:
+// - cluster.RepairResult: the number of pulled and pushed files
+// - error: any error that occurred during the repair
+func (s *HTTPFileStorageServer) Repair(ctx context.Context, peer string) (cluster.RepairResult, error) {
+	return cluster.Repair(ctx, s.tracedStorage(ctx), s.clusterClient, peer)
+}
+
+// runRepairLoop periodically repairs the storage with all configured sync
+// peers until the context is cancelled.
+//
+// Parameters:
+// - ctx: the context stopping the loop
+func (s *HTTPFileStorageServer) runRepairLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.config.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, peer := range s.config.SyncPeers {
+			result, err := s.Repair(ctx, peer)
+			if err != nil {
+				s.logger.Error("error repairing storage", "peer", peer, "error", err)
+				continue
+			}
+			if result.Pulled > 0 || result.Pushed > 0 {
+				s.logger.Info("storage repaired", "peer", peer, "pulled", result.Pulled, "pushed", result.Pushed)
+			}
+		}
+	}
+}
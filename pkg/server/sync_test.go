@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// saveToStorage puts the content directly into the storage, bypassing the server.
+func saveToStorage(t *testing.T, storer storage.Storer, content []byte) string {
+	t.Helper()
+
+	tmpFile, err := os.CreateTemp("", "content")
+	assert.NoError(t, err)
+	_, err = tmpFile.Write(content)
+	assert.NoError(t, err)
+	tmpFile.Close()
+
+	hash := contentHash(content)
+	assert.NoError(t, storer.SaveFileFromTemp(hash, tmpFile.Name()))
+
+	return hash
+}
+
+func TestRepairCopiesMissingFilesBothWays(t *testing.T) {
+	local, localStorer := newTestServer(t, nil)
+	peer, peerStorer := newTestServer(t, nil)
+
+	peerHTTP := httptest.NewServer(peer.setupRouter())
+	defer peerHTTP.Close()
+
+	shared := saveToStorage(t, localStorer, []byte("shared"))
+	saveToStorage(t, peerStorer, []byte("shared"))
+	onlyLocal := saveToStorage(t, localStorer, []byte("only local"))
+	onlyPeer := saveToStorage(t, peerStorer, []byte("only peer"))
+
+	result, err := local.Repair(context.Background(), peerHTTP.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Pulled)
+	assert.Equal(t, 1, result.Pushed)
+
+	for _, hash := range []string{shared, onlyLocal, onlyPeer} {
+		exists, err := localStorer.Exists(hash)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		exists, err = peerStorer.Exists(hash)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	}
+
+	// Replicas are in sync now, nothing is copied
+	result, err = local.Repair(context.Background(), peerHTTP.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Pulled)
+	assert.Equal(t, 0, result.Pushed)
+}
+
+func TestShardsEndpoints(t *testing.T) {
+	server, storer := newTestServer(t, nil)
+	r := server.setupRouter()
+
+	hash := saveToStorage(t, storer, []byte("content"))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/sync/shards", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"root"`)
+	assert.Contains(t, w.Body.String(), `"`+hash[:2]+`"`)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/sync/shards/"+hash[:2], nil))
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"hashes":["`+hash+`"]}`, w.Body.String())
+}
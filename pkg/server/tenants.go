@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+)
+
+// tenantKey is the key of the tenant a request acts on in the gin context.
+const tenantKey = "tenant"
+
+// resolveTenant is a middleware for the file routes that determines the tenant
+// the request acts on, either from the /t/:tenant path or from the principal.
+//
+// Principals belonging to a tenant may only access their own tenant. Principals
+// without a tenant need the admin scope and act on the shared store directly
+// unless they name a tenant in the path. It is a no-op if tenants are disabled.
+func (s *HTTPFileStorageServer) resolveTenant(c *gin.Context) {
+	if s.tenants == nil {
+		c.Next()
+		return
+	}
+
+	tenant := c.Param("tenant")
+	if tenant != "" {
+		if err := storage.ValidateTenant(tenant); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"msg": err.Error()})
+			return
+		}
+	}
+
+	if principal, ok := PrincipalFromContext(c); ok {
+		switch {
+		case principal.Tenant == "" && principal.AuthMethod != AuthMethodSignedURL && !principal.HasScope(ScopeAdmin):
+			c.AbortWithStatusJSON(403, gin.H{"msg": "principal doesn't belong to a tenant"})
+			return
+		case tenant == "":
+			tenant = principal.Tenant
+		case principal.Tenant != "" && principal.Tenant != tenant:
+			c.AbortWithStatusJSON(403, gin.H{"msg": fmt.Sprintf("access to tenant %q is denied", tenant)})
+			return
+		}
+	}
+
+	c.Set(tenantKey, tenant)
+	c.Next()
+}
+
+// tenantFilePath returns the path of the file routes of the tenant.
+func tenantFilePath(tenant string) string {
+	if tenant == "" {
+		return "/file"
+	}
+	return "/t/" + url.PathEscape(tenant) + "/file"
+}
+
+// addTenantRef references an uploaded file from the tenant with the metadata
+// of its upload, writing the error response if it can't be added.
+//
+// Returns whether the file is new to the tenant and false if the request was aborted
+func (s *HTTPFileStorageServer) addTenantRef(c *gin.Context, tenant string, upload *upload, metadata map[string]string) (bool, bool) {
+	file := storage.TenantFile{
+		Hash:        upload.hash,
+		Name:        upload.name,
+		Size:        upload.size,
+		ContentType: upload.contentType,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if len(metadata) > 0 {
+		file.Metadata = metadata
+	}
+	added, err := s.tenants.AddRef(tenant, file, s.liveConfig().QuotaOf(tenant))
+
+	if errors.Is(err, storage.ErrQuotaExceeded) {
+		c.AbortWithStatusJSON(507, gin.H{"msg": err.Error()})
+		return false, false
+	} else if err != nil {
+		c.AbortWithError(500, fmt.Errorf("error adding file to tenant: %v", err))
+		return false, false
+	}
+
+	return added, true
+}
+
+// listTenantFilesHandler returns the files of the tenant with its usage and quota.
+func (s *HTTPFileStorageServer) listTenantFilesHandler(c *gin.Context) {
+	tenant := c.GetString(tenantKey)
+	if tenant == "" {
+		c.AbortWithStatusJSON(400, gin.H{"msg": "tenant is required"})
+		return
+	}
+
+	files, err := s.tenants.List(tenant)
+	if err != nil {
+		c.AbortWithError(500, fmt.Errorf("error listing files: %v", err))
+		return
+	}
+
+	usage, err := s.tenants.Usage(tenant)
+	if err != nil {
+		c.AbortWithError(500, fmt.Errorf("error computing usage: %v", err))
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"tenant": tenant,
+		"usage":  usage,
+		"quota":  s.liveConfig().QuotaOf(tenant),
+		"files":  files,
+	})
+}
+
+// tenantFileHandler returns the metadata of a file of the tenant.
+func (s *HTTPFileStorageServer) tenantFileHandler(c *gin.Context) {
+	tenant := c.GetString(tenantKey)
+	if tenant == "" {
+		c.AbortWithStatusJSON(400, gin.H{"msg": "tenant is required"})
+		return
+	}
+
+	file, err := s.tenants.Get(tenant, c.Param("hash"))
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(404, gin.H{"msg": "file not found"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"msg": err.Error()})
+		return
+	}
+
+	c.JSON(200, file)
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTenantTestRouter creates a router with two tenants and an admin.
+func newTenantTestRouter(t *testing.T) (*gin.Engine, *HTTPFileStorageServer) {
+	t.Helper()
+
+	allFileScopes := []string{ScopeFilesRead, ScopeFilesWrite, ScopeFilesDelete}
+	server, _ := newTestServer(t, &Config{
+		APIKeys: []APIKey{
+			{Principal: "alice", Tenant: "team-a", Key: "alice-secret", Scopes: allFileScopes},
+			{Principal: "bob", Tenant: "team-b", Key: "bob-secret", Scopes: allFileScopes},
+			{Principal: "ops", Key: "ops-secret", Scopes: append(allFileScopes, ScopeAdmin)},
+			{Principal: "ci", Key: "ci-secret", Scopes: allFileScopes},
+		},
+		Tenants:      true,
+		TenantQuotas: map[string]int64{"team-b": 10},
+	})
+
+	return server.setupRouter(), server
+}
+
+// serveAs performs a request with the API key.
+func serveAs(r *gin.Engine, apiKey string, method string, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set(APIKeyHeader, apiKey)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// uploadAs uploads the content with the API key.
+func uploadAs(t *testing.T, r *gin.Engine, apiKey string, path string, content []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := newUploadRequest(t, path, content)
+	req.Header.Set(APIKeyHeader, apiKey)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestTenantIsolation(t *testing.T) {
+	r, server := newTenantTestRouter(t)
+
+	shared := []byte("shared")
+	private := []byte("private to team-a")
+	sharedHash := contentHash(shared)
+	privateHash := contentHash(private)
+
+	assert.Equal(t, 201, uploadAs(t, r, "alice-secret", "/file", shared).Code)
+	assert.Equal(t, 201, uploadAs(t, r, "alice-secret", "/t/team-a/file", private).Code)
+	assert.Equal(t, 200, uploadAs(t, r, "alice-secret", "/file", private).Code)
+
+	// The second tenant gets 201 for content already in the store
+	assert.Equal(t, 201, uploadAs(t, r, "bob-secret", "/file", shared).Code)
+	hashes, err := server.storer.List()
+	assert.NoError(t, err)
+	assert.Len(t, hashes, 2, "content must be deduplicated across tenants")
+
+	// Tenants only see their own files
+	assert.Equal(t, 200, serveAs(r, "bob-secret", "GET", "/file/"+sharedHash).Code)
+	assert.Equal(t, 404, serveAs(r, "bob-secret", "GET", "/file/"+privateHash).Code)
+	assert.Equal(t, 403, serveAs(r, "bob-secret", "GET", "/t/team-a/file/"+privateHash).Code)
+	assert.Equal(t, 403, serveAs(r, "bob-secret", "GET", "/t/team-a/files").Code)
+	assert.Equal(t, 404, serveAs(r, "bob-secret", "GET", "/files/"+privateHash).Code)
+
+	w := serveAs(r, "bob-secret", "GET", "/files")
+	assert.Equal(t, 200, w.Code)
+	var listing struct {
+		Tenant string `json:"tenant"`
+		Usage  int64  `json:"usage"`
+		Files  []struct {
+			Hash string `json:"hash"`
+			Name string `json:"name"`
+		} `json:"files"`
+	}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&listing))
+	assert.Equal(t, "team-b", listing.Tenant)
+	assert.Equal(t, int64(len(shared)), listing.Usage)
+	assert.Len(t, listing.Files, 1)
+	assert.Equal(t, sharedHash, listing.Files[0].Hash)
+	assert.Equal(t, "test", listing.Files[0].Name)
+
+	// Tenants can't delete each other's files
+	assert.Equal(t, 403, serveAs(r, "bob-secret", "DELETE", "/t/team-a/file/"+privateHash).Code)
+	assert.Equal(t, 200, serveAs(r, "bob-secret", "DELETE", "/file/"+privateHash).Code)
+	assert.Equal(t, 200, serveAs(r, "alice-secret", "GET", "/file/"+privateHash).Code)
+
+	// Shared content is kept until the last tenant deletes it
+	assert.Equal(t, 200, serveAs(r, "alice-secret", "DELETE", "/file/"+sharedHash).Code)
+	assert.Equal(t, 404, serveAs(r, "alice-secret", "GET", "/file/"+sharedHash).Code)
+	assert.Equal(t, 200, serveAs(r, "bob-secret", "GET", "/file/"+sharedHash).Code)
+
+	assert.Equal(t, 200, serveAs(r, "bob-secret", "DELETE", "/file/"+sharedHash).Code)
+	exists, err := server.storer.Exists(sharedHash)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestTenantAccessOfPrincipalsWithoutTenant(t *testing.T) {
+	r, server := newTenantTestRouter(t)
+
+	content := []byte("team-a file")
+	hash := contentHash(content)
+	assert.Equal(t, 201, uploadAs(t, r, "alice-secret", "/file", content).Code)
+
+	// Principals without a tenant need the admin scope
+	assert.Equal(t, 403, serveAs(r, "ci-secret", "GET", "/t/team-a/file/"+hash).Code)
+	assert.Equal(t, 403, uploadAs(t, r, "ci-secret", "/file", []byte("untracked")).Code)
+
+	// Admins access any tenant and the shared store
+	assert.Equal(t, 200, serveAs(r, "ops-secret", "GET", "/t/team-a/file/"+hash).Code)
+	assert.Equal(t, 200, serveAs(r, "ops-secret", "GET", "/t/team-a/files/"+hash).Code)
+	assert.Equal(t, 400, serveAs(r, "ops-secret", "GET", "/files").Code)
+
+	// Deleting from the shared store removes the file from all tenants
+	assert.Equal(t, 200, serveAs(r, "ops-secret", "DELETE", "/file/"+hash).Code)
+	assert.Equal(t, 404, serveAs(r, "alice-secret", "GET", "/files/"+hash).Code)
+
+	usage, err := server.tenants.Usage("team-a")
+	assert.NoError(t, err)
+	assert.Zero(t, usage)
+}
+
+func TestTenantQuota(t *testing.T) {
+	r, _ := newTenantTestRouter(t)
+
+	assert.Equal(t, 201, uploadAs(t, r, "bob-secret", "/file", []byte("8 bytes!")).Code)
+	assert.Equal(t, 507, uploadAs(t, r, "bob-secret", "/file", []byte("too much")).Code)
+
+	// The quota of another tenant is not affected
+	assert.Equal(t, 201, uploadAs(t, r, "alice-secret", "/file", []byte("too much")).Code)
+
+	// Deleting a file frees the quota
+	assert.Equal(t, 200, serveAs(r, "bob-secret", "DELETE", "/file/"+contentHash([]byte("8 bytes!"))).Code)
+	assert.Equal(t, 201, uploadAs(t, r, "bob-secret", "/file", []byte("too much")).Code)
+}
+
+func TestNewServerWithTenantsInClusterMode(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+
+	_, err := NewHTTPFileStorageServer(server.storer, &Config{
+		Tenants:        true,
+		ClusterSelf:    "http://a",
+		ClusterMembers: []string{"http://a", "http://b"},
+	})
+	assert.Error(t, err)
+}
+
+func TestTenantMetadataIsolation(t *testing.T) {
+	r, server := newTenantTestRouter(t)
+	server.RegisterPreSaveHook(func(ctx context.Context, upload *UploadContext) error {
+		upload.SetMetadata("uploaded_by", upload.Principal.Name)
+		return nil
+	})
+
+	content := []byte("same bytes")
+	hash := contentHash(content)
+	assert.Equal(t, 201, uploadAs(t, r, "alice-secret", "/file", content).Code)
+	assert.Equal(t, 201, uploadAs(t, r, "bob-secret", "/file", content).Code)
+
+	// Every tenant only sees the metadata of its own upload
+	for key, principal := range map[string]string{"alice-secret": "alice", "bob-secret": "bob"} {
+		w := serveAs(r, key, "GET", "/file/"+hash+"/meta")
+		assert.Equal(t, 200, w.Code)
+		var resp struct {
+			Metadata map[string]string `json:"metadata"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, map[string]string{"uploaded_by": principal}, resp.Metadata)
+	}
+}
+
+func TestNewServerWithTenantsWithoutAuth(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+
+	_, err := NewHTTPFileStorageServer(server.storer, &Config{Tenants: true, StoragePath: t.TempDir()})
+	assert.ErrorContains(t, err, "tenants require authentication")
+	assert.ErrorContains(t, (&Config{Tenants: true}).Validate(), "tenants require authentication")
+}
+
+func TestParseTenantConfig(t *testing.T) {
+	quotas, err := parseTenantQuotas("team-a:10G, team-b:512MB,team-c:100")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"team-a": 10 << 30, "team-b": 512 << 20, "team-c": 100}, quotas)
+
+	_, err = parseTenantQuotas("team-a:lots")
+	assert.Error(t, err)
+
+	apiKeys, err := parseAPIKeys("alice@team-a:secret:files:read")
+	assert.NoError(t, err)
+	assert.Equal(t, []APIKey{{Principal: "alice", Tenant: "team-a", Key: "secret", Scopes: []string{ScopeFilesRead}}}, apiKeys)
+}
+
+func TestSignedURLOfTenant(t *testing.T) {
+	server, _ := newTestServer(t, &Config{
+		APIKeys:       []APIKey{{Principal: "alice", Tenant: "team-a", Key: "alice-secret", Scopes: []string{ScopeFilesRead, ScopeFilesWrite}}},
+		Tenants:       true,
+		URLSigningKey: testURLSigningKey,
+	})
+	r := server.setupRouter()
+
+	content := []byte("shared with a link")
+	assert.Equal(t, 201, uploadAs(t, r, "alice-secret", "/file", content).Code)
+
+	code, signedURL := presign(t, r, "download", "alice-secret", gin.H{"hash": contentHash(content)})
+	assert.Equal(t, 200, code)
+	assert.Contains(t, signedURL, "/t/team-a/file/")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", signedURL, nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+}
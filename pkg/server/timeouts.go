@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DefaultReadHeaderTimeout is the time clients are given to send the request
+	// headers unless configured otherwise.
+	DefaultReadHeaderTimeout = 10 * time.Second
+
+	// DefaultIdleTimeout is the time keep-alive connections are kept open
+	// without requests unless configured otherwise.
+	DefaultIdleTimeout = 15 * time.Second
+
+	// DefaultProgressTimeout is the time a transfer may go without a byte sent
+	// or received unless configured otherwise.
+	DefaultProgressTimeout = 30 * time.Second
+
+	// transferRateWindow is the time spent waiting for the client the transfer
+	// rate is measured over
+	transferRateWindow = 10 * time.Second
+)
+
+var (
+	// errTransferStalled is returned by transfers going without a byte sent or
+	// received for the progress timeout.
+	errTransferStalled = errors.New("transfer stalled")
+
+	// errTransferTooSlow is returned by transfers slower than the minimal transfer rate.
+	errTransferTooSlow = errors.New("transfer is too slow")
+)
+
+// isTransferTimeout reports whether the error is returned by a transfer
+// interrupted by the progress timeout or the minimal transfer rate.
+func isTransferTimeout(err error) bool {
+	return errors.Is(err, errTransferStalled) || errors.Is(err, errTransferTooSlow)
+}
+
+// uploadTimeoutError returns the error rejecting an upload interrupted by the
+// progress timeout or the minimal transfer rate with 408 Request Timeout.
+func uploadTimeoutError(err error) *uploadError {
+	if errors.Is(err, errTransferTooSlow) {
+		return &uploadError{408, "upload is too slow"}
+	}
+	return &uploadError{408, "upload stalled"}
+}
+
+// readHeaderTimeout returns the time clients are given to send the request headers.
+func (s *HTTPFileStorageServer) readHeaderTimeout() time.Duration {
+	if s.config.ReadHeaderTimeout > 0 {
+		return s.config.ReadHeaderTimeout
+	}
+	return DefaultReadHeaderTimeout
+}
+
+// idleTimeout returns the time keep-alive connections are kept open without requests.
+func (s *HTTPFileStorageServer) idleTimeout() time.Duration {
+	if s.config.IdleTimeout > 0 {
+		return s.config.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// progressTimeout returns the time a transfer may go without a byte sent or received.
+func (s *HTTPFileStorageServer) progressTimeout() time.Duration {
+	if s.config.ProgressTimeout > 0 {
+		return s.config.ProgressTimeout
+	}
+	return DefaultProgressTimeout
+}
+
+// guardTransfers is a middleware replacing absolute timeouts of requests with
+// deadlines extended while bytes keep flowing, so that large transfers can
+// take as long as they need, while stalled and too slow clients are cut off.
+//
+// Every read of the request body and every write of the response must
+// complete within the progress timeout. If the minimal transfer rate is set,
+// the rate is measured over the time spent waiting for the client, so that
+// the time the server itself spends, e.g. on hashing or throttling, doesn't count.
+//
+// Deadlines are not supported over HTTP/3, QUIC closes stalled connections there.
+func (s *HTTPFileStorageServer) guardTransfers(c *gin.Context) {
+	controller := http.NewResponseController(c.Writer)
+	timeout := s.progressTimeout()
+
+	// The deadline may be left by the previous request on the connection
+	controller.SetWriteDeadline(time.Time{})
+
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		c.Request.Body = &guardedReader{
+			ReadCloser: c.Request.Body,
+			controller: controller,
+			rate:       transferRate{min: s.config.MinTransferRate, window: s.rateWindow},
+			timeout:    timeout,
+		}
+	}
+	c.Writer = &guardedWriter{
+		ResponseWriter: c.Writer,
+		controller:     controller,
+		rate:           transferRate{min: s.config.MinTransferRate, window: s.rateWindow},
+		timeout:        timeout,
+	}
+
+	c.Next()
+
+	// The buffered response is written after the handler returns
+	controller.SetWriteDeadline(time.Now().Add(timeout))
+}
+
+// transferRate measures the rate of a transfer over the time spent waiting for the client.
+type transferRate struct {
+	// min is the minimal rate in bytes per second, not checked if zero
+	min int64
+	// window is the time spent waiting the rate is measured over
+	window time.Duration
+
+	// waited is the time spent waiting in the current window
+	waited time.Duration
+	// transferred is the number of bytes transferred in the current window
+	transferred int64
+}
+
+// observe records the bytes transferred by a read or a write started at the time.
+//
+// Returns errTransferTooSlow if the rate over the last window is below the minimum.
+func (r *transferRate) observe(start time.Time, n int) error {
+	r.waited += time.Since(start)
+	r.transferred += int64(n)
+	if r.min <= 0 || r.waited < r.window {
+		return nil
+	}
+
+	rate := float64(r.transferred) / r.waited.Seconds()
+	r.waited, r.transferred = 0, 0
+	if rate < float64(r.min) {
+		return errTransferTooSlow
+	}
+	return nil
+}
+
+// guardedReader extends the read deadline of the connection before every read of the request body.
+type guardedReader struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	rate       transferRate
+	timeout    time.Duration
+}
+
+func (r *guardedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	deadline := start.Add(r.timeout)
+	hasDeadline := r.controller.SetReadDeadline(deadline) == nil
+
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		// The server reads from the connection in the background once the body
+		// is read, an expired deadline would cancel the request
+		r.controller.SetReadDeadline(time.Time{})
+		return n, err
+	} else if err != nil {
+		if hasDeadline && !time.Now().Before(deadline) {
+			return n, errTransferStalled
+		}
+		return n, err
+	}
+
+	return n, r.rate.observe(start, n)
+}
+
+// guardedWriter extends the write deadline of the connection before every write of the response.
+type guardedWriter struct {
+	gin.ResponseWriter
+	controller *http.ResponseController
+	rate       transferRate
+	timeout    time.Duration
+}
+
+func (w *guardedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	deadline := start.Add(w.timeout)
+	hasDeadline := w.controller.SetWriteDeadline(deadline) == nil
+
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil {
+		if hasDeadline && !time.Now().Before(deadline) {
+			return n, errTransferStalled
+		}
+		return n, err
+	}
+
+	return n, w.rate.observe(start, n)
+}
+
+func (w *guardedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *guardedWriter) Flush() {
+	w.controller.SetWriteDeadline(time.Now().Add(w.timeout))
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap returns the wrapped writer, so that http.ResponseController reaches the connection.
+func (w *guardedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rawUpload sends the headers of an upload of the content over a raw
+// connection, so that the test controls the pace of the body.
+//
+// Returns the connection and the multipart body, the content starts at the
+// offset of the file.
+func rawUpload(t *testing.T, url string, content []byte) (net.Conn, []byte, int) {
+	t.Helper()
+
+	prefix := "--boundary\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"slow\"\r\n" +
+		"Content-Type: application/octet-stream\r\n\r\n"
+	body := append(append([]byte(prefix), content...), "\r\n--boundary--\r\n"...)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "POST /file HTTP/1.1\r\nHost: storage\r\n"+
+		"Content-Type: multipart/form-data; boundary=boundary\r\nContent-Length: %d\r\n\r\n", len(body))
+
+	return conn, body, len(prefix)
+}
+
+// readResponse reads the response from the connection, returning its status code and message.
+func readResponse(t *testing.T, conn net.Conn) (int, string) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Msg string `json:"msg"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body.Msg
+}
+
+func TestProgressTimeoutExtendsWhileTransferring(t *testing.T) {
+	server, _ := newTestServer(t, &Config{ProgressTimeout: 200 * time.Millisecond})
+	httpServer := httptest.NewServer(server.setupRouter())
+	defer httpServer.Close()
+
+	// The upload takes several times the timeout, but never stalls for it
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	conn, body, _ := rawUpload(t, httpServer.URL, content)
+	for i := 0; i < len(body); i += 100 {
+		conn.Write(body[i:min(i+100, len(body))])
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	status, _ := readResponse(t, conn)
+	assert.Equal(t, 201, status)
+}
+
+func TestProgressTimeoutCutsOffStalledUploads(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	server, _ := newTestServer(t, &Config{ProgressTimeout: 200 * time.Millisecond})
+	httpServer := httptest.NewServer(server.setupRouter())
+	defer httpServer.Close()
+
+	conn, body, offset := rawUpload(t, httpServer.URL, bytes.Repeat([]byte("0123456789"), 100))
+	conn.Write(body[:offset+100])
+
+	status, msg := readResponse(t, conn)
+	assert.Equal(t, 408, status)
+	assert.Equal(t, "upload stalled", msg)
+
+	// The temporary file of the upload is removed
+	entries, err := os.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestProgressTimeoutCutsOffStalledDownloads(t *testing.T) {
+	server, _ := newTestServer(t, &Config{ProgressTimeout: 200 * time.Millisecond})
+	httpServer := httptest.NewServer(server.setupRouter())
+	defer httpServer.Close()
+
+	// The file is larger than the socket buffers
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	resp, err := http.DefaultClient.Do(newUploadRequest(t, httpServer.URL+"/file", content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+
+	// The client never reads the response
+	conn, err := net.Dial("tcp", strings.TrimPrefix(httpServer.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /file/%s HTTP/1.1\r\nHost: storage\r\n\r\n", contentHash(content))
+
+	assert.Eventually(t, func() bool { return server.activeRequests.Load() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return server.activeRequests.Load() == 0 }, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestMinTransferRate(t *testing.T) {
+	server, _ := newTestServer(t, &Config{MinTransferRate: 1000})
+	server.rateWindow = 200 * time.Millisecond
+	httpServer := httptest.NewServer(server.setupRouter())
+	defer httpServer.Close()
+
+	// Uploads faster than the minimum complete
+	resp, err := http.DefaultClient.Do(newUploadRequest(t, httpServer.URL+"/file", bytes.Repeat([]byte("fast"), 1<<16)))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 201, resp.StatusCode)
+	}
+
+	// The client trickles 500 bytes per second, never stalling for the progress timeout
+	conn, body, offset := rawUpload(t, httpServer.URL, bytes.Repeat([]byte("0123456789"), 100))
+	conn.Write(body[:offset])
+	go func() {
+		for i := offset; i < len(body); i += 10 {
+			if _, err := conn.Write(body[i:min(i+10, len(body))]); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	status, msg := readResponse(t, conn)
+	assert.Equal(t, 408, status)
+	assert.Equal(t, "upload is too slow", msg)
+}
+
+func TestTransferRate(t *testing.T) {
+	rate := transferRate{min: 100, window: time.Second}
+
+	// The rate is not checked until the window is full
+	assert.NoError(t, rate.observe(time.Now().Add(-500*time.Millisecond), 10))
+	assert.ErrorIs(t, rate.observe(time.Now().Add(-500*time.Millisecond), 10), errTransferTooSlow)
+
+	// Every window is measured on its own
+	assert.NoError(t, rate.observe(time.Now().Add(-time.Second), 1000))
+
+	rate = transferRate{window: time.Second}
+	assert.NoError(t, rate.observe(time.Now().Add(-time.Minute), 0))
+}
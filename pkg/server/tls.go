@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certCheckInterval is the interval the certificate files are checked for changes at.
+const certCheckInterval = 10 * time.Second
+
+// certReloader keeps the certificate of the server and the CAs verifying the
+// client certificates, reloading them when their files change or on SIGHUP.
+//
+// A reload replaces all of them or nothing, so that an invalid file, e.g.
+// a certificate written before its key, doesn't take the server down.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	// clientAuth is the policy of the server for client certificates
+	clientAuth tls.ClientAuthType
+
+	// interval is the interval the files are checked for changes at
+	interval time.Duration
+
+	logger *slog.Logger
+
+	lock sync.RWMutex
+	// cert is the certificate of the server
+	cert *tls.Certificate
+	// clientCAs verify the client certificates, nil if they are not requested
+	clientCAs *x509.CertPool
+	// modTimes are the modification times of the loaded files
+	modTimes map[string]time.Time
+}
+
+// newCertReloader loads the certificates of the configuration.
+//
+// Returns:
+// - *certReloader: the reloader, nil if TLS is disabled
+// - error: an error if the configuration is incomplete or the files are invalid
+func newCertReloader(config *Config, logger *slog.Logger) (*certReloader, error) {
+	if !config.IsTLSEnabled() {
+		if config.TLSClientCAFile != "" || config.TLSRequireClientCert {
+			return nil, fmt.Errorf("client certificates require a TLS certificate and key")
+		}
+		return nil, nil
+	}
+
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return nil, fmt.Errorf("both a TLS certificate and a key are required")
+	}
+
+	reloader := &certReloader{
+		certFile:     config.TLSCertFile,
+		keyFile:      config.TLSKeyFile,
+		clientCAFile: config.TLSClientCAFile,
+		clientAuth:   tls.NoClientCert,
+		interval:     certCheckInterval,
+		logger:       logger,
+	}
+	if config.TLSClientCAFile != "" {
+		reloader.clientAuth = tls.VerifyClientCertIfGiven
+		if config.TLSRequireClientCert {
+			reloader.clientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if config.TLSRequireClientCert {
+		return nil, fmt.Errorf("requiring client certificates requires a client CA")
+	}
+
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// files returns the files the certificates are loaded from.
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+// load loads the certificates from their files, keeping the current ones if any file is invalid.
+func (r *certReloader) load() error {
+	// The modification times are taken first, so that a change while loading is not missed
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing TLS certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		data, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("client CA %s contains no PEM certificates", r.clientCAFile)
+		}
+	}
+
+	r.lock.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	r.lock.Unlock()
+
+	r.logger.Info("TLS certificate loaded", "subject", leaf.Subject.String(), "not_after", leaf.NotAfter)
+	return nil
+}
+
+// changed reports whether any file was modified since the certificates were loaded.
+func (r *certReloader) changed() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// The file may be being replaced, it is checked again later
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates on SIGHUP or when their files change until
+// the context is done. The signal is subscribed to before watch returns.
+func (r *certReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			case <-ticker.C:
+				if !r.changed() {
+					continue
+				}
+			}
+
+			if err := r.load(); err != nil {
+				r.logger.Error("error reloading TLS certificate, keeping the current one", "error", err)
+			}
+		}
+	}()
+}
+
+// getCertificate returns the current certificate of the server.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// getClientCertificate returns the current certificate of the server to
+// authenticate with to other members.
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// serverConfig returns the TLS configuration of the server. Every handshake
+// uses the certificates loaded last.
+func (r *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+
+			return &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: r.getCertificate,
+				ClientAuth:     r.clientAuth,
+				ClientCAs:      r.clientCAs,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// peerTransport returns the transport of the requests to other cluster
+// members, sync peers and the upstream.
+//
+// It authenticates with the certificate of the server and trusts the client
+// CAs besides the system roots, since members are expected to share a CA.
+func (r *certReloader) peerTransport() (*http.Transport, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if r.clientCAFile != "" {
+		data, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA: %v", err)
+		}
+		roots.AppendCertsFromPEM(data)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              roots,
+		GetClientCertificate: r.getClientCertificate,
+	}
+	return transport, nil
+}
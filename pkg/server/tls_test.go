@@ -0,0 +1,236 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// file is the path of the PEM certificate of the CA
+	file string
+}
+
+// newTestCA creates a CA writing its files to a temporary directory.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue issues a certificate for 127.0.0.1 usable by servers and clients.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCert writes the certificate and its key to the PEM files.
+func writeCert(t *testing.T, cert tls.Certificate, certFile string, keyFile string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
+// newTLSConfig returns a configuration serving the certificate issued by the CA.
+func newTLSConfig(t *testing.T, ca *testCA) *Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	config := &Config{
+		TLSCertFile: filepath.Join(dir, "server.pem"),
+		TLSKeyFile:  filepath.Join(dir, "server-key.pem"),
+	}
+	writeCert(t, ca.issue(t, pkix.Name{CommonName: "server"}), config.TLSCertFile, config.TLSKeyFile)
+
+	return config
+}
+
+// newTLSClient returns a client trusting the CA, authenticating with the certificates.
+func newTLSClient(ca *testCA, certs ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots, Certificates: certs}
+	return &http.Client{Transport: transport}
+}
+
+// serverCommonName returns the common name of the certificate the server presents.
+func serverCommonName(t *testing.T, client *http.Client, baseURL string) string {
+	t.Helper()
+
+	resp, err := client.Get(baseURL + "/healthz")
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	resp.Body.Close()
+	client.CloseIdleConnections()
+
+	return resp.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func TestServesTLS(t *testing.T) {
+	ca := newTestCA(t)
+	_, baseURL, _ := startServer(t, newTLSConfig(t, ca))
+
+	resp, err := newTLSClient(ca).Get(baseURL + "/healthz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+	}
+
+	// Plain HTTP is not served
+	resp, err = http.Get("http" + baseURL[len("https"):] + "/healthz")
+	if err == nil {
+		resp.Body.Close()
+		assert.Equal(t, 400, resp.StatusCode)
+	}
+}
+
+func TestRequiresClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	config := newTLSConfig(t, ca)
+	config.TLSClientCAFile = ca.file
+	config.TLSRequireClientCert = true
+	_, baseURL, _ := startServer(t, config)
+
+	_, err := newTLSClient(ca).Get(baseURL + "/healthz")
+	assert.Error(t, err)
+
+	// Certificates of other CAs are rejected as well
+	other := newTestCA(t)
+	_, err = newTLSClient(ca, other.issue(t, pkix.Name{CommonName: "ci"})).Get(baseURL + "/healthz")
+	assert.Error(t, err)
+
+	resp, err := newTLSClient(ca, ca.issue(t, pkix.Name{CommonName: "ci"})).Get(baseURL + "/healthz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+}
+
+func TestClientCertPrincipal(t *testing.T) {
+	ca := newTestCA(t)
+	config := newTLSConfig(t, ca)
+	config.TLSClientCAFile = ca.file
+	config.ClientCerts = []ClientCert{
+		{Subject: "CN=ci", Principal: "ci", Scopes: []string{ScopeFilesRead}},
+		{Subject: "CN=ops,O=Acme", Principal: "ops", Scopes: []string{ScopeAdmin}},
+	}
+	server, _ := newTestServer(t, config)
+	r := server.setupRouter()
+
+	request := func(path string, certs ...tls.Certificate) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if len(certs) > 0 {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certs[0].Leaf, ca.cert}}}
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The common name matches any subject with it
+	ci := ca.issue(t, pkix.Name{CommonName: "ci", Organization: []string{"Acme"}})
+	assert.Equal(t, 404, request("/file/"+contentHash([]byte("missing")), ci))
+	assert.Equal(t, 403, request("/metrics", ci))
+
+	// The distinguished name must match as a whole
+	assert.Equal(t, 200, request("/metrics", ca.issue(t, pkix.Name{CommonName: "ops", Organization: []string{"Acme"}})))
+	assert.Equal(t, 401, request("/metrics", ca.issue(t, pkix.Name{CommonName: "ops", Organization: []string{"Other"}})))
+
+	assert.Equal(t, 401, request("/metrics"))
+}
+
+func TestInvalidTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+
+	for _, config := range []*Config{
+		{TLSCertFile: "cert.pem"},
+		{TLSClientCAFile: ca.file},
+		{TLSCertFile: "missing.pem", TLSKeyFile: "missing-key.pem"},
+		{ClientCerts: []ClientCert{{Subject: "CN=ci", Principal: "ci"}}},
+	} {
+		_, err := newCertReloader(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err == nil {
+			_, err = newAuthenticator(config)
+		}
+		assert.Error(t, err)
+	}
+}
+
+func TestParseClientCerts(t *testing.T) {
+	clientCerts, err := parseClientCerts("CN=ci,O=Acme|ci@team-a|files:read,files:write; CN=ops|ops")
+	assert.NoError(t, err)
+	assert.Equal(t, []ClientCert{
+		{Subject: "CN=ci,O=Acme", Principal: "ci", Tenant: "team-a", Scopes: []string{ScopeFilesRead, ScopeFilesWrite}},
+		{Subject: "CN=ops", Principal: "ops"},
+	}, clientCerts)
+
+	_, err = parseClientCerts("CN=ci")
+	assert.Error(t, err)
+}
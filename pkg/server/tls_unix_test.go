@@ -0,0 +1,55 @@
+//go:build unix
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadsCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	config := newTLSConfig(t, ca)
+	server, baseURL, _ := startServer(t, config)
+	client := newTLSClient(ca)
+
+	assert.Equal(t, "server", serverCommonName(t, client, baseURL))
+
+	// An invalid certificate is not loaded
+	assert.NoError(t, os.WriteFile(config.TLSCertFile, []byte("not a certificate"), 0o600))
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "server", serverCommonName(t, client, baseURL))
+
+	// SIGHUP reloads the certificate
+	writeCert(t, ca.issue(t, pkix.Name{CommonName: "renewed"}), config.TLSCertFile, config.TLSKeyFile)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	assert.Eventually(t, func() bool { return serverCommonName(t, client, baseURL) == "renewed" }, 5*time.Second, 50*time.Millisecond)
+
+	// A change of the files is noticed without a signal
+	reloader, err := newCertReloader(config, server.logger)
+	if !assert.NoError(t, err) {
+		return
+	}
+	reloader.interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloader.watch(ctx)
+
+	writeCert(t, ca.issue(t, pkix.Name{CommonName: "rotated"}), config.TLSCertFile, config.TLSKeyFile)
+	// File systems with a coarse resolution may keep the modification time
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(config.TLSCertFile, future, future))
+	assert.Eventually(t, func() bool {
+		cert, _ := reloader.getCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		return err == nil && leaf.Subject.CommonName == "rotated"
+	}, 5*time.Second, 10*time.Millisecond)
+}
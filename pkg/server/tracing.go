@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/pkg/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	// tracerName is the name of the instrumentation scope of the spans
+	tracerName = "github.com/pavlov061356/http_based_file_storage/pkg/server"
+
+	// tracingServiceName is the service name reported with the spans
+	tracingServiceName = "http_based_file_storage"
+
+	// defaultTracingURLPath is the path of the OTLP/HTTP traces endpoint
+	defaultTracingURLPath = "/v1/traces"
+)
+
+// newTracerProvider creates the provider exporting the spans to the OTLP/HTTP
+// endpoint of the configuration.
+//
+// Returns:
+// - *sdktrace.TracerProvider: the provider, nil if tracing is disabled
+// - error: an error if the endpoint or the sample ratio is invalid
+func newTracerProvider(config *Config) (*sdktrace.TracerProvider, error) {
+	if config.TracingEndpoint == "" {
+		return nil, nil
+	}
+
+	endpoint, err := url.Parse(config.TracingEndpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid tracing endpoint %q", config.TracingEndpoint)
+	}
+
+	ratio := config.TracingSampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio must be between 0 and 1")
+	}
+
+	urlPath := endpoint.Path
+	if urlPath == "" || urlPath == "/" {
+		urlPath = defaultTracingURLPath
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint.Host),
+		otlptracehttp.WithURLPath(urlPath),
+	}
+	if endpoint.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	// The exporter connects lazily, an unavailable collector doesn't stop the server
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %v", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", tracingServiceName))),
+	), nil
+}
+
+// newTracer returns the tracer of the provider, a no-op tracer if the provider is nil.
+func newTracer(provider *sdktrace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		return noop.NewTracerProvider().Tracer(tracerName)
+	}
+	return provider.Tracer(tracerName)
+}
+
+// newPropagator returns the propagator of the W3C trace context and baggage.
+func newPropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+// traceRequests is a middleware starting a server span for every request.
+//
+// The span continues the trace of the W3C traceparent header of the client,
+// the handlers start their spans as its children from the request context.
+func (s *HTTPFileStorageServer) traceRequests(c *gin.Context) {
+	ctx := s.propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+	name := c.Request.Method + " " + c.FullPath()
+	if c.FullPath() == "" {
+		name = c.Request.Method
+	}
+	ctx, span := s.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", c.Request.Method),
+			attribute.String("http.route", c.FullPath()),
+			attribute.String("url.path", c.Request.URL.Path),
+			attribute.String("request.id", c.GetString(requestIDKey)),
+		))
+	defer span.End()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if principal, ok := PrincipalFromContext(c); ok {
+		span.SetAttributes(attribute.String("enduser.id", principal.Name))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, c.Errors.ByType(gin.ErrorTypePrivate).String())
+	}
+}
+
+// startSpan starts a span as a child of the span of the request and makes it
+// the parent of the spans started from the request context.
+//
+// Parameters:
+// - c: the gin context
+// - name: the name of the span
+//
+// Returns the span, which must be ended.
+func (s *HTTPFileStorageServer) startSpan(c *gin.Context, name string) trace.Span {
+	ctx, span := s.tracer.Start(c.Request.Context(), name)
+	c.Request = c.Request.WithContext(ctx)
+	return span
+}
+
+// endSpan ends the span, recording the error if there is one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedStorage returns the storage recording a span for every call made for
+// the operation of the context, the storage itself if tracing is disabled.
+func (s *HTTPFileStorageServer) tracedStorage(ctx context.Context) storage.Storer {
+	if s.tracerProvider == nil {
+		return s.storer
+	}
+	return &tracedStorer{Storer: s.storer, ctx: ctx, tracer: s.tracer}
+}
+
+// tracedStorer records a span for every call of the wrapped storage.
+//
+// The storage is embedded, since storage.Storer can't be implemented outside
+// of its package. The methods not overridden, e.g. LockStats, are not traced.
+type tracedStorer struct {
+	storage.Storer
+
+	// ctx is the context of the operation the storage is called for
+	ctx    context.Context
+	tracer trace.Tracer
+}
+
+// start starts the span of a call of the storage.
+func (s *tracedStorer) start(method string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := s.tracer.Start(s.ctx, "storage."+method, trace.WithAttributes(attrs...))
+	return span
+}
+
+// end ends the span of a call of the storage. A missing file or a file that
+// already exists are expected outcomes rather than errors.
+func (s *tracedStorer) end(span trace.Span, err error) {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrExist) {
+		span.SetAttributes(attribute.String("storage.outcome", err.Error()))
+		err = nil
+	}
+	endSpan(span, err)
+}
+
+func (s *tracedStorer) Exists(hash string) (bool, error) {
+	span := s.start("Exists", attribute.String("file.hash", hash))
+	exists, err := s.Storer.Exists(hash)
+	span.SetAttributes(attribute.Bool("file.exists", exists))
+	s.end(span, err)
+	return exists, err
+}
+
+func (s *tracedStorer) SaveFileFromTemp(hash string, tmpFilePath string) error {
+	span := s.start("SaveFileFromTemp", attribute.String("file.hash", hash))
+	err := s.Storer.SaveFileFromTemp(hash, tmpFilePath)
+	s.end(span, err)
+	return err
+}
+
+func (s *tracedStorer) Read(hash string) (string, error) {
+	span := s.start("Read", attribute.String("file.hash", hash))
+	path, err := s.Storer.Read(hash)
+	s.end(span, err)
+	return path, err
+}
+
+func (s *tracedStorer) ReadEncoded(hash string, acceptedEncodings []string) (string, string, error) {
+	span := s.start("ReadEncoded", attribute.String("file.hash", hash), attribute.StringSlice("file.accepted_encodings", acceptedEncodings))
+	path, encoding, err := s.Storer.ReadEncoded(hash, acceptedEncodings)
+	span.SetAttributes(attribute.String("file.encoding", encoding))
+	s.end(span, err)
+	return path, encoding, err
+}
+
+func (s *tracedStorer) Delete(hash string) error {
+	span := s.start("Delete", attribute.String("file.hash", hash))
+	err := s.Storer.Delete(hash)
+	s.end(span, err)
+	return err
+}
+
+func (s *tracedStorer) Metadata(hash string) (map[string]string, error) {
+	span := s.start("Metadata", attribute.String("file.hash", hash))
+	metadata, err := s.Storer.Metadata(hash)
+	s.end(span, err)
+	return metadata, err
+}
+
+func (s *tracedStorer) SetMetadata(hash string, metadata map[string]string) error {
+	span := s.start("SetMetadata", attribute.String("file.hash", hash))
+	err := s.Storer.SetMetadata(hash, metadata)
+	s.end(span, err)
+	return err
+}
+
+func (s *tracedStorer) List() ([]string, error) {
+	span := s.start("List")
+	hashes, err := s.Storer.List()
+	span.SetAttributes(attribute.Int("storage.files", len(hashes)))
+	s.end(span, err)
+	return hashes, err
+}
+
+func (s *tracedStorer) ListShard(shard string) ([]string, error) {
+	span := s.start("ListShard", attribute.String("storage.shard", shard))
+	hashes, err := s.Storer.ListShard(shard)
+	span.SetAttributes(attribute.Int("storage.files", len(hashes)))
+	s.end(span, err)
+	return hashes, err
+}
+
+func (s *tracedStorer) ShardDigests() (map[string]string, error) {
+	span := s.start("ShardDigests")
+	digests, err := s.Storer.ShardDigests()
+	s.end(span, err)
+	return digests, err
+}
+
+func (s *tracedStorer) Reencrypt(ctx context.Context) (int, error) {
+	ctx, span := s.tracer.Start(ctx, "storage.Reencrypt")
+	rewritten, err := s.Storer.Reencrypt(ctx)
+	span.SetAttributes(attribute.Int("storage.rewritten", rewritten))
+	s.end(span, err)
+	return rewritten, err
+}
+
+func (s *tracedStorer) Usage() (storage.Usage, error) {
+	span := s.start("Usage")
+	usage, err := s.Storer.Usage()
+	s.end(span, err)
+	return usage, err
+}
+
+// endHandlerSpan ends the span of a handler, recording the error of the
+// request if it failed with 5xx.
+func endHandlerSpan(c *gin.Context, span trace.Span) {
+	var err error
+	if status := c.Writer.Status(); status >= 500 {
+		err = fmt.Errorf("request failed with status %d", status)
+		if last := c.Errors.Last(); last != nil {
+			err = last.Err
+		}
+	}
+	endSpan(span, err)
+}
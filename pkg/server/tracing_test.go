@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectorStub is an in-process OTLP/HTTP collector keeping the received spans.
+type collectorStub struct {
+	lock  sync.Mutex
+	spans []*tracepb.Span
+}
+
+// startCollectorStub starts a collector stub and returns it with its base URL.
+func startCollectorStub(t *testing.T) (*collectorStub, string) {
+	t.Helper()
+
+	collector := &collectorStub{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			w.WriteHeader(404)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		var request collectortrace.ExportTraceServiceRequest
+		assert.NoError(t, proto.Unmarshal(body, &request))
+
+		collector.lock.Lock()
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				collector.spans = append(collector.spans, scopeSpans.Spans...)
+			}
+		}
+		collector.lock.Unlock()
+
+		response, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(response)
+	}))
+	t.Cleanup(ts.Close)
+
+	return collector, ts.URL
+}
+
+// byName returns the received spans by their names.
+func (c *collectorStub) byName() map[string][]*tracepb.Span {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	spans := map[string][]*tracepb.Span{}
+	for _, span := range c.spans {
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+	return spans
+}
+
+// newTracedServer creates a server exporting its spans to a collector stub.
+func newTracedServer(t *testing.T) (*HTTPFileStorageServer, *collectorStub) {
+	t.Helper()
+
+	collector, endpoint := startCollectorStub(t)
+	server, _ := newTestServer(t, &Config{TracingEndpoint: endpoint})
+	t.Cleanup(func() { server.tracerProvider.Shutdown(context.Background()) })
+
+	return server, collector
+}
+
+func TestUploadIsTraced(t *testing.T) {
+	server, collector := newTracedServer(t)
+	r := server.setupRouter()
+
+	var callbackCalled bool
+	server.RegisterPOSTSaveCallback(func(hash string, filePath string) error {
+		callbackCalled = true
+		return nil
+	})
+
+	// The trace of the client is continued
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	content := []byte("traced content")
+	req := newUploadRequest(t, "/file", content)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+	assert.True(t, callbackCalled)
+
+	assert.NoError(t, server.tracerProvider.ForceFlush(context.Background()))
+	spans := collector.byName()
+
+	for _, name := range []string{"POST /file", "SaveFile", "upload.receive", "hash.verify", "storage.SaveFileFromTemp", "callback.post_save"} {
+		if assert.Len(t, spans[name], 1, name) {
+			assert.Equal(t, traceID, hex.EncodeToString(spans[name][0].TraceId), name)
+		}
+	}
+
+	// Spans are nested under the span of the request
+	request := spans["POST /file"][0]
+	handler := spans["SaveFile"][0]
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(request.ParentSpanId))
+	assert.Equal(t, request.SpanId, handler.ParentSpanId)
+	assert.Equal(t, handler.SpanId, spans["storage.SaveFileFromTemp"][0].ParentSpanId)
+	assert.Equal(t, handler.SpanId, spans["callback.post_save"][0].ParentSpanId)
+}
+
+func TestDownloadIsTraced(t *testing.T) {
+	server, collector := newTracedServer(t)
+	r := server.setupRouter()
+
+	content := []byte("traced download")
+	hash := contentHash(content)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newUploadRequest(t, "/file", content))
+	assert.Equal(t, 201, w.Code)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/file/"+hash, nil),
+		httptest.NewRequest("DELETE", "/file/"+hash, nil),
+	} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+	}
+
+	assert.NoError(t, server.tracerProvider.ForceFlush(context.Background()))
+	spans := collector.byName()
+
+	for _, name := range []string{"SendFile", "storage.ReadEncoded", "hash.compute", "DeleteFile", "storage.Exists", "storage.Delete"} {
+		assert.Len(t, spans[name], 1, name)
+	}
+	assert.Equal(t, spans["SendFile"][0].SpanId, spans["hash.compute"][0].ParentSpanId)
+	assert.Equal(t, spans["DeleteFile"][0].SpanId, spans["storage.Delete"][0].ParentSpanId)
+}
+
+func TestInvalidTracingEndpoint(t *testing.T) {
+	for _, config := range []*Config{
+		{TracingEndpoint: "localhost:4318"},
+		{TracingEndpoint: "http://localhost:4318", TracingSampleRatio: 2},
+	} {
+		_, err := newTracerProvider(config)
+		assert.Error(t, err)
+	}
+}
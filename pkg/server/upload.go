@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+)
+
+// sniffSize is the number of bytes the content type is detected from.
+const sniffSize = 512
+
+// uploadError is an error rejecting an upload with a status code.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+// upload is a file received from a multipart request.
+type upload struct {
+	// path is the path to the temporary file holding the content
+	path string
+	// name is the name of the file given by the client
+	name string
+	// size is the size of the content
+	size int64
+	// contentType is the content type detected from the content
+	contentType string
+	// hash is the SHA256 of the content
+	hash string
+}
+
+// UploadPolicy restricts the files that can be uploaded.
+//
+// Deny lists take precedence over allow lists. Everything is allowed if the
+// lists are empty.
+type UploadPolicy struct {
+	// MaxUploadSize is the maximal size of an uploaded file in bytes, not limited if zero.
+	MaxUploadSize int64 `json:"max_upload_size"`
+	// AllowedContentTypes are the content types files may have, e.g. "image/*" or "application/pdf".
+	// The content type is detected from the content, not taken from the client.
+	AllowedContentTypes []string `json:"allowed_content_types"`
+	// DeniedContentTypes are the content types files must not have.
+	DeniedContentTypes []string `json:"denied_content_types"`
+	// AllowedExtensions are the extensions of the file names files may have, e.g. ".jpg".
+	AllowedExtensions []string `json:"allowed_extensions"`
+	// DeniedExtensions are the extensions of the file names files must not have.
+	DeniedExtensions []string `json:"denied_extensions"`
+}
+
+// matchContentType reports whether the media type matches one of the patterns.
+func matchContentType(mediaType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if pattern == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeExtension lowercases the extension and adds the leading dot.
+func normalizeExtension(extension string) string {
+	extension = strings.ToLower(strings.TrimSpace(extension))
+	if !strings.HasPrefix(extension, ".") {
+		extension = "." + extension
+	}
+	return extension
+}
+
+// checkName checks the extension of the file name against the policy.
+func (p *UploadPolicy) checkName(name string) error {
+	extension := strings.ToLower(filepath.Ext(name))
+
+	for _, denied := range p.DeniedExtensions {
+		if normalizeExtension(denied) == extension {
+			return &uploadError{415, fmt.Sprintf("files with the %q extension are not allowed", extension)}
+		}
+	}
+
+	if len(p.AllowedExtensions) > 0 && !slices.ContainsFunc(p.AllowedExtensions, func(allowed string) bool {
+		return normalizeExtension(allowed) == extension
+	}) {
+		return &uploadError{415, fmt.Sprintf("files with the %q extension are not allowed", extension)}
+	}
+
+	return nil
+}
+
+// checkContentType checks the detected content type against the policy.
+func (p *UploadPolicy) checkContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	if matchContentType(mediaType, p.DeniedContentTypes) ||
+		(len(p.AllowedContentTypes) > 0 && !matchContentType(mediaType, p.AllowedContentTypes)) {
+		return &uploadError{415, fmt.Sprintf("files of type %q are not allowed", mediaType)}
+	}
+
+	return nil
+}
+
+// maxUploadSize returns the maximal size of the upload of the request, zero if it is not limited.
+// Uploads to signed URLs are also limited to the signed size.
+func (s *HTTPFileStorageServer) maxUploadSize(c *gin.Context) int64 {
+	maxSize := s.config.UploadPolicy.MaxUploadSize
+	if signed := c.GetInt64(uploadMaxSizeKey); signed > 0 && (maxSize == 0 || signed < maxSize) {
+		maxSize = signed
+	}
+	return maxSize
+}
+
+// receiveUpload streams the "file" part of the multipart request into a
+// temporary file, enforcing the upload policy while reading.
+//
+// The request is rejected as soon as the file exceeds the maximal size, or
+// its name or the content type detected from its first bytes is not allowed.
+//
+// Parameters:
+// - c: the gin context
+//
+// Returns:
+// - *upload: the received file, its temporary file must be removed by the caller
+// - error: an *uploadError if the upload is rejected, any other error if it failed
+func (s *HTTPFileStorageServer) receiveUpload(c *gin.Context) (*upload, error) {
+	policy := &s.config.UploadPolicy
+	maxSize := s.maxUploadSize(c)
+
+	if maxSize > 0 {
+		// Reject uploads declaring a larger body before reading anything,
+		// and stop reading bodies outgrowing the limit
+		if c.Request.ContentLength > maxSize+multipartOverhead {
+			return nil, &uploadError{413, "file is too large"}
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+multipartOverhead)
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, &uploadError{400, fmt.Sprintf("error reading multipart form: %v", err)}
+	}
+
+	for {
+		part, err := reader.NextPart()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, &uploadError{413, "file is too large"}
+		} else if isTransferTimeout(err) {
+			return nil, uploadTimeoutError(err)
+		} else if err == io.EOF {
+			return nil, &uploadError{400, "file is missing"}
+		} else if err != nil {
+			return nil, &uploadError{400, fmt.Sprintf("error reading multipart form: %v", err)}
+		}
+
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		upload, err := s.receivePart(part.FileName(), part, policy, maxSize)
+		part.Close()
+		if errors.As(err, &maxBytesErr) {
+			return nil, &uploadError{413, "file is too large"}
+		} else if isTransferTimeout(err) {
+			return nil, uploadTimeoutError(err)
+		}
+		return upload, err
+	}
+}
+
+// receivePart copies the content of the file part into a temporary file.
+func (s *HTTPFileStorageServer) receivePart(name string, part io.Reader, policy *UploadPolicy, maxSize int64) (*upload, error) {
+	if err := policy.checkName(name); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	contentType := http.DetectContentType(head)
+	if err = policy.checkContentType(contentType); err != nil {
+		return nil, err
+	}
+
+	// Read one byte over the limit to detect larger files
+	var content io.Reader = io.MultiReader(bytes.NewReader(head), part)
+	if maxSize > 0 {
+		content = io.LimitReader(content, maxSize+1)
+	}
+
+	path, size, hash, err := writeTemp(content)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && size > maxSize {
+		os.Remove(path)
+		return nil, &uploadError{413, "file is too large"}
+	}
+
+	return &upload{
+		path:        path,
+		name:        name,
+		size:        size,
+		contentType: contentType,
+		hash:        hash,
+	}, nil
+}
+
+// writeTemp copies the content into a new temporary file, computing its hash.
+//
+// Returns the path of the temporary file, which must be removed by the caller,
+// the size and the hash of the content, and an error if there was any
+func writeTemp(content io.Reader) (string, int64, string, error) {
+	file, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return "", 0, "", fmt.Errorf("error creating temp file: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), content)
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, "", err
+	}
+
+	return file.Name(), size, helpers.EncodeHash(hash), nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pngHeader is the start of a PNG image, enough to detect its type.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// newNamedUploadRequest creates a multipart upload request with the given file name.
+func newNamedUploadRequest(t *testing.T, name string, content []byte) *http.Request {
+	t.Helper()
+
+	b := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(b)
+	assert.NoError(t, multipartWriter.WriteField("comment", "uploaded by a test"))
+	part, err := multipartWriter.CreateFormFile("file", name)
+	assert.NoError(t, err)
+	_, err = part.Write(content)
+	assert.NoError(t, err)
+	multipartWriter.Close()
+
+	req := httptest.NewRequest("POST", "/file", b)
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	return req
+}
+
+// serveUpload serves the request and returns the status code and the error message.
+func serveUpload(t *testing.T, server *HTTPFileStorageServer, req *http.Request) (int, string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.setupRouter().ServeHTTP(w, req)
+
+	var resp struct {
+		Msg string `json:"msg"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp.Msg
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	server, _ := newTestServer(t, &Config{UploadPolicy: UploadPolicy{MaxUploadSize: 1024}})
+
+	code, _ := serveUpload(t, server, newNamedUploadRequest(t, "exact.bin", bytes.Repeat([]byte("a"), 1024)))
+	assert.Equal(t, 201, code)
+
+	code, msg := serveUpload(t, server, newNamedUploadRequest(t, "large.bin", bytes.Repeat([]byte("a"), 1025)))
+	assert.Equal(t, 413, code)
+	assert.NotEmpty(t, msg)
+
+	// A body declaring a larger size is rejected without being read
+	req := newNamedUploadRequest(t, "declared.bin", []byte("small"))
+	req.ContentLength = 1 << 40
+	code, _ = serveUpload(t, server, req)
+	assert.Equal(t, 413, code)
+}
+
+// countingReader counts the bytes read from an endless stream of zeros.
+type countingReader struct {
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	clear(p)
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestMaxUploadSizeIsEnforcedWhileStreaming(t *testing.T) {
+	server, _ := newTestServer(t, &Config{UploadPolicy: UploadPolicy{MaxUploadSize: 1 << 20}})
+
+	// A runaway upload of unknown length
+	body := &countingReader{}
+	prefix := "--boundary\r\nContent-Disposition: form-data; name=\"file\"; filename=\"runaway\"\r\n\r\n"
+	req := httptest.NewRequest("POST", "/file", io.MultiReader(bytes.NewBufferString(prefix), body))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+
+	code, _ := serveUpload(t, server, req)
+	assert.Equal(t, 413, code)
+	assert.Less(t, body.read, int64(4<<20), "the upload must be rejected once it exceeds the limit")
+}
+
+func TestContentTypePolicy(t *testing.T) {
+	server, _ := newTestServer(t, &Config{UploadPolicy: UploadPolicy{
+		AllowedContentTypes: []string{"image/*", "text/plain"},
+		DeniedContentTypes:  []string{"image/gif"},
+	}})
+
+	tests := []struct {
+		name    string
+		content []byte
+		code    int
+	}{
+		{"image.png", pngHeader, 201},
+		// The content type is detected from the content, not the name
+		{"image.txt", append(append([]byte{}, pngHeader...), 1), 201},
+		{"notes.txt", []byte("plain text"), 201},
+		{"image.png", []byte("%PDF-1.4 not an image"), 415},
+		{"animation.gif", []byte("GIF89a......"), 415},
+	}
+
+	for _, test := range tests {
+		code, msg := serveUpload(t, server, newNamedUploadRequest(t, test.name, test.content))
+		assert.Equal(t, test.code, code, test.name)
+		if test.code == 415 {
+			assert.NotEmpty(t, msg)
+		}
+	}
+}
+
+func TestExtensionPolicy(t *testing.T) {
+	server, _ := newTestServer(t, &Config{UploadPolicy: UploadPolicy{DeniedExtensions: []string{"exe", ".BAT"}}})
+
+	code, _ := serveUpload(t, server, newNamedUploadRequest(t, "setup.EXE", []byte("MZ binary")))
+	assert.Equal(t, 415, code)
+	code, _ = serveUpload(t, server, newNamedUploadRequest(t, "run.bat", []byte("echo")))
+	assert.Equal(t, 415, code)
+	code, _ = serveUpload(t, server, newNamedUploadRequest(t, "readme.md", []byte("# readme")))
+	assert.Equal(t, 201, code)
+
+	server, _ = newTestServer(t, &Config{UploadPolicy: UploadPolicy{AllowedExtensions: []string{".jpg"}}})
+	code, _ = serveUpload(t, server, newNamedUploadRequest(t, "photo.jpg", []byte("photo")))
+	assert.Equal(t, 201, code)
+	code, _ = serveUpload(t, server, newNamedUploadRequest(t, "photo", []byte("photo")))
+	assert.Equal(t, 415, code)
+}
+
+func TestUploadWithoutFile(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+
+	b := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(b)
+	assert.NoError(t, multipartWriter.WriteField("comment", "no file"))
+	multipartWriter.Close()
+
+	req := httptest.NewRequest("POST", "/file", b)
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+
+	code, _ := serveUpload(t, server, req)
+	assert.Equal(t, 400, code)
+}
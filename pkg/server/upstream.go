@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultUpstreamTimeout is the time a fetch from the upstream may take unless configured otherwise.
+const DefaultUpstreamTimeout = 5 * time.Minute
+
+// flightGroup coalesces concurrent calls with the same key into a single call.
+type flightGroup struct {
+	mux   sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is an in-flight or completed call of a flightGroup.
+type flightCall struct {
+	done chan struct{}
+	err  error
+}
+
+// Do runs fn once for all concurrent callers with the same key and returns
+// its error to every one of them. The call runs in its own goroutine, so that
+// callers can stop waiting for it without cancelling it for the others.
+//
+// Parameters:
+// - ctx: the context of the caller, Do returns its error once it is done
+// - key: the key identifying the call
+// - fn: the function to run
+//
+// Returns:
+// - error: the error returned by fn or the one of the context
+func (g *flightGroup) Do(ctx context.Context, key string, fn func() error) error {
+	g.mux.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+
+		go func() {
+			call.err = fn()
+
+			g.mux.Lock()
+			delete(g.calls, key)
+			g.mux.Unlock()
+
+			close(call.done)
+		}()
+	}
+	g.mux.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchFromUpstream fetches a missing file from the upstream and saves it to
+// the storage. Concurrent misses for the same hash result in a single fetch.
+//
+// Parameters:
+// - ctx: the context of the request that missed the file
+// - hash: the hash of the file
+//
+// Returns:
+// - error: os.ErrNotExist if the upstream doesn't have the file, any other error that occurred while fetching it
+func (s *HTTPFileStorageServer) fetchFromUpstream(ctx context.Context, hash string) error {
+	return s.upstreamFlights.Do(ctx, hash, func() error {
+		// The fetch is shared by all waiting requests, so it must not be
+		// cancelled when the first of them goes away, but it must end
+		timeout := s.config.UpstreamTimeout
+		if timeout <= 0 {
+			timeout = DefaultUpstreamTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+
+		// Another request might have fetched the file right before this one
+		if exists, err := s.tracedStorage(ctx).Exists(hash); err == nil && exists {
+			return nil
+		}
+
+		// The content is verified against the hash while downloading
+		filePath, err := s.clusterClient.Fetch(ctx, s.config.UpstreamURL, hash)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(filePath)
+
+		err = s.tracedStorage(ctx).SaveFileFromTemp(hash, filePath)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestUpstream starts an upstream server counting and delaying file downloads.
+func newTestUpstream(t *testing.T, delay time.Duration) (*httptest.Server, *HTTPFileStorageServer, *int32) {
+	t.Helper()
+
+	upstream, _ := newTestServer(t, nil)
+	router := upstream.setupRouter()
+
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/file/") {
+			atomic.AddInt32(&downloads, 1)
+			time.Sleep(delay)
+		}
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, upstream, &downloads
+}
+
+func TestPullThroughCacheFetchesMissingFile(t *testing.T) {
+	upstreamHTTP, upstream, downloads := newTestUpstream(t, 0)
+	hash := saveToStorage(t, upstream.storer, []byte("upstream content"))
+
+	cache, cacheStorer := newTestServer(t, &Config{UpstreamURL: upstreamHTTP.URL})
+	r := cache.setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+hash, nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "upstream content", w.Body.String())
+
+	// The file is cached locally and served without the upstream afterwards
+	exists, err := cacheStorer.Exists(hash)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+hash, nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(downloads))
+}
+
+func TestPullThroughCacheMissingUpstreamFile(t *testing.T) {
+	upstreamHTTP, _, _ := newTestUpstream(t, 0)
+
+	cache, _ := newTestServer(t, &Config{UpstreamURL: upstreamHTTP.URL})
+	r := cache.setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+contentHash([]byte("nowhere")), nil))
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestPullThroughCacheUnavailableUpstream(t *testing.T) {
+	upstreamHTTP, _, _ := newTestUpstream(t, 0)
+	upstreamHTTP.Close()
+
+	cache, _ := newTestServer(t, &Config{UpstreamURL: upstreamHTTP.URL})
+	r := cache.setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+contentHash([]byte("nowhere")), nil))
+	assert.Equal(t, 502, w.Code)
+}
+
+func TestPullThroughCacheCoalescesConcurrentMisses(t *testing.T) {
+	upstreamHTTP, upstream, downloads := newTestUpstream(t, 100*time.Millisecond)
+	hash := saveToStorage(t, upstream.storer, []byte("popular content"))
+
+	cache, _ := newTestServer(t, &Config{UpstreamURL: upstreamHTTP.URL})
+	cacheHTTP := httptest.NewServer(cache.setupRouter())
+	defer cacheHTTP.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := http.Get(cacheHTTP.URL + "/file/" + hash)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, 200, resp.StatusCode)
+			assert.Equal(t, "popular content", string(body))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(downloads))
+}
+
+func TestPullThroughCacheStalledUpstream(t *testing.T) {
+	// An upstream that accepts requests but never answers
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(stalled.Close)
+	t.Cleanup(func() { close(release) })
+
+	cache, _ := newTestServer(t, &Config{UpstreamURL: stalled.URL, UpstreamTimeout: 100 * time.Millisecond})
+	r := cache.setupRouter()
+	hash := contentHash([]byte("stalled"))
+
+	// A client going away stops waiting for the fetch
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	start := time.Now()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+hash, nil).WithContext(ctx))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// The fetch itself times out, so later requests don't hang either
+	w = httptest.NewRecorder()
+	start = time.Now()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/file/"+hash, nil))
+	assert.Equal(t, 502, w.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
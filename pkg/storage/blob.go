@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported encodings of the stored content.
+const (
+	// EncodingZstd stores the content compressed with zstd.
+	EncodingZstd = "zstd"
+	// EncodingGzip stores the content compressed with gzip.
+	EncodingGzip = "gzip"
+)
+
+// blobMagic starts every blob stored with a header. Blobs without it are
+// stored as is, which keeps the files written before the header was
+// introduced readable.
+const blobMagic = "HFSBLOB\x00"
+
+// maxBlobHeaderSize limits the size of the header to protect from reading
+// garbage as a header length.
+const maxBlobHeaderSize = 64 << 10
+
+// minCompressionGain is the minimal share of space compression must save,
+// otherwise the content is stored uncompressed.
+const minCompressionGain = 0.1
+
+// blobHeader describes how the content of a blob is stored.
+//
+// On disk the header is stored as blobMagic, followed by the big-endian uint32
+// length of the JSON encoded header and the header itself.
+type blobHeader struct {
+	// Version is the version of the header format.
+	Version int `json:"v"`
+	// Encoding is the compression of the content, empty if it is not compressed.
+	Encoding string `json:"encoding,omitempty"`
+	// Size is the size of the original content.
+	Size int64 `json:"size"`
+
+	// Encryption is the algorithm the content is encrypted with, empty if it is not encrypted.
+	// The content is compressed before it is encrypted.
+	Encryption string `json:"encryption,omitempty"`
+	// KeyID is the ID of the key-encryption key the data key is wrapped with.
+	KeyID string `json:"key_id,omitempty"`
+	// WrappedKey is the data key of the blob encrypted with the key-encryption key.
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+	// NoncePrefix is the random prefix of the nonces of the encrypted chunks.
+	NoncePrefix []byte `json:"nonce_prefix,omitempty"`
+	// ChunkSize is the size of the plaintext chunks encrypted separately.
+	ChunkSize int `json:"chunk_size,omitempty"`
+}
+
+// Option configures a Storage.
+type Option func(s *Storage) error
+
+// WithCompression makes the storage compress the files at rest.
+//
+// Files are still addressed by the hash of the uncompressed content. Content
+// that is already compressed or doesn't shrink enough is stored uncompressed.
+//
+// encoding: EncodingZstd, EncodingGzip or an empty string to disable compression.
+func WithCompression(encoding string) Option {
+	return func(s *Storage) error {
+		switch encoding {
+		case "", EncodingZstd, EncodingGzip:
+			s.compression = encoding
+			return nil
+		default:
+			return fmt.Errorf("unsupported compression %q", encoding)
+		}
+	}
+}
+
+// NewDecoder returns a reader decoding the content stored with the given encoding.
+//
+// encoding: the encoding of the content, an empty string for plain content.
+// r: the reader of the encoded content.
+//
+// Returns the reader of the decoded content and an error if there was any
+func NewDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return io.NopCloser(r), nil
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// newEncoder returns a writer encoding the content with the given encoding.
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingZstd:
+		return zstd.NewWriter(w)
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// isCompressible reports whether content starting with the given bytes is
+// worth compressing. Images, media and archives are already compressed.
+func isCompressible(head []byte) bool {
+	contentType := http.DetectContentType(head)
+
+	switch {
+	case strings.HasPrefix(contentType, "image/") && contentType != "image/bmp" && contentType != "image/x-icon":
+		return false
+	case strings.HasPrefix(contentType, "video/"), strings.HasPrefix(contentType, "audio/"), strings.HasPrefix(contentType, "font/woff"):
+		return false
+	}
+
+	switch contentType {
+	case "application/zip", "application/x-gzip", "application/x-rar-compressed", "application/pdf", "application/vnd.ms-fontobject":
+		return false
+	}
+
+	// Zstd frames are not detected by http.DetectContentType
+	return !bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd})
+}
+
+// readBlobHeader reads the header of a blob.
+//
+// Returns nil if the blob is stored without a header and an error if there was any
+func readBlobHeader(r *bufio.Reader) (*blobHeader, error) {
+	magic, err := r.Peek(len(blobMagic))
+	if err == io.EOF || (err == nil && string(magic) != blobMagic) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Skip the magic and read the length of the header
+	prefix := make([]byte, len(blobMagic)+4)
+	if _, err = io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("error reading blob header: %v", err)
+	}
+
+	headerSize := binary.BigEndian.Uint32(prefix[len(blobMagic):])
+	if headerSize > maxBlobHeaderSize {
+		return nil, fmt.Errorf("blob header is too large")
+	}
+
+	rawHeader := make([]byte, headerSize)
+	if _, err = io.ReadFull(r, rawHeader); err != nil {
+		return nil, fmt.Errorf("error reading blob header: %v", err)
+	}
+
+	header := &blobHeader{}
+	if err = json.Unmarshal(rawHeader, header); err != nil {
+		return nil, fmt.Errorf("error decoding blob header: %v", err)
+	}
+
+	if header.Version != 1 {
+		return nil, fmt.Errorf("unsupported blob version %d", header.Version)
+	}
+
+	return header, nil
+}
+
+// writeBlobHeader writes the header of a blob.
+func writeBlobHeader(w io.Writer, header *blobHeader) error {
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, len(blobMagic)+4)
+	copy(prefix, blobMagic)
+	binary.BigEndian.PutUint32(prefix[len(blobMagic):], uint32(len(rawHeader)))
+
+	if _, err = w.Write(prefix); err != nil {
+		return err
+	}
+	_, err = w.Write(rawHeader)
+	return err
+}
+
+// openBlob opens a stored blob and reads its header.
+//
+// Returns the blob file, the reader positioned at the stored content, the
+// header or nil if the blob has none, and an error if there was any
+func openBlob(filePath string) (*os.File, io.Reader, *blobHeader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	header, err := readBlobHeader(reader)
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+
+	return file, reader, header, nil
+}
+
+// openContent opens a stored blob and decrypts its content if it is encrypted.
+//
+// Returns the blob file, the reader of the decrypted content, which is still
+// compressed with the returned encoding, and an error if there was any
+func (s *Storage) openContent(filePath string) (*os.File, io.Reader, string, error) {
+	file, reader, header, err := openBlob(filePath)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if header == nil {
+		return file, reader, "", nil
+	}
+
+	if header.Encryption != "" {
+		if s.keyring == nil {
+			file.Close()
+			return nil, nil, "", fmt.Errorf("file is encrypted, but encryption is not configured")
+		}
+
+		reader, err = s.keyring.newDecryptReader(reader, header)
+		if err != nil {
+			file.Close()
+			return nil, nil, "", err
+		}
+	}
+
+	return file, reader, header.Encoding, nil
+}
+
+// decodeBlob copies the original content of a stored blob to the writer.
+func (s *Storage) decodeBlob(filePath string, w io.Writer) error {
+	file, reader, encoding, err := s.openContent(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder, err := NewDecoder(encoding, reader)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	_, err = io.Copy(w, decoder)
+	return err
+}
+
+// storeBlob moves the content of a temporary file to the blob path, compressing
+// and encrypting it if the storage is configured to.
+//
+// The caller must hold the mutex of the hash.
+func (s *Storage) storeBlob(tmpFilePath string, filePath string) error {
+	src, err := os.Open(tmpFilePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	head = head[:n]
+
+	header := &blobHeader{Version: 1, Size: info.Size()}
+	if s.compression != "" && isCompressible(head) {
+		header.Encoding = s.compression
+	}
+
+	// Plain content can be moved as is unless it looks like a blob header
+	if header.Encoding == "" && s.keyring == nil && !bytes.HasPrefix(head, []byte(blobMagic)) {
+		src.Close()
+		return os.Rename(tmpFilePath, filePath)
+	}
+
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Write the encoded blob next to its final path, so that it can be renamed atomically
+	dst, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if err = s.writeEncodedBlob(dst, src, header); err != nil {
+		return err
+	}
+
+	// Store the content uncompressed if compression didn't pay off
+	if header.Encoding != "" {
+		info, err := dst.Stat()
+		if err != nil {
+			return err
+		}
+
+		if float64(info.Size()) > float64(header.Size)*(1-minCompressionGain) {
+			if s.keyring == nil && !bytes.HasPrefix(head, []byte(blobMagic)) {
+				src.Close()
+				return os.Rename(tmpFilePath, filePath)
+			}
+
+			// Rewrite the blob uncompressed, still with a header to encrypt it
+			// or to keep the content from being read as a header
+			if _, err = src.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err = dst.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err = dst.Truncate(0); err != nil {
+				return err
+			}
+
+			header.Encoding = ""
+			if err = s.writeEncodedBlob(dst, src, header); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(dst.Name(), filePath); err != nil {
+		return err
+	}
+
+	src.Close()
+	return os.Remove(tmpFilePath)
+}
+
+// writeEncodedBlob writes the header and the content encoded according to it.
+// The content is encrypted with a new data key if the storage has a keyring.
+func (s *Storage) writeEncodedBlob(w io.Writer, src io.Reader, header *blobHeader) error {
+	var dataKey []byte
+	if s.keyring != nil {
+		// Every write gets a new data key and nonce prefix, so they are never reused
+		var err error
+		if dataKey, err = s.keyring.newEncryption(header); err != nil {
+			return err
+		}
+	}
+
+	buffered := bufio.NewWriter(w)
+
+	if err := writeBlobHeader(buffered, header); err != nil {
+		return err
+	}
+
+	// Layer the writers: the content is compressed first and then encrypted
+	var dst io.Writer = buffered
+	closers := []io.Closer{}
+
+	if dataKey != nil {
+		encryptor, err := newEncryptWriter(dst, dataKey, header)
+		if err != nil {
+			return err
+		}
+		dst = encryptor
+		closers = append(closers, encryptor)
+	}
+
+	if header.Encoding != "" {
+		encoder, err := newEncoder(header.Encoding, dst)
+		if err != nil {
+			return err
+		}
+		dst = encoder
+		closers = append(closers, encoder)
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	// Close the outermost writer first, so that it flushes into the inner ones
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return err
+		}
+	}
+
+	return buffered.Flush()
+}
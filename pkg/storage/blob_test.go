@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+	"github.com/stretchr/testify/assert"
+)
+
+// readStored returns the raw content of a stored file.
+func readStored(t *testing.T, basePath string, hash string) []byte {
+	t.Helper()
+
+	content, err := os.ReadFile(helpers.GetFilePath(basePath, hash))
+	assert.NoError(t, err)
+	return content
+}
+
+// readFromStorage reads a file with the Read method of the storage.
+func readFromStorage(t *testing.T, storage Storer, hash string) []byte {
+	t.Helper()
+
+	filePath, err := storage.Read(hash)
+	assert.NoError(t, err)
+	defer os.Remove(filePath)
+
+	content, err := os.ReadFile(filePath)
+	assert.NoError(t, err)
+	return content
+}
+
+func TestNewStorageWithUnsupportedCompression(t *testing.T) {
+	_, err := NewStorage(t.TempDir(), WithCompression("lz4"))
+	assert.Error(t, err)
+}
+
+func TestCompressedStorageRoundTrip(t *testing.T) {
+	for _, encoding := range []string{EncodingZstd, EncodingGzip} {
+		t.Run(encoding, func(t *testing.T) {
+			basePath := t.TempDir()
+			storage, err := NewStorage(basePath, WithCompression(encoding))
+			assert.NoError(t, err)
+
+			data := []byte(strings.Repeat(`{"level":"info","msg":"compressible log line"}`+"\n", 1000))
+			assert.NoError(t, storage.saveFile("hash", data))
+
+			// The file is stored compressed
+			stored := readStored(t, basePath, "hash")
+			assert.True(t, bytes.HasPrefix(stored, []byte(blobMagic)))
+			assert.Less(t, len(stored), len(data)/5)
+
+			// Read returns the original content
+			assert.Equal(t, data, readFromStorage(t, storage, "hash"))
+
+			// ReadEncoded returns the compressed content if the encoding is accepted
+			filePath, contentEncoding, err := storage.ReadEncoded("hash", []string{"br", encoding})
+			assert.NoError(t, err)
+			assert.Equal(t, encoding, contentEncoding)
+
+			file, err := os.Open(filePath)
+			assert.NoError(t, err)
+			decoder, err := NewDecoder(contentEncoding, file)
+			assert.NoError(t, err)
+			decoded, err := io.ReadAll(decoder)
+			assert.NoError(t, err)
+			decoder.Close()
+			file.Close()
+			assert.Equal(t, data, decoded)
+
+			// ReadEncoded decodes the content if the encoding is not accepted
+			filePath, contentEncoding, err = storage.ReadEncoded("hash", []string{"br"})
+			assert.NoError(t, err)
+			assert.Equal(t, "", contentEncoding)
+			decoded, err = os.ReadFile(filePath)
+			assert.NoError(t, err)
+			assert.Equal(t, data, decoded)
+		})
+	}
+}
+
+func TestCompressedStorageSkipsIncompressibleContent(t *testing.T) {
+	basePath := t.TempDir()
+	storage, err := NewStorage(basePath, WithCompression(EncodingZstd))
+	assert.NoError(t, err)
+
+	// Random data doesn't shrink
+	random := make([]byte, 64<<10)
+	_, err = rand.Read(random)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.saveFile("random", random))
+	assert.Equal(t, random, readStored(t, basePath, "random"))
+
+	// Already compressed formats are not compressed again
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{0}, 4096)...)
+	assert.NoError(t, storage.saveFile("png", png))
+	assert.Equal(t, png, readStored(t, basePath, "png"))
+}
+
+func TestStorageKeepsContentLookingLikeHeader(t *testing.T) {
+	basePath := t.TempDir()
+	storage, err := NewStorage(basePath)
+	assert.NoError(t, err)
+
+	// Content starting with the magic must not be mistaken for a header
+	data := []byte(blobMagic + "\x00\x00\x00\x02{}")
+	assert.NoError(t, storage.saveFile("magic", data))
+	assert.Equal(t, data, readFromStorage(t, storage, "magic"))
+}
+
+func TestCompressedStorageReadsPlainFiles(t *testing.T) {
+	basePath := t.TempDir()
+
+	// Files written without compression stay readable after enabling it
+	plain, err := NewStorage(basePath)
+	assert.NoError(t, err)
+	assert.NoError(t, plain.saveFile("hash", []byte(strings.Repeat("data", 1000))))
+
+	compressed, err := NewStorage(basePath, WithCompression(EncodingZstd))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(strings.Repeat("data", 1000)), readFromStorage(t, compressed, "hash"))
+}
@@ -0,0 +1,521 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+)
+
+// EncryptionAlgorithm is the algorithm of the encrypted content stored in blob headers.
+const EncryptionAlgorithm = "AES-256-GCM-STREAM"
+
+// encryptionChunkSize is the size of the plaintext chunks sealed separately,
+// it bounds the memory needed to encrypt and decrypt a stream.
+const encryptionChunkSize = 64 << 10
+
+// noncePrefixSize is the size of the random nonce prefix of a blob. The rest
+// of the 12 byte nonce is the chunk counter and the last chunk flag.
+const noncePrefixSize = 7
+
+// Keyring holds the key-encryption keys used to encrypt files at rest.
+//
+// Every file is encrypted with its own random data key, which is stored in the
+// file header wrapped with the active key-encryption key.
+type Keyring struct {
+	// keys maps key IDs to 32 byte AES-256 keys.
+	keys map[string][]byte
+
+	// active is the ID of the key used to wrap the data keys of new files.
+	active string
+}
+
+// NewKeyring creates a new Keyring.
+//
+// keys: the map of key IDs to 32 byte AES-256 keys.
+// active: the ID of the key to encrypt new files with, may be empty if there is only one key.
+//
+// Returns a pointer to a Keyring instance and an error if there was any.
+func NewKeyring(keys map[string][]byte, active string) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keyring has no keys")
+	}
+
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ":,\n") {
+			return nil, fmt.Errorf("invalid key ID %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes long, got %d", id, len(key))
+		}
+	}
+
+	if active == "" {
+		if len(keys) > 1 {
+			return nil, fmt.Errorf("active key must be set when there are several keys")
+		}
+		for id := range keys {
+			active = id
+		}
+	}
+
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", active)
+	}
+
+	return &Keyring{keys: keys, active: active}, nil
+}
+
+// ParseKeyring parses keys in the "id:base64key" format separated by commas or new lines.
+// Empty lines and lines starting with # are skipped.
+//
+// data: the keys to parse.
+// active: the ID of the key to encrypt new files with, may be empty if there is only one key.
+//
+// Returns a pointer to a Keyring instance and an error if there was any.
+func ParseKeyring(data string, active string) (*Keyring, error) {
+	keys := map[string][]byte{}
+
+	for _, line := range strings.FieldsFunc(data, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, encodedKey, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("key must be in the id:base64key format")
+		}
+		id = strings.TrimSpace(id)
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding key %q: %v", id, err)
+		}
+
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key %q", id)
+		}
+		keys[id] = key
+	}
+
+	return NewKeyring(keys, active)
+}
+
+// LoadKeyring reads keys from a file in the format accepted by ParseKeyring.
+//
+// path: the path to the key file.
+// active: the ID of the key to encrypt new files with, may be empty if there is only one key.
+//
+// Returns a pointer to a Keyring instance and an error if there was any.
+func LoadKeyring(path string, active string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %v", err)
+	}
+
+	return ParseKeyring(string(data), active)
+}
+
+// ActiveKeyID returns the ID of the key used to encrypt new files.
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// KeyIDs returns the sorted IDs of all keys in the keyring.
+func (k *Keyring) KeyIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// WithEncryption makes the storage encrypt the files at rest.
+//
+// Files written before encryption was enabled stay readable and are encrypted
+// by Reencrypt.
+//
+// keyring: the keys to encrypt files with, nil to disable encryption.
+func WithEncryption(keyring *Keyring) Option {
+	return func(s *Storage) error {
+		s.keyring = keyring
+		return nil
+	}
+}
+
+// wrapKey encrypts a data key with the key-encryption key of the given ID.
+func (k *Keyring) wrapKey(id string, dataKey []byte) ([]byte, error) {
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// The key ID is authenticated, so a wrapped key can't be moved between keys
+	return aead.Seal(nonce, nonce, dataKey, []byte(id)), nil
+}
+
+// unwrapKey decrypts a data key wrapped with the key-encryption key of the given ID.
+func (k *Keyring) unwrapKey(id string, wrappedKey []byte) ([]byte, error) {
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+
+	dataKey, err := aead.Open(nil, wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %v", err)
+	}
+
+	return dataKey, nil
+}
+
+// aead returns the AES-GCM cipher of the key-encryption key of the given ID.
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+
+	return newAEAD(key)
+}
+
+// newAEAD creates an AES-GCM cipher.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// newEncryption fills the encryption fields of a blob header with a new
+// random data key wrapped with the active key.
+//
+// Returns the data key and an error if there was any
+func (k *Keyring) newEncryption(header *blobHeader) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := k.wrapKey(k.active, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err = rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+
+	header.Encryption = EncryptionAlgorithm
+	header.KeyID = k.active
+	header.WrappedKey = wrappedKey
+	header.NoncePrefix = noncePrefix
+	header.ChunkSize = encryptionChunkSize
+
+	return dataKey, nil
+}
+
+// chunkNonce returns the nonce of a chunk: the nonce prefix of the blob, the
+// big-endian chunk counter and the flag of the last chunk. The flag prevents
+// truncating a stream at a chunk boundary unnoticed.
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts a stream in chunks sealed with AES-GCM.
+type encryptWriter struct {
+	w           io.Writer
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	buffer      []byte
+	chunkSize   int
+}
+
+// newEncryptWriter creates a writer encrypting the stream with the data key
+// described by the header.
+func newEncryptWriter(w io.Writer, dataKey []byte, header *blobHeader) (*encryptWriter, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:           w,
+		aead:        aead,
+		noncePrefix: header.NoncePrefix,
+		buffer:      make([]byte, 0, header.ChunkSize),
+		chunkSize:   header.ChunkSize,
+	}, nil
+}
+
+// Write buffers the data and seals every complete chunk. A full chunk is
+// sealed only when more data arrives, because the last chunk is sealed differently.
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buffer) == e.chunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buffer[len(e.buffer):e.chunkSize], p)
+		e.buffer = e.buffer[:len(e.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the last chunk, it doesn't close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// seal encrypts and writes the buffered chunk.
+func (e *encryptWriter) seal(last bool) error {
+	if e.counter == ^uint32(0) {
+		return fmt.Errorf("stream is too long to encrypt")
+	}
+
+	sealed := e.aead.Seal(nil, chunkNonce(e.noncePrefix, e.counter, last), e.buffer, nil)
+	e.counter++
+	e.buffer = e.buffer[:0]
+
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader decrypts a stream written by encryptWriter.
+type decryptReader struct {
+	r           *bufio.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	chunk       []byte
+	plain       []byte
+	done        bool
+}
+
+// newDecryptReader creates a reader decrypting the stream with the data key
+// described by the header.
+func (k *Keyring) newDecryptReader(r io.Reader, header *blobHeader) (*decryptReader, error) {
+	if header.Encryption != EncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption %q", header.Encryption)
+	}
+	if header.ChunkSize <= 0 || len(header.NoncePrefix) != noncePrefixSize {
+		return nil, fmt.Errorf("invalid encryption parameters")
+	}
+
+	dataKey, err := k.unwrapKey(header.KeyID, header.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:           bufio.NewReader(r),
+		aead:        aead,
+		noncePrefix: header.NoncePrefix,
+		chunk:       make([]byte, header.ChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// Read decrypts the stream chunk by chunk.
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return fmt.Errorf("encrypted stream is truncated")
+		}
+		return err
+	}
+
+	// The chunk is the last one if nothing follows it
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, peekErr := d.r.Peek(1); peekErr == io.EOF {
+			last = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.noncePrefix, d.counter, last), d.chunk[:n], nil)
+	if err != nil {
+		return fmt.Errorf("error decrypting file: %v", err)
+	}
+
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+// Reencrypt rewrites all files not encrypted with the active key of the keyring.
+//
+// Files encrypted with another key only get their data key rewrapped, so their
+// content is never decrypted to disk. Files stored unencrypted are encrypted.
+// The storage stays available while files are being reencrypted.
+//
+// ctx: the context controlling the job.
+//
+// Returns the number of rewritten files and an error if there was any
+func (s *Storage) Reencrypt(ctx context.Context) (int, error) {
+	if s.keyring == nil {
+		return 0, fmt.Errorf("encryption is not enabled")
+	}
+
+	hashes, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+
+		changed, err := s.reencryptFile(hash)
+		if errors.Is(err, os.ErrNotExist) {
+			// The file was deleted after listing
+			continue
+		} else if err != nil {
+			return rewritten, fmt.Errorf("error reencrypting file %s: %v", hash, err)
+		}
+
+		if changed {
+			rewritten++
+		}
+	}
+
+	return rewritten, nil
+}
+
+// reencryptFile rewrites a file if it is not encrypted with the active key.
+//
+// Returns whether the file was rewritten and an error if there was any
+func (s *Storage) reencryptFile(hash string) (bool, error) {
+	mux := createMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
+	defer deleteMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
+
+	s.lockFile(mux)
+	defer mux.Unlock()
+
+	filePath := helpers.GetFilePath(s.basePath, hash)
+
+	file, reader, header, err := openBlob(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	if header != nil && header.KeyID == s.keyring.active {
+		return false, nil
+	}
+
+	dst, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if header != nil && header.KeyID != "" {
+		// Rewrap the data key with the active key and copy the ciphertext as is
+		dataKey, err := s.keyring.unwrapKey(header.KeyID, header.WrappedKey)
+		if err != nil {
+			return false, err
+		}
+
+		if header.WrappedKey, err = s.keyring.wrapKey(s.keyring.active, dataKey); err != nil {
+			return false, err
+		}
+		header.KeyID = s.keyring.active
+
+		buffered := bufio.NewWriter(dst)
+		if err = writeBlobHeader(buffered, header); err != nil {
+			return false, err
+		}
+		if _, err = io.Copy(buffered, reader); err != nil {
+			return false, err
+		}
+		if err = buffered.Flush(); err != nil {
+			return false, err
+		}
+	} else {
+		// Decode the unencrypted file and store it again, which encrypts it
+		if err = s.decodeBlob(filePath, dst); err != nil {
+			return false, err
+		}
+		if err = dst.Close(); err != nil {
+			return false, err
+		}
+		if err = s.storeBlob(dst.Name(), filePath); err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	if err = dst.Close(); err != nil {
+		return false, err
+	}
+
+	return true, os.Rename(dst.Name(), filePath)
+}
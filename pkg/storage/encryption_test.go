@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestKey returns a random key in the "id:base64key" format.
+func newTestKey(t *testing.T, id string) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+// storedHeader returns the header of a stored file.
+func storedHeader(t *testing.T, basePath string, hash string) *blobHeader {
+	t.Helper()
+
+	file, _, header, err := openBlob(helpers.GetFilePath(basePath, hash))
+	assert.NoError(t, err)
+	file.Close()
+	return header
+}
+
+func TestParseKeyring(t *testing.T) {
+	first, second := newTestKey(t, "first"), newTestKey(t, "second")
+
+	keyring, err := ParseKeyring("# comment\n"+first+"\n\n"+second+"\n", "second")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", keyring.ActiveKeyID())
+	assert.Equal(t, []string{"first", "second"}, keyring.KeyIDs())
+
+	// The only key is active by default
+	keyring, err = ParseKeyring(first, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", keyring.ActiveKeyID())
+
+	_, err = ParseKeyring(first+","+second, "")
+	assert.Error(t, err, "active key must be set for several keys")
+
+	_, err = ParseKeyring(first, "missing")
+	assert.Error(t, err, "active key must be in the keyring")
+
+	_, err = ParseKeyring("short:"+base64.StdEncoding.EncodeToString([]byte("short")), "")
+	assert.Error(t, err, "keys must be 32 bytes long")
+
+	_, err = ParseKeyring("", "")
+	assert.Error(t, err, "keyring must not be empty")
+}
+
+func TestEncryptedStorageRoundTrip(t *testing.T) {
+	keyring, err := ParseKeyring(newTestKey(t, "key"), "")
+	assert.NoError(t, err)
+
+	sizes := []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize}
+	for _, compression := range []string{"", EncodingZstd} {
+		basePath := t.TempDir()
+		storage, err := NewStorage(basePath, WithCompression(compression), WithEncryption(keyring))
+		assert.NoError(t, err)
+
+		for _, size := range sizes {
+			data := bytes.Repeat([]byte("secret customer document "), size/25+1)[:size]
+			assert.NoError(t, storage.saveFile("hash", data))
+
+			// The content is not stored in plaintext
+			header := storedHeader(t, basePath, "hash")
+			assert.Equal(t, "key", header.KeyID)
+			if size > 0 {
+				assert.NotContains(t, string(readStored(t, basePath, "hash")), "secret customer document")
+			}
+
+			assert.Equal(t, data, readFromStorage(t, storage, "hash"), "compression %q, size %d", compression, size)
+		}
+	}
+}
+
+func TestEncryptedStorageDetectsTampering(t *testing.T) {
+	keyring, err := ParseKeyring(newTestKey(t, "key"), "")
+	assert.NoError(t, err)
+
+	basePath := t.TempDir()
+	storage, err := NewStorage(basePath, WithEncryption(keyring))
+	assert.NoError(t, err)
+
+	data := []byte(strings.Repeat("data", 2*encryptionChunkSize/4))
+	assert.NoError(t, storage.saveFile("hash", data))
+	filePath := helpers.GetFilePath(basePath, "hash")
+	stored := readStored(t, basePath, "hash")
+
+	// Flipped bits are detected
+	tampered := append([]byte{}, stored...)
+	tampered[len(tampered)-1] ^= 1
+	assert.NoError(t, os.WriteFile(filePath, tampered, 0600))
+	_, err = storage.Read("hash")
+	assert.Error(t, err)
+
+	// Dropping the last chunk is detected
+	assert.NoError(t, os.WriteFile(filePath, stored[:len(stored)-(encryptionChunkSize+16)], 0600))
+	_, err = storage.Read("hash")
+	assert.Error(t, err)
+}
+
+func TestEncryptedStorageWithUnknownKey(t *testing.T) {
+	keyring, err := ParseKeyring(newTestKey(t, "key"), "")
+	assert.NoError(t, err)
+	otherKeyring, err := ParseKeyring(newTestKey(t, "other"), "")
+	assert.NoError(t, err)
+
+	basePath := t.TempDir()
+	storage, err := NewStorage(basePath, WithEncryption(keyring))
+	assert.NoError(t, err)
+	assert.NoError(t, storage.saveFile("hash", []byte("data")))
+
+	// Files can't be read without their key
+	other, err := NewStorage(basePath, WithEncryption(otherKeyring))
+	assert.NoError(t, err)
+	_, err = other.Read("hash")
+	assert.Error(t, err)
+
+	plain, err := NewStorage(basePath)
+	assert.NoError(t, err)
+	_, err = plain.Read("hash")
+	assert.Error(t, err)
+}
+
+func TestReencrypt(t *testing.T) {
+	oldKey, newKey := newTestKey(t, "old"), newTestKey(t, "new")
+	basePath := t.TempDir()
+
+	// A file written before encryption was enabled
+	plain, err := NewStorage(basePath)
+	assert.NoError(t, err)
+	assert.NoError(t, plain.saveFile("plain", []byte("plain data")))
+
+	oldKeyring, err := ParseKeyring(oldKey, "")
+	assert.NoError(t, err)
+	oldStorage, err := NewStorage(basePath, WithCompression(EncodingZstd), WithEncryption(oldKeyring))
+	assert.NoError(t, err)
+	assert.NoError(t, oldStorage.saveFile("old", []byte(strings.Repeat("old data", 1000))))
+
+	// Rotate the key
+	rotatedKeyring, err := ParseKeyring(oldKey+","+newKey, "new")
+	assert.NoError(t, err)
+	rotated, err := NewStorage(basePath, WithCompression(EncodingZstd), WithEncryption(rotatedKeyring))
+	assert.NoError(t, err)
+	assert.NoError(t, rotated.saveFile("new", []byte("new data")))
+
+	rewritten, err := rotated.Reencrypt(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rewritten)
+
+	for _, hash := range []string{"plain", "old", "new"} {
+		assert.Equal(t, "new", storedHeader(t, basePath, hash).KeyID, hash)
+	}
+
+	// The old key is not needed anymore
+	newKeyring, err := ParseKeyring(newKey, "")
+	assert.NoError(t, err)
+	storage, err := NewStorage(basePath, WithEncryption(newKeyring))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("plain data"), readFromStorage(t, storage, "plain"))
+	assert.Equal(t, []byte(strings.Repeat("old data", 1000)), readFromStorage(t, storage, "old"))
+	assert.Equal(t, []byte("new data"), readFromStorage(t, storage, "new"))
+
+	// Everything is already encrypted with the active key
+	rewritten, err = storage.Reencrypt(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rewritten)
+}
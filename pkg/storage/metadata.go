@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+)
+
+// metadataPath returns the path of the metadata of the file with the given hash.
+//
+// Metadata is kept outside of the store directory, so that it is not listed
+// with the files or taken into account in the shard digests.
+func (s *Storage) metadataPath(hash string) (string, error) {
+	if err := validateRefHash(hash); err != nil || len(hash) < 2 {
+		return "", fmt.Errorf("invalid hash %q", hash)
+	}
+	return filepath.Join(s.basePath, "meta", hash[:2], hash+".json"), nil
+}
+
+// Metadata returns the metadata of a file.
+//
+// hash: the hash of the file
+//
+// Returns the metadata, empty if the file has none, and an error if there was any
+func (s *Storage) Metadata(hash string) (map[string]string, error) {
+	metadataPath, err := s.metadataPath(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := createMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
+	s.lockFile(mux)
+	defer mux.Unlock()
+	defer deleteMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
+
+	return readMetadata(metadataPath)
+}
+
+// SetMetadata merges the given values into the metadata of a file. Values that
+// are empty strings remove their keys.
+//
+// hash: the hash of the file
+// metadata: the values to set
+//
+// Returns os.ErrNotExist if the file doesn't exist and an error if there was any
+func (s *Storage) SetMetadata(hash string, metadata map[string]string) error {
+	metadataPath, err := s.metadataPath(hash)
+	if err != nil {
+		return err
+	}
+
+	mux := createMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
+	s.lockFile(mux)
+	defer mux.Unlock()
+	defer deleteMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
+
+	// Don't leave metadata of files that don't exist behind
+	if _, err = os.Stat(helpers.GetFilePath(s.basePath, hash)); err != nil {
+		return err
+	}
+
+	current, err := readMetadata(metadataPath)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range metadata {
+		if value == "" {
+			delete(current, key)
+		} else {
+			current[key] = value
+		}
+	}
+
+	if len(current) == 0 {
+		if err = os.Remove(metadataPath); os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(metadataPath), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(metadataPath, data)
+}
+
+// removeMetadata removes the metadata of a file. The caller must hold the mutex of the hash.
+func (s *Storage) removeMetadata(hash string) error {
+	metadataPath, err := s.metadataPath(hash)
+	if err != nil {
+		// No metadata can be stored for an invalid hash
+		return nil
+	}
+
+	if err = os.Remove(metadataPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readMetadata reads the metadata file, returning empty metadata if it doesn't exist.
+func readMetadata(metadataPath string) (map[string]string, error) {
+	data, err := os.ReadFile(metadataPath)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]string{}
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("error decoding metadata: %v", err)
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMetadata tests that metadata is merged and deleted with the file.
+func TestMetadata(t *testing.T) {
+	storage, err := NewStorage(t.TempDir())
+	assert.NoError(t, err)
+
+	// Metadata can only be set for stored files.
+	assert.ErrorIs(t, storage.SetMetadata("hash1", map[string]string{"key": "value"}), os.ErrNotExist)
+
+	assert.NoError(t, storage.saveFile("hash1", []byte("data")))
+
+	metadata, err := storage.Metadata("hash1")
+	assert.NoError(t, err)
+	assert.Empty(t, metadata)
+
+	assert.NoError(t, storage.SetMetadata("hash1", map[string]string{"a": "1", "b": "2"}))
+	assert.NoError(t, storage.SetMetadata("hash1", map[string]string{"b": "", "c": "3"}))
+
+	metadata, err = storage.Metadata("hash1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "c": "3"}, metadata)
+
+	// Metadata is not listed as a file.
+	hashes, err := storage.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hash1"}, hashes)
+
+	assert.NoError(t, storage.Delete("hash1"))
+	assert.NoError(t, storage.saveFile("hash1", []byte("data")))
+
+	metadata, err = storage.Metadata("hash1")
+	assert.NoError(t, err)
+	assert.Empty(t, metadata, "metadata must be deleted with the file")
+
+	_, err = storage.Metadata("../hash")
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
+)
+
+// ListShard returns the sorted hashes of the files in the given shard.
+//
+// shard: the name of the shard, i.e. the first two characters of the hashes
+//
+// Returns the list of hashes and an error if there was any
+func (s *Storage) ListShard(shard string) ([]string, error) {
+	// Shard names come from requests, make sure they can't escape the store
+	if len(shard) != 2 || strings.ContainsAny(shard, `/\.`) {
+		return nil, fmt.Errorf("invalid shard name %q", shard)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.basePath, "store", shard))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	hashes := []string{}
+	for _, entry := range entries {
+		// Skip temporary files of blobs being written
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		hashes = append(hashes, entry.Name())
+	}
+
+	// os.ReadDir returns entries sorted by name, keep the order explicit anyway
+	sort.Strings(hashes)
+
+	return hashes, nil
+}
+
+// ShardDigests returns the digests of all non-empty shards.
+//
+// The digest of a shard is the SHA256 of the sorted hashes of its files, so two
+// storages have equal digests for a shard only if they hold the same files in it.
+// Digests are cached and recomputed only for the shards changed since the last call.
+//
+// Returns a map of shard names to digests and an error if there was any
+func (s *Storage) ShardDigests() (map[string]string, error) {
+	shards, err := os.ReadDir(filepath.Join(s.basePath, "store"))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.shardDigestsLock.Lock()
+	defer s.shardDigestsLock.Unlock()
+
+	digests := make(map[string]string, len(shards))
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+
+		digest, ok := s.shardDigests[shard.Name()]
+		if !ok {
+			hashes, err := s.ListShard(shard.Name())
+			if err != nil {
+				return nil, err
+			}
+
+			digest = DigestHashes(hashes)
+			s.shardDigests[shard.Name()] = digest
+		}
+
+		// Empty shards are left behind by deleted files, they hold nothing to compare
+		if digest != "" {
+			digests[shard.Name()] = digest
+		}
+	}
+
+	return digests, nil
+}
+
+// DigestHashes returns the digest of a sorted list of hashes, or an empty
+// string if the list is empty.
+//
+// hashes: the sorted list of hashes
+//
+// Returns the hex encoded digest
+func DigestHashes(hashes []string) string {
+	if len(hashes) == 0 {
+		return ""
+	}
+
+	digest := sha256.New()
+	for _, hash := range hashes {
+		digest.Write([]byte(hash))
+		digest.Write([]byte{'\n'})
+	}
+
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// invalidateShardDigest drops the cached digest of the shard containing the given hash.
+func (s *Storage) invalidateShardDigest(hash string) {
+	shard := filepath.Base(helpers.GetFileParentPath(s.basePath, hash))
+
+	s.shardDigestsLock.Lock()
+	delete(s.shardDigests, shard)
+	s.shardDigestsLock.Unlock()
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestShardDigests tests that shard digests follow the content of the shards.
+func TestShardDigests(t *testing.T) {
+	storage, err := NewStorage(t.TempDir())
+	assert.NoError(t, err)
+
+	// An empty storage has no digests.
+	digests, err := storage.ShardDigests()
+	assert.NoError(t, err)
+	assert.Empty(t, digests)
+
+	assert.NoError(t, storage.saveFile("hash1", []byte("data")))
+	assert.NoError(t, storage.saveFile("other", []byte("data")))
+
+	digests, err = storage.ShardDigests()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"ha": DigestHashes([]string{"hash1"}),
+		"ot": DigestHashes([]string{"other"}),
+	}, digests)
+
+	// Adding a file changes the digest of its shard only.
+	assert.NoError(t, storage.saveFile("hash2", []byte("data")))
+	changed, err := storage.ShardDigests()
+	assert.NoError(t, err)
+	assert.Equal(t, DigestHashes([]string{"hash1", "hash2"}), changed["ha"])
+	assert.Equal(t, digests["ot"], changed["ot"])
+
+	// Deleting all files of a shard removes it from the digests.
+	assert.NoError(t, storage.Delete("other"))
+	changed, err = storage.ShardDigests()
+	assert.NoError(t, err)
+	assert.NotContains(t, changed, "ot")
+}
+
+// TestListShard tests the ListShard method of the Storage.
+func TestListShard(t *testing.T) {
+	storage, err := NewStorage(t.TempDir())
+	assert.NoError(t, err)
+
+	assert.NoError(t, storage.saveFile("hash2", []byte("data")))
+	assert.NoError(t, storage.saveFile("hash1", []byte("data")))
+
+	hashes, err := storage.ListShard("ha")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hash1", "hash2"}, hashes)
+
+	hashes, err = storage.ListShard("zz")
+	assert.NoError(t, err)
+	assert.Empty(t, hashes)
+
+	// Shard names must not escape the store directory.
+	_, err = storage.ListShard("..")
+	assert.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is the space taken by the files of the storage.
+type Usage struct {
+	// Objects is the number of stored files.
+	Objects int64
+	// Bytes is the size of the stored files on disk, after compression and encryption.
+	Bytes int64
+}
+
+// LockStats counts the acquisitions of the mutexes guarding the files.
+type LockStats struct {
+	// Acquisitions is the number of times a mutex was locked.
+	Acquisitions uint64
+	// Contended is the number of times a mutex was held by another operation on the same file.
+	Contended uint64
+	// WaitTime is the total time spent waiting for contended mutexes.
+	WaitTime time.Duration
+}
+
+// Usage walks the store and returns the space taken by the files.
+//
+// Returns the usage and an error if there was any
+func (s *Storage) Usage() (Usage, error) {
+	usage := Usage{}
+
+	err := filepath.WalkDir(filepath.Join(s.basePath, "store"), func(path string, entry os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Skip temporary files of blobs being written
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// Deleted while walking
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		usage.Objects++
+		usage.Bytes += info.Size()
+		return nil
+	})
+
+	return usage, err
+}
+
+// LockStats returns the statistics of the mutexes guarding the files.
+func (s *Storage) LockStats() LockStats {
+	return LockStats{
+		Acquisitions: s.lockAcquisitions.Load(),
+		Contended:    s.lockContentions.Load(),
+		WaitTime:     time.Duration(s.lockWaitNanos.Load()),
+	}
+}
+
+// lockFile locks the mutex of a file, counting the time spent waiting for it.
+func (s *Storage) lockFile(mux *sync.Mutex) {
+	s.lockAcquisitions.Add(1)
+	if mux.TryLock() {
+		return
+	}
+
+	start := time.Now()
+	mux.Lock()
+	s.lockContentions.Add(1)
+	s.lockWaitNanos.Add(int64(time.Since(start)))
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestUsage tests that the usage counts the stored files.
+func TestUsage(t *testing.T) {
+	storer, err := NewStorage(t.TempDir())
+	assert.NoError(t, err)
+
+	// An empty storage takes no space.
+	usage, err := storer.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, Usage{}, usage)
+
+	assert.NoError(t, storer.saveFile("hash1", []byte("data")))
+	assert.NoError(t, storer.saveFile("other", []byte("more data")))
+
+	usage, err = storer.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, Usage{Objects: 2, Bytes: 13}, usage)
+}
+
+// TestLockStats tests that waits for the mutex of a file are counted.
+func TestLockStats(t *testing.T) {
+	storer, err := NewStorage(t.TempDir())
+	assert.NoError(t, err)
+	storage := storer.(*Storage)
+
+	assert.NoError(t, storage.saveFile("hash", []byte("data")))
+	stats := storage.LockStats()
+	assert.Equal(t, uint64(1), stats.Acquisitions)
+	assert.Zero(t, stats.Contended)
+
+	// Hold the mutex of the file while it is being saved.
+	mux := createMutexMapEntry(&storage.muxMapLock, storage.muxMap, "hash")
+	mux.Lock()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		mux.Unlock()
+	}()
+	assert.NoError(t, storage.saveFile("hash", []byte("data")))
+
+	stats = storage.LockStats()
+	assert.Equal(t, uint64(2), stats.Acquisitions)
+	assert.Equal(t, uint64(1), stats.Contended)
+	assert.GreaterOrEqual(t, stats.WaitTime, 10*time.Millisecond)
+}
@@ -1,11 +1,15 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pavlov061356/http_based_file_storage/internal/helpers"
 )
@@ -36,12 +40,69 @@ type Storer interface {
 	// Returns the path to the file and an error if there was any
 	Read(hash string) (string, error)
 
+	// ReadEncoded reads a file from the storage keeping it compressed if it is
+	// stored with one of the accepted encodings
+	//
+	// hash: the hash of the file to read
+	// acceptedEncodings: the encodings the caller can handle
+	//
+	// Returns the path to the file, the encoding of its content, empty if the
+	// content is not encoded, and an error if there was any
+	ReadEncoded(hash string, acceptedEncodings []string) (string, string, error)
+
 	// Delete deletes a file from the storage
 	//
 	// hash: the hash of the file to delete
 	//
 	// Returns an error if there was any
 	Delete(hash string) error
+
+	// Metadata returns the metadata of a file
+	//
+	// hash: the hash of the file
+	//
+	// Returns the metadata, empty if the file has none, and an error if there was any
+	Metadata(hash string) (map[string]string, error)
+
+	// SetMetadata merges the given values into the metadata of a file, empty values remove their keys
+	//
+	// hash: the hash of the file
+	// metadata: the values to set
+	//
+	// Returns an error if there was any
+	SetMetadata(hash string, metadata map[string]string) error
+
+	// List returns the hashes of all files in the storage
+	//
+	// Returns the list of hashes and an error if there was any
+	List() ([]string, error)
+
+	// ListShard returns the sorted hashes of the files in the given shard
+	//
+	// shard: the name of the shard, i.e. the first two characters of the hashes
+	//
+	// Returns the list of hashes and an error if there was any
+	ListShard(shard string) ([]string, error)
+
+	// ShardDigests returns the digests of all non-empty shards
+	//
+	// Returns a map of shard names to digests and an error if there was any
+	ShardDigests() (map[string]string, error)
+
+	// Reencrypt rewrites all files not encrypted with the active encryption key
+	//
+	// ctx: the context controlling the job
+	//
+	// Returns the number of rewritten files and an error if there was any
+	Reencrypt(ctx context.Context) (int, error)
+
+	// Usage returns the number and the size on disk of the stored files
+	//
+	// Returns the usage and an error if there was any
+	Usage() (Usage, error)
+
+	// LockStats returns how often operations waited for the mutexes guarding the files
+	LockStats() LockStats
 }
 
 // Storage represents a file storage system.
@@ -55,14 +116,33 @@ type Storage struct {
 
 	// muxMapLock is a mutex used to synchronize access to the muxMap.
 	muxMapLock sync.Mutex
+
+	// shardDigests caches the digests of the store/xx shard directories.
+	// The key is the shard name, a missing entry means the digest must be recomputed.
+	shardDigests map[string]string
+
+	// shardDigestsLock is a mutex used to synchronize access to the shardDigests.
+	shardDigestsLock sync.Mutex
+
+	// compression is the encoding used to compress files at rest, empty if compression is disabled.
+	compression string
+
+	// keyring holds the keys used to encrypt files at rest, nil if encryption is disabled.
+	keyring *Keyring
+
+	// lockAcquisitions, lockContentions and lockWaitNanos count the waits for the mutexes of the muxMap.
+	lockAcquisitions atomic.Uint64
+	lockContentions  atomic.Uint64
+	lockWaitNanos    atomic.Int64
 }
 
 // NewStorage creates a new instance of Storage with the specified base path.
 //
 // basePath: the base path where the files will be stored.
+// opts: the options configuring the storage, e.g. WithCompression.
 //
 // Returns a pointer to a Storage instance and an error if there was any.
-func NewStorage(basePath string) (Storer, error) {
+func NewStorage(basePath string, opts ...Option) (Storer, error) {
 	// Check if the base path exists
 	_, err := os.Stat(basePath)
 	if os.IsNotExist(err) {
@@ -75,11 +155,20 @@ func NewStorage(basePath string) (Storer, error) {
 		// If there was an error while checking the directory, return the error
 		return nil, err
 	}
-	// Return a new Storage instance
-	return &Storage{
-		basePath: basePath,
-		muxMap:   make(map[string]*sync.Mutex),
-	}, nil
+	// Create a new Storage instance and apply the options
+	storage := &Storage{
+		basePath:     basePath,
+		muxMap:       make(map[string]*sync.Mutex),
+		shardDigests: make(map[string]string),
+	}
+
+	for _, opt := range opts {
+		if err := opt(storage); err != nil {
+			return nil, err
+		}
+	}
+
+	return storage, nil
 }
 
 // Exists checks if a file with the given hash exists in the storage.
@@ -115,7 +204,7 @@ func (s *Storage) SaveFileFromTemp(hash string, tmpFilePath string) error {
 
 	filePath := helpers.GetFilePath(s.basePath, hash)
 	// Lock the mutex to prevent concurrent access to the file
-	mux.Lock()
+	s.lockFile(mux)
 	defer mux.Unlock()
 
 	defer deleteMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
@@ -131,11 +220,12 @@ func (s *Storage) SaveFileFromTemp(hash string, tmpFilePath string) error {
 		return os.ErrExist
 	}
 
-	// Save the file by renaming the temporary file
-	err = os.Rename(tmpFilePath, filePath)
+	// Save the file by moving the temporary file, compressing it if needed
+	err = s.storeBlob(tmpFilePath, filePath)
 	if err != nil {
 		return err
 	}
+	s.invalidateShardDigest(hash)
 
 	return nil
 }
@@ -151,15 +241,29 @@ func (s *Storage) saveFile(hash string, data []byte) error {
 	}
 
 	mux := createMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
-	mux.Lock()
+	s.lockFile(mux)
 	defer mux.Unlock()
 
 	defer deleteMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
 
-	err = os.WriteFile(filePath, data, 0644)
+	tmpFile, err := os.CreateTemp(hashedFilePath, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	// Store the data the same way as uploaded files, replacing the existing file
+	err = s.storeBlob(tmpFile.Name(), filePath)
 	if err != nil {
 		return err
 	}
+	s.invalidateShardDigest(hash)
 	return nil
 }
 
@@ -169,8 +273,59 @@ func (s *Storage) saveFile(hash string, data []byte) error {
 //
 // Returns the path to the file and an error if there was any
 func (s *Storage) Read(hash string) (string, error) {
+	return s.readToTemp(hash, func(filePath string, w io.Writer) error {
+		// Decrypt and decompress the content if it is stored encrypted or compressed
+		return s.decodeBlob(filePath, w)
+	})
+}
+
+// ReadEncoded reads a file from the storage and writes it to a temporary file
+// keeping it compressed if it is stored with one of the accepted encodings.
+//
+// hash: the hash of the file to read
+// acceptedEncodings: the encodings the caller can handle
+//
+// Returns the path to the file, the encoding of its content, empty if the
+// content is not encoded, and an error if there was any
+func (s *Storage) ReadEncoded(hash string, acceptedEncodings []string) (string, string, error) {
+	encoding := ""
 
+	tempFilePath, err := s.readToTemp(hash, func(filePath string, w io.Writer) error {
+		file, reader, storedEncoding, err := s.openContent(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if storedEncoding == "" || !slices.Contains(acceptedEncodings, storedEncoding) {
+			decoder, err := NewDecoder(storedEncoding, reader)
+			if err != nil {
+				return err
+			}
+			defer decoder.Close()
+
+			_, err = io.Copy(w, decoder)
+			return err
+		}
+
+		// Copy the stored compressed content as is
+		encoding = storedEncoding
+		_, err = io.Copy(w, reader)
+		return err
+	})
+
+	return tempFilePath, encoding, err
+}
+
+// readToTemp copies a file from the storage to a temporary file.
+//
+// hash: the hash of the file to read
+// copyFile: the function writing the content of the stored file to the temporary file
+//
+// Returns the path to the temporary file and an error if there was any
+func (s *Storage) readToTemp(hash string, copyFile func(filePath string, w io.Writer) error) (string, error) {
 	mux := createMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
+	defer deleteMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
 
 	// Get the file path for the given hash
 	filePath := helpers.GetFilePath(s.basePath, hash)
@@ -186,39 +341,26 @@ func (s *Storage) Read(hash string) (string, error) {
 	if !exists {
 		return "", os.ErrNotExist
 	}
-	mux.Lock()
-
-	file, err := os.Open(filePath)
-
-	if err != nil {
-		// If there was an error while opening the file, return the error
-		return "", fmt.Errorf("error opening file: %v", err)
-	}
-	defer file.Close()
 
-	tempDir, err := os.MkdirTemp(os.TempDir(), hash)
-
-	if err != nil {
-		return "", fmt.Errorf("error creating temp dir: %v", err)
-	}
-	tempFilePath := filepath.Join(tempDir, hash)
+	s.lockFile(mux)
+	defer mux.Unlock()
 
-	temFile, err := os.Create(tempFilePath)
+	// A plain temporary file, so that removing it leaves nothing behind
+	temFile, err := os.CreateTemp(os.TempDir(), hash+"-*")
 	if err != nil {
 		return "", fmt.Errorf("error creating temp file: %v", err)
 	}
 	defer temFile.Close()
+	tempFilePath := temFile.Name()
 
-	_, err = io.Copy(temFile, file)
+	err = copyFile(filePath, temFile)
 
 	if err != nil {
+		temFile.Close()
+		os.Remove(tempFilePath)
 		return "", fmt.Errorf("error copying file: %v", err)
 	}
 
-	mux.Unlock()
-
-	defer deleteMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
-
 	// Return the path to the temporary file
 	return tempFilePath, nil
 }
@@ -235,7 +377,7 @@ func (s *Storage) Delete(hash string) error {
 	filePath := helpers.GetFilePath(s.basePath, hash)
 
 	// Lock the mutex to prevent concurrent access to the file
-	mux.Lock()
+	s.lockFile(mux)
 	defer mux.Unlock()
 	defer deleteMutexMapEntry(&s.muxMapLock, s.muxMap, hash)
 
@@ -244,9 +386,50 @@ func (s *Storage) Delete(hash string) error {
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	if err == nil {
+		s.invalidateShardDigest(hash)
+	}
 
-	return nil
+	return s.removeMetadata(hash)
 }
+
+// List returns the hashes of all files in the storage.
+//
+// Returns the list of hashes and an error if there was any
+func (s *Storage) List() ([]string, error) {
+	storePath := filepath.Join(s.basePath, "store")
+
+	// Every file is stored in a directory named after the first two characters of its hash
+	shards, err := os.ReadDir(storePath)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	hashes := []string{}
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+
+		entries, err := os.ReadDir(filepath.Join(storePath, shard.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			// Skip temporary files of blobs being written
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			hashes = append(hashes, entry.Name())
+		}
+	}
+
+	return hashes, nil
+}
+
 func deleteMutexMapEntry(muxMapLock *sync.Mutex, muxMap map[string]*sync.Mutex, hash string) {
 	muxMapLock.Lock()
 
@@ -268,3 +268,26 @@ func TestStorageReadOnDeletedFile(t *testing.T) {
 	// Assert that the Read method returns an error.
 	assert.Error(t, err)
 }
+
+// TestStorageList tests the List method of the Storage.
+//
+// It verifies that the List method returns the hashes of all saved files.
+func TestStorageList(t *testing.T) {
+	// Create a new Storage instance in an empty directory.
+	storage, err := NewStorage(t.TempDir())
+	assert.NoError(t, err)
+
+	// An empty storage has no files.
+	hashes, err := storage.List()
+	assert.NoError(t, err)
+	assert.Empty(t, hashes)
+
+	// Save files with different hashes.
+	assert.NoError(t, storage.saveFile("hash1", []byte("data")))
+	assert.NoError(t, storage.saveFile("other", []byte("data")))
+
+	// Assert that all saved files are listed.
+	hashes, err = storage.List()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"hash1", "other"}, hashes)
+}
@@ -0,0 +1,443 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when a file doesn't fit into the quota of a tenant.
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// tenantNamePattern restricts tenant names to safe directory names.
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// TenantFile is a reference of a tenant to a file in the shared store.
+type TenantFile struct {
+	// Hash is the hash of the file content.
+	Hash string `json:"hash"`
+	// Name is the name of the file given by the client.
+	Name string `json:"name"`
+	// Size is the size of the file content.
+	Size int64 `json:"size"`
+	// ContentType is the content type of the file given by the client.
+	ContentType string `json:"content_type,omitempty"`
+	// CreatedAt is the time the tenant uploaded the file.
+	CreatedAt time.Time `json:"created_at"`
+	// Metadata is the metadata the tenant's uploads attached to the file, e.g.
+	// by pre-save hooks. It is kept per tenant, unlike the metadata of the store.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// TenantIndex keeps the references of tenants to the files in the shared store.
+//
+// Every tenant has its own directory with a JSON file per referenced hash, so
+// the same content uploaded by several tenants is stored once. A file is
+// deleted from the store when its last reference is removed.
+type TenantIndex struct {
+	basePath string
+	storer   Storer
+
+	// lock serializes changes of references, so that a file is never deleted
+	// while a reference to it is being added
+	lock sync.Mutex
+
+	// usage caches the total size of the files referenced by each tenant
+	usage map[string]int64
+}
+
+// NewTenantIndex creates an index of tenant references to the files of the storage.
+//
+// basePath: the base path of the storage
+// storer: the storage holding the files
+//
+// Returns the index and an error if there was any
+func NewTenantIndex(basePath string, storer Storer) (*TenantIndex, error) {
+	if err := os.MkdirAll(filepath.Join(basePath, "tenants"), 0755); err != nil {
+		return nil, err
+	}
+
+	return &TenantIndex{
+		basePath: basePath,
+		storer:   storer,
+		usage:    map[string]int64{},
+	}, nil
+}
+
+// ValidateTenant checks that the tenant name can be used as a namespace.
+//
+// tenant: the name of the tenant
+//
+// Returns an error if the name is invalid
+func ValidateTenant(tenant string) error {
+	if !tenantNamePattern.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant name %q", tenant)
+	}
+	return nil
+}
+
+// validateRefHash checks that the hash can be used as a file name.
+func validateRefHash(hash string) error {
+	if hash == "" || strings.ContainsAny(hash, `/\`) || strings.HasPrefix(hash, ".") {
+		return fmt.Errorf("invalid hash %q", hash)
+	}
+	return nil
+}
+
+// tenantPath returns the directory of the references of the tenant.
+func (t *TenantIndex) tenantPath(tenant string) string {
+	return filepath.Join(t.basePath, "tenants", tenant)
+}
+
+// refPath returns the path of the reference of the tenant to the hash.
+func (t *TenantIndex) refPath(tenant string, hash string) string {
+	return filepath.Join(t.tenantPath(tenant), hash+".json")
+}
+
+// AddRef adds a reference of the tenant to a file.
+//
+// The reference should be added before the file is saved to the store, so
+// that it can't be deleted in between by another tenant removing its reference.
+//
+// tenant: the name of the tenant
+// file: the metadata of the file
+// quota: the maximal total size of the files of the tenant, zero for no limit
+//
+// Returns false if the tenant already referenced the file, ErrQuotaExceeded if
+// the file doesn't fit into the quota, and an error if there was any
+func (t *TenantIndex) AddRef(tenant string, file TenantFile, quota int64) (bool, error) {
+	if err := ValidateTenant(tenant); err != nil {
+		return false, err
+	}
+	if err := validateRefHash(file.Hash); err != nil {
+		return false, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	refPath := t.refPath(tenant, file.Hash)
+	if _, err := os.Stat(refPath); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	usage, err := t.usageLocked(tenant)
+	if err != nil {
+		return false, err
+	}
+	if quota > 0 && usage+file.Size > quota {
+		return false, ErrQuotaExceeded
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return false, err
+	}
+
+	if err = os.MkdirAll(t.tenantPath(tenant), 0755); err != nil {
+		return false, err
+	}
+	if err = writeFileAtomic(refPath, data); err != nil {
+		return false, err
+	}
+
+	t.usage[tenant] = usage + file.Size
+	return true, nil
+}
+
+// RemoveRef removes the reference of the tenant to a file and deletes the
+// file from the store if no other tenant references it.
+//
+// tenant: the name of the tenant
+// hash: the hash of the file
+//
+// Returns os.ErrNotExist if the tenant doesn't reference the file and an error if there was any
+func (t *TenantIndex) RemoveRef(tenant string, hash string) error {
+	if err := ValidateTenant(tenant); err != nil {
+		return err
+	}
+	if err := validateRefHash(hash); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	file, err := t.readRef(tenant, hash)
+	if err != nil {
+		return err
+	}
+
+	usage, err := t.usageLocked(tenant)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(t.refPath(tenant, hash)); err != nil {
+		return err
+	}
+	t.usage[tenant] = usage - file.Size
+
+	referenced, err := t.isReferencedLocked(hash)
+	if err != nil || referenced {
+		return err
+	}
+
+	return t.storer.Delete(hash)
+}
+
+// DropRefs removes the references of all tenants to a file, e.g. when the file
+// is deleted from the store directly.
+//
+// hash: the hash of the file
+//
+// Returns an error if there was any
+func (t *TenantIndex) DropRefs(hash string) error {
+	if err := validateRefHash(hash); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	tenants, err := t.tenantsLocked()
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		file, err := t.readRef(tenant, hash)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err = os.Remove(t.refPath(tenant, hash)); err != nil {
+			return err
+		}
+		if usage, ok := t.usage[tenant]; ok {
+			t.usage[tenant] = usage - file.Size
+		}
+	}
+
+	return nil
+}
+
+// SetMetadata merges the given values into the metadata of the reference of
+// the tenant to a file. Values that are empty strings remove their keys.
+//
+// tenant: the name of the tenant
+// hash: the hash of the file
+// metadata: the values to set
+//
+// Returns os.ErrNotExist if the tenant doesn't reference the file and an error if there was any
+func (t *TenantIndex) SetMetadata(tenant string, hash string, metadata map[string]string) error {
+	if err := ValidateTenant(tenant); err != nil {
+		return err
+	}
+	if err := validateRefHash(hash); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	file, err := t.readRef(tenant, hash)
+	if err != nil {
+		return err
+	}
+
+	if file.Metadata == nil {
+		file.Metadata = map[string]string{}
+	}
+	for key, value := range metadata {
+		if value == "" {
+			delete(file.Metadata, key)
+		} else {
+			file.Metadata[key] = value
+		}
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(t.refPath(tenant, hash), data)
+}
+
+// Get returns the metadata of a file referenced by the tenant.
+//
+// tenant: the name of the tenant
+// hash: the hash of the file
+//
+// Returns os.ErrNotExist if the tenant doesn't reference the file and an error if there was any
+func (t *TenantIndex) Get(tenant string, hash string) (*TenantFile, error) {
+	if err := ValidateTenant(tenant); err != nil {
+		return nil, err
+	}
+	if err := validateRefHash(hash); err != nil {
+		return nil, err
+	}
+
+	return t.readRef(tenant, hash)
+}
+
+// List returns the metadata of all files referenced by the tenant sorted by hash.
+//
+// tenant: the name of the tenant
+//
+// Returns the list of files and an error if there was any
+func (t *TenantIndex) List(tenant string) ([]TenantFile, error) {
+	if err := ValidateTenant(tenant); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(t.tenantPath(tenant))
+	if os.IsNotExist(err) {
+		return []TenantFile{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	files := []TenantFile{}
+	for _, entry := range entries {
+		hash, ok := strings.CutSuffix(entry.Name(), ".json")
+		// Skip temporary files of references being written
+		if !ok || !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		file, err := t.readRef(tenant, hash)
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed while listing
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		files = append(files, *file)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Hash < files[j].Hash })
+
+	return files, nil
+}
+
+// Usage returns the total size of the files referenced by the tenant.
+//
+// tenant: the name of the tenant
+//
+// Returns the size in bytes and an error if there was any
+func (t *TenantIndex) Usage(tenant string) (int64, error) {
+	if err := ValidateTenant(tenant); err != nil {
+		return 0, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.usageLocked(tenant)
+}
+
+// usageLocked returns the cached usage of the tenant, computing it on first use.
+// The caller must hold the lock.
+func (t *TenantIndex) usageLocked(tenant string) (int64, error) {
+	if usage, ok := t.usage[tenant]; ok {
+		return usage, nil
+	}
+
+	files, err := t.List(tenant)
+	if err != nil {
+		return 0, err
+	}
+
+	var usage int64
+	for _, file := range files {
+		usage += file.Size
+	}
+	t.usage[tenant] = usage
+
+	return usage, nil
+}
+
+// isReferencedLocked reports whether any tenant references the hash.
+// The caller must hold the lock.
+func (t *TenantIndex) isReferencedLocked(hash string) (bool, error) {
+	tenants, err := t.tenantsLocked()
+	if err != nil {
+		return false, err
+	}
+
+	for _, tenant := range tenants {
+		if _, err := os.Stat(t.refPath(tenant, hash)); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// tenantsLocked returns the names of all tenants with references.
+// The caller must hold the lock.
+func (t *TenantIndex) tenantsLocked() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(t.basePath, "tenants"))
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			tenants = append(tenants, entry.Name())
+		}
+	}
+
+	return tenants, nil
+}
+
+// readRef reads the reference of the tenant to the hash.
+func (t *TenantIndex) readRef(tenant string, hash string) (*TenantFile, error) {
+	data, err := os.ReadFile(t.refPath(tenant, hash))
+	if err != nil {
+		return nil, err
+	}
+
+	file := &TenantFile{}
+	if err = json.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("error decoding reference of tenant %q to %s: %v", tenant, hash, err)
+	}
+
+	return file, nil
+}
+
+// writeFileAtomic writes the data to a temporary file next to the path and
+// renames it, so that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTenantIndex creates a storage and a tenant index on top of it.
+func newTestTenantIndex(t *testing.T) (Storer, *TenantIndex) {
+	basePath := t.TempDir()
+
+	storage, err := NewStorage(basePath)
+	assert.NoError(t, err)
+
+	index, err := NewTenantIndex(basePath, storage)
+	assert.NoError(t, err)
+
+	return storage, index
+}
+
+// TestTenantRefs tests that files are deleted from the store with their last reference.
+func TestTenantRefs(t *testing.T) {
+	storage, index := newTestTenantIndex(t)
+
+	file := TenantFile{Hash: "hash1", Name: "report.txt", Size: 4}
+
+	added, err := index.AddRef("team-a", file, 0)
+	assert.NoError(t, err)
+	assert.True(t, added)
+	assert.NoError(t, storage.saveFile("hash1", []byte("data")))
+
+	// Adding the same reference twice doesn't count it twice.
+	added, err = index.AddRef("team-a", file, 0)
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	added, err = index.AddRef("team-b", file, 0)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	assert.NoError(t, index.RemoveRef("team-a", "hash1"))
+	exists, err := storage.Exists("hash1")
+	assert.NoError(t, err)
+	assert.True(t, exists, "file referenced by another tenant must be kept")
+
+	// A tenant can't remove a reference it doesn't have.
+	assert.ErrorIs(t, index.RemoveRef("team-a", "hash1"), os.ErrNotExist)
+
+	assert.NoError(t, index.RemoveRef("team-b", "hash1"))
+	exists, err = storage.Exists("hash1")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+// TestTenantQuota tests that the usage of a tenant is limited by its quota.
+func TestTenantQuota(t *testing.T) {
+	_, index := newTestTenantIndex(t)
+
+	_, err := index.AddRef("team-a", TenantFile{Hash: "hash1", Size: 6}, 10)
+	assert.NoError(t, err)
+
+	_, err = index.AddRef("team-a", TenantFile{Hash: "hash2", Size: 6}, 10)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// Other tenants have their own usage.
+	_, err = index.AddRef("team-b", TenantFile{Hash: "hash2", Size: 6}, 10)
+	assert.NoError(t, err)
+
+	usage, err := index.Usage("team-a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), usage)
+
+	// Removing a reference frees the quota.
+	assert.NoError(t, index.RemoveRef("team-a", "hash1"))
+	_, err = index.AddRef("team-a", TenantFile{Hash: "hash2", Size: 6}, 10)
+	assert.NoError(t, err)
+}
+
+// TestTenantList tests that tenants only list their own references.
+func TestTenantList(t *testing.T) {
+	_, index := newTestTenantIndex(t)
+
+	_, err := index.AddRef("team-a", TenantFile{Hash: "hash2", Name: "b"}, 0)
+	assert.NoError(t, err)
+	_, err = index.AddRef("team-a", TenantFile{Hash: "hash1", Name: "a"}, 0)
+	assert.NoError(t, err)
+	_, err = index.AddRef("team-b", TenantFile{Hash: "hash3", Name: "c"}, 0)
+	assert.NoError(t, err)
+
+	files, err := index.List("team-a")
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	assert.Equal(t, "hash1", files[0].Hash)
+	assert.Equal(t, "a", files[0].Name)
+	assert.Equal(t, "hash2", files[1].Hash)
+
+	_, err = index.Get("team-a", "hash3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	files, err = index.List("team-c")
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// Tenant names and hashes must not escape the tenants directory.
+	_, err = index.List("../store")
+	assert.Error(t, err)
+	_, err = index.Get("team-a", "../team-b/hash3")
+	assert.Error(t, err)
+}
+
+// TestDropRefs tests that dropping a file removes the references of all tenants.
+func TestDropRefs(t *testing.T) {
+	_, index := newTestTenantIndex(t)
+
+	_, err := index.AddRef("team-a", TenantFile{Hash: "hash1", Size: 4}, 0)
+	assert.NoError(t, err)
+	_, err = index.AddRef("team-b", TenantFile{Hash: "hash1", Size: 4}, 0)
+	assert.NoError(t, err)
+
+	assert.NoError(t, index.DropRefs("hash1"))
+
+	for _, tenant := range []string{"team-a", "team-b"} {
+		_, err = index.Get(tenant, "hash1")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		usage, err := index.Usage(tenant)
+		assert.NoError(t, err)
+		assert.Zero(t, usage)
+	}
+}
+
+// TestTenantMetadata tests that the metadata of references is kept per tenant.
+func TestTenantMetadata(t *testing.T) {
+	_, index := newTestTenantIndex(t)
+
+	_, err := index.AddRef("team-a", TenantFile{Hash: "hash1", Size: 4, Metadata: map[string]string{"owner": "alice"}}, 0)
+	assert.NoError(t, err)
+	_, err = index.AddRef("team-b", TenantFile{Hash: "hash1", Size: 4}, 0)
+	assert.NoError(t, err)
+
+	assert.NoError(t, index.SetMetadata("team-b", "hash1", map[string]string{"owner": "bob"}))
+	assert.NoError(t, index.SetMetadata("team-a", "hash1", map[string]string{"label": "report"}))
+
+	file, err := index.Get("team-a", "hash1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "alice", "label": "report"}, file.Metadata)
+
+	file, err = index.Get("team-b", "hash1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "bob"}, file.Metadata)
+
+	assert.ErrorIs(t, index.SetMetadata("team-c", "hash1", map[string]string{"owner": "eve"}), os.ErrNotExist)
+}